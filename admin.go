@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	firebaseauth "github.com/vin047/firebase-middleware"
+
+	"github.com/tripupapp/tripup-server/auth"
+	"github.com/tripupapp/tripup-server/database"
+)
+
+const adminStatsCacheTTL = time.Minute
+const defaultActiveDays = 30
+const maxActiveDays = 365
+
+// how often each instance looks for users newly marked as unreachable, see activityTracker.resume
+const unreachableCheckInterval = time.Minute
+
+// activityTracker records each user's last activity at most once a day, so active user counts don't cost a write per request
+// users marked as having no push recipient since are recorded again on their next request, which resumes their notifications
+type activityTracker struct {
+    neoDB       database.Store
+    mutex       sync.Mutex
+    day         string
+    seen        map[string]bool
+    checkedAt   time.Time
+}
+
+// Track records the authenticated user as active, requests are never failed because activity couldn't be recorded
+func (tracker *activityTracker) Track(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+        if token, ok := authToken(request.Context()); ok && tracker.firstToday(token.UID) {
+            if err := tracker.neoDB.TouchUser(token.UID); err != nil {
+                errLogger.Println(err.Error())
+            }
+        }
+        next.ServeHTTP(response, request)
+    })
+}
+
+// forget has the users' next request recorded again, even if they were already recorded today
+func (tracker *activityTracker) forget(userIDs []string) {
+    tracker.mutex.Lock()
+    defer tracker.mutex.Unlock()
+
+    for _, userID := range userIDs {
+        delete(tracker.seen, userID)
+    }
+}
+
+// resume forgets the users marked as unreachable since the last check by any replica, the checks overlap by an interval
+// so marks aren't missed due to clock skew between the database and this instance, forgetting a user twice is harmless
+func (tracker *activityTracker) resume(neoDB *database.Neo4j) func(ctx context.Context) error {
+    return func(ctx context.Context) error {
+        now := time.Now()
+        since := tracker.checkedAt
+        if since.IsZero() {
+            since = now     // nobody has been recorded yet
+        }
+        userIDs, err := neoDB.GetUnreachableUsers(since.Add(-unreachableCheckInterval))
+        if err != nil {
+            return err
+        }
+        tracker.forget(userIDs)
+        tracker.checkedAt = now
+        return nil
+    }
+}
+
+func (tracker *activityTracker) firstToday(userID string) bool {
+    tracker.mutex.Lock()
+    defer tracker.mutex.Unlock()
+
+    today := time.Now().UTC().Format("2006-01-02")
+    if today != tracker.day {
+        tracker.day = today
+        tracker.seen = make(map[string]bool)
+    }
+    if tracker.seen[userID] {
+        return false
+    }
+    tracker.seen[userID] = true
+    return true
+}
+
+// adminAuth guards the admin routes, which are mounted outside the firebase protected router. Requests carrying a
+// service token (ADMIN_API_SECRET) are verified by signature alone, each token accepted once, so operators can call them
+// from cron or CI without a user; otherwise a firebase token with the "admin" custom claim is required
+func adminAuth(secret string) func(http.Handler) http.Handler {
+    replays := &auth.ServiceTokenReplays{}
+    return func(next http.Handler) http.Handler {
+        userAuth := firebaseauth.JWTHandler(nil)(requireClaims(map[string]string{"admin": "true"})(next))
+        return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+            if header := request.Header.Get("Authorization"); strings.HasPrefix(header, auth.ServiceTokenScheme) {
+                // the body is signed too, so read it for verification and hand the handler a fresh reader
+                body, ok := readSignedBody(response, request)
+                if !ok {
+                    return
+                }
+                request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+                token := strings.TrimPrefix(header, auth.ServiceTokenScheme)
+                now := time.Now()
+                if !auth.VerifyServiceToken(secret, token, request.Method, request.URL.Path, body, now) || replays.Seen(token, now) {
+                    response.WriteHeader(http.StatusUnauthorized)
+                    response.Write([]byte("Invalid service token"))
+                    return
+                }
+                next.ServeHTTP(response, request)
+                return
+            }
+
+            if !auth.IsInitialised() {
+                response.WriteHeader(http.StatusNotImplemented)
+                response.Write([]byte("firebase is not configured"))
+                return
+            }
+            userAuth.ServeHTTP(response, request)
+        })
+    }
+}
+
+type cachedStats struct {
+    stats       *database.GlobalStats
+    fetchedAt   time.Time
+}
+
+// adminStats serves deployment wide totals as JSON, callers are authorised by adminAuth
+// the aggregation scans every asset, so results are cached briefly per ?days= value
+type adminStats struct {
+    neoDB   *database.Neo4j
+    mutex   sync.Mutex
+    cache   map[int]cachedStats
+}
+
+func (admin *adminStats) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+    days := defaultActiveDays
+    if daysParam := request.URL.Query().Get("days"); len(daysParam) != 0 {
+        var err error
+        days, err = strconv.Atoi(daysParam)
+        if err != nil || days <= 0 || days > maxActiveDays {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("days must be between 1 and " + strconv.Itoa(maxActiveDays)))
+            return
+        }
+    }
+
+    cached, err := admin.get(days)
+    if err != nil {
+        ServerErrorHandler(response, err)
+        return
+    }
+
+    dataJSON, err := json.Marshal(map[string]interface{} {
+        "users": cached.stats.Users,
+        "activeUsers": cached.stats.ActiveUsers,
+        "activeDays": days,
+        "groups": cached.stats.Groups,
+        "assets": cached.stats.Assets,
+        "storedBytes": cached.stats.StoredBytes,
+        "generatedAt": cached.fetchedAt.UTC().Format(time.RFC3339),
+    })
+    if err != nil {
+        response.WriteHeader(http.StatusInternalServerError)
+        errLogger.Println(err.Error())
+        return
+    }
+    response.Header().Set("Content-Type", "application/json")
+    response.WriteHeader(http.StatusOK)
+    response.Write(dataJSON)
+}
+
+// get returns the cached totals for days if fresh, otherwise aggregates them again
+// the lock is held while aggregating, so concurrent requests wait for one query rather than each running their own
+func (admin *adminStats) get(days int) (cachedStats, error) {
+    admin.mutex.Lock()
+    defer admin.mutex.Unlock()
+
+    if cached, ok := admin.cache[days]; ok && time.Since(cached.fetchedAt) < adminStatsCacheTTL {
+        return cached, nil
+    }
+    stats, err := admin.neoDB.GlobalStats(time.Now().AddDate(0, 0, -days))
+    if err != nil {
+        return cachedStats{}, err
+    }
+    if admin.cache == nil {
+        admin.cache = make(map[int]cachedStats)
+    }
+    cached := cachedStats{stats: stats, fetchedAt: time.Now()}
+    admin.cache[days] = cached
+    return cached, nil
+}
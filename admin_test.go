@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tripupapp/tripup-server/auth"
+	"github.com/tripupapp/tripup-server/database"
+)
+
+func TestAdminAuthBodyLimit(t *testing.T) {
+    tests := []struct {
+        name    string
+        size    int
+        want    int
+    }{
+        {name: "at limit", size: maxSignedBodySize, want: http.StatusOK},
+        {name: "over limit", size: maxSignedBodySize + 1, want: http.StatusRequestEntityTooLarge},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            called := false
+            handler := adminAuth("secret")(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+                called = true
+            }))
+
+            body := bytes.Repeat([]byte("a"), test.size)
+            request := httptest.NewRequest(http.MethodPost, "/admin/stats", bytes.NewReader(body))
+            request.Header.Set("Authorization", auth.ServiceTokenScheme + auth.SignServiceToken("secret", http.MethodPost, "/admin/stats", body, time.Now()))
+            response := httptest.NewRecorder()
+            handler.ServeHTTP(response, request)
+
+            if response.Code != test.want {
+                t.Fatalf("got status %d, want %d: %s", response.Code, test.want, response.Body)
+            }
+            if called != (test.want == http.StatusOK) {
+                t.Errorf("handler called %v, want %v", called, !called)
+            }
+        })
+    }
+}
+
+func TestActivityTrackerForget(t *testing.T) {
+    store := database.NewMemStore()
+    userUUID := newUser(t, store, "user")
+    tracker := &activityTracker{neoDB: store}
+    handler := tracker.Track(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {}))
+    visit := func() {
+        request := httptest.NewRequest(http.MethodGet, "/", nil)
+        request = request.WithContext(context.WithValue(request.Context(), tokenKey{}, "user"))
+        handler.ServeHTTP(httptest.NewRecorder(), request)
+    }
+    // RemoveInvalidRecipient reports whether the user was reachable, i.e. whether the last visit resumed notifications
+    markResumed := func() bool {
+        resumed, err := store.RemoveInvalidRecipient(userUUID)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return resumed
+    }
+
+    markResumed()
+    visit()
+    if !markResumed() {
+        t.Fatal("first visit of the day didn't resume notifications")
+    }
+    visit()
+    if markResumed() {
+        t.Fatal("second visit of the day recorded again")
+    }
+    tracker.forget([]string{"user"})
+    visit()
+    if !markResumed() {
+        t.Error("visit after being forgotten didn't resume notifications")
+    }
+}
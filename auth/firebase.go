@@ -10,10 +10,12 @@ import (
 
 	firebase "firebase.google.com/go"
 	firebaseAuth "firebase.google.com/go/auth"
+
+	"github.com/tripupapp/tripup-server/logging"
 )
 
 var client *firebaseAuth.Client
-var errLogger = log.New(os.Stderr, "[ERROR] ServerLog: ", log.LstdFlags | log.Lshortfile)
+var errLogger = log.New(logging.Writer(logging.Error, os.Stderr), "[ERROR] ServerLog: ", log.LstdFlags | log.Lshortfile)
 
 // InitialiseFirebaseAuthBackend initialises the firebase backend client
 func InitialiseFirebaseAuthBackend(credentialsFilePath *string) {
@@ -37,6 +39,11 @@ func InitialiseFirebaseAuthBackend(credentialsFilePath *string) {
 	}
 }
 
+// IsInitialised reports whether the firebase backend client has been set up
+func IsInitialised() bool {
+	return client != nil
+}
+
 // GetUserAuthProviders provides the authorisation mechanisms contained by the users record on firebase
 func GetUserAuthProviders(ctx context.Context, uid string) (AuthProviders, error) {
 	var authProviders AuthProviders
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceTokenScheme prefixes service tokens in the Authorization header, "Service <unix seconds>.<hex signature>"
+const ServiceTokenScheme = "Service "
+
+// service tokens older or further in the future than this are rejected, and tokens seen within it are rejected as replays
+const serviceTokenMaxSkew = 5 * time.Minute
+
+// SignServiceToken returns a service token for a request, the hex HMAC-SHA256 of
+// "<unix seconds>\n<method>\n<path>\n<hex SHA-256 of body>" keyed with the shared secret, so a token only authorises the
+// request it was signed for
+func SignServiceToken(secret string, method string, path string, body []byte, at time.Time) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + path + "\n" + hex.EncodeToString(bodyHash[:])))
+	return timestamp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyServiceToken checks that token was signed with secret for this method, path and body, within the allowed clock skew
+func VerifyServiceToken(secret string, token string, method string, path string, body []byte, now time.Time) bool {
+	if len(secret) == 0 {
+		return false
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > serviceTokenMaxSkew || skew < -serviceTokenMaxSkew {
+		return false
+	}
+	expected := SignServiceToken(secret, method, path, body, time.Unix(timestamp, 0))
+	return hmac.Equal([]byte(expected), []byte(token))
+}
+
+// ServiceTokenReplays remembers the service tokens accepted within the allowed clock skew, so a captured token can't be
+// replayed while it is still valid. Tokens are only remembered by this instance
+type ServiceTokenReplays struct {
+	mutex	sync.Mutex
+	seen	map[string]time.Time
+}
+
+// Seen reports whether token has already been used, recording it if not. Tokens past the allowed clock skew are forgotten,
+// as VerifyServiceToken rejects them anyway
+func (replays *ServiceTokenReplays) Seen(token string, now time.Time) bool {
+	replays.mutex.Lock()
+	defer replays.mutex.Unlock()
+	if replays.seen == nil {
+		replays.seen = make(map[string]time.Time)
+	}
+	for seenToken, seenAt := range replays.seen {
+		if now.Sub(seenAt) > 2 * serviceTokenMaxSkew {
+			delete(replays.seen, seenToken)
+		}
+	}
+	if _, ok := replays.seen[token]; ok {
+		return true
+	}
+	replays.seen[token] = now
+	return false
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+)
+
+// limitRequestBody rejects requests declaring a body larger than limit bytes with a 413, and stops reading bodies of
+// unknown length once they exceed it, so a client can't have a handler decode an arbitrarily large payload
+func limitRequestBody(limit int64) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+            if request.ContentLength > limit {
+                response.WriteHeader(http.StatusRequestEntityTooLarge)
+                response.Write([]byte("Request body too large"))
+                return
+            }
+            request.Body = http.MaxBytesReader(response, request.Body, limit)
+            next.ServeHTTP(response, request)
+        })
+    }
+}
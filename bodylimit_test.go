@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitRequestBody(t *testing.T) {
+    handler := limitRequestBody(8)(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+        if _, err := ioutil.ReadAll(request.Body); err != nil {
+            response.WriteHeader(http.StatusRequestEntityTooLarge)
+            return
+        }
+        response.WriteHeader(http.StatusOK)
+    }))
+    tests := []struct {
+        name            string
+        body            string
+        unknownLength   bool
+        want            int
+    }{
+        {name: "within limit", body: "12345678", want: http.StatusOK},
+        {name: "declared too large", body: "123456789", want: http.StatusRequestEntityTooLarge},
+        {name: "read too large", body: "123456789", unknownLength: true, want: http.StatusRequestEntityTooLarge},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            request := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+            if test.unknownLength {
+                request.ContentLength = -1
+            }
+            response := httptest.NewRecorder()
+            handler.ServeHTTP(response, request)
+            if response.Code != test.want {
+                t.Errorf("got status %d, want %d", response.Code, test.want)
+            }
+        })
+    }
+}
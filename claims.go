@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// requireClaims rejects requests with 403 Forbidden unless the firebase token carries every claim in required with the
+// given value, e.g. {"email_verified": "true"}. Values are compared in their text form, so booleans and numbers can be
+// required as well as strings. Must be used after the firebase authorization middleware, and can be layered per route
+func requireClaims(required map[string]string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+            token, ok := authToken(request.Context())
+            if !ok {
+                response.WriteHeader(http.StatusUnauthorized)
+                response.Write([]byte("Unable to extract token from request context"))
+                return
+            }
+            for name, value := range required {
+                if claim, ok := token.Claims[name]; !ok || fmt.Sprint(claim) != value {
+                    response.WriteHeader(http.StatusForbidden)
+                    response.Write([]byte(fmt.Sprintf("token claim %s must be %s", name, value)))
+                    return
+                }
+            }
+            next.ServeHTTP(response, request)
+        })
+    }
+}
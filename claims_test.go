@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	firebaseAuth "firebase.google.com/go/auth"
+)
+
+func TestRequireClaims(t *testing.T) {
+    required := map[string]string{"email_verified": "true"}
+    tests := []struct {
+        name    string
+        claims  map[string]interface{}
+        signed  bool
+        want    int
+    }{
+        {name: "present", claims: map[string]interface{}{"email_verified": true}, signed: true, want: http.StatusOK},
+        {name: "absent", claims: map[string]interface{}{}, signed: true, want: http.StatusForbidden},
+        {name: "false", claims: map[string]interface{}{"email_verified": false}, signed: true, want: http.StatusForbidden},
+        {name: "text value", claims: map[string]interface{}{"email_verified": "true"}, signed: true, want: http.StatusOK},
+        {name: "no token", want: http.StatusUnauthorized},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            previous := authToken
+            authToken = func(ctx context.Context) (*firebaseAuth.Token, bool) {
+                return &firebaseAuth.Token{UID: "user", Claims: test.claims}, test.signed
+            }
+            t.Cleanup(func() {
+                authToken = previous
+            })
+
+            called := false
+            handler := requireClaims(required)(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+                called = true
+            }))
+            response := httptest.NewRecorder()
+            handler.ServeHTTP(response, httptest.NewRequest("GET", "/users/self", nil))
+
+            if response.Code != test.want {
+                t.Errorf("got status %d, want %d: %s", response.Code, test.want, response.Body)
+            }
+            if called != (test.want == http.StatusOK) {
+                t.Errorf("next handler called: %v", called)
+            }
+        })
+    }
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// responses smaller than this are sent uncompressed, as the gzip overhead outweighs the saving
+const compressionThreshold = 1400
+
+type bufferedResponseWriter struct {
+    http.ResponseWriter
+    buffer  bytes.Buffer
+    status  int
+}
+
+func (writer *bufferedResponseWriter) WriteHeader(status int) {
+    writer.status = status
+}
+
+func (writer *bufferedResponseWriter) Write(data []byte) (int, error) {
+    return writer.buffer.Write(data)
+}
+
+// Gzip compresses responses for clients that accept gzip encoding, once they reach compressionThreshold bytes
+func Gzip(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+        if !strings.Contains(request.Header.Get("Accept-Encoding"), "gzip") {
+            next.ServeHTTP(response, request)
+            return
+        }
+
+        writer := &bufferedResponseWriter{ResponseWriter: response, status: http.StatusOK}
+        next.ServeHTTP(writer, request)
+
+        response.Header().Add("Vary", "Accept-Encoding")
+        if writer.buffer.Len() < compressionThreshold {
+            response.WriteHeader(writer.status)
+            response.Write(writer.buffer.Bytes())
+            return
+        }
+
+        // sniff before compressing, otherwise the content type is detected from the gzipped bytes
+        if len(response.Header().Get("Content-Type")) == 0 {
+            response.Header().Set("Content-Type", http.DetectContentType(writer.buffer.Bytes()))
+        }
+        response.Header().Set("Content-Encoding", "gzip")
+        response.Header().Del("Content-Length")
+        response.WriteHeader(writer.status)
+        gzipWriter := gzip.NewWriter(response)
+        defer gzipWriter.Close()
+        if _, err := gzipWriter.Write(writer.buffer.Bytes()); err != nil {
+            errLogger.Println(err.Error())
+        }
+    })
+}
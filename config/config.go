@@ -0,0 +1,350 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tripupapp/tripup-server/logging"
+)
+
+// Config contains the server settings, loaded from environment variables at startup
+type Config struct {
+    ServerHost              string
+    ServerPort              string
+    ServerSocket            string
+    ServerTimeout           time.Duration
+    ShutdownTimeout         time.Duration
+    ReadHeaderTimeout       time.Duration
+    ReadTimeout             time.Duration
+    WriteTimeout            time.Duration
+    IdleTimeout             time.Duration
+    ServerMaxRequests       int
+    RunMaintenance          bool
+    MetricsToken            string
+    AdminAPISecret          string
+    CursorSecret            string
+    RequiredClaims          map[string]string
+    StatsInterval           time.Duration
+    ReconcileInterval       time.Duration
+    ThrottleAssets          int
+    ThrottleGroups          int
+    ThrottleInfo            int
+    ThrottleSchema          int
+    LookupRateLimit         int
+    LookupMaxIdentifiers    int
+    ExistsRateLimit         int
+    MaxGroupInvites         int
+    MaxGroupSize            int
+    MaxRequestBytes         int
+    MaxCreateDateAhead      time.Duration
+    LeaveGroupKeepsAssets   bool
+    MinBillableBytesPhoto   int
+    MinBillableBytesVideo   int
+    TLSCertFile             string
+    TLSKeyFile              string
+    NeoUser                 string
+    NeoPass                 string
+    NeoHost                 string
+    NeoPort                 string
+    OneSignalAppID          string
+    OneSignalAPIKey         string
+    OneSignalWebhookSecret  string
+    FirebaseWebhookSecret   string
+    NotificationWindow      time.Duration
+    NotificationTimeout     time.Duration
+    NotifyBreakerThreshold  int
+    NotifyBreakerCooldown   time.Duration
+    FirebaseCredentialsFile string
+    AWSRegion               string
+    AWSEndpoint             string
+    AWSForcePathStyle       bool
+    StorageKeySecret        string
+    StorageKeyMigrating     bool
+    LogLevel                logging.Level
+    LogSampleRate           int
+}
+
+// secretSuffixes mark the fields Summary redacts, new secrets must be named to match one of them
+var secretSuffixes = []string{"Secret", "APIKey", "Pass", "Token"}
+
+// Summary describes every setting as space separated name=value pairs for logging at startup, secrets are only reported as
+// set or unset
+func (config *Config) Summary() string {
+    value := reflect.ValueOf(*config)
+    var fields []string
+    for i := 0; i < value.NumField(); i++ {
+        name := value.Type().Field(i).Name
+        field := value.Field(i).Interface()
+
+        var formatted string
+        switch field := field.(type) {
+        case string:
+            formatted = strconv.Quote(field)
+            for _, suffix := range secretSuffixes {
+                if strings.HasSuffix(name, suffix) {
+                    formatted = "unset"
+                    if len(field) != 0 {
+                        formatted = "redacted"
+                    }
+                }
+            }
+        case map[string]string:
+            var pairs []string
+            for key, value := range field {
+                pairs = append(pairs, key + "=" + value)
+            }
+            sort.Strings(pairs)
+            formatted = strconv.Quote(strings.Join(pairs, ","))
+        default:
+            formatted = fmt.Sprint(field)
+        }
+        fields = append(fields, name + "=" + formatted)
+    }
+    return strings.Join(fields, " ")
+}
+
+// ValidationError lists every missing or invalid setting, so they can all be fixed in one go
+type ValidationError struct {
+    Problems []string
+}
+
+func (e *ValidationError) Error() string {
+    return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+type loader struct {
+    problems []string
+}
+
+func (l *loader) required(key string) string {
+    value, exists := os.LookupEnv(key)
+    if !exists || len(value) == 0 {
+        l.problems = append(l.problems, key + " not set")
+    }
+    return value
+}
+
+func (l *loader) optional(key string) string {
+    return os.Getenv(key)
+}
+
+func (l *loader) duration(key string) time.Duration {
+    value := l.required(key)
+    if len(value) == 0 {
+        return 0
+    }
+    return l.parseDuration(key, value)
+}
+
+func (l *loader) optionalDuration(key string, defaultValue time.Duration) time.Duration {
+    value := l.optional(key)
+    if len(value) == 0 {
+        return defaultValue
+    }
+    return l.parseDuration(key, value)
+}
+
+func (l *loader) optionalPositiveDuration(key string, defaultValue time.Duration) time.Duration {
+    value := l.optional(key)
+    if len(value) == 0 {
+        return defaultValue
+    }
+    duration, err := time.ParseDuration(value)
+    if err != nil || duration <= 0 {
+        l.problems = append(l.problems, fmt.Sprintf("%s is not a positive duration: %q", key, value))
+    }
+    return duration
+}
+
+func (l *loader) parseDuration(key string, value string) time.Duration {
+    duration, err := time.ParseDuration(value)
+    if err != nil {
+        l.problems = append(l.problems, fmt.Sprintf("%s is not a valid duration: %q", key, value))
+    }
+    return duration
+}
+
+func (l *loader) positiveInt(key string) int {
+    value := l.required(key)
+    if len(value) == 0 {
+        return 0
+    }
+    return l.parsePositiveInt(key, value)
+}
+
+func (l *loader) optionalPositiveInt(key string, defaultValue int) int {
+    value := l.optional(key)
+    if len(value) == 0 {
+        return defaultValue
+    }
+    return l.parsePositiveInt(key, value)
+}
+
+func (l *loader) optionalBool(key string, defaultValue bool) bool {
+    value := l.optional(key)
+    if len(value) == 0 {
+        return defaultValue
+    }
+    flag, err := strconv.ParseBool(value)
+    if err != nil {
+        l.problems = append(l.problems, fmt.Sprintf("%s is not a boolean: %q", key, value))
+    }
+    return flag
+}
+
+// optionalClaims parses a comma separated list of name=value token claim requirements
+func (l *loader) optionalClaims(key string) map[string]string {
+    claims := make(map[string]string)
+    value := l.optional(key)
+    if len(value) == 0 {
+        return claims
+    }
+    for _, requirement := range strings.Split(value, ",") {
+        parts := strings.SplitN(strings.TrimSpace(requirement), "=", 2)
+        if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+            l.problems = append(l.problems, fmt.Sprintf("%s entries must be claim=value: %q", key, requirement))
+            continue
+        }
+        claims[parts[0]] = parts[1]
+    }
+    return claims
+}
+
+func (l *loader) parsePositiveInt(key string, value string) int {
+    number, err := strconv.Atoi(value)
+    if err != nil || number <= 0 {
+        l.problems = append(l.problems, fmt.Sprintf("%s is not a positive integer: %q", key, value))
+    }
+    return number
+}
+
+// Load reads the configuration from the environment, returning a *ValidationError describing all problems found
+func Load() (*Config, error) {
+    var l loader
+    var config Config
+
+    config.ServerSocket = l.optional("TRIPUP_SERVER_SOCKET")
+    config.ServerHost = l.optional("TRIPUP_SERVER_HOST")
+    if len(config.ServerSocket) != 0 {
+        if len(config.ServerHost) != 0 {
+            l.problems = append(l.problems, "TRIPUP_SERVER_SOCKET and TRIPUP_SERVER_HOST are mutually exclusive")
+        }
+    } else {
+        config.ServerPort = l.required("TRIPUP_SERVER_PORT")
+        if _, err := strconv.ParseUint(config.ServerPort, 10, 16); len(config.ServerPort) != 0 && err != nil {
+            l.problems = append(l.problems, fmt.Sprintf("TRIPUP_SERVER_PORT is not a valid port number: %q", config.ServerPort))
+        }
+    }
+    config.ServerTimeout = l.duration("TRIPUP_SERVER_TIMEOUT")
+    config.ShutdownTimeout = l.optionalDuration("TRIPUP_SHUTDOWN_TIMEOUT", 30 * time.Second)
+    // zero disables a net/http timeout entirely, which would leave the server open to slow clients (slowloris)
+    config.ReadHeaderTimeout = l.optionalPositiveDuration("TRIPUP_SERVER_READ_HEADER_TIMEOUT", 10 * time.Second)
+    config.ReadTimeout = l.optionalPositiveDuration("TRIPUP_SERVER_READ_TIMEOUT", 30 * time.Second)
+    // by default leave the handler time to write its response, so existing deployments with a long TRIPUP_SERVER_TIMEOUT
+    // keep working; only an explicitly configured write timeout has to be checked against it
+    config.WriteTimeout = l.optionalPositiveDuration("TRIPUP_SERVER_WRITE_TIMEOUT", config.ServerTimeout + 10 * time.Second)
+    config.IdleTimeout = l.optionalPositiveDuration("TRIPUP_SERVER_IDLE_TIMEOUT", 120 * time.Second)
+    if len(l.optional("TRIPUP_SERVER_WRITE_TIMEOUT")) != 0 && config.WriteTimeout <= config.ServerTimeout {
+        l.problems = append(l.problems, "TRIPUP_SERVER_WRITE_TIMEOUT must be longer than TRIPUP_SERVER_TIMEOUT")
+    }
+    config.ServerMaxRequests = l.positiveInt("TRIPUP_SERVER_MAX_REQ")
+    config.ThrottleAssets = l.optionalPositiveInt("THROTTLE_ASSETS", config.ServerMaxRequests)
+    config.ThrottleGroups = l.optionalPositiveInt("THROTTLE_GROUPS", config.ServerMaxRequests)
+    config.ThrottleInfo = l.optionalPositiveInt("THROTTLE_INFO", config.ServerMaxRequests)
+    config.ThrottleSchema = l.optionalPositiveInt("THROTTLE_SCHEMA", config.ServerMaxRequests)
+    config.LookupRateLimit = l.optionalPositiveInt("TRIPUP_LOOKUP_RATE_LIMIT", 20)   // contact lookups per user per minute
+    config.LookupMaxIdentifiers = l.optionalPositiveInt("TRIPUP_LOOKUP_MAX_IDENTIFIERS", 500)
+    config.ExistsRateLimit = l.optionalPositiveInt("TRIPUP_EXISTS_RATE_LIMIT", 30)  // contact existence checks per user per hour
+    config.MaxGroupInvites = l.optionalPositiveInt("TRIPUP_MAX_GROUP_INVITES", 100)    // users added per PATCH /groups/{groupID}/users
+    config.MaxGroupSize = l.optionalPositiveInt("TRIPUP_MAX_GROUP_SIZE", 500)  // members and pending invites per group
+    config.MaxRequestBytes = l.optionalPositiveInt("TRIPUP_MAX_REQUEST_BYTES", 10485760)  // 10 MB, per request body
+    config.MaxCreateDateAhead = l.optionalDuration("TRIPUP_MAX_CREATEDATE_AHEAD", 0)  // unset or "0s" accepts any CreateDate
+    if config.MaxCreateDateAhead < 0 {
+        l.problems = append(l.problems, "TRIPUP_MAX_CREATEDATE_AHEAD must not be negative")
+    }
+    // what happens to the assets a user shared into a group when they leave it, DELETE /groups/{groupID}?assets= overrides
+    switch value := strings.ToLower(l.optional("TRIPUP_LEAVE_GROUP_ASSETS")); value {
+    case "", "remove":
+        config.LeaveGroupKeepsAssets = false
+    case "keep":
+        config.LeaveGroupKeepsAssets = true
+    default:
+        l.problems = append(l.problems, fmt.Sprintf("TRIPUP_LEAVE_GROUP_ASSETS must be remove or keep: %q", value))
+    }
+    config.MinBillableBytesPhoto = l.optionalPositiveInt("MIN_BILLABLE_BYTES_PHOTO", 131072)   // 128 KB
+    config.MinBillableBytesVideo = l.optionalPositiveInt("MIN_BILLABLE_BYTES_VIDEO", 131072)
+    config.RunMaintenance = l.optionalBool("TRIPUP_RUN_MAINTENANCE", true)
+    config.ReconcileInterval = l.optionalPositiveDuration("TRIPUP_RECONCILE_INTERVAL", 24 * time.Hour)
+
+    config.TLSCertFile = l.optional("TLS_CERT_FILE")
+    config.TLSKeyFile = l.optional("TLS_KEY_FILE")
+    if (len(config.TLSCertFile) == 0) != (len(config.TLSKeyFile) == 0) {
+        l.problems = append(l.problems, "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+    }
+
+    config.NeoUser = l.required("TRIPUP_NEO_USER")
+    config.NeoPass = l.required("TRIPUP_NEO_PASS")
+    config.NeoHost = l.required("TRIPUP_NEO_HOST")
+    config.NeoPort = l.required("TRIPUP_NEO_PORT")
+
+    // optional, notifications are dropped when neither is set
+    config.OneSignalAppID = l.optional("ONESIGNAL_APPID")
+    config.OneSignalAPIKey = l.optional("ONESIGNAL_APIKEY")
+    if (len(config.OneSignalAppID) == 0) != (len(config.OneSignalAPIKey) == 0) {
+        l.problems = append(l.problems, "ONESIGNAL_APPID and ONESIGNAL_APIKEY must be set together")
+    }
+    config.OneSignalWebhookSecret = l.optional("ONESIGNAL_WEBHOOK_SECRET")
+    config.NotificationWindow = l.optionalDuration("TRIPUP_NOTIFICATION_COALESCE_WINDOW", 30 * time.Second)   // "0s" disables
+    config.NotificationTimeout = l.optionalPositiveDuration("TRIPUP_NOTIFICATION_TIMEOUT", 10 * time.Second)
+    config.NotifyBreakerThreshold = l.optionalPositiveInt("TRIPUP_NOTIFICATION_BREAKER_THRESHOLD", 5)  // consecutive failures
+    config.NotifyBreakerCooldown = l.optionalPositiveDuration("TRIPUP_NOTIFICATION_BREAKER_COOLDOWN", time.Minute)
+
+    config.MetricsToken = l.optional("TRIPUP_METRICS_TOKEN")
+    config.AdminAPISecret = l.optional("ADMIN_API_SECRET")  // optional, enables service tokens on /admin
+    config.CursorSecret = l.optional("TRIPUP_CURSOR_SECRET")  // signs pagination cursors, a random one is used when not set
+    config.RequiredClaims = l.optionalClaims("TRIPUP_REQUIRED_CLAIMS")  // e.g. "email_verified=true", checked on every protected route
+    config.StatsInterval = l.optionalPositiveDuration("TRIPUP_STATS_INTERVAL", 5 * time.Minute)
+
+    config.FirebaseWebhookSecret = l.optional("FIREBASE_WEBHOOK_SECRET")    // optional, enables /webhooks/firebase/user-deleted
+    config.FirebaseCredentialsFile = l.optional("GOOGLE_APPLICATION_CREDENTIALS")   // firebase falls back to default credentials when not set
+    config.AWSRegion = l.optional("AWS_REGION")                                     // aws falls back to the shared config when not set
+    config.AWSEndpoint = l.optional("AWS_ENDPOINT")                                 // optional, for S3 compatible providers
+    // "auto" uses path-style addressing with a custom endpoint and virtual-hosted addressing with AWS itself
+    switch value := strings.ToLower(l.optional("AWS_FORCE_PATH_STYLE")); value {
+    case "", "auto":
+        config.AWSForcePathStyle = len(config.AWSEndpoint) != 0
+    case "true":
+        config.AWSForcePathStyle = true
+    case "false":
+        config.AWSForcePathStyle = false
+    default:
+        l.problems = append(l.problems, fmt.Sprintf("AWS_FORCE_PATH_STYLE must be true, false or auto: %q", value))
+    }
+
+    config.StorageKeySecret = l.optional("TRIPUP_STORAGE_KEY_SECRET")               // optional, obfuscates object keys in storage
+    // while migrating, objects not yet moved to their obfuscated key are still found under their original key
+    config.StorageKeyMigrating = l.optionalBool("TRIPUP_STORAGE_KEY_MIGRATING", false)
+    if config.StorageKeyMigrating && len(config.StorageKeySecret) == 0 {
+        l.problems = append(l.problems, "TRIPUP_STORAGE_KEY_MIGRATING requires TRIPUP_STORAGE_KEY_SECRET")
+    }
+
+    config.LogLevel = logging.Info
+    if value := l.optional("LOG_LEVEL"); len(value) != 0 {
+        level, err := logging.ParseLevel(value)
+        if err != nil {
+            l.problems = append(l.problems, "LOG_LEVEL: " + err.Error())
+        }
+        config.LogLevel = level
+    }
+    config.LogSampleRate = l.optionalPositiveInt("LOG_INFO_SAMPLE_RATE", 0)    // info lines per second, unset logs every line
+
+    if len(l.problems) != 0 {
+        return nil, &ValidationError{l.problems}
+    }
+    return &config, nil
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// setenv sets key for the duration of the test
+func setenv(t *testing.T, key string, value string) {
+    previous, exists := os.LookupEnv(key)
+    os.Setenv(key, value)
+    t.Cleanup(func() {
+        if exists {
+            os.Setenv(key, previous)
+        } else {
+            os.Unsetenv(key)
+        }
+    })
+}
+
+func TestOptionalClaims(t *testing.T) {
+    tests := []struct {
+        name    string
+        value   string
+        want    map[string]string
+        invalid bool
+    }{
+        {name: "unset", value: "", want: map[string]string{}},
+        {name: "single", value: "email_verified=true", want: map[string]string{"email_verified": "true"}},
+        {name: "several", value: "email_verified=true, tier=paid", want: map[string]string{"email_verified": "true", "tier": "paid"}},
+        {name: "value containing =", value: "role=a=b", want: map[string]string{"role": "a=b"}},
+        {name: "missing value", value: "email_verified=", invalid: true},
+        {name: "missing name", value: "=true", invalid: true},
+        {name: "no separator", value: "email_verified", invalid: true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            setenv(t, "TRIPUP_REQUIRED_CLAIMS", test.value)
+            var l loader
+            claims := l.optionalClaims("TRIPUP_REQUIRED_CLAIMS")
+            if test.invalid {
+                if len(l.problems) == 0 {
+                    t.Errorf("got %v, want a problem reported", claims)
+                }
+                return
+            }
+            if len(l.problems) != 0 {
+                t.Errorf("unexpected problems: %v", l.problems)
+            }
+            if !reflect.DeepEqual(claims, test.want) {
+                t.Errorf("got %v, want %v", claims, test.want)
+            }
+        })
+    }
+}
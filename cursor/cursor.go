@@ -0,0 +1,42 @@
+package cursor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ErrInvalid is returned when decoding a cursor that wasn't issued by this server for the user and listing
+var ErrInvalid = errors.New("invalid cursor")
+
+// Encode returns an opaque pagination cursor for position, signed with secret together with the user's subject and the
+// listing it pages through (e.g. "groups"), so clients can't alter it or replay it for another user or endpoint
+func Encode(secret []byte, subject string, scope string, position string) string {
+    encoded := base64.RawURLEncoding.EncodeToString([]byte(position))
+    return encoded + "." + base64.RawURLEncoding.EncodeToString(sign(secret, subject, scope, encoded))
+}
+
+// Decode returns the position in a cursor produced by Encode with the same secret, subject and scope
+func Decode(secret []byte, subject string, scope string, cursor string) (string, error) {
+    parts := strings.SplitN(cursor, ".", 2)
+    if len(parts) != 2 {
+        return "", ErrInvalid
+    }
+    signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil || !hmac.Equal(signature, sign(secret, subject, scope, parts[0])) {
+        return "", ErrInvalid
+    }
+    position, err := base64.RawURLEncoding.DecodeString(parts[0])
+    if err != nil {
+        return "", ErrInvalid
+    }
+    return string(position), nil
+}
+
+func sign(secret []byte, subject string, scope string, encoded string) []byte {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte(subject + "\n" + scope + "\n" + encoded))
+    return mac.Sum(nil)
+}
@@ -0,0 +1,1566 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tripupapp/tripup-server/auth"
+)
+
+// MemStore is an in-memory Store for tests, following the semantics of the *Neo4j queries so handlers can be exercised
+// without a database. Legacy trip favourites and schema 0 asset keys aren't modelled
+type MemStore struct {
+    mutex       sync.Mutex
+    users       map[string]*memUser         // by id
+    groups      map[string]*memGroup        // by uuid
+    assets      map[string]*memAsset        // by uuid
+    events      map[string]PendingEvent     // by uuid
+    receipts    map[string]map[string]string   // by provider notification id
+}
+
+type memUser struct {
+    id              string
+    uuid            string
+    publicKey       string
+    privateKey      string
+    schemaVersion   string
+    contacts        map[string]string   // hashed identifiers, by the property names in contactProperties
+    removed         map[string]string   // identifiers removed with RemoveUserContact, by property name
+    nickname        string
+    avatar          string
+    muted           []string
+    unreachable     bool
+    pending         []string            // event uuids, oldest first
+}
+
+// memMembership is a MEMBER relationship, invites have an inviter until they are accepted
+type memMembership struct {
+    key     string
+    inviter string
+}
+
+type memGroup struct {
+    name    string
+    members map[string]*memMembership   // by user uuid
+    assets  map[string]string           // GROUP_ASSET by asset uuid, with the sharedKey or empty if not shared
+}
+
+type memAsset struct {
+    owner           string              // user uuid
+    key             string
+    fields          map[string]interface{}
+    renditions      map[string]Rendition
+    archived        bool
+    tags            []string
+    filenameSetAt   int64
+    sharedWith      map[string]bool     // MEMORY_SHARED, by user uuid
+}
+
+var _ Store = (*MemStore)(nil)
+
+// NewMemStore returns an empty MemStore
+func NewMemStore() *MemStore {
+    return &MemStore{
+        users: make(map[string]*memUser),
+        groups: make(map[string]*memGroup),
+        assets: make(map[string]*memAsset),
+        events: make(map[string]PendingEvent),
+        receipts: make(map[string]map[string]string),
+    }
+}
+
+func (store *MemStore) userByUUID(uuid string) *memUser {
+    for _, user := range store.users {
+        if user.uuid == uuid {
+            return user
+        }
+    }
+    return nil
+}
+
+// membership returns the group and the user's membership of it, nil if either doesn't exist
+func (store *MemStore) membership(id string, groupID string) (*memUser, *memGroup, *memMembership) {
+    user, group := store.users[id], store.groups[groupID]
+    if user == nil || group == nil {
+        return nil, nil, nil
+    }
+    membership := group.members[user.uuid]
+    if membership == nil {
+        return nil, nil, nil
+    }
+    return user, group, membership
+}
+
+// ownedAsset returns the asset if it is owned by the user with the given id
+func (store *MemStore) ownedAsset(id string, assetid string) *memAsset {
+    user, asset := store.users[id], store.assets[assetid]
+    if user == nil || asset == nil || asset.owner != user.uuid {
+        return nil
+    }
+    return asset
+}
+
+// pruneShared removes the asset from users that are no longer in any group it is in
+func (store *MemStore) pruneShared(assetid string) {
+    asset := store.assets[assetid]
+    for userID := range asset.sharedWith {
+        kept := false
+        for _, group := range store.groups {
+            if _, ok := group.assets[assetid]; ok && group.members[userID] != nil {
+                kept = true
+                break
+            }
+        }
+        if !kept {
+            delete(asset.sharedWith, userID)
+        }
+    }
+}
+
+// shareWithGroup shares the asset with every member of the group apart from the user with the given uuid
+func (store *MemStore) shareWithGroup(asset *memAsset, group *memGroup, except string) {
+    for userID := range group.members {
+        if userID != except {
+            asset.sharedWith[userID] = true
+        }
+    }
+}
+
+// releaseContacts removes each of contacts from any other user holding it, unless it is their only contact, as
+// releaseContacts does in neo4j
+func (store *MemStore) releaseContacts(id string, contacts map[string]string) {
+    for property, value := range contacts {
+        for _, other := range store.users {
+            if other.id != id && other.contacts[property] == value && len(other.contacts) > 1 {
+                delete(other.contacts, property)
+            }
+        }
+    }
+}
+
+func memContacts(authProviders auth.AuthProviders) map[string]string {
+    contacts := make(map[string]string)
+    if len(authProviders.PhoneNumber) != 0 {
+        contacts["number"] = authProviders.PhoneNumber
+    }
+    if len(authProviders.Email) != 0 {
+        contacts["email"] = authProviders.Email
+    }
+    if len(authProviders.AppleID) != 0 {
+        contacts["appleid"] = authProviders.AppleID
+    }
+    return contacts
+}
+
+func (store *MemStore) CreateUser(id string, uuid string, authProviders auth.AuthProviders, publickey string, privatekey string, schemaVersion string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if store.users[id] != nil {
+        return ErrUserExists
+    }
+    if store.userByUUID(uuid) != nil {
+        return ErrIDInUse
+    }
+    contacts := memContacts(authProviders)
+    store.releaseContacts(id, contacts)
+    store.users[id] = &memUser{id: id, uuid: uuid, publicKey: publickey, privateKey: privatekey, schemaVersion: schemaVersion, contacts: contacts}
+    return nil
+}
+
+func (store *MemStore) UpdateUserContact(id string, authProviders auth.AuthProviders) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[id]
+    if user == nil {
+        return nil
+    }
+    contacts := memContacts(authProviders)
+    for property, value := range user.removed {
+        if contacts[property] == value {
+            delete(contacts, property)
+        } else {
+            delete(user.removed, property)
+        }
+    }
+    store.releaseContacts(id, contacts)
+    user.contacts = contacts
+    return nil
+}
+
+func (store *MemStore) RemoveUserContact(id string, provider string) error {
+    property, ok := contactProperties[provider]
+    if !ok {
+        return fmt.Errorf("unknown contact provider: %s", provider)
+    }
+
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[id]
+    if user == nil {
+        return io.EOF
+    }
+    if _, linked := user.contacts[property]; linked {
+        if len(user.contacts) <= 1 {
+            return ErrLastContact
+        }
+        if user.removed == nil {
+            user.removed = make(map[string]string)
+        }
+        user.removed[property] = user.contacts[property]
+        delete(user.contacts, property)
+    }
+    return nil
+}
+
+func (store *MemStore) GetUser(id string) (*map[string]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[id]
+    if user == nil {
+        return nil, io.EOF
+    }
+    return &map[string]string {
+        "uuid": user.uuid,
+        "privatekey": user.privateKey,
+        "schemaVersion": user.schemaVersion,
+    }, nil
+}
+
+func (store *MemStore) GetUserProfile(id string) (map[string]interface{}, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[id]
+    if user == nil {
+        return nil, io.EOF
+    }
+    providers := []string{}
+    for _, provider := range []string{"phone", "email", "apple"} {
+        if _, ok := user.contacts[contactProperties[provider]]; ok {
+            providers = append(providers, provider)
+        }
+    }
+    profile := map[string]interface{} {
+        "uuid": user.uuid,
+        "publickey": user.publicKey,
+        "schemaVersion": user.schemaVersion,
+        "authProviders": providers,
+    }
+    if len(user.nickname) != 0 {
+        profile["nickname"] = user.nickname
+    }
+    if len(user.avatar) != 0 {
+        profile["avatar"] = user.avatar
+    }
+    return profile, nil
+}
+
+func (store *MemStore) GetUserAccount(id string) (map[string]interface{}, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[id]
+    if user == nil {
+        return nil, io.EOF
+    }
+    var count, storedBytes int64
+    for _, asset := range store.assets {
+        if asset.owner == user.uuid {
+            count++
+            if totalsize, ok := asset.fields["totalsize"].(int64); ok {
+                storedBytes += totalsize
+            }
+        }
+    }
+    account := map[string]interface{} {
+        "assets": count,
+        "storedBytes": storedBytes,
+    }
+    for property, value := range user.contacts {
+        account[property] = value
+    }
+    return account, nil
+}
+
+// RemoveInvalidRecipient marks the user as having no push recipient, as *Neo4j.RemoveInvalidRecipient does
+func (store *MemStore) RemoveInvalidRecipient(uuid string) (bool, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.userByUUID(uuid)
+    if user == nil || user.unreachable {
+        return false, nil
+    }
+    user.unreachable = true
+    return true, nil
+}
+
+// TouchUser resumes group notifications for a user marked by RemoveInvalidRecipient, last activity isn't modelled
+func (store *MemStore) TouchUser(id string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if user := store.users[id]; user != nil {
+        user.unreachable = false
+    }
+    return nil
+}
+
+// DeleteUser removes the user and their group memberships, as DETACH DELETE leaves their assets behind so does this
+func (store *MemStore) DeleteUser(id string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[id]
+    if user == nil {
+        return nil
+    }
+    for _, group := range store.groups {
+        delete(group.members, user.uuid)
+    }
+    for _, asset := range store.assets {
+        delete(asset.sharedWith, user.uuid)
+    }
+    delete(store.users, id)
+    return nil
+}
+
+func (store *MemStore) SetUserProfile(id string, nickname string, avatar string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[id]
+    if user == nil {
+        return nil
+    }
+    if len(avatar) != 0 {
+        asset := store.assets[avatar]
+        if asset == nil {
+            return ErrAssetNotFound
+        }
+        if asset.owner != user.uuid {
+            return ErrAssetNotOwned
+        }
+    }
+    user.nickname = nickname
+    user.avatar = avatar
+    return nil
+}
+
+func (store *MemStore) GetProfilesForUsers(uuids []string) (map[string]map[string]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := make(map[string]map[string]string)
+    for _, uuid := range uuids {
+        user := store.userByUUID(uuid)
+        if user == nil || (len(user.nickname) == 0 && len(user.avatar) == 0) {
+            continue
+        }
+        profile := make(map[string]string)
+        if len(user.nickname) != 0 {
+            profile["nickname"] = user.nickname
+        }
+        if len(user.avatar) != 0 {
+            profile["avatar"] = user.avatar
+        }
+        data[uuid] = profile
+    }
+    return data, nil
+}
+
+func (store *MemStore) GetPublicInfoForUsers(uuids []string, numbers []string, emails []string) (map[string]string, map[string]map[string]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    existingMatches := make(map[string]string)
+    newMatches := make(map[string]map[string]string)
+    for _, uuid := range uuids {
+        if user := store.userByUUID(uuid); user != nil {
+            existingMatches[uuid] = user.publicKey
+        }
+    }
+
+    // each user is only returned once, for the first identifier that matched them
+    found := make(map[string]bool)
+    match := func(property string, values []string) {
+        for _, value := range values {
+            for _, user := range store.users {
+                if user.contacts[property] == value && !found[user.uuid] {
+                    found[user.uuid] = true
+                    newMatches[value] = map[string]string {
+                        "uuid": user.uuid,
+                        "publicKey": user.publicKey,
+                    }
+                }
+            }
+        }
+    }
+    match("number", numbers)
+    match("email", emails)
+    match("appleid", emails)
+
+    if len(existingMatches) == 0 && len(newMatches) == 0 {
+        return existingMatches, newMatches, io.EOF
+    }
+    return existingMatches, newMatches, nil
+}
+
+func (store *MemStore) VerifyUUIDS(uuids []string) ([]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    var result []string
+    for _, uuid := range uuids {
+        if store.userByUUID(uuid) != nil {
+            result = append(result, uuid)
+        }
+    }
+    if len(result) == 0 {
+        return nil, io.EOF
+    }
+    return result, nil
+}
+
+func (store *MemStore) ValidateIDs(id string, userids []string, assetids []string, groupids []string) (map[string][]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := map[string][]string {
+        "userIDs": []string{},
+        "assetIDs": []string{},
+        "groupIDs": []string{},
+    }
+    caller := store.users[id]
+    if caller == nil {
+        return data, nil
+    }
+    for _, userid := range userids {
+        if store.userByUUID(userid) != nil {
+            data["userIDs"] = append(data["userIDs"], userid)
+        }
+    }
+    for _, assetid := range assetids {
+        if asset := store.assets[assetid]; asset != nil && (asset.owner == caller.uuid || asset.sharedWith[caller.uuid]) {
+            data["assetIDs"] = append(data["assetIDs"], assetid)
+        }
+    }
+    for _, groupid := range groupids {
+        if group := store.groups[groupid]; group != nil && group.members[caller.uuid] != nil {
+            data["groupIDs"] = append(data["groupIDs"], groupid)
+        }
+    }
+    return data, nil
+}
+
+func (store *MemStore) SetNotificationPrefs(id string, disabled []string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if user := store.users[id]; user != nil {
+        user.muted = append([]string(nil), disabled...)
+    }
+    return nil
+}
+
+func (store *MemStore) GetNotificationPrefs(uuids []string) (map[string][]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := make(map[string][]string)
+    for _, uuid := range uuids {
+        if user := store.userByUUID(uuid); user != nil && len(user.muted) != 0 {
+            data[uuid] = append([]string(nil), user.muted...)
+        }
+    }
+    return data, nil
+}
+
+func (store *MemStore) RecordNotificationsSent(notificationIDs []string, signal string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    for _, notificationID := range notificationIDs {
+        if _, exists := store.receipts[notificationID]; !exists {
+            store.receipts[notificationID] = map[string]string {
+                "signal": signal,
+                "status": "sent",
+            }
+        }
+    }
+    return nil
+}
+
+func (store *MemStore) RecordNotificationReceipt(notificationID string, event string, status string) (bool, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    receipt := store.receipts[notificationID]
+    if receipt == nil {
+        return false, nil
+    }
+    receipt["event"] = event
+    receipt["status"] = status
+    return true, nil
+}
+
+// NotificationReceipt returns the tracked status of a notification, which handlers only ever write
+func (store *MemStore) NotificationReceipt(notificationID string) map[string]string {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    return store.receipts[notificationID]
+}
+
+func (store *MemStore) AddPendingEvent(uuids []string, eventid string, signal string, data string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    store.events[eventid] = PendingEvent{ID: eventid, Signal: signal, Data: data, Created: EpochMillis(time.Now())}
+    for _, uuid := range uuids {
+        if user := store.userByUUID(uuid); user != nil {
+            user.pending = append(user.pending, eventid)
+        }
+    }
+    return nil
+}
+
+func (store *MemStore) GetPendingEvents(id string) ([]PendingEvent, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[id]
+    if user == nil || len(user.pending) == 0 {
+        return nil, io.EOF
+    }
+    var events []PendingEvent
+    for _, eventid := range user.pending {
+        events = append(events, store.events[eventid])
+    }
+    return events, nil
+}
+
+func (store *MemStore) AckPendingEvents(id string, eventids []string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[id]
+    if user == nil {
+        return nil
+    }
+    acked := make(map[string]bool)
+    for _, eventid := range eventids {
+        acked[eventid] = true
+    }
+    var pending []string
+    for _, eventid := range user.pending {
+        if !acked[eventid] {
+            pending = append(pending, eventid)
+        }
+    }
+    user.pending = pending
+
+    for eventid := range acked {
+        held := false
+        for _, other := range store.users {
+            for _, pendingID := range other.pending {
+                held = held || pendingID == eventid
+            }
+        }
+        if !held {
+            delete(store.events, eventid)
+        }
+    }
+    return nil
+}
+
+func (store *MemStore) CreateAsset(id string, assetid string, assettype string, remotepath string, createdate *string, location *string, duration *string, originalfilename *string, originaluti *string, pixelwidth int, pixelheight int, md5 string, key string, remotepathorig *string, renditions map[string]Rendition) (*uint64, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[id]
+    if user == nil {
+        return nil, io.EOF
+    }
+    if existing := store.assets[assetid]; existing != nil {
+        if totalsize, ok := existing.fields["totalsize"].(int64); ok {
+            result := uint64(totalsize)
+            return &result, ErrAssetExists
+        }
+        return nil, ErrAssetExists
+    }
+
+    fields := map[string]interface{} {
+        "uuid": assetid,
+        "type": assettype,
+        "remotepath": remotepath,
+        "pixelwidth": int64(pixelwidth),
+        "pixelheight": int64(pixelheight),
+        "md5": md5,
+        "uploaddate": EpochMillis(time.Now()),
+    }
+    optional := map[string]*string {
+        "createdate": createdate,
+        "location": location,
+        "duration": duration,
+        "originalfilename": originalfilename,
+        "originaluti": originaluti,
+        "remotepathorig": remotepathorig,
+    }
+    for name, value := range optional {
+        if value != nil {
+            fields[name] = *value
+        }
+    }
+    if createdate != nil {
+        if millis, ok := createDateMillis(*createdate); ok {
+            fields["createdatemillis"] = millis
+        }
+    }
+    asset := &memAsset{owner: user.uuid, key: key, fields: fields, renditions: make(map[string]Rendition), sharedWith: make(map[string]bool)}
+    store.assets[assetid] = asset
+
+    if len(renditions) == 0 {
+        return nil, nil
+    }
+    totalsize := setMemRenditions(asset, renditions)
+    return &totalsize, nil
+}
+
+// setMemRenditions creates or replaces the named renditions, returning the asset totalsize as setRenditions does
+func setMemRenditions(asset *memAsset, renditions map[string]Rendition) uint64 {
+    for name, rendition := range renditions {
+        asset.renditions[name] = rendition
+    }
+    var totalsize uint64
+    for _, rendition := range asset.renditions {
+        totalsize += rendition.Size
+    }
+    asset.fields["totalsize"] = int64(totalsize)
+    return totalsize
+}
+
+func (store *MemStore) AddPathForOriginalAsset(id string, assetid string, remotepathorig string, renditions map[string]Rendition) (uint64, error) {
+    if len(renditions) == 0 {
+        return 0, errors.New("renditions missing")
+    }
+
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    asset := store.ownedAsset(id, assetid)
+    if asset == nil {
+        return 0, io.EOF
+    }
+    asset.fields["remotepathorig"] = remotepathorig
+    return setMemRenditions(asset, renditions), nil
+}
+
+func (store *MemStore) SetAssetsOriginalFilenames(id string, data map[string]string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    for assetid, originalfilename := range data {
+        if asset := store.ownedAsset(id, assetid); asset != nil {
+            asset.fields["originalfilename"] = originalfilename
+            asset.filenameSetAt = EpochMillis(time.Now())
+        }
+    }
+    return nil
+}
+
+func (store *MemStore) SetAssetsOriginalFilenamesVersioned(id string, data map[string]OriginalFilenameUpdate) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    for assetid, update := range data {
+        if asset := store.ownedAsset(id, assetid); asset != nil && (asset.filenameSetAt == 0 || asset.filenameSetAt < update.SetAt) {
+            asset.fields["originalfilename"] = update.Filename
+            asset.filenameSetAt = update.SetAt
+        }
+    }
+    return nil
+}
+
+func (store *MemStore) GetAssetsOriginalFilenames(id string, assetids []string) (map[string]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := make(map[string]string)
+    for _, assetid := range assetids {
+        if asset := store.ownedAsset(id, assetid); asset != nil {
+            if originalfilename, ok := asset.fields["originalfilename"].(string); ok {
+                data[assetid] = originalfilename
+            }
+        }
+    }
+    return data, nil
+}
+
+func (store *MemStore) RemoveOriginalForAsset(id string, assetid string) (string, uint64, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    asset := store.ownedAsset(id, assetid)
+    if asset == nil {
+        return "", 0, ErrAssetNotFound
+    }
+    original, ok := asset.renditions["original"]
+    if !ok {
+        return "", 0, ErrNoOriginal
+    }
+    delete(asset.renditions, "original")
+    delete(asset.fields, "remotepathorig")
+    return original.RemotePath, setMemRenditions(asset, nil), nil
+}
+
+func (store *MemStore) DeleteAssets(userid string, assetids []string) (*[]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    pathsToDelete := []string{}
+    user := store.users[userid]
+    if user == nil {
+        return &pathsToDelete, nil
+    }
+    seen := make(map[string]bool)
+    addPath := func(path interface{}) {
+        if path, ok := path.(string); ok && !seen[path] {
+            seen[path] = true
+            pathsToDelete = append(pathsToDelete, path)
+        }
+    }
+    for _, assetid := range assetids {
+        asset := store.assets[assetid]
+        if asset == nil {
+            continue
+        }
+        if asset.owner != user.uuid {
+            delete(asset.sharedWith, user.uuid)
+            continue
+        }
+        addPath(asset.fields["remotepath"])
+        addPath(asset.fields["remotepathorig"])
+        var names []string
+        for name := range asset.renditions {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            addPath(asset.renditions[name].RemotePath)
+        }
+        for _, group := range store.groups {
+            delete(group.assets, assetid)
+        }
+        delete(store.assets, assetid)
+    }
+    return &pathsToDelete, nil
+}
+
+func (store *MemStore) GetOwnedAssetIDs(id string) ([]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    var assetids []string
+    for assetid := range store.assets {
+        if store.ownedAsset(id, assetid) != nil {
+            assetids = append(assetids, assetid)
+        }
+    }
+    sort.Strings(assetids)
+    return assetids, nil
+}
+
+func (store *MemStore) GetAssetTypes(id string, assetids []string) (map[string]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := make(map[string]string)
+    for _, assetid := range assetids {
+        if asset := store.ownedAsset(id, assetid); asset != nil {
+            data[assetid] = "photo"
+            if assettype, ok := asset.fields["type"].(string); ok {
+                data[assetid] = assettype
+            }
+        }
+    }
+    return data, nil
+}
+
+// SetFavourite isn't supported, favourites are still recorded against the legacy trip model
+func (store *MemStore) SetFavourite(userid string, tripid string, assetid string) error {
+    return nil
+}
+
+// UnsetFavourite isn't supported, see SetFavourite
+func (store *MemStore) UnsetFavourite(userid string, tripid string, assetid string) error {
+    return nil
+}
+
+func (store *MemStore) SetAssetArchived(id string, assetid string, archived bool) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    asset := store.ownedAsset(id, assetid)
+    if asset == nil {
+        return ErrAssetNotFound
+    }
+    asset.archived = archived
+    return nil
+}
+
+func (store *MemStore) SetAssetTags(id string, assetid string, tags []string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    asset := store.ownedAsset(id, assetid)
+    if asset == nil {
+        return ErrAssetNotFound
+    }
+    asset.tags = append([]string(nil), tags...)
+    return nil
+}
+
+// ownAssetEntry returns the asset as listed for its owner by getAssets
+func ownAssetEntry(owner string, asset *memAsset) map[string]interface{} {
+    entry := make(map[string]interface{})
+    for name, value := range asset.fields {
+        entry[name] = value
+    }
+    tags := []interface{}{}
+    for _, tag := range asset.tags {
+        tags = append(tags, tag)
+    }
+    entry["ownerid"] = owner
+    entry["key"] = asset.key
+    entry["favourite"] = false
+    entry["archived"] = asset.archived
+    entry["tags"] = tags
+    return entry
+}
+
+// sharedAssetEntries returns the asset as listed by getAssets for a user it is shared with, once per group they share it in
+func (store *MemStore) sharedAssetEntries(user *memUser, assetid string, asset *memAsset) []interface{} {
+    if !asset.sharedWith[user.uuid] || store.userByUUID(asset.owner) == nil {
+        return nil
+    }
+    var groupIDs []string
+    for groupID, group := range store.groups {
+        if _, ok := group.assets[assetid]; ok && group.members[user.uuid] != nil {
+            groupIDs = append(groupIDs, groupID)
+        }
+    }
+    sort.Strings(groupIDs)
+
+    var entries []interface{}
+    for _, groupID := range groupIDs {
+        entry := make(map[string]interface{})
+        for name, value := range asset.fields {
+            entry[name] = value
+        }
+        entry["ownerid"] = asset.owner
+        entry["key"] = nil
+        if sharedKey := store.groups[groupID].assets[assetid]; len(sharedKey) != 0 {
+            entry["key"] = sharedKey
+        }
+        entry["favourite"] = false
+        entry["groupid"] = groupID
+        entry["archived"] = false
+        entry["tags"] = []interface{}{}
+        entries = append(entries, entry)
+    }
+    return entries
+}
+
+// listAssets returns the user's own assets accepted by ownFilter and, if sharedFilter is set, the shared assets it accepts,
+// ordered by uuid then by order. io.EOF if there are none, as getAssets
+func (store *MemStore) listAssets(id string, order AssetOrder, ownFilter func(*memAsset) bool, sharedFilter func(*memAsset) bool) ([]interface{}, error) {
+    user := store.users[id]
+    if user == nil {
+        return nil, io.EOF
+    }
+    var assetids []string
+    for assetid := range store.assets {
+        assetids = append(assetids, assetid)
+    }
+    sort.Strings(assetids)
+
+    var assets []interface{}
+    for _, assetid := range assetids {
+        asset := store.assets[assetid]
+        if asset.owner == user.uuid {
+            if ownFilter(asset) {
+                assets = append(assets, ownAssetEntry(user.uuid, asset))
+            }
+        } else if sharedFilter != nil && sharedFilter(asset) {
+            assets = append(assets, store.sharedAssetEntries(user, assetid, asset)...)
+        }
+    }
+    if len(assets) == 0 {
+        return nil, io.EOF
+    }
+    sortAssets(assets, order)
+    return assets, nil
+}
+
+func (store *MemStore) GetAssets(id string, includeArchived bool, order AssetOrder) ([]interface{}, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    return store.listAssets(id, order, func(asset *memAsset) bool {
+        return includeArchived || !asset.archived
+    }, func(asset *memAsset) bool {
+        return true
+    })
+}
+
+func (store *MemStore) GetAssetsByTag(id string, tag string, includeArchived bool, order AssetOrder) ([]interface{}, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    return store.listAssets(id, order, func(asset *memAsset) bool {
+        for _, assetTag := range asset.tags {
+            if assetTag == tag {
+                return includeArchived || !asset.archived
+            }
+        }
+        return false
+    }, nil)
+}
+
+func (store *MemStore) GetAssetsInDateRange(id string, from time.Time, to time.Time, includeArchived bool, order AssetOrder) ([]interface{}, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    inRange := func(asset *memAsset) bool {
+        millis, ok := asset.fields["createdatemillis"].(int64)
+        return ok && millis >= EpochMillis(from) && millis <= EpochMillis(to)
+    }
+    return store.listAssets(id, order, func(asset *memAsset) bool {
+        return inRange(asset) && (includeArchived || !asset.archived)
+    }, inRange)
+}
+
+func (store *MemStore) GetAssetsByIDs(id string, assetids []string) ([]interface{}, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    requested := make(map[string]bool)
+    for _, assetid := range assetids {
+        requested[assetid] = true
+    }
+    inRequest := func(asset *memAsset) bool {
+        return requested[asset.fields["uuid"].(string)]
+    }
+    return store.listAssets(id, AssetOrder{}, inRequest, inRequest)
+}
+
+func (store *MemStore) GetAssetsSchema0(id string) ([]interface{}, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[id]
+    if user == nil {
+        return nil, io.EOF
+    }
+    var assets []interface{}
+    for assetid, asset := range store.assets {
+        if asset.owner == user.uuid {
+            assets = append(assets, map[string]interface{} {
+                "id": assetid,
+                "remotepathorig": asset.fields["remotepathorig"],
+                "tripkey": nil,
+                "assetkey": nil,
+                "key": asset.key,
+                "md5": asset.fields["md5"],
+            })
+            continue
+        }
+        for _, entry := range store.sharedAssetEntries(user, assetid, asset) {
+            entry := entry.(map[string]interface{})
+            assets = append(assets, map[string]interface{} {
+                "id": assetid,
+                "remotepathorig": asset.fields["remotepathorig"],
+                "groupid": entry["groupid"],
+                "sharedkey": entry["key"],
+                "md5": asset.fields["md5"],
+            })
+        }
+    }
+    if len(assets) == 0 {
+        return nil, io.EOF
+    }
+    return assets, nil
+}
+
+func (store *MemStore) UpdateAssetKeys(id string, keys map[string]string) ([]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    updated := []string{}
+    for assetid, key := range keys {
+        if asset := store.ownedAsset(id, assetid); asset != nil {
+            asset.key = key
+            updated = append(updated, assetid)
+        }
+    }
+    return updated, nil
+}
+
+func (store *MemStore) PatchSchema0(id string, assetkeys map[string]string, assetmd5s map[string]string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[id]
+    if user == nil {
+        return io.EOF
+    }
+    switch user.schemaVersion {
+    case "0":
+    case "1":
+        return ErrSchemaMigrated
+    default:
+        return ErrSchemaNewer
+    }
+    for assetid, key := range assetkeys {
+        if asset := store.ownedAsset(id, assetid); asset != nil {
+            asset.key = key
+        }
+    }
+    for assetid, md5 := range assetmd5s {
+        if asset := store.assets[assetid]; asset != nil && (asset.owner == user.uuid || asset.sharedWith[user.uuid]) {
+            asset.fields["md5"] = md5
+        }
+    }
+    user.schemaVersion = "1"
+    return nil
+}
+
+// otherMembers returns the members of the group apart from the user with the given uuid, as listed by GetGroups
+func (store *MemStore) otherMembers(group *memGroup, except string) []interface{} {
+    var userIDs []string
+    for userID := range group.members {
+        if userID != except {
+            userIDs = append(userIDs, userID)
+        }
+    }
+    sort.Strings(userIDs)
+    members := []interface{}{}
+    for _, userID := range userIDs {
+        member := map[string]interface{} {
+            "uuid": userID,
+            "key": nil,
+        }
+        if user := store.userByUUID(userID); user != nil {
+            member["key"] = user.publicKey
+        }
+        members = append(members, member)
+    }
+    return members
+}
+
+func (store *MemStore) GetGroupsFiltered(id string, query string, cursor string, limit int) (map[string]map[string]interface{}, string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := make(map[string]map[string]interface{})
+    user := store.users[id]
+    if user == nil {
+        return data, "", io.EOF
+    }
+    var groupIDs []string
+    for groupID, group := range store.groups {
+        if group.members[user.uuid] != nil && groupID > cursor && strings.Contains(strings.ToLower(group.name), strings.ToLower(query)) {
+            groupIDs = append(groupIDs, groupID)
+        }
+    }
+    sort.Strings(groupIDs)
+
+    next := ""
+    if limit > 0 && len(groupIDs) > limit {
+        groupIDs = groupIDs[:limit]
+        next = groupIDs[limit - 1]
+    }
+    for _, groupID := range groupIDs {
+        group := store.groups[groupID]
+        data[groupID] = map[string]interface{} {
+            "name": group.name,
+            "key": group.members[user.uuid].key,
+            "members": store.otherMembers(group, user.uuid),
+        }
+    }
+    if len(data) == 0 {
+        return data, "", io.EOF
+    }
+    return data, next, nil
+}
+
+func (store *MemStore) GetGroupsWithMemberCounts(id string, groupIDs []string) (map[string]int64, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := make(map[string]int64)
+    for _, groupID := range groupIDs {
+        if _, group, _ := store.membership(id, groupID); group != nil {
+            data[groupID] = int64(len(group.members))
+        }
+    }
+    return data, nil
+}
+
+func (store *MemStore) CreateGroup(id string, groupid string, name string, key string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if store.groups[groupid] != nil {
+        return ErrIDInUse
+    }
+    user := store.users[id]
+    if user == nil {
+        return nil
+    }
+    store.groups[groupid] = &memGroup{
+        name: name,
+        members: map[string]*memMembership{user.uuid: {key: key}},
+        assets: make(map[string]string),
+    }
+    return nil
+}
+
+func (store *MemStore) JoinGroup(id string, groupID string, groupKey string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user, group, membership := store.membership(id, groupID)
+    if membership == nil {
+        return ErrNotGroupMember
+    }
+    if len(membership.inviter) == 0 {
+        return ErrAlreadyMember
+    }
+    membership.key = groupKey
+    membership.inviter = ""
+    for assetid, sharedKey := range group.assets {
+        if len(sharedKey) != 0 {
+            store.assets[assetid].sharedWith[user.uuid] = true
+        }
+    }
+    return nil
+}
+
+func (store *MemStore) LeaveGroup(ownerid string, groupid string, keepAssets bool) (int64, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user, group, membership := store.membership(ownerid, groupid)
+    if membership == nil {
+        return 0, nil
+    }
+    delete(group.members, user.uuid)
+    for userID, invite := range group.members {
+        if invite.inviter == user.uuid {
+            delete(group.members, userID)
+        }
+    }
+
+    var unshared int64
+    if !keepAssets {
+        for assetid := range group.assets {
+            if store.assets[assetid].owner == user.uuid {
+                delete(group.assets, assetid)
+                store.pruneShared(assetid)
+                unshared++
+            }
+        }
+    }
+
+    // once nobody is left, remove any assets kept in the group and the group itself
+    if len(group.members) == 0 {
+        delete(store.groups, groupid)
+        for assetid := range group.assets {
+            store.pruneShared(assetid)
+        }
+    }
+    return unshared, nil
+}
+
+func (store *MemStore) IsGroupMember(id string, groupID string) (bool, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    _, _, membership := store.membership(id, groupID)
+    return membership != nil, nil
+}
+
+func (store *MemStore) RotateGroupKey(id string, groupID string, keys map[string]string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    _, group, membership := store.membership(id, groupID)
+    if membership == nil {
+        return ErrNotGroupMember
+    }
+    mismatch := &KeyMapMismatchError{}
+    for member := range group.members {
+        if _, ok := keys[member]; !ok {
+            mismatch.Missing = append(mismatch.Missing, member)
+        }
+    }
+    for userID := range keys {
+        if group.members[userID] == nil {
+            mismatch.Unexpected = append(mismatch.Unexpected, userID)
+        }
+    }
+    if len(mismatch.Missing) != 0 || len(mismatch.Unexpected) != 0 {
+        sort.Strings(mismatch.Missing)
+        sort.Strings(mismatch.Unexpected)
+        return mismatch
+    }
+    for userID, key := range keys {
+        group.members[userID].key = key
+    }
+    return nil
+}
+
+func (store *MemStore) AddUsersToGroup(id string, groupid string, users []map[string]string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    inviter, group, membership := store.membership(id, groupid)
+    if membership == nil {
+        return nil
+    }
+    for _, user := range users {
+        if store.userByUUID(user["uuid"]) != nil && group.members[user["uuid"]] == nil {
+            group.members[user["uuid"]] = &memMembership{key: user["key"], inviter: inviter.uuid}
+        }
+    }
+    return nil
+}
+
+func (store *MemStore) GetUsersInGroup(id string, groupID string) (map[string]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := make(map[string]string)
+    if user, group, _ := store.membership(id, groupID); group != nil {
+        for userID := range group.members {
+            if other := store.userByUUID(userID); other != nil && userID != user.uuid {
+                data[userID] = other.publicKey
+            }
+        }
+    }
+    if len(data) == 0 {
+        return data, io.EOF
+    }
+    return data, nil
+}
+
+func (store *MemStore) GetUsersInGroupWithStats(id string, groupID string) (map[string]map[string]interface{}, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := make(map[string]map[string]interface{})
+    _, group, _ := store.membership(id, groupID)
+    if group == nil {
+        return data, ErrNotGroupMember
+    }
+    for userID := range group.members {
+        member := store.userByUUID(userID)
+        if member == nil {
+            continue
+        }
+        var sharedAssets int64
+        for assetid, sharedKey := range group.assets {
+            if len(sharedKey) != 0 && store.assets[assetid].owner == userID {
+                sharedAssets++
+            }
+        }
+        data[userID] = map[string]interface{} {
+            "publicKey": member.publicKey,
+            "sharedAssets": sharedAssets,
+        }
+    }
+    return data, nil
+}
+
+func (store *MemStore) GetUsersInGroupPaginated(id string, groupID string, cursor string, limit int) (map[string]string, string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := make(map[string]string)
+    user, group, _ := store.membership(id, groupID)
+    if group == nil {
+        return data, "", io.EOF
+    }
+    var userIDs []string
+    for userID := range group.members {
+        if userID != user.uuid && userID > cursor && store.userByUUID(userID) != nil {
+            userIDs = append(userIDs, userID)
+        }
+    }
+    sort.Strings(userIDs)
+
+    next := ""
+    if len(userIDs) > limit {
+        userIDs = userIDs[:limit]
+        next = userIDs[limit - 1]
+    }
+    for _, userID := range userIDs {
+        data[userID] = store.userByUUID(userID).publicKey
+    }
+    if len(data) == 0 {
+        return data, "", io.EOF
+    }
+    return data, next, nil
+}
+
+// StreamOtherGroupMembers calls fn with batches of the group's members apart from the user, fn is called without holding
+// the store lock so it is free to use the store
+func (store *MemStore) StreamOtherGroupMembers(id string, groupID string, batchSize int, fn func(userIDs []string, unreachableIDs []string)) error {
+    store.mutex.Lock()
+    var members []*memUser
+    if group := store.groups[groupID]; group != nil {
+        for userID := range group.members {
+            if member := store.userByUUID(userID); member != nil && member.id != id {
+                members = append(members, member)
+            }
+        }
+    }
+    sort.Slice(members, func(i, j int) bool {
+        return members[i].uuid < members[j].uuid
+    })
+    var batches [][2][]string
+    for start := 0; start < len(members); start += batchSize {
+        end := start + batchSize
+        if end > len(members) {
+            end = len(members)
+        }
+        var batch [2][]string
+        for _, member := range members[start:end] {
+            if member.unreachable {
+                batch[1] = append(batch[1], member.uuid)
+            } else {
+                batch[0] = append(batch[0], member.uuid)
+            }
+        }
+        batches = append(batches, batch)
+    }
+    store.mutex.Unlock()
+
+    for _, batch := range batches {
+        fn(batch[0], batch[1])
+    }
+    return nil
+}
+
+func (store *MemStore) AddAssetsToGroup(userid string, groupid string, assetids []string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    _, group, membership := store.membership(userid, groupid)
+    if membership == nil {
+        return nil
+    }
+    for _, assetid := range assetids {
+        if _, linked := group.assets[assetid]; store.ownedAsset(userid, assetid) != nil && !linked {
+            group.assets[assetid] = ""
+        }
+    }
+    return nil
+}
+
+func (store *MemStore) RemoveAssetsFromGroup(userid string, groupid string, assetids []string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    _, group, membership := store.membership(userid, groupid)
+    if membership == nil {
+        return nil
+    }
+    for _, assetid := range assetids {
+        if _, linked := group.assets[assetid]; store.ownedAsset(userid, assetid) != nil && linked {
+            delete(group.assets, assetid)
+            store.pruneShared(assetid)
+        }
+    }
+    return nil
+}
+
+func (store *MemStore) GetGroupsForSharedAsset(id string, assetid string) (map[string]map[string]interface{}, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := make(map[string]map[string]interface{})
+    asset := store.ownedAsset(id, assetid)
+    if asset == nil {
+        return data, ErrAssetNotFound
+    }
+    for groupID, group := range store.groups {
+        if sharedKey, ok := group.assets[assetid]; ok && group.members[asset.owner] != nil {
+            data[groupID] = map[string]interface{} {
+                "name": group.name,
+                "shared": len(sharedKey) != 0,
+            }
+        }
+    }
+    if len(data) == 0 {
+        return data, io.EOF
+    }
+    return data, nil
+}
+
+func (store *MemStore) MoveSharedAsset(id string, assetid string, fromgroupid string, togroupid string, assetkey string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user, fromGroup, _ := store.membership(id, fromgroupid)
+    _, toGroup, _ := store.membership(id, togroupid)
+    if fromGroup == nil || toGroup == nil {
+        return ErrNotGroupMember
+    }
+    asset := store.ownedAsset(id, assetid)
+    if _, linked := fromGroup.assets[assetid]; asset == nil || !linked {
+        return ErrAssetNotFound
+    }
+    if sharedKey := toGroup.assets[assetid]; len(sharedKey) != 0 && sharedKey != assetkey {
+        return ErrSharedKeyConflict
+    }
+    delete(fromGroup.assets, assetid)
+    store.pruneShared(assetid)
+    toGroup.assets[assetid] = assetkey
+    store.shareWithGroup(asset, toGroup, user.uuid)
+    return nil
+}
+
+func (store *MemStore) AssetsOwnedBy(id string, assetids []string) ([]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    var unowned []string
+    for _, assetid := range assetids {
+        if store.ownedAsset(id, assetid) == nil {
+            unowned = append(unowned, assetid)
+        }
+    }
+    return unowned, nil
+}
+
+func (store *MemStore) GetSharedAssetKeys(id string, groupid string, assetids []string) (map[string]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := make(map[string]string)
+    _, group, _ := store.membership(id, groupid)
+    if group == nil {
+        return data, nil
+    }
+    for _, assetid := range assetids {
+        if sharedKey := group.assets[assetid]; len(sharedKey) != 0 {
+            data[assetid] = sharedKey
+        }
+    }
+    return data, nil
+}
+
+func (store *MemStore) ShareAssets(id string, groupid string, assetids []string, assetkeys []string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user, group, _ := store.membership(id, groupid)
+    if group == nil {
+        return nil
+    }
+    for index, assetid := range assetids {
+        asset := store.ownedAsset(id, assetid)
+        sharedKey, linked := group.assets[assetid]
+        // never replace the key other members decrypt with
+        if asset == nil || !linked || (len(sharedKey) != 0 && sharedKey != assetkeys[index]) {
+            continue
+        }
+        group.assets[assetid] = assetkeys[index]
+        store.shareWithGroup(asset, group, user.uuid)
+    }
+    return nil
+}
+
+func (store *MemStore) UnshareAssets(id string, groupid string, assetids []string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    _, group, _ := store.membership(id, groupid)
+    if group == nil {
+        return nil
+    }
+    for _, assetid := range assetids {
+        if _, linked := group.assets[assetid]; store.ownedAsset(id, assetid) != nil && linked {
+            group.assets[assetid] = ""
+            store.assets[assetid].sharedWith = make(map[string]bool)
+        }
+    }
+    return nil
+}
+
+func (store *MemStore) UnshareAssetFromAllGroups(id string, assetid string) ([]string, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    asset := store.ownedAsset(id, assetid)
+    if asset == nil {
+        return nil, ErrAssetNotFound
+    }
+    groupids := []string{}
+    for groupID, group := range store.groups {
+        if len(group.assets[assetid]) != 0 {
+            group.assets[assetid] = ""
+            groupids = append(groupids, groupID)
+        }
+    }
+    sort.Strings(groupids)
+    asset.sharedWith = make(map[string]bool)
+    return groupids, nil
+}
+
+func (store *MemStore) GetAssetsForAllGroups(userid string) (map[string]map[string][]interface{}, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    data := make(map[string]map[string][]interface{})
+    user := store.users[userid]
+    if user == nil {
+        return data, io.EOF
+    }
+    for groupID, group := range store.groups {
+        if group.members[user.uuid] == nil {
+            continue
+        }
+        assetids, sharedassetids := []interface{}{}, []interface{}{}
+        for assetid, sharedKey := range group.assets {
+            asset := store.assets[assetid]
+            if asset.owner != user.uuid && !asset.sharedWith[user.uuid] {
+                continue
+            }
+            assetids = append(assetids, assetid)
+            if len(sharedKey) != 0 {
+                sharedassetids = append(sharedassetids, assetid)
+            }
+        }
+        data[groupID] = map[string][]interface{} {
+            "assetids": assetids,
+            "sharedassetids": sharedassetids,
+        }
+    }
+    if len(data) == 0 {
+        return data, io.EOF
+    }
+    return data, nil
+}
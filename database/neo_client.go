@@ -1,26 +1,119 @@
 package database
 
 import (
+	"context"
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/google/uuid"
 	bolt "github.com/johnnadratowski/golang-neo4j-bolt-driver"
+	boltErrors "github.com/johnnadratowski/golang-neo4j-bolt-driver/errors"
 
 	"github.com/tripupapp/tripup-server/auth"
+	"github.com/tripupapp/tripup-server/config"
+	"github.com/tripupapp/tripup-server/logging"
 )
 
-var debugLogger *log.Logger = log.New(os.Stdout, "[DEBUG] NeoLog: ", log.LstdFlags | log.Lshortfile)
-var errLogger *log.Logger = log.New(os.Stderr, "[ERROR] NeoLog: ", log.LstdFlags | log.Lshortfile)
+var debugLogger *log.Logger = log.New(logging.Writer(logging.Debug, os.Stdout), "[DEBUG] NeoLog: ", log.LstdFlags | log.Lshortfile)
+var warnLogger *log.Logger = log.New(logging.Writer(logging.Warn, os.Stderr), "[WARN] NeoLog: ", log.LstdFlags)
+var errLogger *log.Logger = log.New(logging.Writer(logging.Error, os.Stderr), "[ERROR] NeoLog: ", log.LstdFlags | log.Lshortfile)
 
 var neoDB *Neo4j
 var once sync.Once
 
+// UnavailableError is returned when a connection to the database cannot be established
+type UnavailableError struct {
+    Err error
+}
+
+func (e *UnavailableError) Error() string {
+    return fmt.Sprintf("neo4j unavailable: %v", e.Err)
+}
+
+func (e *UnavailableError) Unwrap() error {
+    return e.Err
+}
+
+// IsUnavailable reports whether err means the database couldn't be reached, either when connecting or because the
+// connection was lost part way through a query, as opposed to the query itself failing. The driver wraps the network
+// error in its own error type, and a connection dropped mid read surfaces as io.EOF inside it
+func IsUnavailable(err error) bool {
+    var unavailableErr *UnavailableError
+    if errors.As(err, &unavailableErr) {
+        return true
+    }
+    var boltErr *boltErrors.Error
+    if errors.As(err, &boltErr) {
+        if err = boltErr.InnerMost(); err == io.EOF {
+            return true
+        }
+    }
+    var netErr net.Error
+    return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// ErrAssetExists is returned when creating an asset that the user already has, the existing asset is left unchanged
+var ErrAssetExists = errors.New("asset already exists")
+
+// ErrNoOriginal is returned when removing the original of an asset that has no original rendition
+var ErrNoOriginal = errors.New("asset has no original")
+
+// ErrAssetNotFound is returned when an asset doesn't exist or isn't owned by the user
+var ErrAssetNotFound = errors.New("asset not found")
+
+// ErrAssetNotOwned is returned when an asset exists but belongs to another user, for operations that only accept the
+// user's own assets
+var ErrAssetNotOwned = errors.New("asset is not owned by user")
+
+// ErrNotGroupMember is returned when the user isn't a member of a group the operation requires
+var ErrNotGroupMember = errors.New("user is not a member of group")
+
+// ErrSharedKeyConflict is returned when an asset is already shared in a group with a different key, the key other members
+// decrypt with is left unchanged
+var ErrSharedKeyConflict = errors.New("asset is already shared in group with a different key")
+
+// ErrAlreadyMember is returned when joining a group the user has already joined, membership is left unchanged
+var ErrAlreadyMember = errors.New("user is already a member of group")
+
+// KeyMapMismatchError is returned when a group key map doesn't cover exactly the current members of the group
+type KeyMapMismatchError struct {
+    Missing     []string
+    Unexpected  []string
+}
+
+func (e *KeyMapMismatchError) Error() string {
+    return fmt.Sprintf("group key map doesn't match membership, missing: %v, unexpected: %v", e.Missing, e.Unexpected)
+}
+
+// ErrIDInUse is returned when a newly generated user or group uuid is already taken, callers should generate another
+var ErrIDInUse = errors.New("uuid already in use")
+
+// ErrUserExists is returned when creating a user for an auth subject that already has one
+var ErrUserExists = errors.New("user already exists")
+
+// ErrSchemaMigrated is returned when migrating a user that is already on the target schema version, nothing is changed
+var ErrSchemaMigrated = errors.New("user is already on the target schema version")
+
+// ErrSchemaNewer is returned when migrating a user that is on a later schema version than the migration produces
+var ErrSchemaNewer = errors.New("user is on a newer schema version")
+
+// ErrLastContact is returned when removing a contact would leave the user undiscoverable
+var ErrLastContact = errors.New("cannot remove the last contact method for user")
+
+// contactProperties maps auth provider names to the user property holding the hashed identifier
+var contactProperties = map[string]string {
+    "phone": "number",
+    "email": "email",
+    "apple": "appleid",
+}
+
 type Neo4j struct {
     driverPool bolt.DriverPool
 }
@@ -32,26 +125,9 @@ func Instance() *Neo4j {
     return neoDB
 }
 
-func (neo *Neo4j) Connect() {
-    user, exists := os.LookupEnv("TRIPUP_NEO_USER")
-    if !exists {
-        errLogger.Panicln("TRIPUP_NEO_USER not set")
-    }
-    pass, exists := os.LookupEnv("TRIPUP_NEO_PASS")
-    if !exists {
-        errLogger.Panicln("TRIPUP_NEO_PASS not set")
-    }
-    host, exists := os.LookupEnv("TRIPUP_NEO_HOST")
-    if !exists {
-        errLogger.Panicln("TRIPUP_NEO_HOST not set")
-    }
-    port, exists := os.LookupEnv("TRIPUP_NEO_PORT")
-    if !exists {
-        errLogger.Panicln("TRIPUP_NEO_PORT not set")
-    }
-
+func (neo *Neo4j) Connect(cfg *config.Config) {
     driverpool, err := bolt.NewDriverPool(
-        fmt.Sprintf("bolt://%s:%s@%s:%s", user, pass, host, port),
+        fmt.Sprintf("bolt://%s:%s@%s:%s", cfg.NeoUser, cfg.NeoPass, cfg.NeoHost, cfg.NeoPort),
         10) // max 10 connections - need to increase later!!!!
     if err != nil {
         errLogger.Panicln("error creating driverpool")
@@ -60,20 +136,52 @@ func (neo *Neo4j) Connect() {
     }
 }
 
-func (neo *Neo4j) CreateUser(id string, uuid string, authProviders auth.AuthProviders, publickey string, privatekey string, schemaVersion string) error {
-    conn, err := neo.driverPool.OpenPool()
+// indexes and constraints the queries rely on, created at startup. Creating one that already exists is a no-op
+var indexes = []string{
+    "CREATE INDEX ON :Asset(createdatemillis)",   // GetAssetsInDateRange
+    "CREATE CONSTRAINT ON (receipt:NotificationReceipt) ASSERT receipt.id IS UNIQUE",   // RecordNotificationReceipt
+    "CREATE CONSTRAINT ON (lock:Lock) ASSERT lock.name IS UNIQUE",    // AcquireLock, stops replicas creating duplicate lock nodes on first use
+    "CREATE INDEX ON :User(pushUnreachable)",     // GetUnreachableUsers
+}
+
+// EnsureIndexes creates any missing indexes, each in its own transaction as schema changes can't be mixed with writes
+func (neo *Neo4j) EnsureIndexes() error {
+    conn, err := neo.openConn()
     if err != nil {
         return err
     }
     defer conn.Close()
 
-    stmt, err := conn.PrepareNeo(
-        "CREATE (user:User { uuid: {uuid}, publicKey: {publickey}, privateKey: {privatekey}, id: {id}, number: {number}, email: {email}, appleid: {appleid}, schemaVersion: {schemaVersion} }) " +
-        "RETURN user.uuid")
+    for _, index := range indexes {
+        if _, err := conn.ExecNeo(index, nil); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Shutdown closes the connections held by the driver pool
+func (neo *Neo4j) Shutdown(ctx context.Context) error {
+    if closer, ok := neo.driverPool.(io.Closer); ok {
+        return closer.Close()
+    }
+    return nil
+}
+
+func (neo *Neo4j) openConn() (bolt.Conn, error) {
+    conn, err := neo.driverPool.OpenPool()
+    if err != nil {
+        return nil, &UnavailableError{err}
+    }
+    return conn, nil
+}
+
+func (neo *Neo4j) CreateUser(id string, uuid string, authProviders auth.AuthProviders, publickey string, privatekey string, schemaVersion string) error {
+    conn, err := neo.openConn()
     if err != nil {
         return err
     }
-    defer stmt.Close() // closing the statment will also close the rows
+    defer conn.Close()
 
     args := map[string]interface{} {
         "id": id,
@@ -96,76 +204,282 @@ func (neo *Neo4j) CreateUser(id string, uuid string, authProviders auth.AuthProv
         args["appleid"] = authProviders.AppleID
     }
 
+    tx, err := conn.Begin()
+    if err != nil {
+        return err
+    }
+
+    // a retried create must not add a second user for the same subject, the existing user is left unchanged
+    rows, err := conn.QueryNeo(
+        "MATCH (user:User) " +
+        "WHERE user.id = {id} OR user.uuid = {uuid} " +
+        "RETURN user.id = {id} ", map[string]interface{} {
+        "id": id,
+        "uuid": uuid,
+    })
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    sameSubject, uuidTaken := false, false
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            rows.Close()
+            tx.Rollback()
+            return err
+        }
+        if row[0].(bool) {
+            sameSubject = true
+        } else {
+            uuidTaken = true
+        }
+    }
+    rows.Close()
+    if sameSubject {
+        tx.Rollback()
+        return ErrUserExists
+    }
+    if uuidTaken {
+        tx.Rollback()
+        return ErrIDInUse
+    }
+
+    if err := releaseContacts(conn, args); err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    stmt, err := conn.PrepareNeo(
+        "CREATE (user:User { uuid: {uuid}, publicKey: {publickey}, privateKey: {privatekey}, id: {id}, number: {number}, email: {email}, appleid: {appleid}, schemaVersion: {schemaVersion} }) " +
+        "RETURN user.uuid")
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
     // executing a statement just returns summary information
     result, err := stmt.ExecNeo(args)
     if err != nil {
+        tx.Rollback()
         return err
     }
 
-    _, err = result.RowsAffected()
-    return err
+    if _, err = result.RowsAffected(); err != nil {
+        tx.Rollback()
+        return err
+    }
+    stmt.Close()
+    return tx.Commit()
+}
+
+// releaseContacts removes each hashed identifier in args from any other user holding it, so an identifier maps to at most
+// one user. Identifiers are only set once firebase has verified them, so the verifying user is the current owner and any
+// other holder is stale, e.g. a phone number recycled by the carrier. Must be run within the transaction setting them
+// an identifier that is the other user's only contact is left with them, as removing it would leave them unreachable by
+// contact lookup, and the collision is logged for an operator to resolve
+func releaseContacts(conn bolt.Conn, args map[string]interface{}) error {
+    for _, property := range contactProperties {
+        value, ok := args[property].(string)
+        if !ok {
+            continue
+        }
+        var others []string
+        for _, other := range contactProperties {
+            if other != property {
+                others = append(others, "exists(other." + other + ")")
+            }
+        }
+        // property names can't be parameterised, but are taken from contactProperties so are safe to concatenate
+        rows, err := conn.QueryNeo(
+            "MATCH (other:User { " + property + ": {value} }) " +
+            "WHERE other.id <> {id} " +
+            "WITH other, " + strings.Join(others, " OR ") + " AS released " +
+            "FOREACH (_ IN CASE WHEN released THEN [1] ELSE [] END | REMOVE other." + property + ") " +
+            "RETURN other.uuid, released ", map[string]interface{} {
+            "id": args["id"],
+            "value": value,
+        })
+        if err != nil {
+            return err
+        }
+        for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+            if err != nil {
+                rows.Close()
+                return err
+            }
+            if row[1].(bool) {
+                warnLogger.Printf("%s reassigned from user %s, claimed by another user\n", property, row[0].(string))
+            } else {
+                warnLogger.Printf("%s claimed by another user but not released from user %s, as it is their only contact\n", property, row[0].(string))
+            }
+        }
+        rows.Close()
+    }
+    return nil
 }
 
+// UpdateUserContact replaces the user's hashed identifiers with those firebase currently reports. An identifier the user
+// removed with RemoveUserContact stays removed while firebase still reports the same one, as it is still linked there;
+// a different identifier, or none, for that provider lifts the suppression
 func (neo *Neo4j) UpdateUserContact(id string, authProviders auth.AuthProviders) error {
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
         return err
     }
     defer conn.Close()
 
+    tx, err := conn.Begin()
+    if err != nil {
+        return err
+    }
+
+    removed, err := removedContacts(conn, id)
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+
     args := map[string]interface{} {
         "id": id,
         "number": nil,
         "email": nil,
         "appleid": nil,
     }
+    values := map[string]string {
+        "number": authProviders.PhoneNumber,
+        "email": authProviders.Email,
+        "appleid": authProviders.AppleID,
+    }
 
-    var numberQuery string
-    if len(authProviders.PhoneNumber) != 0 {
-        args["number"] = authProviders.PhoneNumber
-        numberQuery = "SET user.number = {number} "
-    } else {
-        numberQuery = "REMOVE user.number "
+    // property names can't be parameterised, but are taken from contactProperties so are safe to concatenate
+    query := "MATCH (user:User { id: {id} }) "
+    for _, property := range contactProperties {
+        value := values[property]
+        if len(value) != 0 && value != removed[property] {
+            args[property] = value
+            query += "SET user." + property + " = {" + property + "} "
+        } else {
+            query += "REMOVE user." + property + " "
+        }
+        if value != removed[property] {
+            query += "REMOVE user." + removedProperty(property) + " "
+        }
     }
 
-    var emailQuery string
-    if len(authProviders.Email) != 0 {
-        args["email"] = authProviders.Email
-        emailQuery = "SET user.email = {email} "
-    } else {
-        emailQuery = "REMOVE user.email "
+    if err := releaseContacts(conn, args); err != nil {
+        tx.Rollback()
+        return err
     }
 
-    var appleIDQuery string
-    if len(authProviders.AppleID) != 0 {
-        args["appleid"] = authProviders.AppleID
-        appleIDQuery = "SET user.appleid = {appleid} "
-    } else {
-        appleIDQuery = "REMOVE user.appleid "
+    stmt, err := conn.PrepareNeo(query)
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // executing a statement just returns summary information
+    result, err := stmt.ExecNeo(args)
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    if _, err = result.RowsAffected(); err != nil {
+        tx.Rollback()
+        return err
+    }
+    stmt.Close()
+    return tx.Commit()
+}
+
+// removedProperty is the user property holding the identifier removed with RemoveUserContact for a contact property
+func removedProperty(property string) string {
+    return property + "Removed"
+}
+
+// removedContacts returns the identifiers the user removed with RemoveUserContact, by contact property
+func removedContacts(conn bolt.Conn, id string) (map[string]string, error) {
+    properties := []string{"number", "email", "appleid"}
+    var columns []string
+    for _, property := range properties {
+        columns = append(columns, "user." + removedProperty(property))
+    }
+    rows, err := conn.QueryNeo(
+        "MATCH (user:User { id: {id} }) " +
+        "RETURN " + strings.Join(columns, ", ") + " ", map[string]interface{} {
+        "id": id,
+    })
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    // query only returns 1 row, so will return io.EOF as error
+    removed := make(map[string]string)
+    row, _, err := rows.NextNeo()
+    if err != nil && err != io.EOF {
+        return nil, err
     }
+    for index, value := range row {
+        if value, ok := value.(string); ok {
+            removed[properties[index]] = value
+        }
+    }
+    return removed, nil
+}
+
+// RemoveUserContact clears the hashed identifier for provider, so the user is no longer discoverable by it. The identifier
+// is kept aside so UpdateUserContact doesn't restore it while firebase still reports it
+func (neo *Neo4j) RemoveUserContact(id string, provider string) error {
+    property, ok := contactProperties[provider]
+    if !ok {
+        return fmt.Errorf("unknown contact provider: %s", provider)
+    }
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
 
+    // property names can't be parameterised, but are taken from contactProperties so are safe to concatenate
     stmt, err := conn.PrepareNeo(
         "MATCH (user:User { id: {id} }) " +
-        numberQuery +
-        emailQuery +
-        appleIDQuery)
+        "WITH user, exists(user." + property + ") AS linked, size([contact IN [user.number, user.email, user.appleid] WHERE contact IS NOT NULL]) AS contacts " +
+        "FOREACH (_ IN CASE WHEN linked AND contacts > 1 THEN [1] ELSE [] END | SET user." + removedProperty(property) + " = user." + property + " REMOVE user." + property + ") " +
+        "RETURN linked, contacts")
     if err != nil {
         return err
     }
     defer stmt.Close() // closing the statment will also close the rows
 
-    // executing a statement just returns summary information
-    result, err := stmt.ExecNeo(args)
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+    })
     if err != nil {
         return err
     }
 
-    _, err = result.RowsAffected()
-    return err
+    // query only returns 1 row, so will return io.EOF as error
+    // second parameter is metadata, which is discarded
+    data, _, err := rows.NextNeo()
+    if err != nil && err != io.EOF {
+        return err
+    }
+
+    if len(data) == 0 { // no user found
+        return io.EOF
+    }
+    if data[0].(bool) && data[1].(int64) <= 1 {
+        return ErrLastContact
+    }
+    return nil
 }
 
 func (neo *Neo4j) GetUser(id string) (*map[string]string, error) {
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
         return nil, err
     }
@@ -206,71 +520,750 @@ func (neo *Neo4j) GetUser(id string) (*map[string]string, error) {
     }, nil
 }
 
-func (neo *Neo4j) GetPublicInfoForUsers(uuids []string, numbers []string, emails []string) (map[string]string, map[string]map[string]string, error) {
-    existingMatches := make(map[string]string)
-    newMatches := make(map[string]map[string]string)
-
-    conn, err := neo.driverPool.OpenPool()
+// GetUserProfile returns the users public profile along with the auth providers linked to the account
+// only the presence of each provider is reported, never the hashed identifiers themselves
+func (neo *Neo4j) GetUserProfile(id string) (map[string]interface{}, error) {
+    conn, err := neo.openConn()
     if err != nil {
-        return existingMatches, newMatches, err
+        return nil, err
     }
     defer conn.Close()
 
     stmt, err := conn.PrepareNeo(
-        "WITH split({uuids}, ',') as uuids " + // notice the String split function - explanation below
-        "MATCH (user:User) " +
-        "WHERE user.uuid in uuids " +
-        "RETURN user.uuid as id, true as uuid, user.publicKey " +
-        "UNION " +
-        "WITH split({numbers}, ',') as numbers " + // notice the String split function - explanation below
-        "MATCH (user:User) " +
-        "WHERE user.number in numbers " +
-        "RETURN user.number as id, user.uuid as uuid, user.publicKey " +
-        "UNION " +
-        "WITH split({emails}, ',') as emails " + // notice the String split function - explanation below
-        "MATCH (user:User) " +
-        "WHERE user.email in emails " +
-        "RETURN user.email as id, user.uuid as uuid, user.publicKey " +
-        "UNION " +
-        "WITH split({emails}, ',') as emails " + // notice the String split function - explanation below
-        "MATCH (user:User) " +
-        "WHERE user.appleid in emails " +
-        "RETURN user.appleid as id, user.uuid as uuid, user.publicKey")
+        "MATCH (user:User { id: {id} }) " +
+        "RETURN user.uuid, user.publicKey, user.schemaVersion, exists(user.number), exists(user.email), exists(user.appleid), user.nickname, user.avatar")
     if err != nil {
-        return existingMatches, newMatches, err
+        return nil, err
     }
     defer stmt.Close() // closing the statment will also close the rows
 
-    // transform uuids array to a comma seperated string
-    // we do this because variable substitution using the golang neo4j driver does not work with arrays
-    // see: https://github.com/johnnadratowski/golang-neo4j-bolt-driver/pull/8 which is currently unmerged
-    // so we must substitute as a string, then in cypher, split string back to array
-    uuidsString := fmt.Sprintf("%v", strings.Join(uuids, ","))
-    numbersString := fmt.Sprintf("%v", strings.Join(numbers, ","))
-    emailsString := fmt.Sprintf("%v", strings.Join(emails, ","))
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+    })
+    if err != nil {
+        return nil, err
+    }
 
-    args := map[string]interface{} {
-        "uuids": uuidsString,
-        "numbers": numbersString,
-        "emails": emailsString,
+    // query only returns 1 row, so will return io.EOF as error
+    // second parameter is metadata, which is discarded
+    data, _, err := rows.NextNeo()
+    if err != nil && err != io.EOF {
+        return nil, err
     }
 
-    rows, err := stmt.QueryNeo(args)
-    if err != nil {
-        return existingMatches, newMatches, err
+    if len(data) == 0 { // no user found
+        return nil, io.EOF
     }
 
-    // foundUUIDS is a Golang Set, used to prevent duplicate uuids from being returned to client
-    type void struct{}
-    var member void
-    foundUUIDS := make(map[string]void)
-    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
-        if err != nil {
-            return existingMatches, newMatches, err
-        }
+    providers := []string{}
+    if data[3].(bool) {
+        providers = append(providers, "phone")
+    }
+    if data[4].(bool) {
+        providers = append(providers, "email")
+    }
+    if data[5].(bool) {
+        providers = append(providers, "apple")
+    }
 
-        switch uuid := row[1].(type) {
-        case bool:
+    profile := map[string]interface{} {
+        "uuid": data[0].(string),
+        "publickey": data[1].(string),
+        "schemaVersion": data[2].(string),
+        "authProviders": providers,
+    }
+    if data[6] != nil {
+        profile["nickname"] = data[6].(string)
+    }
+    if data[7] != nil {
+        profile["avatar"] = data[7].(string)
+    }
+    return profile, nil
+}
+
+// GetUserAccount returns the users stored contact details and the storage used by assets they own
+func (neo *Neo4j) GetUserAccount(id string) (map[string]interface{}, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (user:User { id: {id} }) " +
+        "OPTIONAL MATCH (user) - [:MEMORY] - (asset:Asset) " +
+        "RETURN user.number, user.email, user.appleid, count(asset), sum(asset.totalsize) ")
+    if err != nil {
+        return nil, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    // query only returns 1 row, so will return io.EOF as error
+    // second parameter is metadata, which is discarded
+    data, _, err := rows.NextNeo()
+    if err != nil && err != io.EOF {
+        return nil, err
+    }
+
+    if len(data) == 0 { // no user found
+        return nil, io.EOF
+    }
+
+    account := map[string]interface{} {
+        "assets": data[3].(int64),
+        "storedBytes": data[4].(int64),
+    }
+    if data[0] != nil {
+        account["number"] = data[0].(string)
+    }
+    if data[1] != nil {
+        account["email"] = data[1].(string)
+    }
+    if data[2] != nil {
+        account["appleid"] = data[2].(string)
+    }
+    return account, nil
+}
+
+// TouchUser records the current time as the user's last activity, used to count active users. Group notifications resume
+// for users marked by RemoveInvalidRecipient, as opening the app registers their device again
+func (neo *Neo4j) TouchUser(id string) error {
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (user:User { id: {id} }) " +
+        "SET user.lastActive = timestamp() " +
+        "REMOVE user.pushUnreachable ")
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+
+    _, err = stmt.ExecNeo(map[string]interface{} {
+        "id": id,
+    })
+    return err
+}
+
+// RemoveInvalidRecipient stops group notifications being pushed to a user the notification provider has no device for,
+// until they are next active, they are kept as pending events instead. Returns false if the user doesn't exist or was
+// already removed
+func (neo *Neo4j) RemoveInvalidRecipient(uuid string) (bool, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return false, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (user:User { uuid: {uuid} }) " +
+        "WHERE NOT exists(user.pushUnreachable) " +
+        "SET user.pushUnreachable = timestamp() " +
+        "RETURN user.uuid ")
+    if err != nil {
+        return false, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "uuid": uuid,
+    })
+    if err != nil {
+        return false, err
+    }
+
+    // query returns at most 1 row, so will return io.EOF as error
+    // second parameter is metadata, which is discarded
+    data, _, err := rows.NextNeo()
+    if err != nil && err != io.EOF {
+        return false, err
+    }
+    return len(data) != 0, nil
+}
+
+// GetUnreachableUsers returns the ids of users marked by RemoveInvalidRecipient at or after the given time, on any replica
+func (neo *Neo4j) GetUnreachableUsers(since time.Time) ([]string, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (user:User) " +
+        "WHERE user.pushUnreachable >= {since} " +
+        "RETURN user.id ")
+    if err != nil {
+        return nil, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "since": EpochMillis(since),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var ids []string
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return nil, err
+        }
+        ids = append(ids, row[0].(string))
+    }
+    return ids, nil
+}
+
+// DeleteUser removes the user node along with any relationships still attached to it, their assets and group memberships
+// should be removed first so that storage objects and groups are cleaned up
+func (neo *Neo4j) DeleteUser(id string) error {
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (user:User { id: {id} }) " +
+        "DETACH DELETE user ")
+    if err != nil {
+        return err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    _, err = stmt.ExecNeo(map[string]interface{} {
+        "id": id,
+    })
+    return err
+}
+
+// SetUserProfile sets the users display fields, an empty value removes the field
+// nickname is encrypted by the client, avatar is the id of an asset owned by the user, returns ErrAssetNotFound if the
+// avatar doesn't exist and ErrAssetNotOwned if it belongs to another user
+func (neo *Neo4j) SetUserProfile(id string, nickname string, avatar string) error {
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    if len(avatar) != 0 {
+        rows, err := conn.QueryNeo(
+            "MATCH (asset:Asset { uuid: {avatar} }) " +
+            "OPTIONAL MATCH (asset) - [memory:MEMORY] -> (:User { id: {id} }) " +
+            "RETURN memory IS NOT NULL ", map[string]interface{} {
+            "id": id,
+            "avatar": avatar,
+        })
+        if err != nil {
+            return err
+        }
+        // query only returns 1 row, so will return io.EOF as error
+        row, _, err := rows.NextNeo()
+        rows.Close()
+        if err != nil && err != io.EOF {
+            return err
+        }
+        if len(row) == 0 {
+            return ErrAssetNotFound
+        }
+        if owned := row[0].(bool); !owned {
+            return ErrAssetNotOwned
+        }
+    }
+
+    var nicknameQuery string
+    if len(nickname) != 0 {
+        nicknameQuery = "SET user.nickname = {nickname} "
+    } else {
+        nicknameQuery = "REMOVE user.nickname "
+    }
+
+    var avatarQuery string
+    if len(avatar) != 0 {
+        avatarQuery = "SET user.avatar = {avatar} "
+    } else {
+        avatarQuery = "REMOVE user.avatar "
+    }
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (user:User { id: {id} }) " +
+        nicknameQuery +
+        avatarQuery)
+    if err != nil {
+        return err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // executing a statement just returns summary information
+    result, err := stmt.ExecNeo(map[string]interface{} {
+        "id": id,
+        "nickname": nickname,
+        "avatar": avatar,
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = result.RowsAffected()
+    return err
+}
+
+// GetProfilesForUsers returns the display fields for the given users, keyed by uuid. Users without any are omitted
+func (neo *Neo4j) GetProfilesForUsers(uuids []string) (map[string]map[string]string, error) {
+    data := make(map[string]map[string]string)
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return data, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "WITH split({uuids}, ',') as uuids " + // notice the String split function - explanation below
+        "MATCH (user:User) " +
+        "WHERE user.uuid in uuids AND (exists(user.nickname) OR exists(user.avatar)) " +
+        "RETURN user.uuid, user.nickname, user.avatar ")
+    if err != nil {
+        return data, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // transform uuids array to a comma seperated string
+    // we do this because variable substitution using the golang neo4j driver does not work with arrays
+    // see: https://github.com/johnnadratowski/golang-neo4j-bolt-driver/pull/8 which is currently unmerged
+    // so we must substitute as a string, then in cypher, split string back to array
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "uuids": strings.Join(uuids, ","),
+    })
+    if err != nil {
+        return data, err
+    }
+
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return data, err
+        }
+        profile := make(map[string]string)
+        if row[1] != nil {
+            profile["nickname"] = row[1].(string)
+        }
+        if row[2] != nil {
+            profile["avatar"] = row[2].(string)
+        }
+        data[row[0].(string)] = profile
+    }
+    return data, nil
+}
+
+// SetNotificationPrefs replaces the notification types the user has opted out of
+func (neo *Neo4j) SetNotificationPrefs(id string, disabled []string) error {
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    var query string
+    if len(disabled) == 0 {
+        query = "REMOVE user.mutedNotifications "
+    } else {
+        query = "SET user.mutedNotifications = {muted} "
+    }
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (user:User { id: {id} }) " +
+        query)
+    if err != nil {
+        return err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // stored as a comma seperated string, as the golang neo4j driver cannot encode arrays
+    result, err := stmt.ExecNeo(map[string]interface{} {
+        "id": id,
+        "muted": strings.Join(disabled, ","),
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = result.RowsAffected()
+    return err
+}
+
+// GetNotificationPrefs returns the notification types each of the given users has opted out of, users with all types enabled are omitted
+func (neo *Neo4j) GetNotificationPrefs(uuids []string) (map[string][]string, error) {
+    data := make(map[string][]string)
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return data, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "WITH split({uuids}, ',') as uuids " + // notice the String split function - explanation below
+        "MATCH (user:User) " +
+        "WHERE user.uuid in uuids AND exists(user.mutedNotifications) " +
+        "RETURN user.uuid, user.mutedNotifications ")
+    if err != nil {
+        return data, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // transform uuids array to a comma seperated string
+    // we do this because variable substitution using the golang neo4j driver does not work with arrays
+    // see: https://github.com/johnnadratowski/golang-neo4j-bolt-driver/pull/8 which is currently unmerged
+    // so we must substitute as a string, then in cypher, split string back to array
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "uuids": strings.Join(uuids, ","),
+    })
+    if err != nil {
+        return data, err
+    }
+
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return data, err
+        }
+        data[row[0].(string)] = strings.Split(row[1].(string), ",")
+    }
+    return data, nil
+}
+
+// RecordNotificationsSent tracks notifications accepted by the provider under the IDs it assigned them, so the delivery
+// receipts it later reports can be matched to notifications this server sent
+func (neo *Neo4j) RecordNotificationsSent(notificationIDs []string, signal string) error {
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "UNWIND {notificationIDs} AS notificationID " +
+        "MERGE (receipt:NotificationReceipt { id: notificationID }) " +
+        "ON CREATE SET receipt.signal = {signal}, receipt.status = 'sent', receipt.sent = timestamp(), receipt.updated = timestamp() ")
+    if err != nil {
+        return err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // executing a statement just returns summary information
+    result, err := stmt.ExecNeo(map[string]interface{} {
+        "notificationIDs": notificationIDs,
+        "signal": signal,
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = result.RowsAffected()
+    return err
+}
+
+// RecordNotificationReceipt stores the latest delivery status reported by the notification provider, returning false
+// for notifications this server has no record of sending, which are left untracked
+func (neo *Neo4j) RecordNotificationReceipt(notificationID string, event string, status string) (bool, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return false, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (receipt:NotificationReceipt { id: {notificationID} }) " +
+        "SET receipt.event = {event}, receipt.status = {status}, receipt.updated = timestamp() " +
+        "RETURN count(receipt) ")
+    if err != nil {
+        return false, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "notificationID": notificationID,
+        "event": event,
+        "status": status,
+    })
+    if err != nil {
+        return false, err
+    }
+
+    // query only returns 1 row, so will return io.EOF as error
+    data, _, err := rows.NextNeo()
+    if err != nil && err != io.EOF {
+        return false, err
+    }
+    return len(data) != 0 && data[0].(int64) != 0, nil
+}
+
+// PruneNotificationReceipts deletes the receipts of notifications sent before the given time, returning how many
+func (neo *Neo4j) PruneNotificationReceipts(before time.Time) (int64, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return 0, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (receipt:NotificationReceipt) " +
+        "WHERE receipt.sent < {before} " +
+        "DELETE receipt " +
+        "RETURN count(receipt) ")
+    if err != nil {
+        return 0, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "before": EpochMillis(before),
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    // query only returns 1 row, so will return io.EOF as error
+    data, _, err := rows.NextNeo()
+    if err != nil && err != io.EOF {
+        return 0, err
+    }
+    if len(data) == 0 {
+        return 0, nil
+    }
+    return data[0].(int64), nil
+}
+
+// PendingEvent is a notification that couldn't be pushed to a user, held until they acknowledge it
+type PendingEvent struct {
+    ID      string
+    Signal  string
+    Data    string  // JSON encoded notification data
+    Created int64   // milliseconds since the epoch
+}
+
+// AddPendingEvent records an event for each user by uuid, one event node is shared by all of them
+func (neo *Neo4j) AddPendingEvent(uuids []string, eventid string, signal string, data string) error {
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "CREATE (event:PendingEvent { uuid: {eventid}, signal: {signal}, data: {data}, created: timestamp() }) " +
+        "WITH event " +
+        "MATCH (user:User) " +
+        "WHERE user.uuid IN split({uuids}, ',') " +
+        "CREATE (user) - [:PENDING] -> (event) ")
+    if err != nil {
+        return err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // executing a statement just returns summary information
+    result, err := stmt.ExecNeo(map[string]interface{} {
+        "uuids": strings.Join(uuids, ","),
+        "eventid": eventid,
+        "signal": signal,
+        "data": data,
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = result.RowsAffected()
+    return err
+}
+
+// GetPendingEvents returns the user's unacknowledged events oldest first, io.EOF if there are none
+func (neo *Neo4j) GetPendingEvents(id string) ([]PendingEvent, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {id} }) - [:PENDING] -> (event:PendingEvent) " +
+        "RETURN event.uuid, event.signal, event.data, event.created " +
+        "ORDER BY event.created ")
+    if err != nil {
+        return nil, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var events []PendingEvent
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return nil, err
+        }
+        events = append(events, PendingEvent{
+            ID: row[0].(string),
+            Signal: row[1].(string),
+            Data: row[2].(string),
+            Created: row[3].(int64),
+        })
+    }
+    if len(events) == 0 {
+        return nil, io.EOF
+    }
+    return events, nil
+}
+
+// AckPendingEvents clears the given events for the user, events no other user is still pending are deleted
+func (neo *Neo4j) AckPendingEvents(id string, eventids []string) error {
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {id} }) - [pending:PENDING] -> (event:PendingEvent) " +
+        "WHERE event.uuid IN split({eventids}, ',') " +
+        "DELETE pending " +
+        "WITH DISTINCT event " +
+        "WHERE size((event) <- [:PENDING] - ()) = 0 " +
+        "DELETE event ")
+    if err != nil {
+        return err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // executing a statement just returns summary information
+    result, err := stmt.ExecNeo(map[string]interface{} {
+        "id": id,
+        "eventids": strings.Join(eventids, ","),
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = result.RowsAffected()
+    return err
+}
+
+// PrunePendingEvents deletes events recorded before the given time whether or not they were acknowledged, returning how many
+func (neo *Neo4j) PrunePendingEvents(before time.Time) (int64, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return 0, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (event:PendingEvent) " +
+        "WHERE event.created < {before} " +
+        "DETACH DELETE event " +
+        "RETURN count(event) ")
+    if err != nil {
+        return 0, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "before": before.UnixNano() / int64(time.Millisecond),
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    // query only returns 1 row, so will return io.EOF as error
+    data, _, err := rows.NextNeo()
+    if err != nil && err != io.EOF {
+        return 0, err
+    }
+    if len(data) == 0 {
+        return 0, nil
+    }
+    return data[0].(int64), nil
+}
+
+func (neo *Neo4j) GetPublicInfoForUsers(uuids []string, numbers []string, emails []string) (map[string]string, map[string]map[string]string, error) {
+    existingMatches := make(map[string]string)
+    newMatches := make(map[string]map[string]string)
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return existingMatches, newMatches, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "WITH split({uuids}, ',') as uuids " + // notice the String split function - explanation below
+        "MATCH (user:User) " +
+        "WHERE user.uuid in uuids " +
+        "RETURN user.uuid as id, true as uuid, user.publicKey " +
+        "UNION " +
+        "WITH split({numbers}, ',') as numbers " + // notice the String split function - explanation below
+        "MATCH (user:User) " +
+        "WHERE user.number in numbers " +
+        "RETURN user.number as id, user.uuid as uuid, user.publicKey " +
+        "UNION " +
+        "WITH split({emails}, ',') as emails " + // notice the String split function - explanation below
+        "MATCH (user:User) " +
+        "WHERE user.email in emails " +
+        "RETURN user.email as id, user.uuid as uuid, user.publicKey " +
+        "UNION " +
+        "WITH split({emails}, ',') as emails " + // notice the String split function - explanation below
+        "MATCH (user:User) " +
+        "WHERE user.appleid in emails " +
+        "RETURN user.appleid as id, user.uuid as uuid, user.publicKey")
+    if err != nil {
+        return existingMatches, newMatches, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // transform uuids array to a comma seperated string
+    // we do this because variable substitution using the golang neo4j driver does not work with arrays
+    // see: https://github.com/johnnadratowski/golang-neo4j-bolt-driver/pull/8 which is currently unmerged
+    // so we must substitute as a string, then in cypher, split string back to array
+    uuidsString := fmt.Sprintf("%v", strings.Join(uuids, ","))
+    numbersString := fmt.Sprintf("%v", strings.Join(numbers, ","))
+    emailsString := fmt.Sprintf("%v", strings.Join(emails, ","))
+
+    args := map[string]interface{} {
+        "uuids": uuidsString,
+        "numbers": numbersString,
+        "emails": emailsString,
+    }
+
+    rows, err := stmt.QueryNeo(args)
+    if err != nil {
+        return existingMatches, newMatches, err
+    }
+
+    // foundUUIDS is a Golang Set, used to prevent duplicate uuids from being returned to client
+    type void struct{}
+    var member void
+    foundUUIDS := make(map[string]void)
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return existingMatches, newMatches, err
+        }
+
+        switch uuid := row[1].(type) {
+        case bool:
             actualUUID := row[0].(string)
             existingMatches[actualUUID] = row[2].(string)
         case string:
@@ -287,99 +1280,315 @@ func (neo *Neo4j) GetPublicInfoForUsers(uuids []string, numbers []string, emails
         }
     }
 
-    if len(existingMatches) == 0 && len(newMatches) == 0 {
-        return existingMatches, newMatches, io.EOF
+    if len(existingMatches) == 0 && len(newMatches) == 0 {
+        return existingMatches, newMatches, io.EOF
+    }
+    return existingMatches, newMatches, nil
+}
+
+func (neo *Neo4j) VerifyUUIDS(uuids []string) ([]string, error) {
+    if len(uuids) == 0 {
+        return nil, io.EOF
+    }
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "WITH split({uuidstring}, ',') as uuids " + // notice the String split function - explanation below
+        "MATCH (user:User) " +
+        "WHERE user.uuid in uuids " +
+        "RETURN user.uuid")
+    if err != nil {
+        return nil, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // transform uuids array to a comma seperated string
+    // we do this because variable substitution using the golang neo4j driver does not work with arrays
+    // see: https://github.com/johnnadratowski/golang-neo4j-bolt-driver/pull/8 which is currently unmerged
+    // so we must substitute as a string, then in cypher, split string back to array
+    uuidstring := fmt.Sprintf("%v", strings.Join(uuids, ","))
+
+    args := map[string]interface{} {
+        "uuidstring": uuidstring,
+    }
+
+    rows, err := stmt.QueryNeo(args)
+    if err != nil {
+        return nil, err
+    }
+
+    var result []string
+    for {
+        row, _, err := rows.NextNeo()
+        if err == nil {
+            result = append(result, row[0].(string))
+        } else if err == io.EOF {
+            break
+        } else {
+            return nil, err
+        }
+    }
+
+    if len(result) == 0 {
+        return nil, io.EOF
+    }
+
+    return result, nil
+}
+
+// ValidateIDs returns, in one query, the subset of userids that exist, of assetids that are owned by or shared with
+// the user, and of groupids that the user is a member of
+func (neo *Neo4j) ValidateIDs(id string, userids []string, assetids []string, groupids []string) (map[string][]string, error) {
+    data := map[string][]string {
+        "userIDs": []string{},
+        "assetIDs": []string{},
+        "groupIDs": []string{},
+    }
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return data, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "WITH split({userids}, ',') as userids, split({assetids}, ',') as assetids, split({groupids}, ',') as groupids " + // notice the String split function - explanation below
+        "MATCH (caller:User { id: {id} }) " +
+        "OPTIONAL MATCH (user:User) " +
+        "WHERE user.uuid in userids " +
+        "WITH caller, assetids, groupids, collect(DISTINCT user.uuid) AS users " +
+        "OPTIONAL MATCH (caller) - [:MEMORY|MEMORY_SHARED] - (asset:Asset) " +
+        "WHERE asset.uuid in assetids " +
+        "WITH caller, groupids, users, collect(DISTINCT asset.uuid) AS assets " +
+        "OPTIONAL MATCH (caller) - [:MEMBER] -> (group:Group) " +
+        "WHERE group.uuid in groupids " +
+        "RETURN users, assets, collect(DISTINCT group.uuid) AS groups ")
+    if err != nil {
+        return data, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // transform id arrays to comma seperated strings
+    // we do this because variable substitution using the golang neo4j driver does not work with arrays
+    // see: https://github.com/johnnadratowski/golang-neo4j-bolt-driver/pull/8 which is currently unmerged
+    // so we must substitute as a string, then in cypher, split string back to array
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "userids": strings.Join(userids, ","),
+        "assetids": strings.Join(assetids, ","),
+        "groupids": strings.Join(groupids, ","),
+    })
+    if err != nil {
+        return data, err
+    }
+
+    row, _, err := rows.NextNeo()
+    if err == io.EOF {
+        return data, nil    // caller doesn't exist, so nothing is valid for them
+    } else if err != nil {
+        return data, err
+    }
+    for index, key := range []string{"userIDs", "assetIDs", "groupIDs"} {
+        for _, validID := range row[index].([]interface{}) {
+            data[key] = append(data[key], validID.(string))
+        }
+    }
+    return data, nil
+}
+
+func (neo *Neo4j) GetGroups(id string) (map[string]map[string]interface{}, error) {
+    data := make(map[string]map[string]interface{})
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return data, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (user:User {id: {id} }) - [membership:MEMBER] - (group:Group) " +
+        "OPTIONAL MATCH (group) - [:MEMBER] - (users:User) " +
+        "WHERE user <> users " +
+        "RETURN group.uuid, group.name, membership.key, CASE WHEN users IS NOT NULL THEN collect({uuid: users.uuid, key: users.publicKey}) ELSE [] END")
+    if err != nil {
+        return data, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    args := map[string]interface{} {
+        "id": id,
+    }
+    rows, err := stmt.QueryNeo(args)
+    if err != nil {
+        return data, err
+    }
+
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return data, err
+        }
+        data[row[0].(string)] = map[string]interface{} {
+            "name": row[1].(string),
+            "key": row[2].(string),
+            "members": row[3].([]interface{}),
+        }
+    }
+
+    if len(data) == 0 {
+        return data, io.EOF
+    }
+    return data, nil
+}
+
+// GetGroupsWithMemberCounts returns the number of members, including the user, of each of the given groups the user is a
+// member of
+func (neo *Neo4j) GetGroupsWithMemberCounts(id string, groupIDs []string) (map[string]int64, error) {
+    data := make(map[string]int64)
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return data, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User {id: {id} }) - [:MEMBER] - (group:Group) " +
+        "WHERE group.uuid IN split({groupids}, ',') " +
+        "MATCH (group) - [:MEMBER] - (member:User) " +  // separate MATCH, within one pattern the user's membership can't be matched twice
+        "RETURN group.uuid, count(member) ")
+    if err != nil {
+        return data, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "groupids": strings.Join(groupIDs, ","),
+    })
+    if err != nil {
+        return data, err
     }
-    return existingMatches, newMatches, nil
-}
 
-func (neo *Neo4j) VerifyUUIDS(uuids []string) ([]string, error) {
-    if len(uuids) == 0 {
-        errLogger.Panicln()
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return data, err
+        }
+        data[row[0].(string)] = row[1].(int64)
     }
+    return data, nil
+}
 
-    conn, err := neo.driverPool.OpenPool()
+// GetGroupsForSharedAsset returns the groups, of which the user is a member, that the user's asset has been added to,
+// keyed by group id, with whether the asset is shared with the group. Returns ErrAssetNotFound if the user doesn't own the asset
+func (neo *Neo4j) GetGroupsForSharedAsset(id string, assetid string) (map[string]map[string]interface{}, error) {
+    data := make(map[string]map[string]interface{})
+
+    conn, err := neo.openConn()
     if err != nil {
-        errLogger.Panicln(err)
+        return data, err
     }
     defer conn.Close()
 
     stmt, err := conn.PrepareNeo(
-        "WITH split({uuidstring}, ',') as uuids " + // notice the String split function - explanation below
-        "MATCH (user:User) " +
-        "WHERE user.uuid in uuids " +
-        "RETURN user.uuid")
+        "MATCH (user:User { id: {id} }) <- [:MEMORY] - (asset:Asset { uuid: {assetid} }) " +
+        "OPTIONAL MATCH (asset) - [groupasset:GROUP_ASSET] -> (group:Group) <- [:MEMBER] - (user) " +
+        "RETURN group.uuid, group.name, exists(groupasset.sharedKey) ")
     if err != nil {
-        errLogger.Panicln(err)
+        return data, err
     }
     defer stmt.Close() // closing the statment will also close the rows
 
-    // transform uuids array to a comma seperated string
-    // we do this because variable substitution using the golang neo4j driver does not work with arrays
-    // see: https://github.com/johnnadratowski/golang-neo4j-bolt-driver/pull/8 which is currently unmerged
-    // so we must substitute as a string, then in cypher, split string back to array
-    uuidstring := fmt.Sprintf("%v", strings.Join(uuids, ","))
-
-    args := map[string]interface{} {
-        "uuidstring": uuidstring,
-    }
-
-    rows, err := stmt.QueryNeo(args)
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "assetid": assetid,
+    })
     if err != nil {
-        errLogger.Panicln(err)
+        return data, err
     }
 
-    var result []string
-    for {
-        row, _, err := rows.NextNeo()
-        if err == nil {
-            result = append(result, row[0].(string))
-        } else if err == io.EOF {
-            break
-        } else {
-            errLogger.Panicln(err)
+    found := false
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return data, err
+        }
+        found = true
+        if row[0] == nil {
+            continue    // asset is owned, but not in any group
+        }
+        data[row[0].(string)] = map[string]interface{} {
+            "name": row[1].(string),
+            "shared": row[2].(bool),
         }
     }
 
-    if len(result) == 0 {
-        return nil, io.EOF
+    if !found {
+        return data, ErrAssetNotFound
     }
-
-    return result, nil
+    if len(data) == 0 {
+        return data, io.EOF
+    }
+    return data, nil
 }
 
-func (neo *Neo4j) GetGroups(id string) (map[string]map[string]interface{}, error) {
+// GetGroupsFiltered returns up to limit of the user's groups, ordered by uuid and starting after cursor, optionally filtered to
+// names containing query (case insensitive), along with the cursor for the next page, which is empty when there are no more.
+// A limit of 0 returns every group after cursor
+func (neo *Neo4j) GetGroupsFiltered(id string, query string, cursor string, limit int) (map[string]map[string]interface{}, string, error) {
     data := make(map[string]map[string]interface{})
 
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
-        return data, err
+        return data, "", err
     }
     defer conn.Close()
 
+    limitClause := ""
+    if limit > 0 {
+        limitClause = "LIMIT {limit} "
+    }
     stmt, err := conn.PrepareNeo(
         "MATCH (user:User {id: {id} }) - [membership:MEMBER] - (group:Group) " +
+        "WHERE group.uuid > {cursor} AND toLower(group.name) CONTAINS toLower({query}) " +
+        "WITH user, membership, group " +
+        "ORDER BY group.uuid " +
+        limitClause +
         "OPTIONAL MATCH (group) - [:MEMBER] - (users:User) " +
         "WHERE user <> users " +
-        "RETURN group.uuid, group.name, membership.key, CASE WHEN users IS NOT NULL THEN collect({uuid: users.uuid, key: users.publicKey}) ELSE [] END")
+        "RETURN group.uuid, group.name, membership.key, CASE WHEN users IS NOT NULL THEN collect({uuid: users.uuid, key: users.publicKey}) ELSE [] END " +
+        "ORDER BY group.uuid ")
     if err != nil {
-        return data, err
+        return data, "", err
     }
     defer stmt.Close() // closing the statment will also close the rows
 
-    args := map[string]interface{} {
+    // fetch one extra row to find out whether there is another page
+    rows, err := stmt.QueryNeo(map[string]interface{} {
         "id": id,
-    }
-    rows, err := stmt.QueryNeo(args)
+        "query": query,
+        "cursor": cursor,
+        "limit": limit + 1,
+    })
     if err != nil {
-        return data, err
+        return data, "", err
     }
 
+    var last string
+    next := ""
     for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
         if err != nil {
-            return data, err
+            return data, "", err
         }
-        data[row[0].(string)] = map[string]interface{} {
+        if limit > 0 && len(data) == limit {
+            next = last
+            break
+        }
+        last = row[0].(string)
+        data[last] = map[string]interface{} {
             "name": row[1].(string),
             "key": row[2].(string),
             "members": row[3].([]interface{}),
@@ -387,27 +1596,54 @@ func (neo *Neo4j) GetGroups(id string) (map[string]map[string]interface{}, error
     }
 
     if len(data) == 0 {
-        return data, io.EOF
+        return data, "", io.EOF
     }
-    return data, nil
+    return data, next, nil
 }
 
-func (neo *Neo4j) CreateAsset(id string, assetid string, assettype string, remotepath string, createdate *string, location *string, duration *string, originalfilename *string, originaluti *string, pixelwidth int, pixelheight int, md5 string, key string, remotepathorig *string, totalsize *uint64) error {
-    conn, err := neo.driverPool.OpenPool()
+// Rendition is a stored version of an asset (e.g. original, low, medium) and its size in bytes
+type Rendition struct {
+    RemotePath  string
+    Size        uint64
+}
+
+// createDateMillis parses a client CreateDate into epoch milliseconds, stored alongside the original string as
+// createdatemillis so assets can be queried by date. Bolt v1 can't carry Neo4j temporal values, which asset{.*} would
+// return to the driver, so the queryable form is an integer like uploaddate. Returns false for dates that aren't RFC3339
+func createDateMillis(createdate string) (int64, bool) {
+    parsed, err := time.Parse(time.RFC3339Nano, createdate)
     if err != nil {
-        return err
+        return 0, false
+    }
+    return EpochMillis(parsed), true
+}
+
+// EpochMillis converts t to milliseconds since the epoch, without overflowing for dates far from it as UnixNano would
+func EpochMillis(t time.Time) int64 {
+    return t.Unix() * 1000 + int64(t.Nanosecond()) / int64(time.Millisecond)
+}
+
+// CreateAsset creates the asset, returning its totalsize if any renditions were provided
+// if the user already has the asset it is left unchanged, and its stored totalsize is returned along with ErrAssetExists
+// location is client encrypted ciphertext, so is stored as given and can't be queried on
+func (neo *Neo4j) CreateAsset(id string, assetid string, assettype string, remotepath string, createdate *string, location *string, duration *string, originalfilename *string, originaluti *string, pixelwidth int, pixelheight int, md5 string, key string, remotepathorig *string, renditions map[string]Rendition) (*uint64, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return nil, err
     }
     defer conn.Close()
 
-    fields := "memory.key = {key}, asset.type = {type}, asset.remotepath = {remotepath}, asset.remotepathorig = {remotepathorig}, asset.createdate = {createdate}, asset.location = {location}, asset.duration = {duration}, asset.originalfilename = {originalfilename}, asset.originaluti = {originaluti}, asset.pixelwidth = {pixelwidth}, asset.pixelheight = {pixelheight}, asset.md5 = {md5}, asset.totalsize = {totalsize} "
+    fields := "memory.key = {key}, asset.type = {type}, asset.remotepath = {remotepath}, asset.remotepathorig = {remotepathorig}, asset.createdate = {createdate}, asset.createdatemillis = {createdatemillis}, asset.location = {location}, asset.duration = {duration}, asset.originalfilename = {originalfilename}, asset.originaluti = {originaluti}, asset.pixelwidth = {pixelwidth}, asset.pixelheight = {pixelheight}, asset.md5 = {md5}, asset.totalsize = {totalsize} "
 
     stmt, err := conn.PrepareNeo(
         "MATCH (user:User { id: {id} }) " +
         "MERGE (user) <- [memory:MEMORY] - (asset:Asset { uuid: {assetid} }) " +
-        "ON CREATE SET " + fields +
-        "ON MATCH SET " + fields)
+        "ON CREATE SET asset._created = true, asset.uploaddate = timestamp(), " + fields +
+        "WITH asset, exists(asset._created) AS created " +
+        "REMOVE asset._created " +
+        "RETURN created, asset.totalsize ")
     if err != nil {
-        return err
+        return nil, err
     }
     defer stmt.Close() // closing the statment will also close the rows
 
@@ -419,6 +1655,7 @@ func (neo *Neo4j) CreateAsset(id string, assetid string, assettype string, remot
         "remotepath": remotepath,
         "remotepathorig": nil,
         "createdate": nil,
+        "createdatemillis": nil,
         "location": nil,
         "duration": nil,
         "originalfilename": nil,
@@ -430,6 +1667,11 @@ func (neo *Neo4j) CreateAsset(id string, assetid string, assettype string, remot
         "totalsize": nil }
     if createdate != nil {
         input["createdate"] = *createdate
+        if millis, ok := createDateMillis(*createdate); ok {
+            input["createdatemillis"] = millis
+        } else {
+            warnLogger.Printf("asset %s CreateDate %q isn't RFC3339, it won't be found by date range queries\n", assetid, *createdate)
+        }
     }
     if location != nil {
         input["location"] = *location
@@ -446,35 +1688,50 @@ func (neo *Neo4j) CreateAsset(id string, assetid string, assettype string, remot
     if remotepathorig != nil {
         input["remotepathorig"] = *remotepathorig
     }
-    if totalsize != nil {
-        input["totalsize"] = *totalsize
-    }
 
-    result, err := stmt.ExecNeo(input)
+    rows, err := stmt.QueryNeo(input)
     if err != nil {
-        return err
+        return nil, err
+    }
+    row, _, err := rows.NextNeo()
+    if err != nil {
+        return nil, err
+    }
+    if created := row[0].(bool); !created {
+        if existing, ok := row[1].(int64); ok {
+            totalsize := uint64(existing)
+            return &totalsize, ErrAssetExists
+        }
+        return nil, ErrAssetExists
     }
 
-    _, err = result.RowsAffected()
-    return err
+    if len(renditions) == 0 {
+        return nil, nil
+    }
+    totalsize, err := neo.setRenditions(id, assetid, renditions)
+    if err != nil {
+        return nil, err
+    }
+    return &totalsize, nil
 }
 
-func (neo *Neo4j) AddPathForOriginalAsset(id string, assetid string, remotepathorig string, totalsize uint64) error {
-    if totalsize <= 0 {
-        return errors.New("totalsize invalid")
+// AddPathForOriginalAsset sets the original path of an asset created without one, returning the updated totalsize
+func (neo *Neo4j) AddPathForOriginalAsset(id string, assetid string, remotepathorig string, renditions map[string]Rendition) (uint64, error) {
+    if len(renditions) == 0 {
+        return 0, errors.New("renditions missing")
     }
 
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
-        errLogger.Panicln(err)
+        return 0, err
     }
     defer conn.Close()
 
     stmt, err := conn.PrepareNeo(
         "MATCH (:User { id: {id} }) <- [:MEMORY] - (asset:Asset { uuid: {assetid} }) " +
-        "SET asset.remotepathorig = {remotepathorig}, asset.totalsize = {totalsize} ")
+        "SET asset.remotepathorig = {remotepathorig} ")
     if err != nil {
-        errLogger.Panicln(err)
+        return 0, err
     }
     defer stmt.Close() // closing the statment will also close the rows
 
@@ -483,22 +1740,69 @@ func (neo *Neo4j) AddPathForOriginalAsset(id string, assetid string, remotepatho
         "id": id,
         "assetid": assetid,
         "remotepathorig": remotepathorig,
-        "totalsize": totalsize,
     })
     if err != nil {
-        errLogger.Panicln(err)
+        return 0, err
+    }
+    if _, err = result.RowsAffected(); err != nil {
+        return 0, err
     }
 
-    _, err = result.RowsAffected()
+    return neo.setRenditions(id, assetid, renditions)
+}
+
+// setRenditions creates or replaces the named renditions of an asset owned by the user,
+// returning the asset totalsize, which is kept as the sum of all of its rendition sizes
+func (neo *Neo4j) setRenditions(id string, assetid string, renditions map[string]Rendition) (uint64, error) {
+    conn, err := neo.openConn()
     if err != nil {
-        errLogger.Panicln(err)
+        return 0, err
     }
+    defer conn.Close()
 
-    return err
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {id} }) <- [:MEMORY] - (asset:Asset { uuid: {assetid} }) " +
+        "MERGE (asset) - [:RENDITION] -> (rendition:Rendition { name: {name} }) " +
+        "SET rendition.remotepath = {remotepath}, rendition.size = {size} " +
+        "WITH asset " +
+        "MATCH (asset) - [:RENDITION] -> (renditions:Rendition) " +
+        "WITH asset, sum(renditions.size) AS totalsize " +
+        "SET asset.totalsize = totalsize " +
+        "RETURN totalsize ")
+    if err != nil {
+        return 0, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // have to use loop as the unofficial neo4j go driver cannot encode lists/maps
+    var totalsize uint64
+    for name, rendition := range renditions {
+        rows, err := stmt.QueryNeo(map[string] interface{} {
+            "id": id,
+            "assetid": assetid,
+            "name": name,
+            "remotepath": rendition.RemotePath,
+            "size": rendition.Size,
+        })
+        if err != nil {
+            return 0, err
+        }
+        row, _, err := rows.NextNeo()
+        if err != nil {
+            return 0, err
+        }
+        totalsize = uint64(row[0].(int64))
+        if err := rows.Close(); err != nil {
+            return 0, err
+        }
+    }
+    return totalsize, nil
 }
 
+// SetAssetsOriginalFilenames always applies the updates, stamping them with the server time so a versioned update made
+// before them isn't applied afterwards
 func (neo *Neo4j) SetAssetsOriginalFilenames(id string, data map[string]string) error {
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
         return err
     }
@@ -511,7 +1815,7 @@ func (neo *Neo4j) SetAssetsOriginalFilenames(id string, data map[string]string)
     //     "SET asset.originalfilename = data.originalfilename ")
     stmt, err := conn.PrepareNeo(
         "MATCH (:User { id: {id} }) <- [:MEMORY] - (asset:Asset { uuid: {assetid} }) " +
-        "SET asset.originalfilename = {originalfilename} ")
+        "SET asset.originalfilename = {originalfilename}, asset.originalfilenameSetAt = timestamp() ")
     if err != nil {
         return err
     }
@@ -534,49 +1838,174 @@ func (neo *Neo4j) SetAssetsOriginalFilenames(id string, data map[string]string)
     return nil
 }
 
-func (neo *Neo4j) LeaveGroup(ownerid string, groupid string) error {
-    conn, err := neo.driverPool.OpenPool()
+// OriginalFilenameUpdate is an original filename along with the client time it was set, in milliseconds since the epoch
+type OriginalFilenameUpdate struct {
+    Filename    string
+    SetAt       int64
+}
+
+// SetAssetsOriginalFilenamesVersioned only applies updates that are newer than the one currently stored, so concurrent
+// updates from multiple devices resolve to the most recent by client time rather than by arrival order
+func (neo *Neo4j) SetAssetsOriginalFilenamesVersioned(id string, data map[string]OriginalFilenameUpdate) error {
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {id} }) <- [:MEMORY] - (asset:Asset { uuid: {assetid} }) " +
+        "WHERE NOT exists(asset.originalfilenameSetAt) OR asset.originalfilenameSetAt < {setat} " +
+        "SET asset.originalfilename = {originalfilename}, asset.originalfilenameSetAt = {setat} ")
     if err != nil {
         return err
     }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // have to use loop as the unofficial neo4j go driver cannot encode lists/maps
+    for assetid, update := range data {
+        result, err := stmt.ExecNeo(map[string] interface{} {   // executing a statement just returns summary information
+            "id": id,
+            "assetid": assetid,
+            "originalfilename": update.Filename,
+            "setat": update.SetAt,
+        })
+        if err != nil {
+            return err
+        }
+        _, err = result.RowsAffected(); if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// GetAssetsOriginalFilenames returns the original filename of each asset owned by the user, assets not owned or without a filename are omitted
+func (neo *Neo4j) GetAssetsOriginalFilenames(id string, assetids []string) (map[string]string, error) {
+    data := make(map[string]string)
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return data, err
+    }
     defer conn.Close()
 
     stmt, err := conn.PrepareNeo(
+        "WITH split({assetids}, ',') as assetids " + // notice the String split function - explanation below
+        "MATCH (:User { id: {id} }) <- [:MEMORY] - (asset:Asset) " +
+        "WHERE asset.uuid in assetids AND exists(asset.originalfilename) " +
+        "RETURN asset.uuid, asset.originalfilename ")
+    if err != nil {
+        return data, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // transform assetids array to a comma seperated string
+    // we do this because variable substitution using the golang neo4j driver does not work with arrays
+    // see: https://github.com/johnnadratowski/golang-neo4j-bolt-driver/pull/8 which is currently unmerged
+    // so we must substitute as a string, then in cypher, split string back to array
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "assetids": strings.Join(assetids, ","),
+    })
+    if err != nil {
+        return data, err
+    }
+
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return data, err
+        }
+        data[row[0].(string)] = row[1].(string)
+    }
+    return data, nil
+}
+
+// LeaveGroup removes the user from the group along with the invites they sent, the group is deleted once nobody is left in
+// it. Unless keepAssets is set the assets the user shared into the group are unshared from it, returning how many were
+func (neo *Neo4j) LeaveGroup(ownerid string, groupid string, keepAssets bool) (int64, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return 0, err
+    }
+    defer conn.Close()
+
+    tx, err := conn.Begin()
+    if err != nil {
+        return 0, err
+    }
+
+    args := map[string]interface{} {
+        "ownerid": ownerid,
+        "groupid": groupid,
+    }
+    rows, err := conn.QueryNeo(
         "MATCH (user:User { id: {ownerid} }) - [membership:MEMBER] - (group:Group { uuid: {groupid} }) " +
         "SET group._lock = true " +
         "DELETE membership " +
         "WITH user, group " +
         "OPTIONAL MATCH (group) - [invites:MEMBER {inviter: user.uuid}] - (:User) " +
         "DELETE invites " +
-        "WITH user, group " +
-        "OPTIONAL MATCH (group) - [groupRel:GROUP_ASSET] - (assets:Asset) - [:MEMORY] - (user) " +
+        "RETURN DISTINCT group.uuid ", args)
+    if err != nil {
+        tx.Rollback()
+        return 0, err
+    }
+    _, _, err = rows.NextNeo()
+    rows.Close()
+    if err == io.EOF {
+        tx.Rollback()
+        return 0, nil   // not a member, nothing to leave
+    } else if err != nil {
+        tx.Rollback()
+        return 0, err
+    }
+
+    var unshared int64
+    if !keepAssets {
+        rows, err := conn.QueryNeo(
+            "MATCH (user:User { id: {ownerid} }) - [:MEMORY] - (assets:Asset) - [groupRel:GROUP_ASSET] - (group:Group { uuid: {groupid} }) " +
+            "DELETE groupRel " +
+            "WITH DISTINCT assets " +
+            "OPTIONAL MATCH (assets) - [sharedmemories:MEMORY_SHARED] - (users:User) " +
+            "WHERE NOT (users) - [:MEMBER] - (:Group) - [:GROUP_ASSET] - (assets) " +
+            "DELETE sharedmemories " +
+            "RETURN count(DISTINCT assets) ", args)
+        if err != nil {
+            tx.Rollback()
+            return 0, err
+        }
+        data, _, err := rows.NextNeo()
+        rows.Close()
+        if err != nil {
+            tx.Rollback()
+            return 0, err
+        }
+        unshared = data[0].(int64)
+    }
+
+    // once nobody is left, remove any assets kept in the group and the group itself
+    _, err = conn.ExecNeo(
+        "MATCH (group:Group { uuid: {groupid} }) " +
+        "WHERE NOT (group) - [:MEMBER] - (:User) " +
+        "OPTIONAL MATCH (group) - [groupRel:GROUP_ASSET] - (assets:Asset) " +
         "DELETE groupRel " +
         "WITH group, assets " +
         "OPTIONAL MATCH (assets) - [sharedmemories:MEMORY_SHARED] - (users:User) " +
         "WHERE NOT (users) - [:MEMBER] - (:Group) - [:GROUP_ASSET] - (assets) " +
         "DELETE sharedmemories " +
-        "WITH group " +
+        "WITH DISTINCT group " +
         "WHERE size((group) - [] - ()) = 0 " +
-        "DELETE group ")
-    if err != nil {
-        return err
-    }
-    defer stmt.Close() // closing the statment will also close the rows
-
-    // executing a statement just returns summary information
-    result, err := stmt.ExecNeo(map[string] interface{} {
-        "ownerid": ownerid,
-        "groupid": groupid })
+        "DELETE group ", args)
     if err != nil {
-        return err
+        tx.Rollback()
+        return 0, err
     }
-
-    _, err = result.RowsAffected()
-    return err
+    return unshared, tx.Commit()
 }
 
 func (neo *Neo4j) DeleteAssets(userid string, assetids []string) (*[]string, error) {
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
         return nil, err
     }
@@ -593,9 +2022,12 @@ func (neo *Neo4j) DeleteAssets(userid string, assetids []string) (*[]string, err
         "WITH user, assetids " +
         "MATCH (user) - [:MEMORY] - (assets:Asset) " +
         "WHERE assets.uuid in assetids " +
-        "WITH assets, assets.remotepath AS remotepaths, assets.remotepathorig AS remotepathsoriginal " +
+        "OPTIONAL MATCH (assets) - [:RENDITION] -> (renditions:Rendition) " +
+        "WITH assets, assets.remotepath AS remotepaths, assets.remotepathorig AS remotepathsoriginal, collect(renditions) AS renditions " +
+        "WITH assets, remotepaths, remotepathsoriginal, renditions, [rendition IN renditions | rendition.remotepath] AS renditionpaths " +
         "DETACH DELETE assets " +
-        "RETURN remotepaths, remotepathsoriginal ")
+        "FOREACH (rendition IN renditions | DELETE rendition) " +
+        "RETURN remotepaths, remotepathsoriginal, renditionpaths ")
     if err != nil {
         return nil, err
     }
@@ -615,20 +2047,80 @@ func (neo *Neo4j) DeleteAssets(userid string, assetids []string) (*[]string, err
         return nil, err
     }
 
+    // legacy paths and rendition paths overlap for assets with renditions, so only include each path once
     var pathsToDelete []string
+    seen := make(map[string]bool)
+    addPath := func(path interface{}) {
+        if path, ok := path.(string); ok && !seen[path] {
+            seen[path] = true
+            pathsToDelete = append(pathsToDelete, path)
+        }
+    }
     for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
         if err != nil {
             return &pathsToDelete, err
         }
-        pathsToDelete = append(pathsToDelete, row[0].(string))
-        pathsToDelete = append(pathsToDelete, row[1].(string))
+        addPath(row[0])
+        addPath(row[1])
+        if renditionpaths, ok := row[2].([]interface{}); ok {
+            for _, path := range renditionpaths {
+                addPath(path)
+            }
+        }
+    }
+
+    return &pathsToDelete, nil
+}
+
+// RemoveOriginalForAsset removes the original rendition of an asset owned by the user, keeping its other renditions
+// returns the storage path of the original, which the caller must delete, and the recalculated asset totalsize
+func (neo *Neo4j) RemoveOriginalForAsset(id string, assetid string) (string, uint64, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return "", 0, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {id} }) <- [:MEMORY] - (asset:Asset { uuid: {assetid} }) " +
+        "OPTIONAL MATCH (asset) - [originalrel:RENDITION] -> (original:Rendition { name: 'original' }) " +
+        "WITH asset, originalrel, original, original.remotepath AS path " +
+        "FOREACH (ignored IN CASE WHEN original IS NULL THEN [] ELSE [1] END | REMOVE asset.remotepathorig DELETE originalrel, original) " +
+        "WITH asset, path " +
+        "OPTIONAL MATCH (asset) - [:RENDITION] -> (renditions:Rendition) " +
+        "WITH asset, path, sum(renditions.size) AS totalsize " +
+        "FOREACH (ignored IN CASE WHEN path IS NULL THEN [] ELSE [1] END | SET asset.totalsize = totalsize) " +
+        "RETURN path, totalsize ")
+    if err != nil {
+        return "", 0, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "assetid": assetid,
+    })
+    if err != nil {
+        return "", 0, err
+    }
+
+    // query only returns 1 row, so will return io.EOF as error
+    // second parameter is metadata, which is discarded
+    data, _, err := rows.NextNeo()
+    if err != nil && err != io.EOF {
+        return "", 0, err
+    }
+    if len(data) == 0 {
+        return "", 0, ErrAssetNotFound
     }
-
-    return &pathsToDelete, nil
+    if data[0] == nil {
+        return "", 0, ErrNoOriginal
+    }
+    return data[0].(string), uint64(data[1].(int64)), nil
 }
 
 func (neo *Neo4j) RemoveAssetsFromGroup(userid string, groupid string, assetids []string) error {
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
         return err
     }
@@ -672,7 +2164,7 @@ func (neo *Neo4j) RemoveAssetsFromGroup(userid string, groupid string, assetids
 }
 
 func (neo *Neo4j) AddAssetsToGroup(userid string, groupid string, assetids []string) error {
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
         return err
     }
@@ -711,8 +2203,166 @@ func (neo *Neo4j) AddAssetsToGroup(userid string, groupid string, assetids []str
     return err
 }
 
+// GetOwnedAssetIDs returns the ids of every asset the user owns, including archived assets
+func (neo *Neo4j) GetOwnedAssetIDs(id string) ([]string, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {id} }) - [:MEMORY] - (asset:Asset) " +
+        "RETURN asset.uuid ")
+    if err != nil {
+        return nil, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var assetids []string
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return nil, err
+        }
+        assetids = append(assetids, row[0].(string))
+    }
+    return assetids, nil
+}
+
+// GetAssetTypes returns the type of each of the given assets the user owns, assets created before types were recorded are photos
+func (neo *Neo4j) GetAssetTypes(id string, assetids []string) (map[string]string, error) {
+    data := make(map[string]string)
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return data, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {id} }) - [:MEMORY] - (asset:Asset) " +
+        "WHERE asset.uuid IN split({assetids}, ',') " +
+        "RETURN asset.uuid, coalesce(asset.type, 'photo') ")
+    if err != nil {
+        return data, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "assetids": strings.Join(assetids, ","),
+    })
+    if err != nil {
+        return data, err
+    }
+
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return data, err
+        }
+        data[row[0].(string)] = row[1].(string)
+    }
+    return data, nil
+}
+
+// AssetsOwnedBy returns the subset of assetids that are not owned by the user
+func (neo *Neo4j) AssetsOwnedBy(id string, assetids []string) ([]string, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "WITH split({assetids}, ',') as assetids " +    // notice the String split function - explanation below
+        "MATCH (:User { id: {id} }) <- [:MEMORY] - (asset:Asset) " +
+        "WHERE asset.uuid in assetids " +
+        "RETURN asset.uuid ")
+    if err != nil {
+        return nil, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // transform assetids array to a comma seperated string
+    // we do this because variable substitution using the golang neo4j driver does not work with arrays
+    // see: https://github.com/johnnadratowski/golang-neo4j-bolt-driver/pull/8 which is currently unmerged
+    // so we must substitute as a string, then in cypher, split string back to array
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "assetids": strings.Join(assetids, ","),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    owned := make(map[string]bool)
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return nil, err
+        }
+        owned[row[0].(string)] = true
+    }
+
+    var unowned []string
+    for _, assetid := range assetids {
+        if !owned[assetid] {
+            unowned = append(unowned, assetid)
+        }
+    }
+    return unowned, nil
+}
+
+// GetSharedAssetKeys returns the shared key of each of the assets that is already shared into the group, keyed by asset id
+func (neo *Neo4j) GetSharedAssetKeys(id string, groupid string, assetids []string) (map[string]string, error) {
+    data := make(map[string]string)
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return data, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "WITH split({assetids}, ',') as assetids " +    // notice the String split function - explanation below
+        "MATCH (:User { id: {id} }) - [:MEMBER] -> (:Group { uuid: {groupid} }) <- [groupasset:GROUP_ASSET] - (asset:Asset) " +
+        "WHERE asset.uuid in assetids AND exists(groupasset.sharedKey) " +
+        "RETURN asset.uuid, groupasset.sharedKey ")
+    if err != nil {
+        return data, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // transform assetids array to a comma seperated string
+    // we do this because variable substitution using the golang neo4j driver does not work with arrays
+    // see: https://github.com/johnnadratowski/golang-neo4j-bolt-driver/pull/8 which is currently unmerged
+    // so we must substitute as a string, then in cypher, split string back to array
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "groupid": groupid,
+        "assetids": strings.Join(assetids, ","),
+    })
+    if err != nil {
+        return data, err
+    }
+
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return data, err
+        }
+        data[row[0].(string)] = row[1].(string)
+    }
+    return data, nil
+}
+
 func (neo *Neo4j) ShareAssets(id string, groupid string, assetids []string, assetkeys []string) error {
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
         return err
     }
@@ -720,6 +2370,7 @@ func (neo *Neo4j) ShareAssets(id string, groupid string, assetids []string, asse
 
     stmt, err := conn.PrepareNeo(
         "MATCH (user:User { id: {id} }) - [:MEMBER] -> (group:Group { uuid: {groupid} }) <- [groupasset:GROUP_ASSET] - (asset:Asset { uuid: {assetid} }) - [:MEMORY] -> (user) " +
+        "WHERE NOT exists(groupasset.sharedKey) OR groupasset.sharedKey = {key} " +  // never replace the key other members decrypt with
         "SET group._lock = true, groupasset.sharedKey = {key} " +
         "WITH user, group, asset " +
         "MATCH (group) - [:MEMBER] - (others:User) " +
@@ -748,7 +2399,7 @@ func (neo *Neo4j) ShareAssets(id string, groupid string, assetids []string, asse
 }
 
 func (neo *Neo4j) UnshareAssets(id string, groupid string, assetids []string) error {
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
         return err
     }
@@ -787,88 +2438,394 @@ func (neo *Neo4j) UnshareAssets(id string, groupid string, assetids []string) er
     return err
 }
 
-func (neo *Neo4j) SetFavourite(userid string, tripid string, assetid string) {
-    // safety checks
-    if len(userid) == 0 || len(tripid) == 0 || len(assetid) == 0 {
-        errLogger.Panicln()
-    }
-
-    conn, err := neo.driverPool.OpenPool()
+// UnshareAssetFromAllGroups unshares an asset the user owns from every group it is shared with, returning those groups
+// as UnshareAssets does, the asset stays in each group's album but its shared key is removed. Returns ErrAssetNotFound if
+// the user doesn't own the asset
+func (neo *Neo4j) UnshareAssetFromAllGroups(id string, assetid string) ([]string, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {id} }) <- [:MEMORY] - (asset:Asset { uuid: {assetid} }) " +
+        "OPTIONAL MATCH (asset) - [groupasset:GROUP_ASSET] -> (group:Group) " +
+        "WHERE exists(groupasset.sharedKey) " +
+        "SET group._lock = true " +
+        "REMOVE groupasset.sharedKey " +
+        "WITH asset, collect(group.uuid) AS groupids " +
+        "OPTIONAL MATCH (asset) - [sharedmemories:MEMORY_SHARED] - (:User) " +
+        "DELETE sharedmemories " +
+        "RETURN DISTINCT groupids ")
+    if err != nil {
+        return nil, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "assetid": assetid,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    // query only returns 1 row, so will return io.EOF as error
+    // second parameter is metadata, which is discarded
+    data, _, err := rows.NextNeo()
+    if err != nil && err != io.EOF {
+        return nil, err
+    }
+    if len(data) == 0 {
+        return nil, ErrAssetNotFound
+    }
+
+    groupids := []string{}
+    for _, groupid := range data[0].([]interface{}) {
+        groupids = append(groupids, groupid.(string))
+    }
+    return groupids, nil
+}
+
+// MoveSharedAsset removes the user's asset from one group and shares it into another with the given key, in a single
+// transaction so the asset is never in neither group. Returns ErrNotGroupMember or ErrAssetNotFound if validation fails
+func (neo *Neo4j) MoveSharedAsset(id string, assetid string, fromgroupid string, togroupid string, assetkey string) error {
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    tx, err := conn.Begin()
+    if err != nil {
+        return err
+    }
+
+    args := map[string]interface{} {
+        "id": id,
+        "assetid": assetid,
+        "fromgroupid": fromgroupid,
+        "togroupid": togroupid,
+        "key": assetkey,
+    }
+
+    rows, err := conn.QueryNeo(
+        "MATCH (user:User { id: {id} }) " +
+        "OPTIONAL MATCH (user) - [:MEMBER] -> (fromgroup:Group { uuid: {fromgroupid} }) " +
+        "OPTIONAL MATCH (user) - [:MEMBER] -> (togroup:Group { uuid: {togroupid} }) " +
+        "OPTIONAL MATCH (user) <- [:MEMORY] - (asset:Asset { uuid: {assetid} }) - [:GROUP_ASSET] -> (fromgroup) " +
+        "OPTIONAL MATCH (asset) - [existing:GROUP_ASSET] -> (togroup) " +
+        "RETURN fromgroup IS NOT NULL AND togroup IS NOT NULL, asset IS NOT NULL, existing.sharedKey ", args)
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    row, _, err := rows.NextNeo()
+    if err == io.EOF {
+        rows.Close()
+        tx.Rollback()
+        return ErrNotGroupMember
+    } else if err != nil {
+        rows.Close()
+        tx.Rollback()
+        return err
+    }
+    rows.Close()
+    if member := row[0].(bool); !member {
+        tx.Rollback()
+        return ErrNotGroupMember
+    }
+    if owned := row[1].(bool); !owned {
+        tx.Rollback()
+        return ErrAssetNotFound
+    }
+    if sharedKey, shared := row[2].(string); shared && sharedKey != assetkey {
+        tx.Rollback()
+        return ErrSharedKeyConflict
+    }
+
+    // remove from the source group, as RemoveAssetsFromGroup, then share into the destination, as AddAssetsToGroup and ShareAssets
+    statements := []string {
+        "MATCH (user:User { id: {id} }) <- [:MEMORY] - (asset:Asset { uuid: {assetid} }) - [groupasset:GROUP_ASSET] -> (group:Group { uuid: {fromgroupid} }) " +
+        "SET group._lock = true " +
+        "DELETE groupasset " +
+        "WITH asset " +
+        "MATCH (asset) - [sharedmemories:MEMORY_SHARED] - (users:User) " +
+        "WHERE NOT (users) - [:MEMBER] - (:Group) - [:GROUP_ASSET] - (asset) " +
+        "DELETE sharedmemories ",
+
+        "MATCH (user:User { id: {id} }) <- [:MEMORY] - (asset:Asset { uuid: {assetid} }), (user) - [:MEMBER] -> (group:Group { uuid: {togroupid} }) " +
+        "SET group._lock = true " +
+        "MERGE (asset) - [groupasset:GROUP_ASSET] -> (group) " +
+        "WITH user, group, asset, groupasset " +
+        "WHERE NOT exists(groupasset.sharedKey) OR groupasset.sharedKey = {key} " +  // never replace the key other members decrypt with
+        "SET groupasset.sharedKey = {key} " +
+        "WITH user, group, asset " +
+        "MATCH (group) - [:MEMBER] - (others:User) " +
+        "WHERE user <> others " +
+        "MERGE (asset) - [:MEMORY_SHARED] -> (others) ",
+    }
+    for _, statement := range statements {
+        if _, err := conn.ExecNeo(statement, args); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+
+    return tx.Commit()
+}
+
+func (neo *Neo4j) SetFavourite(userid string, tripid string, assetid string) error {
+    // safety checks
+    if len(userid) == 0 || len(tripid) == 0 || len(assetid) == 0 {
+        return errors.New("user, trip and asset IDs are required")
+    }
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {userid} }) <- [:TRIP_OWNER] - (:Trip { uuid: {tripid} }) <- [memory] - (:Asset { uuid: {assetid} }) " +
+        "SET memory.favourite = TRUE ")
+    if err != nil {
+        return err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // executing a statement just returns summary information
+    result, err := stmt.ExecNeo(map[string] interface{} {
+        "userid": userid,
+        "tripid": tripid,
+        "assetid": assetid })
+    if err != nil {
+        return err
+    }
+
+    _, err = result.RowsAffected()
+    return err
+}
+
+func (neo *Neo4j) UnsetFavourite(userid string, tripid string, assetid string) error {
+    // safety checks
+    if len(userid) == 0 || len(tripid) == 0 || len(assetid) == 0 {
+        return errors.New("user, trip and asset IDs are required")
+    }
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {userid} }) <- [:TRIP_OWNER] - (:Trip { uuid: {tripid} }) <- [memory] - (:Asset { uuid: {assetid} }) " +
+        "REMOVE memory.favourite")
+    if err != nil {
+        return err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    // executing a statement just returns summary information
+    result, err := stmt.ExecNeo(map[string] interface{} {
+        "userid": userid,
+        "tripid": tripid,
+        "assetid": assetid })
+    if err != nil {
+        return err
+    }
+
+    _, err = result.RowsAffected()
+    return err
+}
+
+// SetAssetArchived hides or unhides an asset the user owns from their default asset listing, returns ErrAssetNotFound if
+// the user doesn't own the asset. Archived assets are kept, so still count towards storage used
+func (neo *Neo4j) SetAssetArchived(id string, assetid string, archived bool) error {
+    conn, err := neo.openConn()
     if err != nil {
-        errLogger.Panicln(err)
+        return err
     }
     defer conn.Close()
 
+    archivedQuery := "REMOVE memory.archived "
+    if archived {
+        archivedQuery = "SET memory.archived = true "
+    }
     stmt, err := conn.PrepareNeo(
-        "MATCH (:User { id: {userid} }) <- [:TRIP_OWNER] - (:Trip { uuid: {tripid} }) <- [memory] - (:Asset { uuid: {assetid} }) " +
-        "SET memory.favourite = TRUE ")
+        "MATCH (:User { id: {id} }) - [memory:MEMORY] - (asset:Asset { uuid: {assetid} }) " +
+        archivedQuery +
+        "RETURN asset.uuid ")
     if err != nil {
-        errLogger.Panicln(err)
+        return err
     }
     defer stmt.Close() // closing the statment will also close the rows
 
-    // executing a statement just returns summary information
-    result, err := stmt.ExecNeo(map[string] interface{} {
-        "userid": userid,
-        "tripid": tripid,
-        "assetid": assetid })
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "assetid": assetid,
+    })
     if err != nil {
-        errLogger.Panicln(err)
+        return err
     }
 
-    _, err = result.RowsAffected()
-    if err != nil {
-        errLogger.Panicln(err)
+    // query only returns 1 row, so will return io.EOF as error
+    // second parameter is metadata, which is discarded
+    data, _, err := rows.NextNeo()
+    if err != nil && err != io.EOF {
+        return err
     }
-}
-
-func (neo *Neo4j) UnsetFavourite(userid string, tripid string, assetid string) {
-    // safety checks
-    if len(userid) == 0 || len(tripid) == 0 || len(assetid) == 0 {
-        errLogger.Panicln()
+    if len(data) == 0 {
+        return ErrAssetNotFound
     }
+    return nil
+}
 
-    conn, err := neo.driverPool.OpenPool()
+// SetAssetTags replaces the user's tags on an asset they own, an empty list removes them. Returns ErrAssetNotFound if the
+// user doesn't own the asset. Tags are opaque to the server and are stored on the user's MEMORY relationship
+func (neo *Neo4j) SetAssetTags(id string, assetid string, tags []string) error {
+    conn, err := neo.openConn()
     if err != nil {
-        errLogger.Panicln(err)
+        return err
     }
     defer conn.Close()
 
+    tagsQuery := "REMOVE memory.tags "
+    if len(tags) != 0 {
+        tagsQuery = "SET memory.tags = split({tags}, ',') "
+    }
     stmt, err := conn.PrepareNeo(
-        "MATCH (:User { id: {userid} }) <- [:TRIP_OWNER] - (:Trip { uuid: {tripid} }) <- [memory] - (:Asset { uuid: {assetid} }) " +
-        "REMOVE memory.favourite")
+        "MATCH (:User { id: {id} }) - [memory:MEMORY] - (asset:Asset { uuid: {assetid} }) " +
+        tagsQuery +
+        "RETURN asset.uuid ")
     if err != nil {
-        errLogger.Panicln(err)
+        return err
     }
     defer stmt.Close() // closing the statment will also close the rows
 
-    // executing a statement just returns summary information
-    result, err := stmt.ExecNeo(map[string] interface{} {
-        "userid": userid,
-        "tripid": tripid,
-        "assetid": assetid })
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "assetid": assetid,
+        "tags": strings.Join(tags, ","),
+    })
     if err != nil {
-        errLogger.Panicln(err)
+        return err
     }
 
-    _, err = result.RowsAffected()
+    // query only returns 1 row, so will return io.EOF as error
+    // second parameter is metadata, which is discarded
+    data, _, err := rows.NextNeo()
+    if err != nil && err != io.EOF {
+        return err
+    }
+    if len(data) == 0 {
+        return ErrAssetNotFound
+    }
+    return nil
+}
+
+// UpdateAssetKeys replaces the user's key for each asset they own in a single transaction, returning the assets updated
+// assets the user doesn't own are skipped. Only the owner's key is changed, keys the asset is shared to groups with are left alone
+func (neo *Neo4j) UpdateAssetKeys(id string, keys map[string]string) ([]string, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    tx, err := conn.Begin()
     if err != nil {
-        errLogger.Panicln(err)
+        return nil, err
+    }
+
+    updated := []string{}
+    // have to use loop as the unofficial neo4j go driver cannot encode lists/maps
+    for assetid, key := range keys {
+        rows, err := conn.QueryNeo(
+            "MATCH (:User { id: {id} }) - [memory:MEMORY] - (asset:Asset { uuid: {assetid} }) " +
+            "SET memory.key = {key} " +
+            "RETURN asset.uuid ", map[string]interface{} {
+            "id": id,
+            "assetid": assetid,
+            "key": key,
+        })
+        if err != nil {
+            tx.Rollback()
+            return nil, err
+        }
+        // query returns at most 1 row, no row means the user doesn't own the asset
+        data, _, err := rows.NextNeo()
+        rows.Close()
+        if err != nil && err != io.EOF {
+            tx.Rollback()
+            return nil, err
+        }
+        if len(data) != 0 {
+            updated = append(updated, assetid)
+        }
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, err
     }
+    return updated, nil
 }
 
+// PatchSchema0 migrates the user's schema 0 asset keys and md5s to schema 1 in a transaction, recording the new version
+// so the migration is applied once. Returns ErrSchemaMigrated if the user is already on schema 1, ErrSchemaNewer if they
+// are on a later version, and io.EOF if the user doesn't exist
 func (neo *Neo4j) PatchSchema0(id string, assetkeys map[string]string, assetmd5s map[string]string) error {
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
         return err
     }
     defer conn.Close()
 
+    tx, err := conn.Begin()
+    if err != nil {
+        return err
+    }
+
+    // lock the user, so concurrent retries apply the migration once
+    rows, err := conn.QueryNeo(
+        "MATCH (user:User { id: {id} }) " +
+        "SET user._lock = true " +
+        "RETURN user.schemaVersion ", map[string]interface{} {
+        "id": id,
+    })
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    data, _, err := rows.NextNeo()
+    rows.Close()
+    if err != nil && err != io.EOF {
+        tx.Rollback()
+        return err
+    }
+    if len(data) == 0 {
+        tx.Rollback()
+        return io.EOF
+    }
+    switch data[0] {
+    case "0":
+    case "1":
+        tx.Rollback()
+        return ErrSchemaMigrated
+    default:
+        tx.Rollback()
+        return ErrSchemaNewer
+    }
+
     replaceKeyStatement, err := conn.PrepareNeo(
         "MATCH (:User { id: {id} }) <- [memory:MEMORY] - (:Asset {uuid: {assetid} }) " +
         "SET memory.key = {key} " +
         "REMOVE memory.legacy_tripKey, memory.legacy_assetKey ")
     if err != nil {
+        tx.Rollback()
         return err
     }
     defer replaceKeyStatement.Close() // closing the statment will also close the rows
@@ -880,9 +2837,11 @@ func (neo *Neo4j) PatchSchema0(id string, assetkeys map[string]string, assetmd5s
             "assetid": assetid,
             "key": key })
         if err != nil {
+            tx.Rollback()
             return err
         }
         _, err = result.RowsAffected(); if err != nil {
+            tx.Rollback()
             return err
         }
     }
@@ -892,6 +2851,7 @@ func (neo *Neo4j) PatchSchema0(id string, assetkeys map[string]string, assetmd5s
         "MATCH (:User { id: {id} }) <- [memory:MEMORY|:MEMORY_SHARED] - (asset:Asset {uuid: {assetid} }) " +
         "SET asset.md5 = {md5} ")
     if err != nil {
+        tx.Rollback()
         return err
     }
     defer setMD5Statement.Close() // closing the statment will also close the rows
@@ -903,43 +2863,129 @@ func (neo *Neo4j) PatchSchema0(id string, assetkeys map[string]string, assetmd5s
             "assetid": assetid,
             "md5": md5 })
         if err != nil {
+            tx.Rollback()
             return err
         }
         _, err = result.RowsAffected(); if err != nil {
+            tx.Rollback()
             return err
         }
     }
     setMD5Statement.Close()
 
     // finally, set schema version for user
-    setSchemaStatement, err := conn.PrepareNeo(
+    _, err = conn.ExecNeo(
         "MATCH (user:User { id: {id} }) " +
-        "SET user.schemaVersion = '1' ")
+        "SET user.schemaVersion = '1' ", map[string]interface{} {
+        "id": id,
+    })
     if err != nil {
+        tx.Rollback()
         return err
     }
-    defer setSchemaStatement.Close() // closing the statment will also close the rows
+    return tx.Commit()
+}
 
-    result, err := setSchemaStatement.ExecNeo(map[string] interface{} {   // executing a statement just returns summary information
-        "id": id })
+// GetAssets returns the user's own and shared assets, own assets the user has archived are only included when includeArchived is set
+func (neo *Neo4j) GetAssets(id string, includeArchived bool, order AssetOrder) ([]interface{}, error) {
+    archivedFilter := "WHERE NOT exists(memory.archived) "
+    if includeArchived {
+        archivedFilter = ""
+    }
+    query :=
+        "MATCH (user:User {id: {id} }) - [memory:MEMORY] - (asset:Asset) " +
+        archivedFilter +
+        "WITH user.uuid as ownerid, (asset), memory.key as key, exists(memory.favourite) as favourite, exists(memory.archived) as archived, coalesce(memory.tags, []) as tags " +
+        "RETURN asset{.*, ownerid, key, favourite, archived, tags} as assets " +
+        "UNION " +
+        "MATCH (user:User {id: {id} }) - [memory:MEMORY_SHARED] - (asset:Asset) - [groupasset:GROUP_ASSET] - (group:Group) - [:MEMBER] - (user) " +
+        "MATCH (asset:Asset) - [:MEMORY] - (owner:User) " +
+        "WITH owner.uuid as ownerid, (asset), groupasset.sharedKey as key, exists(memory.favourite) as favourite, group.uuid as groupid, false as archived, [] as tags " +
+        "RETURN DISTINCT asset{.*, ownerid, key, favourite, groupid, archived, tags} as assets "
+    assets, err := neo.getAssets(query, map[string]interface{} {
+        "id": id,
+    })
     if err != nil {
-        return err
+        return nil, err
     }
-    _, err = result.RowsAffected()
-    return err
+    sortAssets(assets, order)
+    return assets, nil
+}
+
+// GetAssetsByTag returns the user's own assets they have tagged with tag, archived assets are only included when includeArchived is set
+// tags are compared exactly, so clients filtering on encrypted tags must encrypt them deterministically
+func (neo *Neo4j) GetAssetsByTag(id string, tag string, includeArchived bool, order AssetOrder) ([]interface{}, error) {
+    archivedFilter := "AND NOT exists(memory.archived) "
+    if includeArchived {
+        archivedFilter = ""
+    }
+    query :=
+        "MATCH (user:User {id: {id} }) - [memory:MEMORY] - (asset:Asset) " +
+        "WHERE {tag} IN memory.tags " +
+        archivedFilter +
+        "WITH user.uuid as ownerid, (asset), memory.key as key, exists(memory.favourite) as favourite, exists(memory.archived) as archived, memory.tags as tags " +
+        "RETURN asset{.*, ownerid, key, favourite, archived, tags} as assets "
+    assets, err := neo.getAssets(query, map[string]interface{} {
+        "id": id,
+        "tag": tag,
+    })
+    if err != nil {
+        return nil, err
+    }
+    sortAssets(assets, order)
+    return assets, nil
+}
+
+// GetAssetsInDateRange returns the user's own and shared assets whose CreateDate is within from and to inclusive, in the same
+// form as GetAssets. Assets without a CreateDate, or with one that couldn't be parsed, are never included
+func (neo *Neo4j) GetAssetsInDateRange(id string, from time.Time, to time.Time, includeArchived bool, order AssetOrder) ([]interface{}, error) {
+    rangeFilter := "WHERE asset.createdatemillis >= {from} AND asset.createdatemillis <= {to} "
+    archivedFilter := "AND NOT exists(memory.archived) "
+    if includeArchived {
+        archivedFilter = ""
+    }
+    query :=
+        "MATCH (user:User {id: {id} }) - [memory:MEMORY] - (asset:Asset) " +
+        rangeFilter +
+        archivedFilter +
+        "WITH user.uuid as ownerid, (asset), memory.key as key, exists(memory.favourite) as favourite, exists(memory.archived) as archived, coalesce(memory.tags, []) as tags " +
+        "RETURN asset{.*, ownerid, key, favourite, archived, tags} as assets " +
+        "UNION " +
+        "MATCH (user:User {id: {id} }) - [memory:MEMORY_SHARED] - (asset:Asset) - [groupasset:GROUP_ASSET] - (group:Group) - [:MEMBER] - (user) " +
+        rangeFilter +
+        "MATCH (asset:Asset) - [:MEMORY] - (owner:User) " +
+        "WITH owner.uuid as ownerid, (asset), groupasset.sharedKey as key, exists(memory.favourite) as favourite, group.uuid as groupid, false as archived, [] as tags " +
+        "RETURN DISTINCT asset{.*, ownerid, key, favourite, groupid, archived, tags} as assets "
+    assets, err := neo.getAssets(query, map[string]interface{} {
+        "id": id,
+        "from": EpochMillis(from),
+        "to": EpochMillis(to),
+    })
+    if err != nil {
+        return nil, err
+    }
+    sortAssets(assets, order)
+    return assets, nil
 }
 
-func (neo *Neo4j) GetAssets(id string) ([]interface{}, error) {
+// GetAssetsByIDs returns the assets in assetids that the user owns or has shared with them, in the same form as GetAssets
+// archived assets are included, as they were asked for by ID. Assets the user can't access are left out
+func (neo *Neo4j) GetAssetsByIDs(id string, assetids []string) ([]interface{}, error) {
     query :=
         "MATCH (user:User {id: {id} }) - [memory:MEMORY] - (asset:Asset) " +
-        "WITH user.uuid as ownerid, (asset), memory.key as key, exists(memory.favourite) as favourite " +
-        "RETURN asset{.*, ownerid, key, favourite} as assets " +
+        "WHERE asset.uuid IN split({assetids}, ',') " +
+        "WITH user.uuid as ownerid, (asset), memory.key as key, exists(memory.favourite) as favourite, exists(memory.archived) as archived, coalesce(memory.tags, []) as tags " +
+        "RETURN asset{.*, ownerid, key, favourite, archived, tags} as assets " +
         "UNION " +
         "MATCH (user:User {id: {id} }) - [memory:MEMORY_SHARED] - (asset:Asset) - [groupasset:GROUP_ASSET] - (group:Group) - [:MEMBER] - (user) " +
+        "WHERE asset.uuid IN split({assetids}, ',') " +
         "MATCH (asset:Asset) - [:MEMORY] - (owner:User) " +
-        "WITH owner.uuid as ownerid, (asset), groupasset.sharedKey as key, exists(memory.favourite) as favourite, group.uuid as groupid " +
-        "RETURN DISTINCT asset{.*, ownerid, key, favourite, groupid} as assets "
-    return neo.getAssets(id, query)
+        "WITH owner.uuid as ownerid, (asset), groupasset.sharedKey as key, exists(memory.favourite) as favourite, group.uuid as groupid, false as archived, [] as tags " +
+        "RETURN DISTINCT asset{.*, ownerid, key, favourite, groupid, archived, tags} as assets "
+    return neo.getAssets(query, map[string]interface{} {
+        "id": id,
+        "assetids": strings.Join(assetids, ","),
+    })
 }
 
 func (neo *Neo4j) GetAssetsSchema0(id string) ([]interface{}, error) {
@@ -949,11 +2995,13 @@ func (neo *Neo4j) GetAssetsSchema0(id string) ([]interface{}, error) {
         "UNION " +
         "MATCH (user:User {id: {id} }) - [memory:MEMORY_SHARED] - (asset:Asset) - [groupasset:GROUP_ASSET] - (group:Group) - [:MEMBER] - (user) " +
         "RETURN {id: asset.uuid, remotepathorig: asset.remotepathorig, groupid: group.uuid, sharedkey: groupasset.sharedKey, md5: asset.md5} as assets "
-    return neo.getAssets(id, query)
+    return neo.getAssets(query, map[string]interface{} {
+        "id": id,
+    })
 }
 
-func (neo *Neo4j) getAssets(id string, query string) ([]interface{}, error) {
-    conn, err := neo.driverPool.OpenPool()
+func (neo *Neo4j) getAssets(query string, args map[string]interface{}) ([]interface{}, error) {
+    conn, err := neo.openConn()
     if err != nil {
         return nil, err
     }
@@ -965,126 +3013,317 @@ func (neo *Neo4j) getAssets(id string, query string) ([]interface{}, error) {
     }
     defer stmt.Close() // closing the statment will also close the rows
 
+    rows, err := stmt.QueryNeo(args)
+    if err != nil {
+        return nil, err
+    }
+
+    var data []interface{}
+    err = nil
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return nil, err
+        }
+        data = append(data, row[0])
+    }
+    if len(data) == 0 {
+        return nil, io.EOF
+    }
+    return data, nil
+}
+
+func (neo *Neo4j) GetAssetsForAllGroups(userid string) (map[string]map[string][]interface{}, error) {
+    data := make(map[string]map[string][]interface{})
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return data, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (user:User {id: {userid} }) - [:MEMBER] - (group:Group) " +
+        "WITH user, group " +
+        "OPTIONAL MATCH (user) - [:MEMORY|:MEMORY_SHARED] - (assets:Asset) - [:GROUP_ASSET] - (group) " +
+        "WITH user, group, CASE WHEN assets IS NOT NULL THEN collect(assets.uuid) ELSE [] END as assetids " +
+        "OPTIONAL MATCH (user) - [:MEMORY|:MEMORY_SHARED] - (assets:Asset) - [groupassets:GROUP_ASSET] - (group) " +
+        "WHERE exists(groupassets.sharedKey) " +
+        "RETURN group.uuid, assetids, CASE WHEN assets IS NOT NULL THEN collect(assets.uuid) ELSE [] END as sharedassetids ")
+    if err != nil {
+        return data, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    args := map[string]interface{} {
+        "userid": userid,
+    }
+    rows, err := stmt.QueryNeo(args)
+    if err != nil {
+        return data, err
+    }
+
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return data, err
+        }
+        data[row[0].(string)] = map[string][]interface{} {
+            "assetids": row[1].([]interface{}),
+            "sharedassetids": row[2].([]interface{}),
+        }
+    }
+
+    if len(data) == 0 {
+        return data, io.EOF
+    }
+    return data, nil
+}
+
+func (neo *Neo4j) GetUsersInGroup(id string, groupID string) (map[string]string, error) {
+    data := make(map[string]string)
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return data, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {id} }) - [:MEMBER] -> (:Group { uuid: {groupID} }) <- [:MEMBER] - (otheruser:User) " +
+        "RETURN otheruser.uuid, otheruser.publicKey ")
+    if err != nil {
+        return data, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
     args := map[string]interface{} {
         "id": id,
+        "groupID": groupID,
     }
 
     rows, err := stmt.QueryNeo(args)
     if err != nil {
-        return nil, err
+        return data, err
+    }
+
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return data, err
+        }
+        data[row[0].(string)] = row[1].(string)
+    }
+
+    if len(data) == 0 {
+        return data, io.EOF
+    }
+    return data, nil
+}
+
+// GetUsersInGroupWithStats returns every member of a group the user belongs to, keyed by uuid, with their public key and
+// the number of assets they have shared into the group. Returns ErrNotGroupMember if the user isn't a member
+func (neo *Neo4j) GetUsersInGroupWithStats(id string, groupID string) (map[string]map[string]interface{}, error) {
+    data := make(map[string]map[string]interface{})
+
+    conn, err := neo.openConn()
+    if err != nil {
+        return data, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {id} }) - [:MEMBER] -> (group:Group { uuid: {groupID} }) " +
+        "MATCH (group) <- [:MEMBER] - (member:User) " +  // separate MATCH, within one pattern the user's membership can't be matched twice
+        "OPTIONAL MATCH (member) <- [:MEMORY] - (asset:Asset) - [groupasset:GROUP_ASSET] -> (group) " +
+        "WHERE exists(groupasset.sharedKey) " +
+        "RETURN member.uuid, member.publicKey, count(asset) ")
+    if err != nil {
+        return data, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "groupID": groupID,
+    })
+    if err != nil {
+        return data, err
     }
 
-    var data []interface{}
-    err = nil
     for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
         if err != nil {
-            return nil, err
+            return data, err
+        }
+        data[row[0].(string)] = map[string]interface{} {
+            "publicKey": row[1].(string),
+            "sharedAssets": row[2].(int64),
         }
-        data = append(data, row[0])
     }
+
+    // the user is always a member of their own groups, so no rows means they aren't a member
     if len(data) == 0 {
-        return nil, io.EOF
+        return data, ErrNotGroupMember
     }
     return data, nil
 }
 
-func (neo *Neo4j) GetAssetsForAllGroups(userid string) (map[string]map[string][]interface{}, error) {
-    data := make(map[string]map[string][]interface{})
+// GetUsersInGroupPaginated returns up to limit members of a group the user belongs to, ordered by uuid and starting after cursor,
+// along with the cursor for the next page, which is empty when there are no more members
+func (neo *Neo4j) GetUsersInGroupPaginated(id string, groupID string, cursor string, limit int) (map[string]string, string, error) {
+    data := make(map[string]string)
 
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
-        return data, err
+        return data, "", err
     }
     defer conn.Close()
 
     stmt, err := conn.PrepareNeo(
-        "MATCH (user:User {id: {userid} }) - [:MEMBER] - (group:Group) " +
-        "WITH user, group " +
-        "OPTIONAL MATCH (user) - [:MEMORY|:MEMORY_SHARED] - (assets:Asset) - [:GROUP_ASSET] - (group) " +
-        "WITH user, group, CASE WHEN assets IS NOT NULL THEN collect(assets.uuid) ELSE [] END as assetids " +
-        "OPTIONAL MATCH (user) - [:MEMORY|:MEMORY_SHARED] - (assets:Asset) - [groupassets:GROUP_ASSET] - (group) " +
-        "WHERE exists(groupassets.sharedKey) " +
-        "RETURN group.uuid, assetids, CASE WHEN assets IS NOT NULL THEN collect(assets.uuid) ELSE [] END as sharedassetids ")
+        "MATCH (:User { id: {id} }) - [:MEMBER] -> (:Group { uuid: {groupID} }) <- [:MEMBER] - (otheruser:User) " +
+        "WHERE otheruser.uuid > {cursor} " +
+        "RETURN otheruser.uuid, otheruser.publicKey " +
+        "ORDER BY otheruser.uuid " +
+        "LIMIT {limit} ")
     if err != nil {
-        return data, err
+        return data, "", err
     }
     defer stmt.Close() // closing the statment will also close the rows
 
-    args := map[string]interface{} {
-        "userid": userid,
-    }
-    rows, err := stmt.QueryNeo(args)
+    // fetch one extra row to find out whether there is another page
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "groupID": groupID,
+        "cursor": cursor,
+        "limit": limit + 1,
+    })
     if err != nil {
-        return data, err
+        return data, "", err
     }
 
+    var last string
+    next := ""
     for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
         if err != nil {
-            return data, err
+            return data, "", err
         }
-        data[row[0].(string)] = map[string][]interface{} {
-            "assetids": row[1].([]interface{}),
-            "sharedassetids": row[2].([]interface{}),
+        if len(data) == limit {
+            next = last
+            break
         }
+        last = row[0].(string)
+        data[last] = row[1].(string)
     }
 
     if len(data) == 0 {
-        return data, io.EOF
+        return data, "", io.EOF
     }
-    return data, nil
+    return data, next, nil
 }
 
-func (neo *Neo4j) GetUsersInGroup(id string, groupID string) (map[string]string, error) {
-    data := make(map[string]string)
+// StreamOtherGroupMembers pages through the uuids of every member of a group to notify, excluding the user with the given
+// id, calling fn with each batch of at most batchSize members so large groups are never loaded at once. Members with no
+// push recipient (see RemoveInvalidRecipient) are passed separately as unreachableIDs. Each page is read and its
+// connection returned to the pool before fn is called, so fn is free to query the database itself
+func (neo *Neo4j) StreamOtherGroupMembers(id string, groupID string, batchSize int, fn func(userIDs []string, unreachableIDs []string)) error {
+    cursor := ""
+    for {
+        userIDs, unreachableIDs, last, err := neo.otherGroupMembersPage(id, groupID, cursor, batchSize)
+        if err != nil {
+            return err
+        }
 
-    conn, err := neo.driverPool.OpenPool()
+        if len(userIDs) != 0 || len(unreachableIDs) != 0 {
+            fn(userIDs, unreachableIDs)
+        }
+        if len(userIDs) + len(unreachableIDs) < batchSize {
+            return nil
+        }
+        cursor = last
+    }
+}
+
+// otherGroupMembersPage returns the next batchSize members after cursor for StreamOtherGroupMembers, split by whether they
+// are reachable, along with the last uuid of the page
+func (neo *Neo4j) otherGroupMembersPage(id string, groupID string, cursor string, batchSize int) ([]string, []string, string, error) {
+    conn, err := neo.openConn()
     if err != nil {
-        return data, err
+        return nil, nil, "", err
     }
     defer conn.Close()
 
     stmt, err := conn.PrepareNeo(
-        "MATCH (:User { id: {id} }) - [:MEMBER] -> (:Group { uuid: {groupID} }) <- [:MEMBER] - (otheruser:User) " +
-        "RETURN otheruser.uuid, otheruser.publicKey ")
+        "MATCH (:Group { uuid: {groupID} }) <- [:MEMBER] - (member:User) " +
+        "WHERE member.id <> {id} AND member.uuid > {cursor} " +
+        "RETURN member.uuid, exists(member.pushUnreachable) " +
+        "ORDER BY member.uuid " +
+        "LIMIT {limit} ")
     if err != nil {
-        return data, err
+        return nil, nil, "", err
     }
     defer stmt.Close() // closing the statment will also close the rows
 
-    args := map[string]interface{} {
+    rows, err := stmt.QueryNeo(map[string]interface{} {
         "id": id,
         "groupID": groupID,
-    }
-
-    rows, err := stmt.QueryNeo(args)
+        "cursor": cursor,
+        "limit": batchSize,
+    })
     if err != nil {
-        return data, err
+        return nil, nil, "", err
     }
 
+    var userIDs, unreachableIDs []string
+    var last string
     for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
         if err != nil {
-            return data, err
+            return nil, nil, "", err
+        }
+        last = row[0].(string)
+        if row[1].(bool) {
+            unreachableIDs = append(unreachableIDs, last)
+        } else {
+            userIDs = append(userIDs, last)
         }
-        data[row[0].(string)] = row[1].(string)
-    }
-
-    if len(data) == 0 {
-        return data, io.EOF
     }
-    return data, nil
+    return userIDs, unreachableIDs, last, nil
 }
 
+// CreateGroup creates a group with the user as its only member, returns ErrIDInUse if groupid belongs to another group
 func (neo *Neo4j) CreateGroup(id string, groupid string, name string, key string) error {
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
         return err
     }
     defer conn.Close()
 
+    tx, err := conn.Begin()
+    if err != nil {
+        return err
+    }
+
+    rows, err := conn.QueryNeo(
+        "MATCH (group:Group { uuid: {groupid} }) " +
+        "RETURN group.uuid ", map[string]interface{} {
+        "groupid": groupid,
+    })
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    existing, _, err := rows.NextNeo()
+    rows.Close()
+    if err != nil && err != io.EOF {
+        tx.Rollback()
+        return err
+    }
+    if len(existing) != 0 {
+        tx.Rollback()
+        return ErrIDInUse
+    }
+
     stmt, err := conn.PrepareNeo(
         "MATCH (user:User { id: {id} }) " +
         "MERGE (user) - [:MEMBER {key: {key} }] -> (:Group { uuid: {groupid}, name: {name} })")
     if err != nil {
+        tx.Rollback()
         return err
     }
     defer stmt.Close() // closing the statment will also close the rows
@@ -1096,48 +3335,145 @@ func (neo *Neo4j) CreateGroup(id string, groupid string, name string, key string
         "name": name,
         "key": key })
     if err != nil {
+        tx.Rollback()
         return err
     }
 
-    _, err = result.RowsAffected()
-    return err
+    if _, err = result.RowsAffected(); err != nil {
+        tx.Rollback()
+        return err
+    }
+    stmt.Close()
+    return tx.Commit()
 }
 
+// JoinGroup accepts a pending invite to a group, replacing the group key and linking shared assets
+// returns ErrAlreadyMember without changing anything if already joined, or ErrNotGroupMember if not invited
 func (neo *Neo4j) JoinGroup(id string, groupID string, groupKey string) error {
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
         return err
     }
     defer conn.Close()
 
+    // pending invites have an inviter, checked after taking the group lock so concurrent joins only apply once
     stmt, err := conn.PrepareNeo(
         "MATCH (user:User { id: {id} }) - [membership:MEMBER] - (group:Group { uuid: {groupID} }) " +
         "SET group._lock = true " +
-        "SET membership.key = {groupKey} " +
-        "REMOVE membership.inviter " +
-        "WITH user, group " +
-        "MATCH (group) - [groupasset:GROUP_ASSET] - (assets:Asset) " +
-        "WHERE exists(groupasset.sharedKey) " +
-        "MERGE (user) <- [:MEMORY_SHARED] - (assets) ")
+        "WITH user, group, membership, exists(membership.inviter) AS joining " +
+        "FOREACH (_ IN CASE WHEN joining THEN [1] ELSE [] END | " +
+            "SET membership.key = {groupKey} " +
+            "REMOVE membership.inviter) " +
+        "WITH user, group, joining " +
+        "OPTIONAL MATCH (group) - [groupasset:GROUP_ASSET] - (assets:Asset) " +
+        "WHERE joining AND exists(groupasset.sharedKey) " +
+        "FOREACH (_ IN CASE WHEN assets IS NOT NULL THEN [1] ELSE [] END | " +
+            "MERGE (user) <- [:MEMORY_SHARED] - (assets)) " +
+        "RETURN DISTINCT joining ")
     if err != nil {
         return err
     }
     defer stmt.Close() // closing the statment will also close the rows
 
-    // executing a statement just returns summary information
-    result, err := stmt.ExecNeo(map[string] interface{} {
+    rows, err := stmt.QueryNeo(map[string] interface{} {
         "id": id,
         "groupID": groupID,
         "groupKey": groupKey })
     if err != nil {
         return err
     }
-    _, err = result.RowsAffected()
-    return err
+
+    row, _, err := rows.NextNeo()
+    if err == io.EOF {
+        return ErrNotGroupMember
+    } else if err != nil {
+        return err
+    }
+    if joining := row[0].(bool); !joining {
+        return ErrAlreadyMember
+    }
+    return nil
+}
+
+// RotateGroupKey replaces every member's group key, keyed by user uuid, in a single transaction
+// the user must be a member, and keys must be provided for exactly the current members, otherwise *KeyMapMismatchError is returned
+func (neo *Neo4j) RotateGroupKey(id string, groupID string, keys map[string]string) error {
+    conn, err := neo.openConn()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    tx, err := conn.Begin()
+    if err != nil {
+        return err
+    }
+
+    // lock the group so membership can't change between validating the key map and applying it
+    rows, err := conn.QueryNeo(
+        "MATCH (:User { id: {id} }) - [:MEMBER] -> (group:Group { uuid: {groupID} }) " +
+        "SET group._lock = true " +
+        "WITH group " +
+        "MATCH (group) <- [:MEMBER] - (member:User) " +
+        "RETURN member.uuid ", map[string]interface{} {
+        "id": id,
+        "groupID": groupID,
+    })
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    members := make(map[string]bool)
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            rows.Close()
+            tx.Rollback()
+            return err
+        }
+        members[row[0].(string)] = true
+    }
+    rows.Close()
+    if len(members) == 0 {
+        tx.Rollback()
+        return ErrNotGroupMember
+    }
+
+    mismatch := &KeyMapMismatchError{}
+    for member := range members {
+        if _, ok := keys[member]; !ok {
+            mismatch.Missing = append(mismatch.Missing, member)
+        }
+    }
+    for userID := range keys {
+        if !members[userID] {
+            mismatch.Unexpected = append(mismatch.Unexpected, userID)
+        }
+    }
+    if len(mismatch.Missing) != 0 || len(mismatch.Unexpected) != 0 {
+        tx.Rollback()
+        return mismatch
+    }
+
+    // have to use loop as the unofficial neo4j go driver cannot encode lists/maps
+    for userID, key := range keys {
+        _, err := conn.ExecNeo(
+            "MATCH (:Group { uuid: {groupID} }) <- [membership:MEMBER] - (:User { uuid: {userID} }) " +
+            "SET membership.key = {key} ", map[string]interface{} {
+            "groupID": groupID,
+            "userID": userID,
+            "key": key,
+        })
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+
+    return tx.Commit()
 }
 
 func (neo *Neo4j) AddUsersToGroup(id string, groupid string, users []map[string]string) error {
-    conn, err := neo.driverPool.OpenPool()
+    conn, err := neo.openConn()
     if err != nil {
         return err
     }
@@ -1171,52 +3507,258 @@ func (neo *Neo4j) AddUsersToGroup(id string, groupid string, users []map[string]
     return err
 }
 
-func (neo *Neo4j) UserIsMemberOfGroup(groupid string, user *uuid.UUID) (bool, error) {
-    // safety checks
-    if len(groupid) == 0 {
-        errLogger.Panicln("failed safety check")
+// IsGroupMember reports whether the user with the given id is a member of the group, including pending invites
+func (neo *Neo4j) IsGroupMember(id string, groupID string) (bool, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return false, err
     }
+    defer conn.Close()
 
-    conn, err := neo.driverPool.OpenPool()
+    stmt, err := conn.PrepareNeo(
+        "MATCH (:User { id: {id} }) - [membership:MEMBER] -> (:Group { uuid: {groupID} }) " +
+        "RETURN count(membership) ")
+    if err != nil {
+        return false, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "id": id,
+        "groupID": groupID,
+    })
+    if err != nil {
+        return false, err
+    }
+
+    row, _, err := rows.NextNeo()
     if err != nil {
-        errLogger.Panicln(err)
+        return false, err
+    }
+    return row[0].(int64) != 0, nil
+}
+
+// AcquireLock takes or renews the named lock for owner until ttl elapses, returning false if another owner holds an unexpired lock
+func (neo *Neo4j) AcquireLock(name string, owner string, ttl time.Duration) (bool, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return false, err
     }
     defer conn.Close()
 
     stmt, err := conn.PrepareNeo(
-        "MATCH (:User { uuid: {uuid} }) - [r:MEMBER] -> (:Group { uuid: {guuid} })" +
-        "RETURN SIGN(COUNT(r))")
+        "MERGE (lock:Lock { name: {name} }) " +
+        "SET lock._lock = true " +   // take the write lock before checking ownership, so concurrent acquires are serialised
+        "WITH lock " +
+        "WHERE NOT exists(lock.owner) OR lock.owner = {owner} OR lock.expires < timestamp() " +
+        "SET lock.owner = {owner}, lock.expires = timestamp() + {ttl} " +
+        "RETURN lock.owner ")
     if err != nil {
-        errLogger.Panicln(err)
+        return false, err
     }
     defer stmt.Close() // closing the statment will also close the rows
 
-    args := map[string]interface{} {
-        "uuid": user.String(),
-        "guuid": groupid,
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "name": name,
+        "owner": owner,
+        "ttl": int64(ttl / time.Millisecond),
+    })
+    if err != nil {
+        return false, err
     }
 
-    rows, err := stmt.QueryNeo(args)
+    _, _, err = rows.NextNeo()
+    switch err {
+    case nil:
+        return true, nil
+    case io.EOF:
+        return false, nil
+    default:
+        return false, err
+    }
+}
+
+// ReleaseLock releases the named lock if it is held by owner
+func (neo *Neo4j) ReleaseLock(name string, owner string) error {
+    conn, err := neo.openConn()
     if err != nil {
-        errLogger.Panicln(err)
+        return err
     }
+    defer conn.Close()
 
-    // query only returns 1 row, so will return io.EOF as error
-    // second parameter is metadata, which is discarded
-    data, _, err := rows.NextNeo()
-    if err != nil && err != io.EOF {
-        errLogger.Panicln(err)
+    stmt, err := conn.PrepareNeo(
+        "MATCH (lock:Lock { name: {name}, owner: {owner} }) " +
+        "REMOVE lock.owner, lock.expires ")
+    if err != nil {
+        return err
     }
+    defer stmt.Close() // closing the statment will also close the rows
 
-    if len(data) == 0 {
-        return false, io.EOF
+    result, err := stmt.ExecNeo(map[string]interface{} {
+        "name": name,
+        "owner": owner,
+    })
+    if err != nil {
+        return err
     }
 
-    result := data[0].(int64)
+    _, err = result.RowsAffected()
+    return err
+}
 
-    if result == 1 {
-        return true, nil
+// StoredRendition is a rendition as recorded against an asset, used to reconcile recorded sizes with storage
+type StoredRendition struct {
+    AssetID     string
+    AssetType   string
+    Name        string
+    RemotePath  string
+    Size        uint64
+}
+
+// GetRenditionsPage returns the renditions of up to limit assets, ordered by asset uuid and starting after cursor,
+// along with the cursor of the next page, which is empty once every asset has been returned
+func (neo *Neo4j) GetRenditionsPage(cursor string, limit int) ([]StoredRendition, string, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return nil, "", err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (asset:Asset) " +
+        "WHERE asset.uuid > {cursor} " +
+        "WITH asset ORDER BY asset.uuid LIMIT {limit} " +
+        "OPTIONAL MATCH (asset) - [:RENDITION] -> (rendition:Rendition) " +
+        "RETURN asset.uuid, rendition.name, rendition.remotepath, rendition.size, coalesce(asset.type, 'photo') ")
+    if err != nil {
+        return nil, "", err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "cursor": cursor,
+        "limit": limit,
+    })
+    if err != nil {
+        return nil, "", err
+    }
+
+    var renditions []StoredRendition
+    assets := make(map[string]bool)
+    last := ""
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        if err != nil {
+            return nil, "", err
+        }
+        assetID := row[0].(string)
+        assets[assetID] = true
+        if assetID > last {
+            last = assetID
+        }
+        if row[1] == nil {
+            continue    // asset without renditions
+        }
+        renditions = append(renditions, StoredRendition{
+            AssetID: assetID,
+            AssetType: row[4].(string),
+            Name: row[1].(string),
+            RemotePath: row[2].(string),
+            Size: uint64(row[3].(int64)),
+        })
+    }
+
+    next := ""
+    if len(assets) == limit {
+        next = last
+    }
+    return renditions, next, nil
+}
+
+// CorrectRenditionSize replaces the recorded size of an asset's rendition, returning the recalculated asset totalsize
+func (neo *Neo4j) CorrectRenditionSize(assetid string, name string, size uint64) (uint64, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return 0, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "MATCH (asset:Asset { uuid: {assetid} }) - [:RENDITION] -> (rendition:Rendition { name: {name} }) " +
+        "SET rendition.size = {size} " +
+        "WITH asset " +
+        "MATCH (asset) - [:RENDITION] -> (renditions:Rendition) " +
+        "WITH asset, sum(renditions.size) AS totalsize " +
+        "SET asset.totalsize = totalsize " +
+        "RETURN totalsize ")
+    if err != nil {
+        return 0, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "assetid": assetid,
+        "name": name,
+        "size": size,
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    row, _, err := rows.NextNeo()
+    if err == io.EOF {
+        return 0, ErrAssetNotFound
+    } else if err != nil {
+        return 0, err
+    }
+    return uint64(row[0].(int64)), nil
+}
+
+// GlobalStats holds deployment wide totals, used for capacity planning
+type GlobalStats struct {
+    StoredBytes int64
+    Assets      int64
+    Users       int64
+    ActiveUsers int64
+    Groups      int64
+}
+
+// GlobalStats aggregates totals across the whole database, these queries scan every asset so should be run sparingly
+// ActiveUsers counts users whose last recorded activity is at or after activeSince
+func (neo *Neo4j) GlobalStats(activeSince time.Time) (*GlobalStats, error) {
+    conn, err := neo.openConn()
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    stmt, err := conn.PrepareNeo(
+        "OPTIONAL MATCH (asset:Asset) " +
+        "WITH count(asset) AS assets, sum(asset.totalsize) AS storedbytes " +
+        "OPTIONAL MATCH (user:User) " +
+        "WITH assets, storedbytes, count(user) AS users, sum(CASE WHEN user.lastActive >= {activeSince} THEN 1 ELSE 0 END) AS activeusers " +
+        "OPTIONAL MATCH (group:Group) " +
+        "RETURN storedbytes, assets, users, activeusers, count(group) AS groups ")
+    if err != nil {
+        return nil, err
+    }
+    defer stmt.Close() // closing the statment will also close the rows
+
+    rows, err := stmt.QueryNeo(map[string]interface{} {
+        "activeSince": activeSince.UnixNano() / int64(time.Millisecond),
+    })
+    if err != nil {
+        return nil, err
     }
 
-    return false, nil
+    row, _, err := rows.NextNeo()
+    if err != nil {
+        return nil, err
+    }
+    return &GlobalStats{
+        StoredBytes: row[0].(int64),
+        Assets: row[1].(int64),
+        Users: row[2].(int64),
+        ActiveUsers: row[3].(int64),
+        Groups: row[4].(int64),
+    }, nil
 }
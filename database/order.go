@@ -0,0 +1,62 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// AssetOrder sorts asset listings by one of AssetSortFields, the zero value leaves them in the order neo4j returns
+type AssetOrder struct {
+    Field       string
+    Descending  bool
+}
+
+// AssetSortFields maps the sort fields clients may choose to the asset property they sort on
+var AssetSortFields = map[string]string {
+    "createDate": "createdate",
+    "uploadDate": "uploaddate",     // only recorded for assets created since it was introduced
+    "filename": "originalfilename",
+}
+
+// sortAssets orders assets returned by getAssets in place. Listings that include shared assets are a UNION, which neo4j
+// 3.x can't ORDER BY, so sorting is done here for every listing. Assets without the property always sort last
+func sortAssets(assets []interface{}, order AssetOrder) {
+    property, ok := AssetSortFields[order.Field]
+    if !ok {
+        return
+    }
+    value := func(index int) interface{} {
+        asset, _ := assets[index].(map[string]interface{})
+        return asset[property]
+    }
+    sort.SliceStable(assets, func(i, j int) bool {
+        a, b := value(i), value(j)
+        if a == nil || b == nil {
+            return a != nil
+        }
+        if order.Descending {
+            a, b = b, a
+        }
+        return lessAssetProperty(a, b)
+    })
+}
+
+func lessAssetProperty(a interface{}, b interface{}) bool {
+    switch a := a.(type) {
+    case int64:
+        if b, ok := b.(int64); ok {
+            return a < b
+        }
+    case string:
+        if b, ok := b.(string); ok {
+            // create dates are client timestamps that may carry different offsets, so compare them as times when possible
+            timeA, errA := time.Parse(time.RFC3339Nano, a)
+            timeB, errB := time.Parse(time.RFC3339Nano, b)
+            if errA == nil && errB == nil {
+                return timeA.Before(timeB)
+            }
+            return a < b
+        }
+    }
+    return false
+}
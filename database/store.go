@@ -0,0 +1,82 @@
+package database
+
+import (
+	"time"
+
+	"github.com/tripupapp/tripup-server/auth"
+)
+
+// Store is the set of data operations used by the request handlers, *Neo4j is the production implementation
+type Store interface {
+    // users
+    CreateUser(id string, uuid string, authProviders auth.AuthProviders, publickey string, privatekey string, schemaVersion string) error
+    UpdateUserContact(id string, authProviders auth.AuthProviders) error
+    RemoveUserContact(id string, provider string) error
+    GetUser(id string) (*map[string]string, error)
+    GetUserProfile(id string) (map[string]interface{}, error)
+    GetUserAccount(id string) (map[string]interface{}, error)
+    DeleteUser(id string) error
+    TouchUser(id string) error
+    SetUserProfile(id string, nickname string, avatar string) error
+    GetProfilesForUsers(uuids []string) (map[string]map[string]string, error)
+    GetPublicInfoForUsers(uuids []string, numbers []string, emails []string) (map[string]string, map[string]map[string]string, error)
+    VerifyUUIDS(uuids []string) ([]string, error)
+    ValidateIDs(id string, userids []string, assetids []string, groupids []string) (map[string][]string, error)
+
+    // notifications
+    SetNotificationPrefs(id string, disabled []string) error
+    GetNotificationPrefs(uuids []string) (map[string][]string, error)
+    RecordNotificationsSent(notificationIDs []string, signal string) error
+    RecordNotificationReceipt(notificationID string, event string, status string) (bool, error)
+    AddPendingEvent(uuids []string, eventid string, signal string, data string) error
+    GetPendingEvents(id string) ([]PendingEvent, error)
+    AckPendingEvents(id string, eventids []string) error
+
+    // assets
+    CreateAsset(id string, assetid string, assettype string, remotepath string, createdate *string, location *string, duration *string, originalfilename *string, originaluti *string, pixelwidth int, pixelheight int, md5 string, key string, remotepathorig *string, renditions map[string]Rendition) (*uint64, error)
+    AddPathForOriginalAsset(id string, assetid string, remotepathorig string, renditions map[string]Rendition) (uint64, error)
+    SetAssetsOriginalFilenames(id string, data map[string]string) error
+    SetAssetsOriginalFilenamesVersioned(id string, data map[string]OriginalFilenameUpdate) error
+    GetAssetsOriginalFilenames(id string, assetids []string) (map[string]string, error)
+    RemoveOriginalForAsset(id string, assetid string) (string, uint64, error)
+    DeleteAssets(userid string, assetids []string) (*[]string, error)
+    GetOwnedAssetIDs(id string) ([]string, error)
+    GetAssetTypes(id string, assetids []string) (map[string]string, error)
+    SetFavourite(userid string, tripid string, assetid string) error
+    UnsetFavourite(userid string, tripid string, assetid string) error
+    SetAssetArchived(id string, assetid string, archived bool) error
+    GetAssets(id string, includeArchived bool, order AssetOrder) ([]interface{}, error)
+    SetAssetTags(id string, assetid string, tags []string) error
+    GetAssetsByTag(id string, tag string, includeArchived bool, order AssetOrder) ([]interface{}, error)
+    GetAssetsInDateRange(id string, from time.Time, to time.Time, includeArchived bool, order AssetOrder) ([]interface{}, error)
+    GetAssetsByIDs(id string, assetids []string) ([]interface{}, error)
+    GetAssetsSchema0(id string) ([]interface{}, error)
+    UpdateAssetKeys(id string, keys map[string]string) ([]string, error)
+    PatchSchema0(id string, assetkeys map[string]string, assetmd5s map[string]string) error
+
+    // groups
+    GetGroupsFiltered(id string, query string, cursor string, limit int) (map[string]map[string]interface{}, string, error)
+    GetGroupsWithMemberCounts(id string, groupIDs []string) (map[string]int64, error)
+    CreateGroup(id string, groupid string, name string, key string) error
+    JoinGroup(id string, groupID string, groupKey string) error
+    LeaveGroup(ownerid string, groupid string, keepAssets bool) (int64, error)
+    IsGroupMember(id string, groupID string) (bool, error)
+    RotateGroupKey(id string, groupID string, keys map[string]string) error
+    AddUsersToGroup(id string, groupid string, users []map[string]string) error
+    GetUsersInGroup(id string, groupID string) (map[string]string, error)
+    GetUsersInGroupWithStats(id string, groupID string) (map[string]map[string]interface{}, error)
+    GetUsersInGroupPaginated(id string, groupID string, cursor string, limit int) (map[string]string, string, error)
+    StreamOtherGroupMembers(id string, groupID string, batchSize int, fn func(userIDs []string, unreachableIDs []string)) error
+    AddAssetsToGroup(userid string, groupid string, assetids []string) error
+    RemoveAssetsFromGroup(userid string, groupid string, assetids []string) error
+    GetGroupsForSharedAsset(id string, assetid string) (map[string]map[string]interface{}, error)
+    MoveSharedAsset(id string, assetid string, fromgroupid string, togroupid string, assetkey string) error
+    AssetsOwnedBy(id string, assetids []string) ([]string, error)
+    GetSharedAssetKeys(id string, groupid string, assetids []string) (map[string]string, error)
+    ShareAssets(id string, groupid string, assetids []string, assetkeys []string) error
+    UnshareAssets(id string, groupid string, assetids []string) error
+    UnshareAssetFromAllGroups(id string, assetid string) ([]string, error)
+    GetAssetsForAllGroups(userid string) (map[string]map[string][]interface{}, error)
+}
+
+var _ Store = (*Neo4j)(nil)
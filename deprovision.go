@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/tripupapp/tripup-server/database"
+	"github.com/tripupapp/tripup-server/notification"
+)
+
+// assets deleted per database query and storage request when deprovisioning a user
+const deprovisionBatchSize = 500
+
+func apiFirebaseUserDeletedWebhook(response http.ResponseWriter, request *http.Request) {
+    firebaseUserDeletedWebhook(response, request, database.Instance())
+}
+
+// firebaseUserDeletedWebhook deprovisions a user whose firebase account was deleted without going through this server,
+// so their data isn't left behind. Payloads are signed the same way as the OneSignal webhook, with FIREBASE_WEBHOOK_SECRET
+func firebaseUserDeletedWebhook(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    body, ok := readSignedBody(response, request)
+    if !ok {
+        return
+    }
+
+    if !notification.VerifySignature(firebaseWebhookSecret, body, request.Header.Get("X-Signature")) {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Invalid payload signature"))
+        return
+    }
+
+    var event struct {
+        UID string
+    }
+    if err := json.Unmarshal(body, &event); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    if err := validateArgsNotZero([]string{event.UID}); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte(err.Error()))
+        return
+    }
+
+    if err := deprovisionUser(request.Context(), neoDB, event.UID); err != nil {
+        ServerErrorHandler(response, err)
+        return
+    }
+    response.WriteHeader(http.StatusOK)
+}
+
+// deprovisionUser purges the user's assets from storage, removes them from their groups (notifying the other members) and
+// deletes the user. The user node goes last, so a failed run can be retried. Unknown users have nothing to remove
+func deprovisionUser(ctx context.Context, neoDB database.Store, id string) error {
+    if _, err := neoDB.GetUser(id); err == io.EOF {
+        logger.Printf("deprovision: user %s not found, nothing to remove\n", id)
+        return nil
+    } else if err != nil {
+        return err
+    }
+
+    assetIDs, err := neoDB.GetOwnedAssetIDs(id)
+    if err != nil {
+        return err
+    }
+    for start := 0; start < len(assetIDs); start += deprovisionBatchSize {
+        end := start + deprovisionBatchSize
+        if end > len(assetIDs) {
+            end = len(assetIDs)
+        }
+        if _, err := deleteAssets(ctx, assetIDs[start:end], id, neoDB); err != nil {
+            return err
+        }
+    }
+
+    var groupIDs []string
+    for cursor := ""; ; {
+        groups, next, err := neoDB.GetGroupsFiltered(id, "", cursor, maxGroupsPageSize)
+        if err != nil && err != io.EOF {
+            return err
+        }
+        for groupID := range groups {
+            groupIDs = append(groupIDs, groupID)
+        }
+        if len(next) == 0 {
+            break
+        }
+        cursor = next
+    }
+    var batch notificationBatch
+    for _, groupID := range groupIDs {
+        if _, err := neoDB.LeaveGroup(id, groupID, false); err != nil {    // their assets are already deleted
+            batch.send(ctx)     // still tell the groups already left
+            return err
+        }
+        batch.addGroupExcept(neoDB, groupID, id, notification.UserLeftGroup, &map[string]string{"groupid": groupID})
+    }
+    batch.send(ctx)
+
+    if err := neoDB.DeleteUser(id); err != nil {
+        return err
+    }
+    logger.Printf("deprovision: removed user %s, %d assets and %d group memberships\n", id, len(assetIDs), len(groupIDs))
+    return nil
+}
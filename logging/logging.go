@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the minimum severity that is written, lower levels are discarded
+type Level int32
+
+const (
+    Debug Level = iota
+    Info
+    Warn
+    Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+    return levelNames[level]
+}
+
+// ParseLevel converts a LOG_LEVEL value (debug, info, warn or error) to a Level
+func ParseLevel(name string) (Level, error) {
+    for index, levelName := range levelNames {
+        if strings.EqualFold(name, levelName) {
+            return Level(index), nil
+        }
+    }
+    return Info, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+var currentLevel = int32(Info)
+
+// SetLevel changes the minimum level written by every writer created with Writer
+func SetLevel(level Level) {
+    atomic.StoreInt32(&currentLevel, int32(level))
+}
+
+// Enabled reports whether messages at level are currently written, so callers can skip building expensive messages
+func Enabled(level Level) bool {
+    return int32(level) >= atomic.LoadInt32(&currentLevel)
+}
+
+var sampler = &rateSampler{}
+
+// SetSampleRate caps the info lines written per second, lines beyond the cap are dropped and counted
+// zero disables sampling. Warnings and errors are never sampled
+func SetSampleRate(perSecond int) {
+    sampler.mutex.Lock()
+    defer sampler.mutex.Unlock()
+    sampler.limit = perSecond
+}
+
+type rateSampler struct {
+    mutex   sync.Mutex
+    limit   int
+    second  time.Time
+    count   int
+    dropped int
+}
+
+// allow returns whether a line can be written, and how many lines were dropped in the previous second
+func (s *rateSampler) allow() (bool, int) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if s.limit == 0 {
+        return true, 0
+    }
+
+    now := time.Now().Truncate(time.Second)
+    dropped := 0
+    if !now.Equal(s.second) {
+        dropped = s.dropped
+        s.second = now
+        s.count = 0
+        s.dropped = 0
+    }
+    if s.count >= s.limit {
+        s.dropped++
+        return false, dropped
+    }
+    s.count++
+    return true, dropped
+}
+
+type levelWriter struct {
+    level   Level
+    out     io.Writer
+}
+
+// Writer wraps out so that writes are discarded while level is below the configured level
+// use it as the output of a *log.Logger, so existing Print calls are gated without changing them
+func Writer(level Level, out io.Writer) io.Writer {
+    return &levelWriter{level: level, out: out}
+}
+
+func (w *levelWriter) Write(data []byte) (int, error) {
+    if !Enabled(w.level) {
+        return len(data), nil
+    }
+    if w.level == Info {
+        allowed, dropped := sampler.allow()
+        if dropped != 0 {
+            fmt.Fprintf(w.out, "[INFO] sampling dropped %d log lines\n", dropped)
+        }
+        if !allowed {
+            return len(data), nil
+        }
+    }
+    return w.out.Write(data)
+}
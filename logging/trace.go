@@ -0,0 +1,36 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+)
+
+type traceKey struct{}
+
+// Trace identifies the client request that caused an outbound call, so the request and the S3 and OneSignal calls it
+// triggered can be correlated in the log aggregator
+type Trace struct {
+    RequestID   string
+    Traceparent string  // W3C trace context, passed through unchanged
+}
+
+// ContextWithTrace returns a copy of ctx carrying trace
+func ContextWithTrace(ctx context.Context, trace Trace) context.Context {
+    return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// TraceFromContext returns the trace carried by ctx, empty if there is none
+func TraceFromContext(ctx context.Context) Trace {
+    trace, _ := ctx.Value(traceKey{}).(Trace)
+    return trace
+}
+
+// SetHeaders adds the trace to an outbound request's headers
+func (trace Trace) SetHeaders(header http.Header) {
+    if len(trace.RequestID) != 0 {
+        header.Set("X-Request-ID", trace.RequestID)
+    }
+    if len(trace.Traceparent) != 0 {
+        header.Set("traceparent", trace.Traceparent)
+    }
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tripupapp/tripup-server/database"
+	"github.com/tripupapp/tripup-server/notification"
+)
+
+// statsCollector keeps the latest deployment wide totals, refreshed periodically by the scheduler as the aggregation
+// queries are too heavy to run per scrape, and serves them in the Prometheus text exposition format
+type statsCollector struct {
+    mutex       sync.RWMutex
+    stats       *database.GlobalStats
+    refreshedAt time.Time
+    token       string
+    breaker     *notification.Breaker
+    jobs        *scheduler
+}
+
+func (collector *statsCollector) refresh(neoDB *database.Neo4j) func(ctx context.Context) error {
+    return func(ctx context.Context) error {
+        stats, err := neoDB.GlobalStats(time.Now().AddDate(0, 0, -30))
+        if err != nil {
+            return err
+        }
+        collector.mutex.Lock()
+        collector.stats = stats
+        collector.refreshedAt = time.Now()
+        collector.mutex.Unlock()
+        return nil
+    }
+}
+
+// ServeHTTP requires the configured token as a bearer token, as the totals are not meant to be public
+func (collector *statsCollector) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+    expected := "Bearer " + collector.token
+    if subtle.ConstantTimeCompare([]byte(request.Header.Get("Authorization")), []byte(expected)) != 1 {
+        response.WriteHeader(http.StatusUnauthorized)
+        return
+    }
+
+    collector.mutex.RLock()
+    stats := collector.stats
+    refreshedAt := collector.refreshedAt
+    collector.mutex.RUnlock()
+
+    response.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    response.WriteHeader(http.StatusOK)
+    type gauge struct {
+        name    string
+        help    string
+        value   int64
+    }
+    var gauges []gauge
+    if collector.breaker != nil {
+        breaker := collector.breaker.State()
+        open := int64(0)
+        if breaker.Open {
+            open = 1
+        }
+        gauges = append(gauges,
+            gauge{"tripup_notification_breaker_open", "Whether notifications are failing fast after repeated provider failures.", open},
+            gauge{"tripup_notification_consecutive_failures", "Notification provider failures since the last success.", int64(breaker.Failures)},
+            gauge{"tripup_notification_breaker_trips", "Times the notification breaker has opened since startup.", breaker.Trips},
+        )
+    }
+    if stats != nil {   // not collected yet otherwise
+        gauges = append(gauges, []gauge{
+            {"tripup_stored_bytes", "Total bytes stored across all assets.", stats.StoredBytes},
+            {"tripup_assets", "Total number of assets.", stats.Assets},
+            {"tripup_users", "Total number of users.", stats.Users},
+            {"tripup_active_users", "Users active in the last 30 days.", stats.ActiveUsers},
+            {"tripup_groups", "Total number of groups.", stats.Groups},
+            {"tripup_stats_refreshed_timestamp_seconds", "Time the totals were last aggregated.", refreshedAt.Unix()},
+        }...)
+    }
+    for _, gauge := range gauges {
+        fmt.Fprintf(response, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", gauge.name, gauge.help, gauge.name, gauge.name, gauge.value)
+    }
+
+    if collector.jobs != nil {
+        counts := collector.jobs.counts()
+        fmt.Fprintf(response, "# HELP tripup_job_runs_total Maintenance job runs since startup.\n# TYPE tripup_job_runs_total counter\n")
+        for _, job := range counts {
+            fmt.Fprintf(response, "tripup_job_runs_total{job=%q} %d\n", job.name, job.runs)
+        }
+        fmt.Fprintf(response, "# HELP tripup_job_failures_total Maintenance job runs that failed since startup.\n# TYPE tripup_job_failures_total counter\n")
+        for _, job := range counts {
+            fmt.Fprintf(response, "tripup_job_failures_total{job=%q} %d\n", job.name, job.failures)
+        }
+    }
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"time"
+)
+
+// Asset is an asset created by POST /assets or the CREATE list of PATCH /assets
+type Asset struct {
+    AssetID             string              `json:"assetID"`
+    Type                string              `json:"type"`
+    RemotePath          string              `json:"remotePath"`
+    RemotePathOrig      *string             `json:"remotePathOrig"`
+    Renditions          map[string]string   `json:"renditions,omitempty"`  // additional named renditions (e.g. medium) by remote path
+    CreateDate          *string             `json:"createDate"`
+    Location            *string             `json:"location"`  // encrypted by the client with the asset key, opaque to the server so never parsed or validated as coordinates
+    Duration            *string             `json:"duration"`
+    OriginalFilename    *string             `json:"originalFilename"`
+    OriginalUTI         *string             `json:"originalUTI"`
+    PixelWidth          int                 `json:"pixelWidth"`
+    PixelHeight         int                 `json:"pixelHeight"`
+    Md5                 string              `json:"md5"`
+    Key                 string              `json:"key"`
+}
+
+// AssetBatch is the PATCH /assets payload, assets to create and asset IDs to delete
+type AssetBatch struct {
+    CREATE  []Asset     `json:",omitempty"`
+    DELETE  []string    `json:",omitempty"`
+}
+
+// AssetResult is the outcome of a single item in a PATCH /assets?partial=true batch
+type AssetResult struct {
+    Status      string  `json:"status"`               // created, existing, deleted or failed
+    Reason      string  `json:"reason,omitempty"`
+    Totalsize   *uint64 `json:"totalsize,omitempty"`
+}
+
+// CreatedAsset is what the server stored when creating an asset, renditions and applied defaults are only set if the asset
+// was created by the request, an existing asset is left unchanged
+type CreatedAsset struct {
+    AssetID         string              `json:"assetID"`
+    Totalsize       *uint64             `json:"totalsize"`
+    Renditions      map[string]uint64   `json:"renditions,omitempty"`      // counted size of each rendition by name
+    AppliedDefaults map[string]string   `json:"appliedDefaults,omitempty"` // fields the client didn't set, with the value used
+}
+
+// AssetIDs is the POST /assets/get payload
+type AssetIDs struct {
+    AssetIDs []string
+}
+
+// OriginalPath is the PUT /assets/{assetID}/original payload
+type OriginalPath struct {
+    Remotepathorig string
+}
+
+// OriginalFilename is the PUT /assets/{assetID}/originalfilename payload, applied only if newer than the stored one when
+// SetAt is given
+type OriginalFilename struct {
+    Originalfilename    string
+    SetAt               *time.Time  // optional, client time of the update
+}
+
+// VersionedOriginalFilename is a PATCH /assets/originalfilenames value that is only applied if newer than the stored one,
+// values may also be a plain filename string
+type VersionedOriginalFilename struct {
+    Filename    string
+    SetAt       time.Time
+}
+
+// ArchiveState is the PATCH /assets/{assetID}/archive payload
+type ArchiveState struct {
+    Archived    *bool
+}
+
+// AssetTags is the PUT /assets/{assetID}/tags payload, an empty list removes every tag
+type AssetTags struct {
+    Tags    *[]string
+}
+
+// StoragePaths is the POST /assets/storagepaths payload
+type StoragePaths struct {
+    Paths   []string    `json:"paths"`
+}
+
+// SharedAssetMove is the POST /assets/{assetID}/move payload, the asset key encrypted with the destination group key
+type SharedAssetMove struct {
+    FromGroupID string
+    ToGroupID   string
+    AssetKey    string
+}
+
+// Favourite is the SetFavourite payload
+type Favourite struct {
+    TripID string
+    ImageID string
+    Favourite bool
+}
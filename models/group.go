@@ -0,0 +1,32 @@
+package models
+
+// NewGroup is the POST /groups payload, name and key are encrypted by the client
+type NewGroup struct {
+    Name    string  `json:"name"`
+    Key     string  `json:"key"`
+}
+
+// GroupMembership is the PUT /groups/{groupID} payload, the caller's group key encrypted with their public key
+type GroupMembership struct {
+    Key     string  `json:"key"`
+}
+
+// GroupInvites is the PATCH and POST /groups/{groupID}/users/preview payload, each user has a "uuid" and the group "key"
+// encrypted for them
+type GroupInvites struct {
+    Users   []map[string]string `json:"users"`
+}
+
+// GroupAssetsAmendment is the PATCH /groups/{groupID}/album payload, assets are added to the group or removed from it
+type GroupAssetsAmendment struct {
+    Add         bool
+    AssetIDs    []string
+}
+
+// SharedAssetsAmendment is the PATCH /groups/{groupID}/album/shared payload, asset keys are encrypted with the group key
+// and only needed when sharing
+type SharedAssetsAmendment struct {
+    AssetKeys []string  `json:",omitempty"`
+    AssetIDs []string
+    Share bool
+}
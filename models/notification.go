@@ -0,0 +1,7 @@
+package models
+
+// OneSignalEvent is the part of a OneSignal webhook payload the server reads
+type OneSignalEvent struct {
+    Event           string
+    NotificationID  string  `json:"notificationId"`
+}
@@ -0,0 +1,44 @@
+package models
+
+// NewUser is the POST /users payload, the keys are the user's PGP key pair with the private key encrypted by the client
+type NewUser struct {
+    Publickey   string  `json:"publickey"`
+    Privatekey  string  `json:"privatekey"`
+}
+
+// UserProfile is the PUT /users/self/profile payload, the nickname is encrypted by the client and the avatar is an asset ID
+type UserProfile struct {
+    Nickname    string
+    Avatar      string
+}
+
+// ContactLookup is the POST /users/public payload, numbers and emails are hashed by the client
+type ContactLookup struct {
+    Uuids   []string
+    Numbers []string
+    Emails  []string
+}
+
+// ContactQuery is the POST /users/public/exists payload, exactly one of number or email is set
+type ContactQuery struct {
+    Number  string  `json:"number"`
+    Email   string  `json:"email"`
+}
+
+// Schema0Patch is the PATCH /schema/0 payload, the re-encrypted asset keys and the md5s of their originals by asset ID
+type Schema0Patch struct {
+    AssetKeys map[string]string   `json:",omitempty"`
+    AssetMD5s map[string]string   `json:",omitempty"`
+}
+
+// IDList is the POST /info/validids payload
+type IDList struct {
+    ArrayOfIDs []string
+}
+
+// IDValidation is the POST /info/validate payload, at least one list must be non-empty
+type IDValidation struct {
+    UserIDs     []string
+    AssetIDs    []string
+    GroupIDs    []string
+}
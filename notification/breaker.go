@@ -0,0 +1,94 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of calling the provider while the breaker is open
+var ErrCircuitOpen = errors.New("notification provider circuit is open")
+
+// Breaker wraps a NotificationService, after threshold consecutive failures it fails fast with ErrCircuitOpen for the
+// cooldown rather than waiting on a provider that is down. Once the cooldown passes calls are let through again, a
+// further failure reopens the circuit straight away and a success closes it
+type Breaker struct {
+    service     NotificationService
+    threshold   int
+    cooldown    time.Duration
+    mutex       sync.Mutex
+    failures    int
+    openUntil   time.Time
+    trips       int64
+}
+
+// BreakerState is a snapshot of the breaker, for metrics
+type BreakerState struct {
+    Open        bool
+    Failures    int     // consecutive
+    Trips       int64   // times the circuit has opened since startup
+}
+
+// NewBreaker creates a breaker around service, a zero threshold disables it
+func NewBreaker(service NotificationService, threshold int, cooldown time.Duration) *Breaker {
+    return &Breaker{service: service, threshold: threshold, cooldown: cooldown}
+}
+
+func (breaker *Breaker) Notify(ctx context.Context, userIDs []string, notification Notification, additionalData *map[string]string) (*Result, error) {
+    if breaker.isOpen() {
+        return nil, ErrCircuitOpen
+    }
+    result, err := breaker.service.Notify(ctx, userIDs, notification, additionalData)
+    breaker.record(err)
+    return result, err
+}
+
+// NotifyMany sends each distinct notification in requests, returning the combined result of those accepted and the
+// first error after attempting them all
+func (breaker *Breaker) NotifyMany(ctx context.Context, requests []NotificationRequest) (*Result, error) {
+    result := &Result{}
+    var firstErr error
+    for _, request := range Merge(requests) {
+        sent, err := breaker.Notify(ctx, request.UserIDs, request.Notification, request.AdditionalData)
+        if err != nil && firstErr == nil {
+            firstErr = err
+        }
+        result.add(sent)
+    }
+    return result, firstErr
+}
+
+// State returns the current state of the breaker
+func (breaker *Breaker) State() BreakerState {
+    breaker.mutex.Lock()
+    defer breaker.mutex.Unlock()
+    return BreakerState{
+        Open: time.Now().Before(breaker.openUntil),
+        Failures: breaker.failures,
+        Trips: breaker.trips,
+    }
+}
+
+func (breaker *Breaker) isOpen() bool {
+    breaker.mutex.Lock()
+    defer breaker.mutex.Unlock()
+    return time.Now().Before(breaker.openUntil)
+}
+
+func (breaker *Breaker) record(err error) {
+    breaker.mutex.Lock()
+    defer breaker.mutex.Unlock()
+    if err == nil {
+        breaker.failures = 0
+        return
+    }
+    breaker.failures++
+    if breaker.threshold > 0 && breaker.failures >= breaker.threshold {
+        if breaker.failures == breaker.threshold {
+            errLogger.Printf("%d consecutive notification failures, failing fast for %v\n", breaker.failures, breaker.cooldown)
+        }
+        breaker.openUntil = time.Now().Add(breaker.cooldown)
+        breaker.trips++
+    }
+}
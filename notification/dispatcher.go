@@ -0,0 +1,197 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tripupapp/tripup-server/logging"
+)
+
+var warnLogger = log.New(logging.Writer(logging.Warn, os.Stderr), "[WARN] NotificationLog: ", log.LstdFlags)
+var errLogger = log.New(logging.Writer(logging.Error, os.Stderr), "[ERROR] NotificationLog: ", log.LstdFlags | log.Lshortfile)
+
+// ErrDispatcherClosed is returned when a notification is sent after the dispatcher has been shut down
+var ErrDispatcherClosed = errors.New("notification dispatcher is shut down")
+
+// coalescedNotification collects the recipients of a notification type for a group until its window elapses
+type coalescedNotification struct {
+    notification    Notification
+    additionalData  *map[string]string
+    trace           logging.Trace   // of the request that started the window
+    recipients      map[string]bool
+    timer           *time.Timer
+}
+
+// FailureHandler is called with the recipients of a notification the service failed to deliver
+type FailureHandler func(userIDs []string, notification Notification, additionalData *map[string]string)
+
+// InvalidRecipientHandler is called with the recipients a provider reported as undeliverable, e.g. users with no devices
+type InvalidRecipientHandler func(userIDs []string)
+
+// SentHandler is called with the IDs the provider assigned a notification it accepted
+type SentHandler func(notificationIDs []string, notification Notification)
+
+// Dispatcher sends notifications asynchronously via the wrapped service, so callers aren't held up by the provider
+// notification types that coalesce are held per group for the window, so rapid successive changes produce a single push
+type Dispatcher struct {
+    service     NotificationService
+    window      time.Duration
+    mutex       sync.Mutex
+    pending     sync.WaitGroup
+    coalescing  map[string]*coalescedNotification
+    closed      bool
+    onFailure   FailureHandler
+    onInvalid   InvalidRecipientHandler
+    onSent      SentHandler
+}
+
+// NewDispatcher creates a dispatcher, a zero window disables coalescing
+func NewDispatcher(service NotificationService, window time.Duration) *Dispatcher {
+    return &Dispatcher{service: service, window: window, coalescing: make(map[string]*coalescedNotification)}
+}
+
+// SetFailureHandler registers handler to be called whenever a notification can't be delivered, replacing any previous handler
+func (dispatcher *Dispatcher) SetFailureHandler(handler FailureHandler) {
+    dispatcher.mutex.Lock()
+    defer dispatcher.mutex.Unlock()
+    dispatcher.onFailure = handler
+}
+
+// SetInvalidRecipientHandler registers handler to be called with recipients the provider couldn't deliver to, replacing
+// any previous handler. Without one they are only logged
+func (dispatcher *Dispatcher) SetInvalidRecipientHandler(handler InvalidRecipientHandler) {
+    dispatcher.mutex.Lock()
+    defer dispatcher.mutex.Unlock()
+    dispatcher.onInvalid = handler
+}
+
+// SetSentHandler registers handler to be called whenever the provider accepts a notification, replacing any previous handler
+func (dispatcher *Dispatcher) SetSentHandler(handler SentHandler) {
+    dispatcher.mutex.Lock()
+    defer dispatcher.mutex.Unlock()
+    dispatcher.onSent = handler
+}
+
+// Notify queues the notification for delivery, errors from the provider are logged rather than returned
+// only the trace is kept from ctx, as delivery outlives the request that triggered it. The result is always empty, as the
+// provider hasn't been called yet, undeliverable recipients are passed to the InvalidRecipientHandler once it has
+func (dispatcher *Dispatcher) Notify(ctx context.Context, userIDs []string, notification Notification, additionalData *map[string]string) (*Result, error) {
+    trace := logging.TraceFromContext(ctx)
+
+    dispatcher.mutex.Lock()
+    defer dispatcher.mutex.Unlock()
+    if dispatcher.closed {
+        return nil, ErrDispatcherClosed
+    }
+
+    if dispatcher.window > 0 && notification.coalesce && additionalData != nil && len((*additionalData)["groupid"]) != 0 {
+        key := notification.signal + "/" + (*additionalData)["groupid"]
+        entry, exists := dispatcher.coalescing[key]
+        if !exists {
+            // the window starts with the first notification rather than being extended by later ones,
+            // so busy groups still receive a notification every window
+            entry = &coalescedNotification{notification: notification, additionalData: additionalData, trace: trace, recipients: make(map[string]bool)}
+            entry.timer = time.AfterFunc(dispatcher.window, func() {
+                dispatcher.flush(key)
+            })
+            dispatcher.coalescing[key] = entry
+        }
+        for _, userID := range userIDs {
+            entry.recipients[userID] = true
+        }
+        return &Result{}, nil
+    }
+
+    dispatcher.send(trace, userIDs, notification, additionalData)
+    return &Result{}, nil
+}
+
+// NotifyMany queues requests for delivery as Notify does, after merging those with the same content so fewer provider
+// calls are made. Coalescing notifications are still combined per group
+func (dispatcher *Dispatcher) NotifyMany(ctx context.Context, requests []NotificationRequest) (*Result, error) {
+    for _, request := range Merge(requests) {
+        if _, err := dispatcher.Notify(ctx, request.UserIDs, request.Notification, request.AdditionalData); err != nil {
+            return nil, err
+        }
+    }
+    return &Result{}, nil
+}
+
+// flush sends the coalesced notification for key, if it hasn't already been sent by Shutdown
+func (dispatcher *Dispatcher) flush(key string) {
+    dispatcher.mutex.Lock()
+    defer dispatcher.mutex.Unlock()
+    if entry, exists := dispatcher.coalescing[key]; exists {
+        delete(dispatcher.coalescing, key)
+        dispatcher.sendCoalesced(entry)
+    }
+}
+
+func (dispatcher *Dispatcher) sendCoalesced(entry *coalescedNotification) {
+    var userIDs []string
+    for userID := range entry.recipients {
+        userIDs = append(userIDs, userID)
+    }
+    dispatcher.send(entry.trace, userIDs, entry.notification, entry.additionalData)
+}
+
+// send must be called with the mutex held, so it can't race with Shutdown waiting on pending
+func (dispatcher *Dispatcher) send(trace logging.Trace, userIDs []string, notification Notification, additionalData *map[string]string) {
+    onFailure := dispatcher.onFailure
+    onInvalid := dispatcher.onInvalid
+    onSent := dispatcher.onSent
+    dispatcher.pending.Add(1)
+    go func() {
+        defer dispatcher.pending.Done()
+        ctx := logging.ContextWithTrace(context.Background(), trace)
+        result, err := dispatcher.service.Notify(ctx, userIDs, notification, additionalData)
+        if err != nil {
+            errLogger.Printf("unable to send %s notification: %v\n", notification.signal, err)
+            if onFailure != nil {
+                onFailure(userIDs, notification, additionalData)
+            }
+            return
+        }
+        if len(result.IDs) != 0 && onSent != nil {
+            onSent(result.IDs, notification)
+        }
+        if len(result.Errors) != 0 {
+            warnLogger.Printf("%s notification partly failed: %v\n", notification.signal, result.Errors)
+        }
+        if len(result.InvalidIDs) != 0 {
+            warnLogger.Printf("%s notification undeliverable to %d recipients\n", notification.signal, len(result.InvalidIDs))
+            if onInvalid != nil {
+                onInvalid(result.InvalidIDs)
+            }
+        }
+    }()
+}
+
+// Shutdown stops accepting new notifications, sends any being coalesced, and waits for pending ones to be sent, or for ctx to expire
+func (dispatcher *Dispatcher) Shutdown(ctx context.Context) error {
+    dispatcher.mutex.Lock()
+    dispatcher.closed = true
+    for key, entry := range dispatcher.coalescing {
+        entry.timer.Stop()
+        delete(dispatcher.coalescing, key)
+        dispatcher.sendCoalesced(entry)
+    }
+    dispatcher.mutex.Unlock()
+
+    drained := make(chan struct{})
+    go func() {
+        dispatcher.pending.Wait()
+        close(drained)
+    }()
+
+    select {
+    case <-drained:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
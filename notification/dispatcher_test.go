@@ -0,0 +1,83 @@
+package notification
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var _ NotificationService = NoOp{}
+
+func TestNoOpSwallowsNotifications(t *testing.T) {
+    data := &map[string]string{"groupid": "group"}
+
+    result, err := NoOp{}.Notify(context.Background(), []string{"user"}, GroupInvite, data)
+    if err != nil || result == nil {
+        t.Errorf("Notify got %v, %v, want an empty result", result, err)
+    }
+    result, err = NoOp{}.NotifyMany(context.Background(), []NotificationRequest{{UserIDs: []string{"user"}, Notification: AssetsChangedForGroup, AdditionalData: data}})
+    if err != nil || result == nil {
+        t.Errorf("NotifyMany got %v, %v, want an empty result", result, err)
+    }
+}
+
+func TestDispatcherWithNoOp(t *testing.T) {
+    for _, window := range []time.Duration{0, time.Hour} {
+        dispatcher := NewDispatcher(NoOp{}, window)
+        failed := false
+        dispatcher.SetFailureHandler(func(userIDs []string, notification Notification, additionalData *map[string]string) {
+            failed = true
+        })
+        dispatcher.SetInvalidRecipientHandler(func(userIDs []string) {
+            failed = true
+        })
+
+        data := &map[string]string{"groupid": "group"}
+        if _, err := dispatcher.Notify(context.Background(), []string{"user"}, AssetsChangedForGroup, data); err != nil {
+            t.Errorf("window %s: Notify got %v", window, err)
+        }
+        if _, err := dispatcher.NotifyMany(context.Background(), []NotificationRequest{{UserIDs: []string{"user"}, Notification: GroupInvite}}); err != nil {
+            t.Errorf("window %s: NotifyMany got %v", window, err)
+        }
+        // coalesced notifications are sent on shutdown
+        if err := dispatcher.Shutdown(context.Background()); err != nil {
+            t.Errorf("window %s: Shutdown got %v", window, err)
+        }
+        if failed {
+            t.Errorf("window %s: notification reported as failed", window)
+        }
+    }
+}
+
+// acceptingService is a NotificationService that accepts every notification under the given provider ID
+type acceptingService struct {
+    id  string
+}
+
+func (service acceptingService) Notify(ctx context.Context, userIDs []string, notification Notification, additionalData *map[string]string) (*Result, error) {
+    return &Result{IDs: []string{service.id}, Recipients: len(userIDs)}, nil
+}
+
+func (service acceptingService) NotifyMany(ctx context.Context, requests []NotificationRequest) (*Result, error) {
+    return &Result{IDs: []string{service.id}}, nil
+}
+
+func TestDispatcherReportsSentIDs(t *testing.T) {
+    dispatcher := NewDispatcher(acceptingService{id: "provider-id"}, 0)
+    var sent []string
+    var signal string
+    dispatcher.SetSentHandler(func(notificationIDs []string, notification Notification) {
+        sent = notificationIDs
+        signal = notification.Signal()
+    })
+
+    if _, err := dispatcher.Notify(context.Background(), []string{"user"}, GroupInvite, nil); err != nil {
+        t.Fatal(err)
+    }
+    if err := dispatcher.Shutdown(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if len(sent) != 1 || sent[0] != "provider-id" || signal != GroupInvite.Signal() {
+        t.Errorf("got %v sent for %q, want [provider-id] for %q", sent, signal, GroupInvite.Signal())
+    }
+}
@@ -0,0 +1,17 @@
+package notification
+
+import (
+	"context"
+)
+
+// NoOp is the NotificationService used when no provider is configured, every notification is dropped as if it were sent
+// so handlers don't need to know whether push is available
+type NoOp struct{}
+
+func (NoOp) Notify(ctx context.Context, userIDs []string, notification Notification, additionalData *map[string]string) (*Result, error) {
+    return &Result{}, nil
+}
+
+func (NoOp) NotifyMany(ctx context.Context, requests []NotificationRequest) (*Result, error) {
+    return &Result{}, nil
+}
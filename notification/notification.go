@@ -1,12 +1,100 @@
 package notification
 
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// Notification describes a notification type, silent notifications are delivered as data-only pushes
+// and coalescing notifications are combined per group by the Dispatcher
 type Notification struct {
-    signal  string
-    silent  bool
+    signal      string
+    silent      bool
+    coalesce    bool
+}
+
+// Signal returns the identifier the client uses to distinguish notification types
+func (notification Notification) Signal() string {
+    return notification.signal
 }
 
 type NotificationService interface {
-    Notify([]string, Notification, *map[string]string) (error)
+    Notify(context.Context, []string, Notification, *map[string]string) (*Result, error)
+    NotifyMany(context.Context, []NotificationRequest) (*Result, error)
+}
+
+// Result is the provider's report of a notification it accepted. Providers can accept a request but fail to deliver
+// to some recipients, those are listed in InvalidIDs so they can be pruned, and any other problems in Errors
+type Result struct {
+    IDs         []string    // provider notification IDs, one per provider call
+    Recipients  int
+    InvalidIDs  []string
+    Errors      []string
+}
+
+// add combines other into result, for notifications sent with several provider calls
+func (result *Result) add(other *Result) {
+    if other == nil {
+        return
+    }
+    result.IDs = append(result.IDs, other.IDs...)
+    result.Recipients += other.Recipients
+    result.InvalidIDs = append(result.InvalidIDs, other.InvalidIDs...)
+    result.Errors = append(result.Errors, other.Errors...)
+}
+
+// NotificationRequest is one notification for a set of users, used to send several at once with NotifyMany
+type NotificationRequest struct {
+    UserIDs         []string
+    Notification    Notification
+    AdditionalData  *map[string]string
+}
+
+// Merge combines requests for the same notification with the same data into one, so each can be sent with a single
+// provider call. Requests that differ in data (e.g. the groupid of a multi-group change) can't share a call and are kept
+// apart. Recipients are deduplicated and the order of first appearance is kept
+func Merge(requests []NotificationRequest) []NotificationRequest {
+    var merged []NotificationRequest
+    index := map[string]int{}
+    recipients := map[string]map[string]bool{}
+    for _, request := range requests {
+        key := request.key()
+        position, exists := index[key]
+        if !exists {
+            position = len(merged)
+            index[key] = position
+            recipients[key] = map[string]bool{}
+            merged = append(merged, NotificationRequest{Notification: request.Notification, AdditionalData: request.AdditionalData})
+        }
+        for _, userID := range request.UserIDs {
+            if !recipients[key][userID] {
+                recipients[key][userID] = true
+                merged[position].UserIDs = append(merged[position].UserIDs, userID)
+            }
+        }
+    }
+    return merged
+}
+
+// key identifies the content of the request, requests with the same key deliver the same push
+func (request NotificationRequest) key() string {
+    var builder strings.Builder
+    builder.WriteString(request.Notification.signal)
+    if request.Notification.silent {
+        builder.WriteString("/silent")
+    }
+    if request.AdditionalData != nil {
+        var names []string
+        for name := range *request.AdditionalData {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            builder.WriteString("\x00" + name + "=" + (*request.AdditionalData)[name])
+        }
+    }
+    return builder.String()
 }
 
 var (
@@ -22,12 +110,31 @@ var (
         signal: "userLeftGroup",
         silent: true,
     }
+    GroupKeyRotated Notification = Notification{
+        signal: "groupKeyRotated",
+        silent: true,
+    }
     AssetsChangedForGroup Notification = Notification{
         signal: "assetsChangedForGroup",
         silent: true,
+        coalesce: true,
     }
     AssetsAddedToGroupByUser Notification = Notification{
         signal: "assetsAddedToGroupByUser",
         silent: false,
+        coalesce: true,
     }
 )
+
+// Types contains every notification type that can be delivered to users
+var Types = []Notification{GroupInvite, UserJoinedGroup, UserLeftGroup, GroupKeyRotated, AssetsChangedForGroup, AssetsAddedToGroupByUser}
+
+// IsValidSignal reports whether signal identifies a known notification type
+func IsValidSignal(signal string) bool {
+    for _, notification := range Types {
+        if notification.signal == signal {
+            return true
+        }
+    }
+    return false
+}
@@ -2,18 +2,28 @@ package notification
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"time"
+
+	"github.com/tripupapp/tripup-server/logging"
 )
 
 type OneSignal struct {
     AppID 	string
     APIKey 	string
+    Timeout time.Duration   // per request, zero waits indefinitely
 }
 
-func (onesignal OneSignal) Notify(userIDs []string, notification Notification, additionalData *map[string]string) (error) {
+// Notify sends the notification with one OneSignal call. OneSignal reports recipients it couldn't deliver to in the body of
+// a 200 response, so they're returned in the result rather than as an error
+func (onesignal OneSignal) Notify(ctx context.Context, userIDs []string, notification Notification, additionalData *map[string]string) (*Result, error) {
     data := map[string]string{"signal": notification.signal}
     if additionalData != nil {
         for key, value := range *additionalData {
@@ -21,42 +31,108 @@ func (onesignal OneSignal) Notify(userIDs []string, notification Notification, a
         }
     }
 
-    var contents map[string]interface{}
-    if !notification.silent {
-        contents = make(map[string]interface{})
-        contents["en"] = notification.signal
-    }
-
-    notificationPayload, err := json.Marshal(map[string]interface{} {
+    payload := map[string]interface{} {
         "app_id": onesignal.AppID,
         "include_external_user_ids": userIDs,
         "data": data,
-        "contents": contents,
-        "content_available": true,
-    })
+        "content_available": true,  // wake the app so it can sync in the background
+    }
+    // silent notifications are data-only, so no alert is shown in the notification tray
+    if !notification.silent {
+        payload["contents"] = map[string]string{"en": notification.signal}
+        payload["mutable_content"] = true
+    }
+
+    notificationPayload, err := json.Marshal(payload)
     if err != nil {
-        return err
+        return nil, err
     }
 
-    notificationRequest, err := http.NewRequest("POST", "https://onesignal.com/api/v1/notifications", bytes.NewBuffer(notificationPayload))
+    notificationRequest, err := http.NewRequestWithContext(ctx, "POST", "https://onesignal.com/api/v1/notifications", bytes.NewBuffer(notificationPayload))
     if err != nil {
-        return err
+        return nil, err
     }
     notificationRequest.Header.Set("Content-Type", "application/json; charset=utf-8")
     notificationRequest.Header.Set("Authorization", "Basic " + onesignal.APIKey)
+    logging.TraceFromContext(ctx).SetHeaders(notificationRequest.Header)
 
-    httpClient := &http.Client{}
+    httpClient := &http.Client{Timeout: onesignal.Timeout}
     notificationResponse, err := httpClient.Do(notificationRequest)
     if err != nil {
-        return err
+        return nil, err
     }
     defer notificationResponse.Body.Close()
+    body, err := ioutil.ReadAll(notificationResponse.Body)
+    if err != nil {
+        return nil, err
+    }
     if notificationResponse.StatusCode != http.StatusOK {
-        body, err := ioutil.ReadAll(notificationResponse.Body)
-        if err != nil {
-            return err
+        return nil, errors.New(string(body))
+    }
+    return parseOneSignalResponse(body)
+}
+
+// parseOneSignalResponse reads the result of a create notification call, "errors" is either a list of messages or an
+// object listing the recipients that couldn't be delivered to
+func parseOneSignalResponse(body []byte) (*Result, error) {
+    var response struct {
+        ID          string          `json:"id"`
+        Recipients  int             `json:"recipients"`
+        Errors      json.RawMessage `json:"errors"`
+    }
+    if err := json.Unmarshal(body, &response); err != nil {
+        return nil, err
+    }
+
+    result := &Result{Recipients: response.Recipients}
+    if len(response.ID) != 0 {
+        result.IDs = []string{response.ID}
+    }
+    if len(response.Errors) == 0 || string(response.Errors) == "null" {
+        return result, nil
+    }
+    var messages []string
+    if err := json.Unmarshal(response.Errors, &messages); err == nil {
+        result.Errors = messages
+        return result, nil
+    }
+    var invalid struct {
+        InvalidExternalUserIDs  []string    `json:"invalid_external_user_ids"`
+        InvalidPlayerIDs        []string    `json:"invalid_player_ids"`
+    }
+    if err := json.Unmarshal(response.Errors, &invalid); err != nil {
+        result.Errors = []string{string(response.Errors)}
+        return result, nil
+    }
+    result.InvalidIDs = append(invalid.InvalidExternalUserIDs, invalid.InvalidPlayerIDs...)
+    return result, nil
+}
+
+// NotifyMany sends each distinct notification in requests with one OneSignal call, returning the combined result of
+// those accepted and the first error after attempting them all
+func (onesignal OneSignal) NotifyMany(ctx context.Context, requests []NotificationRequest) (*Result, error) {
+    result := &Result{}
+    var firstErr error
+    for _, request := range Merge(requests) {
+        sent, err := onesignal.Notify(ctx, request.UserIDs, request.Notification, request.AdditionalData)
+        if err != nil && firstErr == nil {
+            firstErr = err
         }
-        return errors.New(string(body))
+        result.add(sent)
+    }
+    return result, firstErr
+}
+
+// VerifySignature checks that signature is the hex encoded HMAC-SHA256 of payload, keyed with the shared webhook secret
+func VerifySignature(secret string, payload []byte, signature string) bool {
+    if len(secret) == 0 || len(signature) == 0 {
+        return false
+    }
+    expected, err := hex.DecodeString(signature)
+    if err != nil {
+        return false
     }
-    return nil
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(payload)
+    return hmac.Equal(mac.Sum(nil), expected)
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pressly/chi"
+
+	"github.com/tripupapp/tripup-server/models"
+)
+
+// apiOperation documents a route, keyed by "METHOD /path" in apiOperations. Request and Response name a schema in
+// apiSchemas, left empty when the body isn't one of the models
+type apiOperation struct {
+    Summary         string
+    Request         string
+    Response        string
+    ResponseType    string  // media type of Response, defaults to application/json
+    Statuses        []int   // besides 200, 401 and 500 which apply to every protected route
+}
+
+// apiSchemas are the models published as OpenAPI component schemas
+var apiSchemas = map[string]interface{}{
+    "Asset": models.Asset{},
+    "AssetBatch": models.AssetBatch{},
+    "AssetResult": models.AssetResult{},
+    "CreatedAsset": models.CreatedAsset{},
+    "NewGroup": models.NewGroup{},
+    "GroupMembership": models.GroupMembership{},
+    "GroupInvites": models.GroupInvites{},
+    "NewUser": models.NewUser{},
+    "UserProfile": models.UserProfile{},
+    "ContactLookup": models.ContactLookup{},
+    "ContactQuery": models.ContactQuery{},
+    "Schema0Patch": models.Schema0Patch{},
+    "IDList": models.IDList{},
+    "IDValidation": models.IDValidation{},
+    "OneSignalEvent": models.OneSignalEvent{},
+    "AssetIDs": models.AssetIDs{},
+    "OriginalPath": models.OriginalPath{},
+    "OriginalFilename": models.OriginalFilename{},
+    "ArchiveState": models.ArchiveState{},
+    "AssetTags": models.AssetTags{},
+    "StoragePaths": models.StoragePaths{},
+    "SharedAssetMove": models.SharedAssetMove{},
+    "GroupAssetsAmendment": models.GroupAssetsAmendment{},
+    "SharedAssetsAmendment": models.SharedAssetsAmendment{},
+}
+
+// apiOperations describes each route registered in startServer, see the API endpoints section of the README for details.
+// Routes missing from here are still published, with a warning logged when the document is built
+var apiOperations = map[string]apiOperation{
+    "GET /ping": {Summary: "ping tripup server"},
+    "GET /time": {Summary: "get server UTC time"},
+    "GET /capabilities": {Summary: "get server version, supported schema versions, features and limits"},
+    "GET /openapi.json": {Summary: "get this document"},
+
+    "POST /users": {Summary: "create user", Request: "NewUser", Statuses: []int{http.StatusCreated, http.StatusBadRequest}},
+    "GET /users/self": {Summary: "get caller UUID", Statuses: []int{http.StatusNotFound}},
+    "POST /users/public": {Summary: "get a user from contact info", Request: "ContactLookup", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusTooManyRequests}},
+    "POST /users/public/exists": {Summary: "check whether a phone number or email belongs to a user, without saying who", Request: "ContactQuery", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusTooManyRequests}},
+    "GET /users/self/profile": {Summary: "get caller profile and linked auth providers", Statuses: []int{http.StatusForbidden}},
+    "PUT /users/self/profile": {Summary: "update caller display fields", Request: "UserProfile", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+    "PUT /users/self/contact": {Summary: "update caller contact info", Statuses: []int{http.StatusBadRequest, http.StatusForbidden}},
+    "DELETE /users/self/contact/{provider}": {Summary: "remove caller contact info for provider", Statuses: []int{http.StatusBadRequest, http.StatusForbidden}},
+    "PUT /users/self/notification-prefs": {Summary: "enable/disable notification types for caller", Statuses: []int{http.StatusBadRequest, http.StatusForbidden}},
+    "POST /users/self/export": {Summary: "export all data held about the caller", Statuses: []int{http.StatusForbidden}},
+    "GET /users/self/pending-events": {Summary: "notifications that failed to push to caller", Statuses: []int{http.StatusNoContent, http.StatusForbidden}},
+    "POST /users/self/pending-events/ack": {Summary: "acknowledge pending events", Statuses: []int{http.StatusBadRequest, http.StatusForbidden}},
+    "GET /users/{userID}": {Summary: "get a user from userID", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+
+    "GET /assets": {Summary: "get callers assets", Statuses: []int{http.StatusNoContent, http.StatusBadRequest, http.StatusForbidden}},
+    "POST /assets": {Summary: "create asset for caller", Request: "Asset", Response: "CreatedAsset", ResponseType: createdAssetMediaType, Statuses: []int{http.StatusCreated, http.StatusBadRequest, http.StatusForbidden}},
+    "PATCH /assets": {Summary: "modify callers assets", Request: "AssetBatch", Statuses: []int{http.StatusMultiStatus, http.StatusBadRequest, http.StatusForbidden}},
+    "PATCH /assets/original": {Summary: "modify callers assets original path", Statuses: []int{http.StatusMultiStatus, http.StatusBadRequest, http.StatusForbidden}},
+    "PATCH /assets/keys": {Summary: "rotate keys for callers own assets", Statuses: []int{http.StatusBadRequest, http.StatusForbidden}},
+    "PATCH /assets/originalfilenames": {Summary: "set original filenames for callers assets", Statuses: []int{http.StatusBadRequest, http.StatusForbidden}},
+    "POST /assets/originalfilenames/get": {Summary: "get original filenames for the given asset ids owned by caller", Statuses: []int{http.StatusBadRequest, http.StatusForbidden}},
+    "POST /assets/storagepaths": {Summary: "map asset paths to where storage keeps them", Request: "StoragePaths", Statuses: []int{http.StatusBadRequest, http.StatusForbidden}},
+    "POST /assets/get": {Summary: "get the assets with the given IDs that the caller can access", Request: "AssetIDs", Statuses: []int{http.StatusBadRequest, http.StatusForbidden}},
+    "PUT /assets/{assetID}/original": {Summary: "replace original path for asset", Request: "OriginalPath", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+    "DELETE /assets/{assetID}/original": {Summary: "delete the original of callers asset, keeping the low rendition", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+    "PUT /assets/{assetID}/originalfilename": {Summary: "set original filename for callers asset", Request: "OriginalFilename", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+    "PATCH /assets/{assetID}/archive": {Summary: "archive or unarchive callers asset", Request: "ArchiveState", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+    "PUT /assets/{assetID}/tags": {Summary: "replace callers tags on their asset", Request: "AssetTags", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+    "GET /assets/{assetID}/groups": {Summary: "get groups the callers asset is in", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+    "POST /assets/{assetID}/move": {Summary: "atomically move callers shared asset between groups", Request: "SharedAssetMove", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict}},
+    "POST /assets/{assetID}/unshare-all": {Summary: "unshare callers asset from every group", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+
+    "GET /groups": {Summary: "get callers groups", Statuses: []int{http.StatusBadRequest, http.StatusForbidden}},
+    "POST /groups": {Summary: "create group for caller", Request: "NewGroup", Statuses: []int{http.StatusCreated, http.StatusBadRequest, http.StatusForbidden}},
+    "GET /groups/album": {Summary: "get assets for all groups of caller", Statuses: []int{http.StatusForbidden}},
+    "PUT /groups/{groupID}": {Summary: "caller joins group they were invited to", Request: "GroupMembership", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+    "DELETE /groups/{groupID}": {Summary: "caller leaves group", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+    "PUT /groups/{groupID}/key": {Summary: "rotate group key", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict}},
+    "GET /groups/{groupID}/users": {Summary: "get list of users in group", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+    "PATCH /groups/{groupID}/users": {Summary: "modify users in group", Request: "GroupInvites", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict}},
+    "POST /groups/{groupID}/users/preview": {Summary: "preview adding users to group without changing anything", Request: "GroupInvites", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+    "PATCH /groups/{groupID}/album": {Summary: "modify group asset list", Request: "GroupAssetsAmendment", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+    "PATCH /groups/{groupID}/album/shared": {Summary: "modify groups shared asset list", Request: "SharedAssetsAmendment", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict}},
+
+    "POST /info/validids": {Summary: "validate UUIDs", Request: "IDList", Statuses: []int{http.StatusBadRequest, http.StatusForbidden}},
+    "POST /info/validate": {Summary: "validate user, asset and group IDs in one request", Request: "IDValidation", Statuses: []int{http.StatusBadRequest, http.StatusForbidden}},
+
+    "GET /schema": {Summary: "get callers data schema version and the latest supported", Statuses: []int{http.StatusForbidden}},
+    "GET /schema/0": {Summary: "get any schema 0 data for caller", Statuses: []int{http.StatusForbidden, http.StatusNotFound}},
+    "PATCH /schema/0": {Summary: "patch schema 0 data for caller to schema 1", Request: "Schema0Patch", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict}},
+
+    "GET /admin/stats": {Summary: "deployment totals and active users", Statuses: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusRequestEntityTooLarge}},
+    "GET /metrics": {Summary: "deployment totals in Prometheus text format"},
+    "POST /webhooks/onesignal": {Summary: "record notification delivery receipt, signed via the X-Signature header", Request: "OneSignalEvent", Statuses: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusRequestEntityTooLarge}},
+    "POST /webhooks/firebase/user-deleted": {Summary: "deprovision a user deleted directly in firebase, signed via the X-Signature header", Statuses: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusRequestEntityTooLarge}},
+}
+
+var pathParameterPattern = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+
+// openAPIDocument serves an OpenAPI 3 description of every route registered on the public router. It is built from the
+// router itself on first request, after startServer has finished registering routes, so it can't drift from them
+type openAPIDocument struct {
+    publicRouter    chi.Routes
+    protectedRouter chi.Routes  // routes behind the firebase authorization middleware
+    once            sync.Once
+    data            []byte
+    err             error
+}
+
+func (document *openAPIDocument) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+    document.once.Do(func() {
+        document.data, document.err = document.build()
+    })
+    if document.err != nil {
+        ServerErrorHandler(response, document.err)
+        return
+    }
+    response.Header().Set("Content-Type", "application/json")
+    response.WriteHeader(http.StatusOK)
+    response.Write(document.data)
+}
+
+func (document *openAPIDocument) build() ([]byte, error) {
+    protected := make(map[string]bool)
+    err := chi.Walk(document.protectedRouter, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+        protected[method + " " + openAPIPath(route)] = true
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    paths := make(map[string]map[string]interface{})
+    err = chi.Walk(document.publicRouter, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+        path := openAPIPath(route)
+        key := method + " " + path
+        operation, ok := apiOperations[key]
+        if !ok {
+            warnLogger.Printf("openapi: %s is undocumented\n", key)
+            operation.Summary = key
+        }
+        if paths[path] == nil {
+            paths[path] = make(map[string]interface{})
+        }
+        paths[path][strings.ToLower(method)] = openAPIOperation(path, operation, protected[key])
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    schemas := make(map[string]interface{})
+    for name, model := range apiSchemas {
+        schemas[name] = openAPISchema(reflect.TypeOf(model))
+    }
+
+    return json.Marshal(map[string]interface{}{
+        "openapi": "3.0.3",
+        "info": map[string]interface{}{
+            "title": "TripUp API",
+            "version": serverVersion,
+            "description": "API is subject to change and there are no guarantees regarding backward compatibility for the moment.",
+        },
+        "paths": paths,
+        "components": map[string]interface{}{
+            "schemas": schemas,
+            "securitySchemes": map[string]interface{}{
+                "firebase": map[string]interface{}{
+                    "type": "http",
+                    "scheme": "bearer",
+                    "bearerFormat": "JWT",
+                    "description": "firebase ID token",
+                },
+                "serviceToken": map[string]interface{}{
+                    "type": "apiKey",
+                    "in": "header",
+                    "name": "Authorization",
+                    "description": "Service <unix seconds>.<hex HMAC-SHA256 of \"<unix seconds>\\n<METHOD>\\n<path>\\n<hex SHA-256 of body>\" keyed with ADMIN_API_SECRET>, each token is accepted once",
+                },
+                "metricsToken": map[string]interface{}{
+                    "type": "http",
+                    "scheme": "bearer",
+                    "description": "TRIPUP_METRICS_TOKEN",
+                },
+            },
+        },
+    })
+}
+
+// openAPIPath converts a chi route to an OpenAPI path, dropping the trailing slash of subrouter roots and any regexp
+// from path parameters
+func openAPIPath(route string) string {
+    if len(route) > 1 {
+        route = strings.TrimSuffix(route, "/")
+    }
+    return pathParameterPattern.ReplaceAllString(route, "{$1}")
+}
+
+func openAPIOperation(path string, operation apiOperation, protected bool) map[string]interface{} {
+    statuses := append([]int{http.StatusOK}, operation.Statuses...)
+    var security []map[string][]string
+    switch {
+    case protected:
+        statuses = append(statuses, http.StatusUnauthorized)
+        security = []map[string][]string{{"firebase": {}}}
+    case strings.HasPrefix(path, "/admin/"):
+        statuses = append(statuses, http.StatusUnauthorized)
+        security = []map[string][]string{{"firebase": {}}, {"serviceToken": {}}}
+    case path == "/metrics":
+        statuses = append(statuses, http.StatusUnauthorized)
+        security = []map[string][]string{{"metricsToken": {}}}
+    default:
+        security = []map[string][]string{}     // unauthenticated, overrides nothing as there's no global requirement
+    }
+    statuses = append(statuses, http.StatusInternalServerError)
+
+    responses := make(map[string]interface{})
+    for _, status := range statuses {
+        statusResponse := map[string]interface{}{"description": http.StatusText(status)}
+        if status == http.StatusOK && len(operation.Response) != 0 {
+            mediaType := operation.ResponseType
+            if len(mediaType) == 0 {
+                mediaType = "application/json"
+            }
+            statusResponse["content"] = openAPIContent(mediaType, operation.Response)
+        }
+        responses[strconv.Itoa(status)] = statusResponse
+    }
+
+    result := map[string]interface{}{
+        "summary": operation.Summary,
+        "security": security,
+        "responses": responses,
+    }
+    if len(operation.Request) != 0 {
+        result["requestBody"] = map[string]interface{}{
+            "required": true,
+            "content": openAPIContent("application/json", operation.Request),
+        }
+    }
+
+    var parameters []map[string]interface{}
+    for _, match := range pathParameterPattern.FindAllStringSubmatch(path, -1) {
+        schema := map[string]interface{}{"type": "string"}
+        if strings.HasSuffix(match[1], "ID") {
+            schema["format"] = "uuid"
+        }
+        parameters = append(parameters, map[string]interface{}{
+            "name": match[1],
+            "in": "path",
+            "required": true,
+            "schema": schema,
+        })
+    }
+    if len(parameters) != 0 {
+        result["parameters"] = parameters
+    }
+    return result
+}
+
+func openAPIContent(mediaType string, schema string) map[string]interface{} {
+    return map[string]interface{}{
+        mediaType: map[string]interface{}{
+            "schema": map[string]interface{}{"$ref": "#/components/schemas/" + schema},
+        },
+    }
+}
+
+// openAPISchema describes a model type the way encoding/json marshals it
+func openAPISchema(modelType reflect.Type) map[string]interface{} {
+    nullable := false
+    if modelType.Kind() == reflect.Ptr {
+        modelType = modelType.Elem()
+        nullable = true
+    }
+
+    var schema map[string]interface{}
+    switch modelType.Kind() {
+    case reflect.String:
+        schema = map[string]interface{}{"type": "string"}
+    case reflect.Bool:
+        schema = map[string]interface{}{"type": "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        schema = map[string]interface{}{"type": "integer"}
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        schema = map[string]interface{}{"type": "integer", "minimum": 0}
+    case reflect.Float32, reflect.Float64:
+        schema = map[string]interface{}{"type": "number"}
+    case reflect.Slice, reflect.Array:
+        schema = map[string]interface{}{"type": "array", "items": openAPISchema(modelType.Elem())}
+    case reflect.Map:
+        schema = map[string]interface{}{"type": "object", "additionalProperties": openAPISchema(modelType.Elem())}
+    case reflect.Struct:
+        if modelType == reflect.TypeOf(time.Time{}) {
+            schema = map[string]interface{}{"type": "string", "format": "date-time"}    // marshalled as RFC3339
+            break
+        }
+        properties := make(map[string]interface{})
+        for i := 0; i < modelType.NumField(); i++ {
+            field := modelType.Field(i)
+            if len(field.PkgPath) != 0 {
+                continue    // unexported
+            }
+            name := field.Name
+            if tag := strings.Split(field.Tag.Get("json"), ","); tag[0] == "-" {
+                continue
+            } else if len(tag[0]) != 0 {
+                name = tag[0]
+            }
+            properties[name] = openAPISchema(field.Type)
+        }
+        schema = map[string]interface{}{"type": "object", "properties": properties}
+    default:
+        schema = map[string]interface{}{}
+    }
+    if nullable {
+        schema["nullable"] = true
+    }
+    return schema
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tripupapp/tripup-server/database"
+	"github.com/tripupapp/tripup-server/notification"
+)
+
+// unacknowledged events are dropped after this long, clients that haven't polled since should do a full refresh anyway
+const pendingEventsRetention = 30 * 24 * time.Hour
+const pendingEventsPruneInterval = 24 * time.Hour
+
+// recordPendingEvents is the dispatcher failure handler, it keeps notifications that couldn't be pushed so the recipients
+// pick them up from GET /users/self/pending-events when they next open the app
+func recordPendingEvents(neoDB database.Store) notification.FailureHandler {
+    return func(userIDs []string, notificationType notification.Notification, additionalData *map[string]string) {
+        data := map[string]string{}
+        if additionalData != nil {
+            data = *additionalData
+        }
+        dataJSON, err := json.Marshal(data)
+        if err != nil {
+            errLogger.Println(err.Error())
+            return
+        }
+        if err := neoDB.AddPendingEvent(userIDs, uuid.New().String(), notificationType.Signal(), string(dataJSON)); err != nil {
+            errLogger.Println(err.Error())
+        }
+    }
+}
+
+// prunePendingEvents removes events older than the retention period, so users that never poll don't accumulate them
+func prunePendingEvents(neoDB *database.Neo4j) func(ctx context.Context) error {
+    return func(ctx context.Context) error {
+        pruned, err := neoDB.PrunePendingEvents(time.Now().Add(-pendingEventsRetention))
+        if err != nil {
+            return err
+        }
+        if pruned != 0 {
+            logger.Printf("pruned %d pending events\n", pruned)
+        }
+        return nil
+    }
+}
+
+func apiGetPendingEvents(response http.ResponseWriter, request *http.Request) {
+    getPendingEvents(response, request, database.Instance())
+}
+
+func apiAckPendingEvents(response http.ResponseWriter, request *http.Request) {
+    ackPendingEvents(response, request, database.Instance())
+}
+
+func getPendingEvents(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    events, err := neoDB.GetPendingEvents(token.UID)
+    switch err {
+    case nil:
+        type pendingEvent struct {
+            ID          string          `json:"id"`
+            Signal      string          `json:"signal"`
+            Data        json.RawMessage `json:"data"`
+            CreatedAt   string          `json:"createdAt"`
+        }
+        var result []pendingEvent
+        for _, event := range events {
+            result = append(result, pendingEvent{
+                ID: event.ID,
+                Signal: event.Signal,
+                Data: json.RawMessage(event.Data),
+                CreatedAt: time.Unix(0, event.Created * int64(time.Millisecond)).UTC().Format(time.RFC3339),
+            })
+        }
+        dataJSON, err := json.Marshal(result)
+        if err != nil {
+            response.WriteHeader(http.StatusInternalServerError)
+            errLogger.Println(err.Error())
+            return
+        }
+        response.WriteHeader(http.StatusOK)
+        response.Write(dataJSON)
+    case io.EOF:
+        response.WriteHeader(http.StatusNoContent)
+    default:
+        ServerErrorHandler(response, err)
+    }
+}
+
+func ackPendingEvents(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    var payload struct {
+        IDs []string
+    }
+    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    if len(payload.IDs) == 0 {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Empty data supplied"))
+        return
+    }
+    for _, eventID := range payload.IDs {
+        if _, err := uuid.Parse(eventID); err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("Invalid UUID string for event ID: " + eventID))
+            return
+        }
+    }
+
+    if err := neoDB.AckPendingEvents(token.UID, payload.IDs); err != nil {
+        ServerErrorHandler(response, err)
+        return
+    }
+    response.WriteHeader(http.StatusOK)
+}
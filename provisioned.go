@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tripupapp/tripup-server/database"
+)
+
+// how long a subject is remembered as provisioned, so a deprovisioned user is turned away again within this window
+const provisionedCacheTTL = 10 * time.Minute
+
+// provisionChecker turns away tokens whose subject has no user yet, so handlers can assume the user exists rather than
+// returning confusing empty results. Only provisioned subjects are cached, a new user passes as soon as they're created
+type provisionChecker struct {
+    neoDB   database.Store
+    mutex   sync.Mutex
+    seen    map[string]time.Time
+}
+
+// Require responds with 403 Forbidden and "account not provisioned" unless the token's subject has a user, must be used
+// after the firebase authorization middleware. POST /users and GET /users/self must not use it, they work beforehand
+func (checker *provisionChecker) Require(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+        token, ok := authToken(request.Context())
+        if !ok {
+            response.WriteHeader(http.StatusUnauthorized)
+            response.Write([]byte("Unable to extract token from request context"))
+            return
+        }
+
+        if !checker.cached(token.UID) {
+            _, err := checker.neoDB.GetUser(token.UID)
+            switch err {
+            case nil:
+                checker.remember(token.UID)
+            case io.EOF:
+                response.WriteHeader(http.StatusForbidden)
+                response.Write([]byte("account not provisioned"))
+                return
+            default:
+                ServerErrorHandler(response, err)
+                return
+            }
+        }
+        next.ServeHTTP(response, request)
+    })
+}
+
+func (checker *provisionChecker) cached(userID string) bool {
+    checker.mutex.Lock()
+    defer checker.mutex.Unlock()
+
+    seenAt, ok := checker.seen[userID]
+    if ok && time.Since(seenAt) >= provisionedCacheTTL {
+        delete(checker.seen, userID)
+        return false
+    }
+    return ok
+}
+
+func (checker *provisionChecker) remember(userID string) {
+    checker.mutex.Lock()
+    defer checker.mutex.Unlock()
+
+    if checker.seen == nil {
+        checker.seen = make(map[string]time.Time)
+    }
+    checker.seen[userID] = time.Now()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pressly/chi"
+
+	"github.com/tripupapp/tripup-server/database"
+)
+
+func TestRequireProvisioned(t *testing.T) {
+    tests := []struct {
+        name        string
+        provisioned bool
+        want        int
+    }{
+        {name: "provisioned", provisioned: true, want: http.StatusOK},
+        {name: "unprovisioned", want: http.StatusForbidden},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            store := database.NewMemStore()
+            if test.provisioned {
+                newUser(t, store, "user")
+            }
+
+            called := false
+            router := chi.NewRouter()
+            router.Route("/assets", func(subrouter chi.Router) {
+                subrouter.Use((&provisionChecker{neoDB: store}).Require)
+                subrouter.Get("/", func(response http.ResponseWriter, request *http.Request) {
+                    called = true
+                })
+            })
+
+            request := httptest.NewRequest("GET", "/assets/", nil)
+            request = request.WithContext(context.WithValue(request.Context(), tokenKey{}, "user"))
+            response := httptest.NewRecorder()
+            router.ServeHTTP(response, request)
+
+            if response.Code != test.want {
+                t.Fatalf("got status %d, want %d: %s", response.Code, test.want, response.Body)
+            }
+            if called != test.provisioned {
+                t.Errorf("handler called %v, want %v", called, test.provisioned)
+            }
+        })
+    }
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type rateWindow struct {
+    start   time.Time
+    count   int
+    logged  bool
+}
+
+// rateLimiter allows each user at most limit requests per fixed window, users are identified by their auth token
+type rateLimiter struct {
+    name        string
+    limit       int
+    window      time.Duration
+    mutex       sync.Mutex
+    users       map[string]*rateWindow
+    lastSweep   time.Time
+}
+
+func newRateLimiter(name string, limit int, window time.Duration) *rateLimiter {
+    return &rateLimiter{
+        name: name,
+        limit: limit,
+        window: window,
+        users: make(map[string]*rateWindow),
+        lastSweep: time.Now(),
+    }
+}
+
+// allow records a request by the user, returning false and the time until the window resets once the limit is reached
+func (limiter *rateLimiter) allow(userID string) (bool, time.Duration) {
+    limiter.mutex.Lock()
+    defer limiter.mutex.Unlock()
+
+    now := time.Now()
+    // drop expired windows, so users that stop making requests don't stay in memory
+    if now.Sub(limiter.lastSweep) > limiter.window {
+        for id, window := range limiter.users {
+            if now.Sub(window.start) > limiter.window {
+                delete(limiter.users, id)
+            }
+        }
+        limiter.lastSweep = now
+    }
+
+    window, ok := limiter.users[userID]
+    if !ok || now.Sub(window.start) > limiter.window {
+        window = &rateWindow{start: now}
+        limiter.users[userID] = window
+    }
+    window.count++
+    if window.count <= limiter.limit {
+        return true, 0
+    }
+
+    // only log once per window, a client hammering the endpoint would otherwise flood the log
+    if !window.logged {
+        window.logged = true
+        warnLogger.Printf("%s: user %s exceeded %d requests in %s, possible enumeration\n", limiter.name, userID, limiter.limit, limiter.window)
+    }
+    return false, window.start.Add(limiter.window).Sub(now)
+}
+
+// Limit rejects requests with 429 Too Many Requests once the user has exhausted their allowance for the current window
+func (limiter *rateLimiter) Limit(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+        token, ok := authToken(request.Context())
+        if !ok {
+            response.WriteHeader(http.StatusUnauthorized)
+            response.Write([]byte("Unable to extract token from request context"))
+            return
+        }
+
+        if allowed, retryAfter := limiter.allow(token.UID); !allowed {
+            response.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()) + 1))
+            response.WriteHeader(http.StatusTooManyRequests)
+            return
+        }
+        next.ServeHTTP(response, request)
+    })
+}
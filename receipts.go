@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/tripupapp/tripup-server/database"
+	"github.com/tripupapp/tripup-server/notification"
+)
+
+// receipts are kept for a week after the notification was sent, OneSignal stops reporting on a notification well before
+const notificationReceiptsRetention = 7 * 24 * time.Hour
+const notificationReceiptsPruneInterval = 24 * time.Hour
+
+// receiptStatuses maps the OneSignal webhook events that are tracked to the status recorded for the notification,
+// other events are acknowledged without being recorded
+var receiptStatuses = map[string]string {
+    "notification.sent": "sent",
+    "notification.delivered": "delivered",
+    "notification.clicked": "clicked",
+    "notification.failed": "failed",
+}
+
+// recordSentNotifications is the dispatcher sent handler, it tracks the notifications OneSignal accepted so the
+// receipts it reports via POST /webhooks/onesignal are only recorded for notifications this server sent
+func recordSentNotifications(neoDB database.Store) notification.SentHandler {
+    return func(notificationIDs []string, notificationType notification.Notification) {
+        if err := neoDB.RecordNotificationsSent(notificationIDs, notificationType.Signal()); err != nil {
+            errLogger.Println(err.Error())
+        }
+    }
+}
+
+// pruneNotificationReceipts removes the receipts of notifications sent before the retention period
+func pruneNotificationReceipts(neoDB *database.Neo4j) func(ctx context.Context) error {
+    return func(ctx context.Context) error {
+        pruned, err := neoDB.PruneNotificationReceipts(time.Now().Add(-notificationReceiptsRetention))
+        if err != nil {
+            return err
+        }
+        if pruned != 0 {
+            logger.Printf("pruned %d notification receipts\n", pruned)
+        }
+        return nil
+    }
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/tripupapp/tripup-server/database"
+)
+
+const invalidRecipientsPruneInterval = time.Hour
+
+// invalidRecipients collects the users the notification provider reported as having no device to deliver to, until
+// the prune job stops group notifications being sent to them. Each instance collects from its own sends
+type invalidRecipients struct {
+    mutex   sync.Mutex
+    ids     map[string]bool
+}
+
+// record is the dispatcher invalid recipient handler
+func (recipients *invalidRecipients) record(userIDs []string) {
+    recipients.mutex.Lock()
+    defer recipients.mutex.Unlock()
+    if recipients.ids == nil {
+        recipients.ids = make(map[string]bool)
+    }
+    for _, userID := range userIDs {
+        recipients.ids[userID] = true
+    }
+}
+
+// take returns the recorded users and starts collecting afresh
+func (recipients *invalidRecipients) take() map[string]bool {
+    recipients.mutex.Lock()
+    defer recipients.mutex.Unlock()
+    ids := recipients.ids
+    recipients.ids = nil
+    return ids
+}
+
+// prune marks every recorded user as unreachable, users that couldn't be marked are kept for the next run
+func (recipients *invalidRecipients) prune(neoDB *database.Neo4j) func(ctx context.Context) error {
+    return func(ctx context.Context) error {
+        ids := recipients.take()
+        pruned := 0
+        for userID := range ids {
+            if err := ctx.Err(); err != nil {
+                recipients.restore(ids)
+                return err
+            }
+            removed, err := neoDB.RemoveInvalidRecipient(userID)
+            if err != nil {
+                recipients.restore(ids)
+                return err
+            }
+            delete(ids, userID)
+            if removed {
+                pruned++
+            }
+        }
+        if pruned != 0 {
+            logger.Printf("pruned %d notification recipients with no device\n", pruned)
+        }
+        return nil
+    }
+}
+
+func (recipients *invalidRecipients) restore(ids map[string]bool) {
+    remaining := make([]string, 0, len(ids))
+    for userID := range ids {
+        remaining = append(remaining, userID)
+    }
+    recipients.record(remaining)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+
+	"github.com/tripupapp/tripup-server/database"
+)
+
+// assets checked per database query when reconciling storage
+const reconcileBatchSize = 500
+
+// reconcileStorage re-checks every recorded rendition size against storage and corrects any drift, so an object replaced
+// with a larger one after its size was recorded is still accounted for. Objects that can't be sized are logged and skipped
+func reconcileStorage(neoDB *database.Neo4j) func(ctx context.Context) error {
+    return func(ctx context.Context) error {
+        var checked, corrected int
+        for cursor := ""; ; {
+            renditions, next, err := neoDB.GetRenditionsPage(cursor, reconcileBatchSize)
+            if err != nil {
+                return err
+            }
+
+            for _, rendition := range renditions {
+                if err := ctx.Err(); err != nil {
+                    return err  // shutting down, the next run starts over
+                }
+                sizes, err := storageBackend.RenditionSizes(ctx, []string{rendition.RemotePath})
+                if err != nil {
+                    errLogger.Printf("reconcile: unable to size %s rendition of asset %s: %v\n", rendition.Name, rendition.AssetID, err)
+                    continue
+                }
+                checked++
+
+                // recorded sizes are floored, so compare against the floored actual size
+                size := sizes[0]
+                if minimum := minimumRenditionSize(rendition.AssetType); size < minimum {
+                    size = minimum
+                }
+                if size == rendition.Size {
+                    continue
+                }
+                totalsize, err := neoDB.CorrectRenditionSize(rendition.AssetID, rendition.Name, size)
+                if err != nil {
+                    return err
+                }
+                corrected++
+                warnLogger.Printf("reconcile: %s rendition of asset %s recorded as %d bytes, stored %d, totalsize now %d\n", rendition.Name, rendition.AssetID, rendition.Size, size, totalsize)
+            }
+
+            if len(next) == 0 {
+                break
+            }
+            cursor = next
+        }
+        logger.Printf("reconcile: checked %d renditions, corrected %d\n", checked, corrected)
+        return nil
+    }
+}
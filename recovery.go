@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/pressly/chi/middleware"
+)
+
+// Recoverer recovers from panics in handlers, logging the stack trace against the request ID and responding with a JSON 500
+// if the handler has already started writing a response, the status can no longer be changed so nothing further is written
+func Recoverer(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+        writer := middleware.NewWrapResponseWriter(response, request.ProtoMajor)
+        defer func() {
+            recovery := recover()
+            if recovery == nil {
+                return
+            }
+            if recovery == http.ErrAbortHandler {
+                panic(recovery) // deliberate abort, let net/http close the connection
+            }
+
+            requestID := middleware.GetReqID(request.Context())
+            errLogger.Printf("[%s] panic: %v\n%s", requestID, recovery, debug.Stack())
+
+            if writer.Status() != 0 {
+                return
+            }
+            body, _ := json.Marshal(map[string]string {
+                "error": http.StatusText(http.StatusInternalServerError),
+                "requestid": requestID,
+            })
+            writer.Header().Set("Content-Type", "application/json")
+            writer.WriteHeader(http.StatusInternalServerError)
+            writer.Write(body)
+        }()
+        next.ServeHTTP(writer, request)
+    })
+}
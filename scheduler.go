@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// jobLocker provides a lock shared between server replicas, used to run exclusive jobs on a single replica at a time
+type jobLocker interface {
+    AcquireLock(name string, owner string, ttl time.Duration) (bool, error)
+    ReleaseLock(name string, owner string) error
+}
+
+// scheduledJob is a named maintenance task run periodically by the scheduler
+type scheduledJob struct {
+    name        string
+    interval    time.Duration
+    exclusive   bool    // only run on the replica holding the job's lock
+    run         func(ctx context.Context) error
+    runs        uint64  // accessed atomically, read by the metrics endpoint
+    failures    uint64  // accessed atomically
+    locked      bool
+}
+
+// jobCounts are a job's runs and failed runs since startup
+type jobCounts struct {
+    name        string
+    runs        uint64
+    failures    uint64
+}
+
+// scheduler runs registered jobs on their own interval, recovering from panics and logging the outcome of every run
+// jobs are registered in main() before start is called, and are cancelled and waited on by Shutdown
+type scheduler struct {
+    jobs            []*scheduledJob
+    locker          jobLocker
+    instanceID      string
+    runExclusive    bool
+    ctx             context.Context
+    cancel          context.CancelFunc
+    running         sync.WaitGroup
+}
+
+// newScheduler creates a scheduler, runExclusive false opts this replica out of exclusive jobs entirely
+func newScheduler(locker jobLocker, instanceID string, runExclusive bool) *scheduler {
+    ctx, cancel := context.WithCancel(context.Background())
+    return &scheduler{locker: locker, instanceID: instanceID, runExclusive: runExclusive, ctx: ctx, cancel: cancel}
+}
+
+// register adds a job, exclusive jobs (e.g. storage purges) run on one replica at a time, coordinated via the locker
+func (s *scheduler) register(name string, interval time.Duration, exclusive bool, run func(ctx context.Context) error) {
+    s.jobs = append(s.jobs, &scheduledJob{name: name, interval: interval, exclusive: exclusive, run: run})
+}
+
+func (s *scheduler) start() {
+    for _, job := range s.jobs {
+        if job.exclusive && !s.runExclusive {
+            logger.Printf("job %s is exclusive and maintenance is disabled on this instance, skipping\n", job.name)
+            continue
+        }
+        s.running.Add(1)
+        go func(job *scheduledJob) {
+            defer s.running.Done()
+            // run once at startup too, otherwise jobs with long intervals never run on instances restarted more often
+            s.execute(job)
+            ticker := time.NewTicker(job.interval)
+            defer ticker.Stop()
+            for {
+                select {
+                case <-ticker.C:
+                    s.execute(job)
+                case <-s.ctx.Done():
+                    return
+                }
+            }
+        }(job)
+    }
+    logger.Printf("scheduler started with %d jobs\n", len(s.jobs))
+}
+
+func (s *scheduler) execute(job *scheduledJob) {
+    if job.exclusive {
+        // the lock outlives the interval so the holder renews it on its next tick, another replica takes over if it stops
+        acquired, err := s.locker.AcquireLock("job:" + job.name, s.instanceID, 2 * job.interval)
+        if err != nil {
+            errLogger.Printf("job %s skipped, unable to acquire lock: %v\n", job.name, err)
+            return
+        }
+        job.locked = acquired
+        if !acquired {
+            return
+        }
+    }
+
+    start := time.Now()
+    err := func() (err error) {
+        defer func() {
+            if recovery := recover(); recovery != nil {
+                err = fmt.Errorf("panic: %v\n%s", recovery, debug.Stack())
+            }
+        }()
+        return job.run(s.ctx)
+    }()
+
+    runs := atomic.AddUint64(&job.runs, 1)
+    if err != nil {
+        failures := atomic.AddUint64(&job.failures, 1)
+        errLogger.Printf("job %s failed after %v (%d of %d runs failed): %v\n", job.name, time.Since(start), failures, runs, err)
+    } else {
+        logger.Printf("job %s completed in %v (%d runs)\n", job.name, time.Since(start), runs)
+    }
+}
+
+// counts returns the runs and failures of every registered job, jobs skipped on this instance report none
+func (s *scheduler) counts() []jobCounts {
+    var counts []jobCounts
+    for _, job := range s.jobs {
+        counts = append(counts, jobCounts{name: job.name, runs: atomic.LoadUint64(&job.runs), failures: atomic.LoadUint64(&job.failures)})
+    }
+    return counts
+}
+
+// Shutdown cancels running jobs and waits for them to return, or for ctx to expire, then releases any locks held
+// so another replica can take over exclusive jobs without waiting for the locks to expire
+func (s *scheduler) Shutdown(ctx context.Context) error {
+    s.cancel()
+
+    stopped := make(chan struct{})
+    go func() {
+        s.running.Wait()
+        close(stopped)
+    }()
+
+    select {
+    case <-stopped:
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+
+    for _, job := range s.jobs {
+        if job.locked {
+            if err := s.locker.ReleaseLock("job:" + job.name, s.instanceID); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
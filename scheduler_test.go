@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedulerRunsJobsAtStartup(t *testing.T) {
+    jobs := newScheduler(nil, "instance", true)
+    ran := make(chan string, 2)
+    jobs.register("succeeds", time.Hour, false, func(ctx context.Context) error {
+        ran <- "succeeds"
+        return nil
+    })
+    jobs.register("fails", time.Hour, false, func(ctx context.Context) error {
+        ran <- "fails"
+        return errors.New("failed")
+    })
+    jobs.start()
+    for count := 0; count < 2; count++ {
+        select {
+        case <-ran:
+        case <-time.After(5 * time.Second):
+            t.Fatal("jobs not run at startup")
+        }
+    }
+    if err := jobs.Shutdown(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+
+    stats := &statsCollector{token: "token", jobs: jobs}
+    request := httptest.NewRequest("GET", "/metrics", nil)
+    request.Header.Set("Authorization", "Bearer token")
+    response := httptest.NewRecorder()
+    stats.ServeHTTP(response, request)
+    if response.Code != http.StatusOK {
+        t.Fatalf("got status %d, want %d", response.Code, http.StatusOK)
+    }
+    for _, want := range []string{
+        `tripup_job_runs_total{job="succeeds"} 1`,
+        `tripup_job_failures_total{job="succeeds"} 0`,
+        `tripup_job_runs_total{job="fails"} 1`,
+        `tripup_job_failures_total{job="fails"} 1`,
+    } {
+        if !strings.Contains(response.Body.String(), want) {
+            t.Errorf("metrics missing %s:\n%s", want, response.Body)
+        }
+    }
+}
@@ -2,16 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -21,15 +26,52 @@ import (
 	firebaseauth "github.com/vin047/firebase-middleware"
 
 	"github.com/tripupapp/tripup-server/auth"
+	"github.com/tripupapp/tripup-server/config"
+	"github.com/tripupapp/tripup-server/cursor"
 	"github.com/tripupapp/tripup-server/database"
+	"github.com/tripupapp/tripup-server/logging"
+	"github.com/tripupapp/tripup-server/models"
 	"github.com/tripupapp/tripup-server/notification"
 	"github.com/tripupapp/tripup-server/storage"
 )
 
-var logger *log.Logger = log.New(os.Stdout, "[INFO] ServerLog: ", log.LstdFlags)
-var errLogger *log.Logger = log.New(os.Stderr, "[ERROR] ServerLog: ", log.LstdFlags | log.Lshortfile)
-var storageBackend = storage.NewS3Backend()
+var logger *log.Logger = log.New(logging.Writer(logging.Info, os.Stdout), "[INFO] ServerLog: ", log.LstdFlags)
+var warnLogger *log.Logger = log.New(logging.Writer(logging.Warn, os.Stderr), "[WARN] ServerLog: ", log.LstdFlags)
+var errLogger *log.Logger = log.New(logging.Writer(logging.Error, os.Stderr), "[ERROR] ServerLog: ", log.LstdFlags | log.Lshortfile)
+var storageBackend storage.StorageBackend
 var notificationService notification.NotificationService
+var notificationDispatcher *notification.Dispatcher
+var authToken = firebaseauth.AuthToken    // replaceable in tests, the middleware keeps the token under an unexported context key
+var userAuthProviders = auth.GetUserAuthProviders    // replaceable in tests, looks the user up on firebase
+var newID = uuid.New    // replaceable in tests, generates new user and group uuids
+var capabilities map[string]interface{}
+var oneSignalWebhookSecret string
+var firebaseWebhookSecret string
+var maxLookupIdentifiers int
+var maxGroupInvites int
+var maxGroupSize int
+var maxCreateDateAhead time.Duration
+var leaveGroupKeepsAssets bool     // default for DELETE /groups/{groupID} without ?assets=
+var cursorSecret []byte
+var minimumRenditionSizes map[string]uint64    // by asset type, smaller renditions are counted as this size towards totalsize
+
+const serverVersion = "1.1.0"
+const latestSchemaVersion = "1"   // data schema new users are created on, older users migrate via /schema/{version}
+const defaultMinimumRenditionSize = 131072  // 128 KB, for asset types without a configured minimum
+const notificationBatchSize = 1000    // group members per notification request
+const maxGroupUsersPageSize = 500
+const maxGroupsPageSize = 500
+const maxIDAttempts = 3     // uuids generated for a new user or group before giving up, a single collision is already unlikely
+const maxAssetTags = 100
+const maxAssetsPerFetch = 500   // asset IDs per POST /assets/get
+const maxStoragePaths = 500     // paths per POST /assets/storagepaths
+const maxAssetTagLength = 1024   // tags are client encrypted, so allow for the ciphertext overhead
+const maxSignedBodySize = 65536  // 64 KB, bodies read in full before their signature is checked
+
+// shutdowner is implemented by subsystems that need to release resources or finish work before the server exits
+type shutdowner interface {
+    Shutdown(ctx context.Context) error
+}
 
 type invalidArgError struct {
     argNumber int
@@ -49,104 +91,326 @@ func validateArgsNotZero(strings []string) error {
 }
 
 func main() {
-    quit := make(chan os.Signal)                        // set up a channel called 'quit' which takes os signals
+    quit := make(chan os.Signal, 1)                     // set up a channel called 'quit' which takes os signals
     signal.Notify(quit, os.Interrupt, syscall.SIGTERM)  // capture SIGINT from CLI and SIGTERM from OS, redirect to 'quit' channel
 
+    // load and validate configuration, reporting every problem at once
+    cfg, err := config.Load()
+    if err != nil {
+        errLogger.Fatalln(err)
+    }
+    logging.SetLevel(cfg.LogLevel)
+    logging.SetSampleRate(cfg.LogSampleRate)
+
     // initialise notification service
-    oneSignalAppID, exists := os.LookupEnv("ONESIGNAL_APPID")
-    if !exists {
-        errLogger.Panicln("ONESIGNAL_APPID not set")
+    // optional like firebase credentials and storage, without OneSignal the API runs (e.g. local development) with push disabled
+    var notificationBreaker *notification.Breaker
+    var provider notification.NotificationService = notification.NoOp{}
+    if len(cfg.OneSignalAppID) != 0 {
+        oneSignal := notification.OneSignal{AppID: cfg.OneSignalAppID, APIKey: cfg.OneSignalAPIKey, Timeout: cfg.NotificationTimeout}
+        notificationBreaker = notification.NewBreaker(oneSignal, cfg.NotifyBreakerThreshold, cfg.NotifyBreakerCooldown)  // fail fast while OneSignal is down
+        provider = notificationBreaker
+    } else {
+        warnLogger.Println("ONESIGNAL_APPID and ONESIGNAL_APIKEY not set, push notifications are disabled")
+    }
+    notificationDispatcher = notification.NewDispatcher(provider, cfg.NotificationWindow)
+    notificationService = notificationDispatcher
+    oneSignalWebhookSecret = cfg.OneSignalWebhookSecret  // optional, webhook endpoint is disabled if not set
+    firebaseWebhookSecret = cfg.FirebaseWebhookSecret    // optional, webhook endpoint is disabled if not set
+    maxLookupIdentifiers = cfg.LookupMaxIdentifiers
+    maxGroupInvites = cfg.MaxGroupInvites
+    maxGroupSize = cfg.MaxGroupSize
+    cursorSecret = []byte(cfg.CursorSecret)
+    if len(cursorSecret) == 0 {
+        // cursors then only work on this instance until it restarts, replicas must share a configured secret
+        warnLogger.Println("TRIPUP_CURSOR_SECRET not set, signing pagination cursors with a random secret")
+        cursorSecret = make([]byte, 32)
+        if _, err := rand.Read(cursorSecret); err != nil {
+            errLogger.Panicln(err)
+        }
     }
-    oneSignalAPIKey, exists := os.LookupEnv("ONESIGNAL_APIKEY")
-    if !exists {
-        errLogger.Panicln("ONESIGNAL_APIKEY not set")
+    maxCreateDateAhead = cfg.MaxCreateDateAhead    // optional, CreateDate isn't checked if not set
+    leaveGroupKeepsAssets = cfg.LeaveGroupKeepsAssets
+    minimumRenditionSizes = map[string]uint64 {
+        "photo": uint64(cfg.MinBillableBytesPhoto),
+        "video": uint64(cfg.MinBillableBytesVideo),
+    }
+
+    // optional features, each flag both enables the feature below and advertises it on GET /capabilities
+    optionalFeatures := map[string]bool {
+        "obfuscatedstoragepaths": len(cfg.StorageKeySecret) != 0,    // clients upload to and download from POST /assets/storagepaths
+        "pushnotifications": notificationBreaker != nil,             // otherwise clients poll GET /users/self/pending-events
+        "deliveryreceipts": len(oneSignalWebhookSecret) != 0,
+        "firebasedeprovisioning": len(firebaseWebhookSecret) != 0,
+    }
+
+    // initialise storage backend
+    storageBackend = storage.NewS3Backend(cfg.AWSRegion, cfg.AWSEndpoint, cfg.AWSForcePathStyle)
+    if optionalFeatures["obfuscatedstoragepaths"] {
+        storageBackend = storage.NewObfuscatedBackend(storageBackend, cfg.StorageKeySecret, cfg.StorageKeyMigrating)
     }
-    notificationService = notification.OneSignal{AppID: oneSignalAppID, APIKey: oneSignalAPIKey}
 
     // initialise neo4j database connection
     neoDB := database.Instance()
-    neoDB.Connect()
+    neoDB.Connect(cfg)
+    if err := neoDB.EnsureIndexes(); err != nil {
+        warnLogger.Println("unable to create neo4j indexes, queries relying on them will be slower:", err)
+    }
+    notificationDispatcher.SetFailureHandler(recordPendingEvents(neoDB))  // undelivered pushes are kept for clients to poll
+    unreachable := &invalidRecipients{}
+    notificationDispatcher.SetInvalidRecipientHandler(unreachable.record)  // users with no device, pruned periodically
+    notificationDispatcher.SetSentHandler(recordSentNotifications(neoDB))  // matched to the receipts OneSignal reports
 
     // initialise auth backend
-    auth.InitialiseFirebaseAuthBackend(nil)
+    var firebaseCredentialsFile *string
+    if len(cfg.FirebaseCredentialsFile) != 0 {
+        firebaseCredentialsFile = &cfg.FirebaseCredentialsFile
+    }
+    auth.InitialiseFirebaseAuthBackend(firebaseCredentialsFile)
 
     // initialise the router
     router := chi.NewRouter()
-    timeout, err := time.ParseDuration(os.Getenv("TRIPUP_SERVER_TIMEOUT"))
-    if err != nil {
-        errLogger.Panicln(err)
+    timeout := cfg.ServerTimeout
+    throttle := cfg.ServerMaxRequests
+
+    var enabledFeatures []string
+    for feature, enabled := range optionalFeatures {
+        if enabled {
+            enabledFeatures = append(enabledFeatures, feature)
+        }
     }
-    throttle, err := strconv.Atoi(os.Getenv("TRIPUP_SERVER_MAX_REQ"))
-    if err != nil {
-        errLogger.Panicln(err)
+    sort.Strings(enabledFeatures)   // map order is random, keep the response stable between requests and replicas
+    features := append([]string{"originalfilenames", "versionedoriginalfilenames", "sharedassets", "archivedassets", "assettags"}, enabledFeatures...)
+
+    // advertised to clients via GET /capabilities so they can feature-detect instead of hardcoding assumptions
+    capabilities = map[string]interface{} {
+        "version": serverVersion,
+        "schemaVersions": []string{"0", latestSchemaVersion},
+        "features": features,
+        "storage": storageBackend.Name(),
+        "limits": map[string]interface{} {
+            "maxConcurrentRequests": throttle,
+            "requestTimeout": timeout.Seconds(),
+            "maxLookupIdentifiers": cfg.LookupMaxIdentifiers,
+            "maxGroupInvites": cfg.MaxGroupInvites,
+            "maxGroupSize": cfg.MaxGroupSize,
+            "maxRequestBytes": cfg.MaxRequestBytes,
+            "maxAssetTags": maxAssetTags,
+            "maxAssetTagLength": maxAssetTagLength,
+        },
     }
 
     router.Use(firebaseauth.JWTHandler(nil))    // firebase authorization middleware
+    if len(cfg.RequiredClaims) != 0 {
+        router.Use(requireClaims(cfg.RequiredClaims))   // optional, stronger token assertions for every protected route
+    }
     router.Use(middleware.Timeout(timeout)) // stop processing request after X seconds
+    activity := &activityTracker{neoDB: neoDB}
+    router.Use(activity.Track)  // record each users last activity, at most once a day
 
     // setup routing
     router.Get("/ping", apiPing)
+    router.Get("/capabilities", apiGetCapabilities)
 
+    lookupLimiter := newRateLimiter("contact lookup", cfg.LookupRateLimit, time.Minute)
+    existsLimiter := newRateLimiter("contact existence", cfg.ExistsRateLimit, time.Hour)   // one identifier per request, so stricter
+    provisioned := &provisionChecker{neoDB: neoDB}    // user scoped routes need the caller to have created their user first
     router.Route("/users", func(subrouter chi.Router) {
         subrouter.Post("/", apiCreateUser)
-        subrouter.Post("/public", apiGetUsersFromAddressable)
         subrouter.Get("/self", apiGetUUID)
-        subrouter.Put("/self/contact", apiUpdateUserContact)
-        subrouter.Get("/{userID}", apiGetUser)
+        subrouter.Group(func(subrouter chi.Router) {
+            subrouter.Use(provisioned.Require)
+            subrouter.With(lookupLimiter.Limit).Post("/public", apiGetUsersFromAddressable)    // contact discovery, rate limited against enumeration
+            subrouter.With(existsLimiter.Limit).Post("/public/exists", apiContactExists)
+            subrouter.Get("/self/profile", apiGetUserProfile)
+            subrouter.Put("/self/profile", apiUpdateUserProfile)
+            subrouter.Put("/self/contact", apiUpdateUserContact)
+            subrouter.Delete("/self/contact/{provider}", apiRemoveUserContact)
+            subrouter.Put("/self/notification-prefs", apiUpdateNotificationPrefs)
+            subrouter.With(Gzip).Post("/self/export", apiExportUserData)
+            subrouter.Get("/self/pending-events", apiGetPendingEvents)
+            subrouter.Post("/self/pending-events/ack", apiAckPendingEvents)
+            subrouter.Get("/{userID}", apiGetUser)
+        })
     })
     router.Route("/assets", func(subrouter chi.Router) {
-        subrouter.Use(middleware.Throttle(throttle))    // max 10 requests processed at same time, backlog others
-        subrouter.Get("/", apiGetAssets)
+        subrouter.Use(middleware.Throttle(cfg.ThrottleAssets))    // max N requests processed at same time, backlog others
+        subrouter.Use(provisioned.Require)
+        subrouter.With(Gzip).Get("/", apiGetAssets)
         subrouter.Post("/", apiCreateAsset)
         subrouter.Patch("/", apiPatchAssets)
         subrouter.Patch("/original", apiPatchAssetsRemoteOriginalPaths)
+        subrouter.Patch("/keys", apiPatchAssetKeys)
         subrouter.Patch("/originalfilenames", apiPatchAssetsOriginalFilenames)
+        subrouter.Post("/originalfilenames/get", apiGetAssetsOriginalFilenames)
+        subrouter.With(Gzip).Post("/get", apiGetAssetsByIDs)
+        subrouter.Post("/storagepaths", getStoragePaths)
         subrouter.Put("/{assetID}/original", apiUpdateOriginalRemote)
+        subrouter.Delete("/{assetID}/original", apiDeleteAssetOriginal)
         subrouter.Put("/{assetID}/originalfilename", apiPutAssetOriginalFilename)
+        subrouter.Patch("/{assetID}/archive", apiSetAssetArchived)
+        subrouter.Put("/{assetID}/tags", apiSetAssetTags)
+        subrouter.Get("/{assetID}/groups", apiGetGroupsForAsset)
+        subrouter.Post("/{assetID}/move", apiMoveSharedAsset)
+        subrouter.Post("/{assetID}/unshare-all", apiUnshareAssetFromAllGroups)
     })
     router.Route("/groups", func(subrouter chi.Router) {
-        subrouter.Use(middleware.Throttle(throttle))    // max 10 requests processed at same time, backlog others
+        subrouter.Use(middleware.Throttle(cfg.ThrottleGroups))    // max N requests processed at same time, backlog others
+        subrouter.Use(provisioned.Require)
         subrouter.Get("/", apiGetGroups)
         subrouter.Post("/", apiCreateGroup)
-        subrouter.Get("/album", apiGetAssetsForAllGroups)
+        subrouter.With(Gzip).Get("/album", apiGetAssetsForAllGroups)
         subrouter.Put("/{groupID}", apiJoinGroup)                               // join group by replacing groupkey and linking shared assets
         subrouter.Delete("/{groupID}", apiLeaveGroup)
+        subrouter.Put("/{groupID}/key", apiRotateGroupKey)                      // replace every members group key
         subrouter.Get("/{groupID}/users", apiGetGroupUsers)
         subrouter.Patch("/{groupID}/users", apiAddUsersToGroup)                 // add and remove users
+        subrouter.Post("/{groupID}/users/preview", apiPreviewGroupInvite)       // dry run of adding users
         subrouter.Patch("/{groupID}/album", apiAmendGroupAssets)                // add and remove assets
         subrouter.Patch("/{groupID}/album/shared", apiAmendGroupSharedAssets)   // share and unshare assets
     })
 
     router.Route("/info", func(subrouter chi.Router) {
-        throttle, err := strconv.Atoi(os.Getenv("TRIPUP_SERVER_MAX_REQ"))
-        if err != nil {
-            errLogger.Panicln(err)
-        }
-        subrouter.Use(middleware.Throttle(throttle))    // max 10 requests processed at same time, backlog others
+        subrouter.Use(middleware.Throttle(cfg.ThrottleInfo))    // max N requests processed at same time, backlog others
+        subrouter.Use(provisioned.Require)
         subrouter.Post("/validids", APIValidateIDs)             // POST  /info/validids
+        subrouter.Post("/validate", apiValidateAllIDs)          // POST  /info/validate
     })
 
     router.Route("/schema", func(subrouter chi.Router) {
-        subrouter.Use(middleware.Throttle(throttle))    // max 10 requests processed at same time, backlog others
+        subrouter.Use(middleware.Throttle(cfg.ThrottleSchema))    // max N requests processed at same time, backlog others
+        subrouter.Use(provisioned.Require)
+        subrouter.Get("/", apiGetSchemaVersion)
         subrouter.Route("/0", func(subrouter chi.Router) {
             subrouter.Get("/", apiGetSchema0)
             subrouter.Patch("/", apiPatchSchema0)
         })
     })
 
-    // init server, assign 'router' as the handler
-    apiServer := &http.Server{ Addr: ":" + os.Getenv("TRIPUP_SERVER_PORT"), Handler: router }
+    // routes that are not protected by firebase authorization, these must verify callers by other means
+    publicRouter := chi.NewRouter()
+    publicRouter.Use(middleware.RequestID)          // tag each request with an ID, used when logging errors
+    publicRouter.Use(Tracing)                       // pass the request ID and traceparent on to OneSignal and S3
+    publicRouter.Use(Recoverer)                     // recover from panics in any handler with a JSON 500
+    publicRouter.Use(middleware.Timeout(timeout))
+    publicRouter.Use(limitRequestBody(int64(cfg.MaxRequestBytes)))    // applies to the protected routes mounted below too
+    if optionalFeatures["deliveryreceipts"] {
+        publicRouter.Post("/webhooks/onesignal", apiOneSignalWebhook)
+    }
+    if optionalFeatures["firebasedeprovisioning"] {
+        publicRouter.Post("/webhooks/firebase/user-deleted", apiFirebaseUserDeletedWebhook)
+    }
+    publicRouter.Get("/time", getServerTime)     // reference clock for clients, nothing sensitive so left open
+    publicRouter.Method(http.MethodGet, "/openapi.json", &openAPIDocument{publicRouter: publicRouter, protectedRouter: router})
+    publicRouter.Route("/admin", func(subrouter chi.Router) {
+        subrouter.Use(adminAuth(cfg.AdminAPISecret))    // service token or firebase "admin" custom claim
+        subrouter.Method(http.MethodGet, "/stats", &adminStats{neoDB: neoDB})
+    })
+    stats := &statsCollector{token: cfg.MetricsToken, breaker: notificationBreaker}
+    if len(cfg.MetricsToken) != 0 {
+        publicRouter.Method(http.MethodGet, "/metrics", stats)
+    }
+    publicRouter.Mount("/", router)
+
+    // listen on a unix domain socket (for sidecar proxies) or host:port, host defaults to all interfaces
+    var listener net.Listener
+    if len(cfg.ServerSocket) != 0 {
+        // remove a stale socket left by a previous run, refusing to start rather than delete anything else at that path
+        if info, err := os.Lstat(cfg.ServerSocket); err == nil {
+            if info.Mode() & os.ModeSocket == 0 {
+                errLogger.Panicf("%s exists and is not a socket, refusing to remove it\n", cfg.ServerSocket)
+            }
+            if err := os.Remove(cfg.ServerSocket); err != nil {
+                errLogger.Panicln(err)
+            }
+        } else if !os.IsNotExist(err) {
+            errLogger.Panicln(err)
+        }
+        listener, err = net.Listen("unix", cfg.ServerSocket)
+    } else {
+        listener, err = net.Listen("tcp", net.JoinHostPort(cfg.ServerHost, cfg.ServerPort))
+    }
+    if err != nil {
+        errLogger.Panicln(err)
+    }
+
+    // init server, assign 'publicRouter' as the handler
+    // middleware.Timeout only bounds handler execution, it doesn't start until the request headers have been read;
+    // ReadHeaderTimeout/ReadTimeout protect the header and body read phases that slowloris style clients hold open
+    apiServer := &http.Server{
+        Handler: publicRouter,
+        ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+        ReadTimeout: cfg.ReadTimeout,
+        WriteTimeout: cfg.WriteTimeout,
+        IdleTimeout: cfg.IdleTimeout,   // keep-alive connections are reused by mobile clients making many small requests
+    }
+
+    // built-in TLS is optional, plain HTTP is served when no certificate is configured (e.g. behind a TLS terminating proxy)
+    if len(cfg.TLSCertFile) != 0 {
+        reloader, err := newCertificateReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+        if err != nil {
+            errLogger.Panicln(err)
+        }
+        apiServer.TLSConfig = newTLSConfig(reloader)
+    }
+
+    // periodic maintenance jobs, register with jobs.register(name, interval, exclusive, func) before start
+    // exclusive jobs are coordinated across replicas with a lock in neo4j, so single instances need no extra config
+    hostname, _ := os.Hostname()
+    jobs := newScheduler(neoDB, hostname + "/" + uuid.New().String(), cfg.RunMaintenance)
+    stats.jobs = jobs   // per job run and failure counts on /metrics
+    if len(cfg.MetricsToken) != 0 {
+        jobs.register("global-stats", cfg.StatsInterval, false, stats.refresh(neoDB))
+    }
+    jobs.register("reconcile-storage", cfg.ReconcileInterval, true, reconcileStorage(neoDB))
+    jobs.register("prune-pending-events", pendingEventsPruneInterval, true, prunePendingEvents(neoDB))
+    jobs.register("prune-invalid-recipients", invalidRecipientsPruneInterval, false, unreachable.prune(neoDB))
+    jobs.register("resume-unreachable-recipients", unreachableCheckInterval, false, activity.resume(neoDB))
+    jobs.register("prune-notification-receipts", notificationReceiptsPruneInterval, true, pruneNotificationReceipts(neoDB))
+    jobs.start()
 
+    shutdownComplete := make(chan struct{})
     go func() {
         <-quit      // block and wait for incoming data (SIGINT) on 'quit' channel
         logger.Println("server shutdown command received")
-        apiServer.Shutdown(context.Background())
+        ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+        defer cancel()
+
+        // stop accepting requests and let in-flight ones finish, then drain subsystems in dependency order
+        if err := apiServer.Shutdown(ctx); err != nil {
+            errLogger.Println("http server shutdown failed:", err)
+        }
+        subsystems := []struct {
+            name        string
+            subsystem   shutdowner
+        }{
+            {"scheduler", jobs},
+            {"notification dispatcher", notificationDispatcher},
+            {"storage backend", storageBackend},
+            {"neo4j", neoDB},
+        }
+        for _, entry := range subsystems {
+            if err := entry.subsystem.Shutdown(ctx); err != nil {
+                errLogger.Printf("%s shutdown failed: %v\n", entry.name, err)
+            } else {
+                logger.Printf("%s shutdown complete\n", entry.name)
+            }
+        }
+        close(shutdownComplete)
     }()
 
-    logger.Println("server initialised successfully, listening on port", os.Getenv("TRIPUP_SERVER_PORT"))
+    logger.Printf("effective configuration: %s storage=%s notifications=%t\n", cfg.Summary(), storageBackend.Name(), notificationBreaker != nil)
+    logger.Println("server initialised successfully, listening on", listener.Addr())
     // start server, main thread will pause here
-    if err := apiServer.ListenAndServe(); err != http.ErrServerClosed {
+    if apiServer.TLSConfig != nil {
+        err = apiServer.ServeTLS(listener, "", "")
+    } else {
+        err = apiServer.Serve(listener)
+    }
+    if err != http.ErrServerClosed {
         errLogger.Println(err)
+    } else {
+        <-shutdownComplete
     }
 
     logger.Println("server shutdown complete")
@@ -156,10 +420,26 @@ func apiPing(response http.ResponseWriter, request *http.Request) {
     ping(response, request, database.Instance())
 }
 
+func apiGetCapabilities(response http.ResponseWriter, request *http.Request) {
+    getCapabilities(response, request, database.Instance())
+}
+
+func apiOneSignalWebhook(response http.ResponseWriter, request *http.Request) {
+    oneSignalWebhook(response, request, database.Instance())
+}
+
 func apiGetUUID(response http.ResponseWriter, request *http.Request) {
     getUUID(response, request, database.Instance())
 }
 
+func apiGetUserProfile(response http.ResponseWriter, request *http.Request) {
+    getUserProfile(response, request, database.Instance())
+}
+
+func apiUpdateUserProfile(response http.ResponseWriter, request *http.Request) {
+    updateUserProfile(response, request, database.Instance())
+}
+
 func apiCreateUser(response http.ResponseWriter, request *http.Request) {
     createUser(response, request, database.Instance())
 }
@@ -168,10 +448,26 @@ func apiUpdateUserContact(response http.ResponseWriter, request *http.Request) {
     updateUserContact(response, request, database.Instance())
 }
 
+func apiUpdateNotificationPrefs(response http.ResponseWriter, request *http.Request) {
+    updateNotificationPrefs(response, request, database.Instance())
+}
+
+func apiRemoveUserContact(response http.ResponseWriter, request *http.Request) {
+    removeUserContact(response, request, database.Instance())
+}
+
+func apiExportUserData(response http.ResponseWriter, request *http.Request) {
+    exportUserData(response, request, database.Instance())
+}
+
 func apiGetUser(response http.ResponseWriter, request *http.Request) {
     getUser(response, request, database.Instance())
 }
 
+func apiContactExists(response http.ResponseWriter, request *http.Request) {
+    contactExists(response, request, database.Instance())
+}
+
 func apiCreateGroup(response http.ResponseWriter, request *http.Request) {
     createGroup(response, request, database.Instance())
 }
@@ -192,6 +488,10 @@ func APIValidateIDs(response http.ResponseWriter, request *http.Request) {
     ValidateIDs(response, request, database.Instance())
 }
 
+func apiValidateAllIDs(response http.ResponseWriter, request *http.Request) {
+    validateAllIDs(response, request, database.Instance())
+}
+
 func apiGetUsersFromAddressable(response http.ResponseWriter, request *http.Request) {
     getUsersFromAddressable(response, request, database.Instance())
 }
@@ -224,10 +524,58 @@ func apiPatchAssetsOriginalFilenames(response http.ResponseWriter, request *http
     patchAssetsOriginalFilenames(response, request, database.Instance())
 }
 
+func apiGetAssetsOriginalFilenames(response http.ResponseWriter, request *http.Request) {
+    getAssetsOriginalFilenames(response, request, database.Instance())
+}
+
+func apiGetGroupsForAsset(response http.ResponseWriter, request *http.Request) {
+    getGroupsForAsset(response, request, database.Instance())
+}
+
+func apiMoveSharedAsset(response http.ResponseWriter, request *http.Request) {
+    moveSharedAsset(response, request, database.Instance())
+}
+
+func apiRotateGroupKey(response http.ResponseWriter, request *http.Request) {
+    rotateGroupKey(response, request, database.Instance())
+}
+
+func apiDeleteAssetOriginal(response http.ResponseWriter, request *http.Request) {
+    deleteAssetOriginal(response, request, database.Instance())
+}
+
+func apiSetAssetArchived(response http.ResponseWriter, request *http.Request) {
+    setAssetArchived(response, request, database.Instance())
+}
+
+func apiSetAssetTags(response http.ResponseWriter, request *http.Request) {
+    setAssetTags(response, request, database.Instance())
+}
+
+func apiPatchAssetKeys(response http.ResponseWriter, request *http.Request) {
+    patchAssetKeys(response, request, database.Instance())
+}
+
+func apiPreviewGroupInvite(response http.ResponseWriter, request *http.Request) {
+    previewGroupInvite(response, request, database.Instance())
+}
+
+func apiUnshareAssetFromAllGroups(response http.ResponseWriter, request *http.Request) {
+    unshareAssetFromAllGroups(response, request, database.Instance())
+}
+
 func apiGetAssets(response http.ResponseWriter, request *http.Request) {
     getAssets(response, request, database.Instance())
 }
 
+func apiGetAssetsByIDs(response http.ResponseWriter, request *http.Request) {
+    getAssetsByIDs(response, request, database.Instance())
+}
+
+func apiGetSchemaVersion(response http.ResponseWriter, request *http.Request) {
+    getSchemaVersion(response, request, database.Instance())
+}
+
 func apiGetSchema0(response http.ResponseWriter, request *http.Request) {
     getAssetsSchema0(response, request, database.Instance())
 }
@@ -256,381 +604,630 @@ func apiAmendGroupAssets(response http.ResponseWriter, request *http.Request) {
     amendGroupAssets(response, request, database.Instance())
 }
 
-func GenericErrorHandler(response http.ResponseWriter) {
-    if recovery := recover(); recovery != nil {
+// ServerErrorHandler responds with 503 and a Retry-After hint when the database is unreachable or the connection to it
+// failed, otherwise 500
+func ServerErrorHandler(response http.ResponseWriter, err error) {
+    if database.IsUnavailable(err) {
+        response.Header().Set("Retry-After", "30")
+        response.WriteHeader(http.StatusServiceUnavailable)
+    } else {
         response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(recovery)
     }
+    errLogger.Println(err.Error())
 }
 
-func ping(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
+// decodeCursor returns the position in a pagination cursor issued to the user for the listing in scope, an empty cursor
+// starts from the beginning. Responds with 400 and returns false for cursors that were altered or issued elsewhere
+func decodeCursor(response http.ResponseWriter, userID string, scope string, value string) (string, bool) {
+    if len(value) == 0 {
+        return "", true
+    }
+    position, err := cursor.Decode(cursorSecret, userID, scope, value)
+    if err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte(err.Error()))
+        return "", false
+    }
+    return position, true
+}
 
-    response.WriteHeader(http.StatusOK)
-    response.Write([]byte("TripUp"))
+// readSignedBody reads a request body whose signature is checked before the request is authenticated, so it is capped to
+// stop unauthenticated callers making the server buffer arbitrarily large bodies. Responds with 413 when the body exceeds
+// the limit, or 400 when it can't be read, and returns false
+func readSignedBody(response http.ResponseWriter, request *http.Request) ([]byte, bool) {
+    body, err := ioutil.ReadAll(http.MaxBytesReader(response, request.Body, maxSignedBodySize))
+    if err != nil {
+        if len(body) >= maxSignedBodySize {
+            response.WriteHeader(http.StatusRequestEntityTooLarge)
+            return nil, false
+        }
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to read payload"))
+        return nil, false
+    }
+    return body, true
+}
+
+// requireGroupMember responds with 403 unless the user is a member of the group. The group queries already match nothing
+// for non-members, but handlers go on to notify the group or invitees, and reads would answer non-members with an
+// empty listing rather than refusing them, so non-members are rejected up front
+func requireGroupMember(response http.ResponseWriter, neoDB database.Store, id string, groupID string) bool {
+    member, err := neoDB.IsGroupMember(id, groupID)
+    if err != nil {
+        ServerErrorHandler(response, err)
+        return false
+    }
+    if !member {
+        response.WriteHeader(http.StatusForbidden)
+        response.Write([]byte(database.ErrNotGroupMember.Error()))
+        return false
+    }
+    return true
 }
 
-func getUUID(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
+// notifyGroupExcept notifies every member of a group apart from the user that performed the action
+// members are streamed from the database in batches, each sent as its own notification request
+func notifyGroupExcept(ctx context.Context, neoDB database.Store, groupID string, exceptUserID string, notificationType notification.Notification, data *map[string]string) {
+    err := neoDB.StreamOtherGroupMembers(exceptUserID, groupID, notificationBatchSize, func(userIDs []string, unreachableIDs []string) {
+        notifyUsers(ctx, neoDB, userIDs, notificationType, data)
+        recordUnreachable(neoDB, unreachableIDs, notificationType, data)
+    })
+    if err != nil {
+        errLogger.Println(err.Error())
+    }
+}
 
-    token, ok := firebaseauth.AuthToken(request.Context())
-    if !ok {
-        response.WriteHeader(http.StatusUnauthorized)
-        response.Write([]byte("Unable to extract token from request context"))
+// notifyUsers sends a notification to the given users, skipping those that have opted out of the notification type
+func notifyUsers(ctx context.Context, neoDB database.Store, userIDs []string, notificationType notification.Notification, data *map[string]string) {
+    recipients := unmutedRecipients(neoDB, userIDs, notificationType)
+    if len(recipients) == 0 {
         return
     }
 
-    data, err := neoDB.GetUser(token.UID)
-
-    switch err {
-    case nil:
-        dataJSON, err := json.Marshal(data)
-        if err != nil {
-            response.WriteHeader(http.StatusInternalServerError)
-            errLogger.Println(err.Error())
-        } else {
-            response.WriteHeader(http.StatusOK)
-            response.Write(dataJSON)
-        }
-    case io.EOF:
-        response.WriteHeader(http.StatusNoContent)
-    default:
-        response.WriteHeader(http.StatusInternalServerError)
+    if _, err := notificationService.Notify(ctx, recipients, notificationType, data); err != nil {
         errLogger.Println(err.Error())
     }
 }
 
-func createUser(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
+// unmutedRecipients returns the users that haven't opted out of the notification type
+func unmutedRecipients(neoDB database.Store, userIDs []string, notificationType notification.Notification) []string {
+    prefs, err := neoDB.GetNotificationPrefs(userIDs)
+    if err != nil {
+        // fall back to notifying everyone, as all types are enabled by default
+        errLogger.Println(err.Error())
+        prefs = nil
+    }
 
-    token, ok := firebaseauth.AuthToken(request.Context())
-    if !ok {
-        response.WriteHeader(http.StatusUnauthorized)
-        response.Write([]byte("Unable to extract token from request context"))
-        return
+    var recipients []string
+    for _, userID := range userIDs {
+        muted := false
+        for _, signal := range prefs[userID] {
+            if signal == notificationType.Signal() {
+                muted = true
+                break
+            }
+        }
+        if !muted {
+            recipients = append(recipients, userID)
+        }
     }
+    return recipients
+}
 
-    type User struct {
-        Publickey           string
-        Privatekey          string
+// recordUnreachable keeps the notification as a pending event for members the provider has no device for, they aren't
+// pushed to but still pick it up when they next open the app
+func recordUnreachable(neoDB database.Store, userIDs []string, notificationType notification.Notification, data *map[string]string) {
+    if recipients := unmutedRecipients(neoDB, userIDs, notificationType); len(recipients) != 0 {
+        recordPendingEvents(neoDB)(recipients, notificationType, data)
     }
-    var user User
-    if err := json.NewDecoder(request.Body).Decode(&user); err != nil {
-        response.WriteHeader(http.StatusBadRequest)
-        response.Write([]byte("Unable to decode JSON payload"))
-        return
+}
+
+// notificationBatch accumulates the notifications of a multi-group operation, then sends them together with NotifyMany
+// so identical pushes share a provider call
+type notificationBatch struct {
+    requests    []notification.NotificationRequest
+}
+
+// addGroupExcept queues a notification for every member of a group apart from the user that performed the action
+func (batch *notificationBatch) addGroupExcept(neoDB database.Store, groupID string, exceptUserID string, notificationType notification.Notification, data *map[string]string) {
+    err := neoDB.StreamOtherGroupMembers(exceptUserID, groupID, notificationBatchSize, func(userIDs []string, unreachableIDs []string) {
+        if recipients := unmutedRecipients(neoDB, userIDs, notificationType); len(recipients) != 0 {
+            batch.requests = append(batch.requests, notification.NotificationRequest{UserIDs: recipients, Notification: notificationType, AdditionalData: data})
+        }
+        recordUnreachable(neoDB, unreachableIDs, notificationType, data)
+    })
+    if err != nil {
+        errLogger.Println(err.Error())
     }
+}
 
-    if err := validateArgsNotZero([]string{user.Publickey, user.Privatekey}); err != nil {
-        response.WriteHeader(http.StatusBadRequest)
-        response.Write([]byte(err.Error()))
+func (batch *notificationBatch) send(ctx context.Context) {
+    if len(batch.requests) == 0 {
         return
     }
+    if _, err := notificationService.NotifyMany(ctx, batch.requests); err != nil {
+        errLogger.Println(err.Error())
+    }
+    batch.requests = nil
+}
 
-    authProviders, err := auth.GetUserAuthProviders(request.Context(), token.UID)
+func ping(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    response.WriteHeader(http.StatusOK)
+    response.Write([]byte("TripUp"))
+}
+
+// getServerTime returns the current server time, clients use the offset from their own clock to correct the
+// timestamps they send for timestamp based conflict resolution (e.g. original filename setAt)
+func getServerTime(response http.ResponseWriter, request *http.Request) {
+    now := time.Now().UTC()
+    dataJSON, err := json.Marshal(map[string]interface{} {
+        "time": now.Format(time.RFC3339Nano),
+        "epochMillis": database.EpochMillis(now),
+    })
     if err != nil {
         response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Printf("Invalid auth providers – %+v\n", authProviders)
+        errLogger.Println(err.Error())
         return
     }
+    response.Header().Set("Cache-Control", "no-store")
+    response.Header().Set("Content-Type", "application/json")
+    response.WriteHeader(http.StatusOK)
+    response.Write(dataJSON)
+}
 
-    userid := uuid.New()
-    // TODO: check user id not in use
-
-    err = neoDB.CreateUser(token.UID, userid.String(), authProviders, user.Publickey, user.Privatekey, "1")
+func getCapabilities(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    dataJSON, err := json.Marshal(capabilities)
     if err != nil {
         response.WriteHeader(http.StatusInternalServerError)
         errLogger.Println(err.Error())
-    } else {
-        response.WriteHeader(http.StatusCreated)
-        response.Write([]byte(userid.String()))
+        return
     }
+    response.WriteHeader(http.StatusOK)
+    response.Write(dataJSON)
 }
 
-func updateUserContact(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+// oneSignalWebhook records the delivery receipts OneSignal reports for notifications this server sent, receipts for
+// notifications it has no record of (e.g. sent from the dashboard, or already pruned) and untracked events are
+// acknowledged without being recorded, so OneSignal doesn't retry them
+func oneSignalWebhook(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    body, ok := readSignedBody(response, request)
     if !ok {
+        return
+    }
+
+    if !notification.VerifySignature(oneSignalWebhookSecret, body, request.Header.Get("X-Signature")) {
         response.WriteHeader(http.StatusUnauthorized)
-        response.Write([]byte("Unable to extract token from request context"))
+        response.Write([]byte("Invalid payload signature"))
         return
     }
 
-    authProviders, err := auth.GetUserAuthProviders(request.Context(), token.UID)
-    if err != nil {
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Printf("Invalid auth providers – %+v\n", authProviders)
+    var receipt models.OneSignalEvent
+    if err := json.Unmarshal(body, &receipt); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
         return
     }
 
-    err = neoDB.UpdateUserContact(token.UID, authProviders)
-    if err != nil {
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
+    if err := validateArgsNotZero([]string{receipt.Event, receipt.NotificationID}); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte(err.Error()))
+        return
+    }
+
+    status, tracked := receiptStatuses[receipt.Event]
+    if !tracked {
+        response.WriteHeader(http.StatusOK)
+        return
+    }
+
+    if _, err := neoDB.RecordNotificationReceipt(receipt.NotificationID, receipt.Event, status); err != nil {
+        ServerErrorHandler(response, err)
     } else {
         response.WriteHeader(http.StatusOK)
     }
 }
 
-func getUser(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    _, ok := firebaseauth.AuthToken(request.Context())
+func getUUID(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
         return
     }
 
-    userID := chi.URLParam(request, "userID")
-    if _, err := uuid.Parse(userID); err != nil {
-        response.WriteHeader(http.StatusBadRequest)
-        response.Write([]byte("Invalid UUID string for User ID"))
-        return
-    }
+    data, err := neoDB.GetUser(token.UID)
 
-    existingMatches, _, err := neoDB.GetPublicInfoForUsers([]string{userID}, []string{}, []string{})
     switch err {
     case nil:
-        var publicKey = existingMatches[userID]
-        response.WriteHeader(http.StatusOK)
-        response.Write([]byte(publicKey))
+        dataJSON, err := json.Marshal(data)
+        if err != nil {
+            response.WriteHeader(http.StatusInternalServerError)
+            errLogger.Println(err.Error())
+        } else {
+            response.WriteHeader(http.StatusOK)
+            response.Write(dataJSON)
+        }
     case io.EOF:
         response.WriteHeader(http.StatusNoContent)
     default:
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
+        ServerErrorHandler(response, err)
     }
 }
 
-func getGroups(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func getUserProfile(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
         return
     }
 
-    data, err := neoDB.GetGroups(token.UID)
+    data, err := neoDB.GetUserProfile(token.UID)
     switch err {
     case nil:
         dataJSON, err := json.Marshal(data)
         if err != nil {
             response.WriteHeader(http.StatusInternalServerError)
-            errLogger.Printf("Unable to marshal JSON. Error is:\n%s\n", err.Error())
-            return
+            errLogger.Println(err.Error())
+        } else {
+            response.WriteHeader(http.StatusOK)
+            response.Write(dataJSON)
         }
-        response.WriteHeader(http.StatusOK)
-        response.Write(dataJSON)
     case io.EOF:
         response.WriteHeader(http.StatusNoContent)
     default:
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
+        ServerErrorHandler(response, err)
     }
 }
 
-func joinGroup(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+// exportUserData assembles everything held about the user into a single JSON document: profile, contact details,
+// storage usage, notification preferences, group memberships and asset metadata
+func exportUserData(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
         return
     }
 
-    groupID := chi.URLParam(request, "groupID")
-    if _, err := uuid.Parse(groupID); err != nil {
-        response.WriteHeader(http.StatusBadRequest)
-        response.Write([]byte("Invalid UUID string for Group ID"))
+    profile, err := neoDB.GetUserProfile(token.UID)
+    switch err {
+    case nil:
+    case io.EOF:
+        response.WriteHeader(http.StatusNoContent)
+        return
+    default:
+        ServerErrorHandler(response, err)
         return
     }
 
-    var group struct {
-        Key    string
-    }
-    if err := json.NewDecoder(request.Body).Decode(&group); err != nil {
-        response.WriteHeader(http.StatusBadRequest)
-        response.Write([]byte("Unable to decode JSON payload"))
-        return
+    account, err := neoDB.GetUserAccount(token.UID)
+    if err != nil {
+        ServerErrorHandler(response, err)
+        return
     }
 
-    err := neoDB.JoinGroup(token.UID, groupID, group.Key)
+    prefs, err := neoDB.GetNotificationPrefs([]string{profile["uuid"].(string)})
     if err != nil {
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
-    } else {
-        response.WriteHeader(http.StatusCreated)
+        ServerErrorHandler(response, err)
+        return
+    }
 
-        // notify users
-        var userIDs []string
-        groupUsers, err := neoDB.GetUsersInGroup(token.UID, groupID)
-        if err == io.EOF {
+    groups := make(map[string]map[string]interface{})
+    for cursor := ""; ; {
+        page, next, err := neoDB.GetGroupsFiltered(token.UID, "", cursor, maxGroupsPageSize)
+        if err != nil && err != io.EOF {
+            ServerErrorHandler(response, err)
             return
         }
-        for userID := range groupUsers {
-            userIDs = append(userIDs, userID)
+        for groupID, group := range page {
+            groups[groupID] = group
         }
-        err = notificationService.Notify(userIDs, notification.UserJoinedGroup, &map[string]string{"groupid": groupID})
-        if err != nil {
-            errLogger.Println(err.Error())
-            return
+        if len(next) == 0 {
+            break
         }
+        cursor = next
+    }
+
+    assets, err := neoDB.GetAssets(token.UID, true, database.AssetOrder{})
+    if err != nil && err != io.EOF {
+        ServerErrorHandler(response, err)
+        return
+    }
+    if assets == nil {
+        assets = []interface{}{}
     }
-}
 
-func createGroup(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
+    disabled := prefs[profile["uuid"].(string)]
+    if disabled == nil {
+        disabled = []string{}
+    }
+    dataJSON, err := json.Marshal(map[string]interface{} {
+        "exportedAt": time.Now().UTC().Format(time.RFC3339),
+        "profile": profile,
+        "account": account,
+        "disabledNotifications": disabled,
+        "groups": groups,
+        "assets": assets,
+    })
+    if err != nil {
+        response.WriteHeader(http.StatusInternalServerError)
+        errLogger.Printf("Unable to marshal JSON. Error is:\n%s\n", err.Error())
+        return
+    }
+    response.Header().Set("Content-Disposition", "attachment; filename=\"tripup-export.json\"")
+    response.WriteHeader(http.StatusOK)
+    response.Write(dataJSON)
+}
 
-    token, ok := firebaseauth.AuthToken(request.Context())
+func updateUserProfile(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
         return
     }
 
-    var group struct {
-        Name    string
-        Key     string
+    var profile models.UserProfile
+    if err := json.NewDecoder(request.Body).Decode(&profile); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    if len(profile.Avatar) != 0 {
+        if _, err := uuid.Parse(profile.Avatar); err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("Invalid UUID string for Avatar"))
+            return
+        }
     }
-    if err := json.NewDecoder(request.Body).Decode(&group); err != nil {
+
+    err := neoDB.SetUserProfile(token.UID, profile.Nickname, profile.Avatar)
+    switch err {
+    case nil:
+        response.WriteHeader(http.StatusOK)
+    case database.ErrAssetNotFound:
+        response.WriteHeader(http.StatusNotFound)
+        response.Write([]byte(err.Error()))
+    case database.ErrAssetNotOwned:
+        response.WriteHeader(http.StatusForbidden)
+        response.Write([]byte(err.Error()))
+    default:
+        ServerErrorHandler(response, err)
+    }
+}
+
+func createUser(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    var user models.NewUser
+    if err := json.NewDecoder(request.Body).Decode(&user); err != nil {
         response.WriteHeader(http.StatusBadRequest)
         response.Write([]byte("Unable to decode JSON payload"))
         return
     }
 
-    if err := validateArgsNotZero([]string{group.Name, group.Key}); err != nil {
+    if err := validateArgsNotZero([]string{user.Publickey, user.Privatekey}); err != nil {
         response.WriteHeader(http.StatusBadRequest)
         response.Write([]byte(err.Error()))
         return
     }
 
-    groupid := uuid.New()
-    // TODO: verify trip uuid isn't already in use
-
-    err := neoDB.CreateGroup(token.UID, groupid.String(), group.Name, group.Key)
+    authProviders, err := userAuthProviders(request.Context(), token.UID)
     if err != nil {
         response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
-    } else {
+        errLogger.Printf("Invalid auth providers – %+v\n", authProviders)
+        return
+    }
+
+    var userid uuid.UUID
+    for attempt := 0; attempt < maxIDAttempts; attempt++ {
+        userid = newID()
+        err = neoDB.CreateUser(token.UID, userid.String(), authProviders, user.Publickey, user.Privatekey, latestSchemaVersion)
+        if err != database.ErrIDInUse {
+            break
+        }
+        warnLogger.Printf("generated user uuid %s already in use, retrying\n", userid)
+    }
+    switch err {
+    case nil:
         response.WriteHeader(http.StatusCreated)
-        response.Write([]byte(groupid.String()))
+        response.Write([]byte(userid.String()))
+    case database.ErrUserExists:
+        // e.g. a retry after a timeout, respond with the user created by the first attempt
+        existing, err := neoDB.GetUser(token.UID)
+        if err != nil {
+            ServerErrorHandler(response, err)
+            return
+        }
+        response.WriteHeader(http.StatusOK)
+        response.Write([]byte((*existing)["uuid"]))
+    default:
+        ServerErrorHandler(response, err)
     }
 }
 
-func addUsersToGroup(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func updateUserContact(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
         return
     }
 
-    groupID := chi.URLParam(request, "groupID")
-    if _, err := uuid.Parse(groupID); err != nil {
-        response.WriteHeader(http.StatusBadRequest)
-        response.Write([]byte("Invalid UUID string for Group ID"))
+    authProviders, err := userAuthProviders(request.Context(), token.UID)
+    if err != nil {
+        response.WriteHeader(http.StatusInternalServerError)
+        errLogger.Printf("Invalid auth providers – %+v\n", authProviders)
         return
     }
 
-    var payload struct {
-        Users []map[string]string
+    err = neoDB.UpdateUserContact(token.UID, authProviders)
+    if err != nil {
+        ServerErrorHandler(response, err)
+    } else {
+        response.WriteHeader(http.StatusOK)
     }
-    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
-        response.WriteHeader(http.StatusBadRequest)
-        response.Write([]byte("Unable to decode JSON payload"))
+}
+
+func removeUserContact(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
         return
     }
 
-    if len(payload.Users) == 0 {
+    provider := chi.URLParam(request, "provider")
+    if provider != "phone" && provider != "email" && provider != "apple" {
         response.WriteHeader(http.StatusBadRequest)
-        response.Write([]byte("Empty data supplied"))
+        response.Write([]byte("Invalid contact provider, must be one of phone, email or apple"))
         return
     }
 
-    err := neoDB.AddUsersToGroup(token.UID, groupID, payload.Users)
-    if err != nil {
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
-    } else {
+    err := neoDB.RemoveUserContact(token.UID, provider)
+    switch err {
+    case nil:
         response.WriteHeader(http.StatusOK)
+    case io.EOF:
+        response.WriteHeader(http.StatusNoContent)
+    case database.ErrLastContact:
+        response.WriteHeader(http.StatusConflict)
+        response.Write([]byte(err.Error()))
+    default:
+        ServerErrorHandler(response, err)
+    }
+}
 
-        // notify users
-        var userIDs []string
-        for _, user := range payload.Users {
-            userIDs = append(userIDs, user["uuid"])
-        }
-        err = notificationService.Notify(userIDs, notification.GroupInvite, nil)
-        if err != nil {
-            errLogger.Println(err.Error())
+func updateNotificationPrefs(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    var prefs map[string]bool
+    if err := json.NewDecoder(request.Body).Decode(&prefs); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    // types not present in the payload remain enabled
+    var disabled []string
+    for signal, enabled := range prefs {
+        if !notification.IsValidSignal(signal) {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("Unknown notification type: " + signal))
             return
         }
+        if !enabled {
+            disabled = append(disabled, signal)
+        }
     }
-}
-
-func ValidateIDs(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
 
-    type RequestData struct {
-        ArrayOfIDs []string
+    if err := neoDB.SetNotificationPrefs(token.UID, disabled); err != nil {
+        ServerErrorHandler(response, err)
+    } else {
+        response.WriteHeader(http.StatusOK)
     }
+}
 
-    var ids RequestData
-    if err := json.NewDecoder(request.Body).Decode(&ids); err != nil {
-        errLogger.Panicln(err)
+func getUser(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    _, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
     }
 
-    result, err := neoDB.VerifyUUIDS(ids.ArrayOfIDs)
-    if err == io.EOF {
-        logger.Println("no valid ids found")
-        response.WriteHeader(http.StatusNoContent)
+    userID := chi.URLParam(request, "userID")
+    if _, err := uuid.Parse(userID); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Invalid UUID string for User ID"))
         return
     }
 
-    dataJson, err := json.Marshal(result)
-    if err != nil {
-        errLogger.Panicln(err)
+    existingMatches, _, err := neoDB.GetPublicInfoForUsers([]string{userID}, []string{}, []string{})
+    switch err {
+    case nil:
+        var publicKey = existingMatches[userID]
+        response.WriteHeader(http.StatusOK)
+        response.Write([]byte(publicKey))
+    case io.EOF:
+        response.WriteHeader(http.StatusNoContent)
+    default:
+        ServerErrorHandler(response, err)
     }
-    response.WriteHeader(http.StatusOK)
-    response.Write(dataJson)
 }
 
-func getUsersFromAddressable(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
+func getGroups(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
 
-    var contacts struct {
-        Uuids   []string
-        Numbers []string
-        Emails  []string
+    // without ?limit=N or ?cursor=C the legacy map of every group is returned, as older clients don't follow cursors;
+    // with either the response is a page of {"groups", "next"}. ?q=name filters both
+    params := request.URL.Query()
+    paginated := len(params.Get("limit")) != 0 || len(params.Get("cursor")) != 0
+    limit := 0
+    if paginated {
+        limit = maxGroupsPageSize
+    }
+    if limitParam := params.Get("limit"); len(limitParam) != 0 {
+        var err error
+        limit, err = strconv.Atoi(limitParam)
+        if err != nil || limit <= 0 || limit > maxGroupsPageSize {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte(fmt.Sprintf("limit must be between 1 and %d", maxGroupsPageSize)))
+            return
+        }
     }
-    if err := json.NewDecoder(request.Body).Decode(&contacts); err != nil {
-        response.WriteHeader(http.StatusBadRequest)
-        response.Write([]byte("Unable to decode JSON payload"))
+
+    position, ok := decodeCursor(response, token.UID, "groups", params.Get("cursor"))
+    if !ok {
         return
     }
 
-    if len(contacts.Uuids) == 0 && len(contacts.Numbers) == 0 && len(contacts.Emails) == 0 {
-        response.WriteHeader(http.StatusBadRequest)
-        response.Write([]byte("No addresses provided"))
+    data, next, err := neoDB.GetGroupsFiltered(token.UID, params.Get("q"), position, limit)
+    if err == nil && params.Get("withMemberCounts") == "true" {
+        // counted for the groups on this page in one query, rather than a request per group
+        groupIDs := make([]string, 0, len(data))
+        for groupID := range data {
+            groupIDs = append(groupIDs, groupID)
+        }
+        var counts map[string]int64
+        counts, err = neoDB.GetGroupsWithMemberCounts(token.UID, groupIDs)
+        for groupID, group := range data {
+            group["memberCount"] = counts[groupID]
+        }
     }
-
-    existingMatches, newMatches, err := neoDB.GetPublicInfoForUsers(contacts.Uuids, contacts.Numbers, contacts.Emails)
     switch err {
     case nil:
-        result := map[string]interface{} {
-            "uuids": existingMatches,
-            "otherIdentifiers": newMatches,
+        var result interface{} = data
+        if len(next) != 0 {
+            next = cursor.Encode(cursorSecret, token.UID, "groups", next)
+        }
+        if paginated {
+            result = map[string]interface{} {
+                "groups": data,
+                "next": next,
+            }
         }
         dataJSON, err := json.Marshal(result)
         if err != nil {
             response.WriteHeader(http.StatusInternalServerError)
-            errLogger.Println(err.Error())
+            errLogger.Printf("Unable to marshal JSON. Error is:\n%s\n", err.Error())
             return
         }
         response.WriteHeader(http.StatusOK)
@@ -638,15 +1235,12 @@ func getUsersFromAddressable(response http.ResponseWriter, request *http.Request
     case io.EOF:
         response.WriteHeader(http.StatusNoContent)
     default:
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
+        ServerErrorHandler(response, err)
     }
 }
 
-func getGroupUsers(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func joinGroup(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
@@ -660,102 +1254,664 @@ func getGroupUsers(response http.ResponseWriter, request *http.Request, neoDB *d
         return
     }
 
-    data, err := neoDB.GetUsersInGroup(token.UID, groupID)
-    if err == io.EOF {
-        response.WriteHeader(http.StatusNoContent)
+    var group models.GroupMembership
+    if err := json.NewDecoder(request.Body).Decode(&group); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
         return
     }
 
-    dataJSON, err := json.Marshal(data)
-    if err != nil {
-        response.WriteHeader(http.StatusInternalServerError)
-        response.Write([]byte("Unable to marshal JSON"))
+    if err := validateArgsNotZero([]string{group.Key}); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte(err.Error()))
         return
     }
-    response.WriteHeader(http.StatusOK)
-    response.Write(dataJSON)
-}
 
-type asset struct {
-    AssetID string
-    Type string
-    RemotePath string
-    RemotePathOrig *string
-    CreateDate *string
-    Location *string
-    Duration *string
-    OriginalFilename *string
-    OriginalUTI *string
-    PixelWidth int
-    PixelHeight int
-    Md5 string
-    Key string
+    err := neoDB.JoinGroup(token.UID, groupID, group.Key)
+    switch err {
+    case nil:
+        response.WriteHeader(http.StatusCreated)
+        notifyGroupExcept(request.Context(), neoDB, groupID, token.UID, notification.UserJoinedGroup, &map[string]string{"groupid": groupID})
+    case database.ErrAlreadyMember:
+        response.WriteHeader(http.StatusOK)     // retried join, nothing changed so members aren't notified again
+    case database.ErrNotGroupMember:
+        response.WriteHeader(http.StatusForbidden)
+        response.Write([]byte(err.Error()))
+    default:
+        ServerErrorHandler(response, err)
+    }
 }
 
-func createAsset(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func rotateGroupKey(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
         return
     }
 
-    var asset asset
-    if err := json.NewDecoder(request.Body).Decode(&asset); err != nil {
+    groupID := chi.URLParam(request, "groupID")
+    if _, err := uuid.Parse(groupID); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Invalid UUID string for Group ID"))
+        return
+    }
+
+    var keys map[string]string     // user uuid -> group key encrypted for that user
+    if err := json.NewDecoder(request.Body).Decode(&keys); err != nil {
         response.WriteHeader(http.StatusBadRequest)
         response.Write([]byte("Unable to decode JSON payload"))
         return
     }
 
-    httpStatus, err, totalsize := createSingleAsset(asset, token.UID, neoDB)
-    if err != nil {
-        response.WriteHeader(httpStatus)
-        if httpStatus == http.StatusInternalServerError {
-            errLogger.Println(err.Error())
-        } else {
-            response.Write([]byte(err.Error()))
-        }
+    if len(keys) == 0 {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("payload is empty"))
         return
     }
+    for userID, key := range keys {
+        if err := validateArgsNotZero([]string{userID, key}); err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("Invalid user ID or key"))
+            return
+        }
+    }
 
-    response.WriteHeader(http.StatusCreated)
-    if totalsize != nil {
-        b := make([]byte, 8)
-        binary.LittleEndian.PutUint64(b, *totalsize)
-        response.Write(b)
+    err := neoDB.RotateGroupKey(token.UID, groupID, keys)
+    var mismatch *database.KeyMapMismatchError
+    switch {
+    case err == nil:
+        response.WriteHeader(http.StatusOK)
+        notifyGroupExcept(request.Context(), neoDB, groupID, token.UID, notification.GroupKeyRotated, &map[string]string{"groupid": groupID})
+    case errors.As(err, &mismatch):
+        dataJSON, _ := json.Marshal(map[string][]string{"missing": mismatch.Missing, "unexpected": mismatch.Unexpected})
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write(dataJSON)
+    case err == database.ErrNotGroupMember:
+        response.WriteHeader(http.StatusForbidden)
+        response.Write([]byte(err.Error()))
+    default:
+        ServerErrorHandler(response, err)
     }
 }
 
-func patchAssets(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func createGroup(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
         return
     }
 
-    var payload struct {
-        CREATE []asset  `json:",omitempty"`
-        DELETE []string `json:",omitempty"`
-    }
-    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+    var group models.NewGroup
+    if err := json.NewDecoder(request.Body).Decode(&group); err != nil {
         response.WriteHeader(http.StatusBadRequest)
         response.Write([]byte("Unable to decode JSON payload"))
         return
     }
 
-    var httpStatus int
-    var err error
-    var resultData = make(map[string]int)
+    if err := validateArgsNotZero([]string{group.Name, group.Key}); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte(err.Error()))
+        return
+    }
 
-    if len(payload.CREATE) != 0 {
-        for _, asset := range payload.CREATE {
-            var totalsize *uint64
-            httpStatus, err, totalsize = createSingleAsset(asset, token.UID, neoDB)
+    var groupid uuid.UUID
+    var err error
+    for attempt := 0; attempt < maxIDAttempts; attempt++ {
+        groupid = newID()
+        err = neoDB.CreateGroup(token.UID, groupid.String(), group.Name, group.Key)
+        if err != database.ErrIDInUse {
+            break
+        }
+        warnLogger.Printf("generated group uuid %s already in use, retrying\n", groupid)
+    }
+    if err != nil {
+        ServerErrorHandler(response, err)
+    } else {
+        response.WriteHeader(http.StatusCreated)
+        response.Write([]byte(groupid.String()))
+    }
+}
+
+func addUsersToGroup(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    groupID := chi.URLParam(request, "groupID")
+    if _, err := uuid.Parse(groupID); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Invalid UUID string for Group ID"))
+        return
+    }
+
+    if !requireGroupMember(response, neoDB, token.UID, groupID) {
+        return
+    }
+
+    var payload models.GroupInvites
+    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    if len(payload.Users) == 0 {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Empty data supplied"))
+        return
+    }
+    if len(payload.Users) > maxGroupInvites {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte(fmt.Sprintf("at most %d users can be added per request", maxGroupInvites)))
+        return
+    }
+    // pending invites count towards the size as well, as they become members once accepted
+    members, err := neoDB.GetUsersInGroup(token.UID, groupID)
+    if err != nil && err != io.EOF {
+        ServerErrorHandler(response, err)
+        return
+    }
+    size := len(members) + 1    // members are listed without the caller
+    for _, user := range payload.Users {
+        if _, member := members[user["uuid"]]; !member {
+            size++
+        }
+    }
+    if size > maxGroupSize {
+        response.WriteHeader(http.StatusConflict)
+        response.Write([]byte(fmt.Sprintf("groups can have at most %d members", maxGroupSize)))
+        return
+    }
+    // every entry is written and notified, so one missing a field would add a keyless member or notify nobody
+    for index, user := range payload.Users {
+        if _, err := uuid.Parse(user["uuid"]); err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte(fmt.Sprintf("users[%d] has an invalid UUID string for User ID", index)))
+            return
+        }
+        if len(user["key"]) == 0 {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte(fmt.Sprintf("users[%d] has no key", index)))
+            return
+        }
+    }
+
+    err = neoDB.AddUsersToGroup(token.UID, groupID, payload.Users)
+    if err != nil {
+        ServerErrorHandler(response, err)
+    } else {
+        response.WriteHeader(http.StatusOK)
+
+        // notify users
+        var userIDs []string
+        for _, user := range payload.Users {
+            userIDs = append(userIDs, user["uuid"])
+        }
+        notifyUsers(request.Context(), neoDB, userIDs, notification.GroupInvite, nil)
+    }
+}
+
+// previewGroupInvite reports, for each user in an add users payload, whether they are a registered user and whether they
+// are already a member of the group, so the client can confirm recipients before the invite notification goes out
+func previewGroupInvite(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    groupID := chi.URLParam(request, "groupID")
+    if _, err := uuid.Parse(groupID); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Invalid UUID string for Group ID"))
+        return
+    }
+
+    if !requireGroupMember(response, neoDB, token.UID, groupID) {
+        return
+    }
+
+    var payload models.GroupInvites
+    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    if len(payload.Users) == 0 {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Empty data supplied"))
+        return
+    }
+
+    // malformed ids can't belong to a registered user, so aren't looked up
+    var userIDs []string
+    for _, user := range payload.Users {
+        if _, err := uuid.Parse(user["uuid"]); err == nil {
+            userIDs = append(userIDs, user["uuid"])
+        }
+    }
+
+    registered := make(map[string]bool)
+    if len(userIDs) != 0 {
+        valid, err := neoDB.VerifyUUIDS(userIDs)
+        if err != nil && err != io.EOF {
+            ServerErrorHandler(response, err)
+            return
+        }
+        for _, userID := range valid {
+            registered[userID] = true
+        }
+    }
+
+    members, err := neoDB.GetUsersInGroup(token.UID, groupID)
+    if err != nil && err != io.EOF {
+        ServerErrorHandler(response, err)
+        return
+    }
+    caller, err := neoDB.GetUser(token.UID)
+    if err != nil {
+        ServerErrorHandler(response, err)
+        return
+    }
+    members[(*caller)["uuid"]] = ""     // GetUsersInGroup only returns the other members
+
+    result := make(map[string]map[string]bool)
+    for _, user := range payload.Users {
+        _, member := members[user["uuid"]]
+        result[user["uuid"]] = map[string]bool {
+            "valid": registered[user["uuid"]],
+            "alreadyMember": member,
+        }
+    }
+
+    dataJSON, err := json.Marshal(result)
+    if err != nil {
+        response.WriteHeader(http.StatusInternalServerError)
+        errLogger.Println(err.Error())
+        return
+    }
+    response.WriteHeader(http.StatusOK)
+    response.Write(dataJSON)
+}
+
+func ValidateIDs(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    var ids models.IDList
+    if err := json.NewDecoder(request.Body).Decode(&ids); err != nil {
+        errLogger.Panicln(err)
+    }
+
+    result, err := neoDB.VerifyUUIDS(ids.ArrayOfIDs)
+    if err == io.EOF {
+        logger.Println("no valid ids found")
+        response.WriteHeader(http.StatusNoContent)
+        return
+    } else if err != nil {
+        ServerErrorHandler(response, err)
+        return
+    }
+
+    dataJson, err := json.Marshal(result)
+    if err != nil {
+        errLogger.Panicln(err)
+    }
+    response.WriteHeader(http.StatusOK)
+    response.Write(dataJson)
+}
+
+// validateAllIDs checks users, assets and groups in one round trip, for clients reconciling their local state
+func validateAllIDs(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    var payload models.IDValidation
+    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    if len(payload.UserIDs) == 0 && len(payload.AssetIDs) == 0 && len(payload.GroupIDs) == 0 {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("payload is empty"))
+        return
+    }
+
+    result, err := neoDB.ValidateIDs(token.UID, payload.UserIDs, payload.AssetIDs, payload.GroupIDs)
+    if err != nil {
+        ServerErrorHandler(response, err)
+        return
+    }
+
+    dataJSON, err := json.Marshal(result)
+    if err != nil {
+        response.WriteHeader(http.StatusInternalServerError)
+        errLogger.Println(err.Error())
+    } else {
+        response.WriteHeader(http.StatusOK)
+        response.Write(dataJSON)
+    }
+}
+
+func getUsersFromAddressable(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    // only registered users can look up contacts, a valid token alone isn't enough
+    if _, err := neoDB.GetUser(token.UID); err != nil {
+        if err == io.EOF {
+            response.WriteHeader(http.StatusForbidden)
+            response.Write([]byte("User not registered"))
+        } else {
+            ServerErrorHandler(response, err)
+        }
+        return
+    }
+
+    var contacts models.ContactLookup
+    if err := json.NewDecoder(request.Body).Decode(&contacts); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    if len(contacts.Uuids) == 0 && len(contacts.Numbers) == 0 && len(contacts.Emails) == 0 {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("No addresses provided"))
+        return
+    }
+
+    if identifiers := len(contacts.Uuids) + len(contacts.Numbers) + len(contacts.Emails); identifiers > maxLookupIdentifiers {
+        warnLogger.Printf("contact lookup: user %s sent %d identifiers, possible enumeration\n", token.UID, identifiers)
+        response.WriteHeader(http.StatusRequestEntityTooLarge)
+        response.Write([]byte(fmt.Sprintf("at most %d identifiers per request", maxLookupIdentifiers)))
+        return
+    }
+
+    existingMatches, newMatches, err := neoDB.GetPublicInfoForUsers(contacts.Uuids, contacts.Numbers, contacts.Emails)
+    switch err {
+    case nil:
+        result := map[string]interface{} {
+            "uuids": existingMatches,
+            "otherIdentifiers": newMatches,
+        }
+
+        // display fields are only included when requested, to keep the response unchanged for older clients
+        if request.URL.Query().Get("profiles") == "true" {
+            var userIDs []string
+            for userID := range existingMatches {
+                userIDs = append(userIDs, userID)
+            }
+            for _, match := range newMatches {
+                userIDs = append(userIDs, match["uuid"])
+            }
+            profiles, err := neoDB.GetProfilesForUsers(userIDs)
+            if err != nil {
+                ServerErrorHandler(response, err)
+                return
+            }
+            result["profiles"] = profiles
+        }
+        dataJSON, err := json.Marshal(result)
+        if err != nil {
+            response.WriteHeader(http.StatusInternalServerError)
+            errLogger.Println(err.Error())
+            return
+        }
+        response.WriteHeader(http.StatusOK)
+        response.Write(dataJSON)
+    case io.EOF:
+        response.WriteHeader(http.StatusNoContent)
+    default:
+        ServerErrorHandler(response, err)
+    }
+}
+
+// contactExists reports whether a single phone number or email belongs to a user, without saying who, for invite flows that
+// don't need the public key. Identifiers are hashed by the client as for getUsersFromAddressable, so plaintext contact
+// details never reach the server. It still allows enumeration, so is rate limited much harder than getUsersFromAddressable
+func contactExists(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    var contact models.ContactQuery
+    if err := json.NewDecoder(request.Body).Decode(&contact); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+    if (len(contact.Number) == 0) == (len(contact.Email) == 0) {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("exactly one of number or email must be provided"))
+        return
+    }
+
+    var numbers, emails []string
+    if len(contact.Number) != 0 {
+        numbers = []string{contact.Number}
+    } else {
+        emails = []string{contact.Email}
+    }
+
+    exists := true
+    _, _, err := neoDB.GetPublicInfoForUsers(nil, numbers, emails)
+    switch err {
+    case nil:
+    case io.EOF:
+        exists = false
+    default:
+        ServerErrorHandler(response, err)
+        return
+    }
+    dataJSON, err := json.Marshal(map[string]bool{"exists": exists})
+    if err != nil {
+        response.WriteHeader(http.StatusInternalServerError)
+        errLogger.Println(err.Error())
+        return
+    }
+    response.WriteHeader(http.StatusOK)
+    response.Write(dataJSON)
+}
+
+func getGroupUsers(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    groupID := chi.URLParam(request, "groupID")
+    if _, err := uuid.Parse(groupID); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Invalid UUID string for Group ID"))
+        return
+    }
+
+    if !requireGroupMember(response, neoDB, token.UID, groupID) {
+        return
+    }
+
+    // without a limit the full membership map is returned, as before; with ?limit=N[&cursor=C] members are paged by uuid
+    // ?withStats=true returns every member with their shared asset count instead, and isn't paginated
+    var result interface{}
+    if request.URL.Query().Get("withStats") == "true" {
+        users, err := neoDB.GetUsersInGroupWithStats(token.UID, groupID)
+        if err == database.ErrNotGroupMember {
+            response.WriteHeader(http.StatusForbidden)
+            response.Write([]byte(err.Error()))
+            return
+        } else if err != nil {
+            ServerErrorHandler(response, err)
+            return
+        }
+        result = users
+    } else if limitParam := request.URL.Query().Get("limit"); len(limitParam) != 0 {
+        limit, err := strconv.Atoi(limitParam)
+        if err != nil || limit <= 0 || limit > maxGroupUsersPageSize {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte(fmt.Sprintf("limit must be between 1 and %d", maxGroupUsersPageSize)))
+            return
+        }
+        scope := "groups/" + groupID + "/users"
+        position, ok := decodeCursor(response, token.UID, scope, request.URL.Query().Get("cursor"))
+        if !ok {
+            return
+        }
+        users, next, err := neoDB.GetUsersInGroupPaginated(token.UID, groupID, position, limit)
+        if err == io.EOF {
+            response.WriteHeader(http.StatusNoContent)
+            return
+        } else if err != nil {
+            ServerErrorHandler(response, err)
+            return
+        }
+        if len(next) != 0 {
+            next = cursor.Encode(cursorSecret, token.UID, scope, next)
+        }
+        result = map[string]interface{} {
+            "users": users,
+            "next": next,
+        }
+    } else {
+        users, err := neoDB.GetUsersInGroup(token.UID, groupID)
+        if err == io.EOF {
+            response.WriteHeader(http.StatusNoContent)
+            return
+        } else if err != nil {
+            ServerErrorHandler(response, err)
+            return
+        }
+        result = users
+    }
+
+    dataJSON, err := json.Marshal(result)
+    if err != nil {
+        response.WriteHeader(http.StatusInternalServerError)
+        response.Write([]byte("Unable to marshal JSON"))
+        return
+    }
+    response.WriteHeader(http.StatusOK)
+    response.Write(dataJSON)
+}
+
+func createAsset(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    var asset models.Asset
+    if err := json.NewDecoder(request.Body).Decode(&asset); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    httpStatus, err, created := createSingleAssetDetailed(request.Context(), asset, token.UID, neoDB)
+    if err != nil {
+        if httpStatus == http.StatusInternalServerError {
+            ServerErrorHandler(response, err)
+        } else {
+            response.WriteHeader(httpStatus)
+            response.Write([]byte(err.Error()))
+        }
+        return
+    }
+
+    // clients opt in to what the server stored for the asset, so they can reconcile it with what they sent
+    if strings.Contains(request.Header.Get("Accept"), createdAssetMediaType) {
+        dataJSON, err := json.Marshal(created)
+        if err != nil {
+            response.WriteHeader(http.StatusInternalServerError)
+            errLogger.Println(err.Error())
+            return
+        }
+        response.Header().Set("Content-Type", createdAssetMediaType)
+        response.WriteHeader(httpStatus)
+        response.Write(dataJSON)
+        return
+    }
+
+    // existing assets also respond with 201, as legacy clients retrying a create expect it
+    totalsize := created.Totalsize
+    if totalsize == nil {
+        response.WriteHeader(http.StatusCreated)
+        return
+    }
+
+    // clients opt in to JSON via the Accept header, matching the PATCH /assets response
+    // otherwise the legacy format is used: totalsize as 8 little-endian bytes (uint64)
+    if strings.Contains(request.Header.Get("Accept"), "application/json") {
+        dataJSON, err := json.Marshal(map[string]uint64{"totalsize": *totalsize})
+        if err != nil {
+            response.WriteHeader(http.StatusInternalServerError)
+            errLogger.Println(err.Error())
+            return
+        }
+        response.Header().Set("Content-Type", "application/json")
+        response.WriteHeader(http.StatusCreated)
+        response.Write(dataJSON)
+    } else {
+        b := make([]byte, 8)
+        binary.LittleEndian.PutUint64(b, *totalsize)
+        response.Header().Set("Content-Type", "application/octet-stream")
+        response.WriteHeader(http.StatusCreated)
+        response.Write(b)
+    }
+}
+
+func patchAssets(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    var payload models.AssetBatch
+    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    // reject the whole batch before anything is created, so malformed ids never reach the database or storage
+    for _, assetID := range payload.DELETE {
+        if _, err := uuid.Parse(assetID); err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("Invalid UUID string for Asset ID in DELETE: " + assetID))
+            return
+        }
+    }
+
+    // opt in to per-item outcomes, otherwise the batch aborts on the first error as legacy clients expect
+    if request.URL.Query().Get("partial") == "true" {
+        patchAssetsPartial(request.Context(), response, token.UID, payload.CREATE, payload.DELETE, neoDB)
+        return
+    }
+
+    var httpStatus int
+    var err error
+    var resultData = make(map[string]int)
+
+    if len(payload.CREATE) != 0 {
+        for _, asset := range payload.CREATE {
+            var totalsize *uint64
+            httpStatus, err, totalsize = createSingleAsset(request.Context(), asset, token.UID, neoDB)
             if err != nil {
                 break
             }
@@ -766,24 +1922,24 @@ func patchAssets(response http.ResponseWriter, request *http.Request, neoDB *dat
     }
 
     if err != nil {
-        response.WriteHeader(httpStatus)
         if httpStatus == http.StatusInternalServerError {
-            errLogger.Println(err.Error())
+            ServerErrorHandler(response, err)
         } else {
+            response.WriteHeader(httpStatus)
             response.Write([]byte(err.Error()))
         }
         return
     }
 
     if len(payload.DELETE) != 0 {
-        httpStatus, err = deleteAssets(payload.DELETE, token.UID, neoDB)
+        httpStatus, err = deleteAssets(request.Context(), payload.DELETE, token.UID, neoDB)
     }
 
     if err != nil {
-        response.WriteHeader(httpStatus)
         if httpStatus == http.StatusInternalServerError {
-            errLogger.Println(err.Error())
+            ServerErrorHandler(response, err)
         } else {
+            response.WriteHeader(httpStatus)
             response.Write([]byte(err.Error()))
         }
         return
@@ -803,7 +1959,69 @@ func patchAssets(response http.ResponseWriter, request *http.Request, neoDB *dat
     }
 }
 
-func createSingleAsset(asset asset, uid string, neoDB *database.Neo4j) (int, error, *uint64) {
+// patchAssetsPartial processes every item in the batch regardless of earlier failures, responding with the outcome of
+// each item by asset ID, with 207 Multi-Status if any item failed so the client can retry just the failed items
+func patchAssetsPartial(ctx context.Context, response http.ResponseWriter, uid string, creates []models.Asset, deletes []string, neoDB database.Store) {
+    results := map[string]map[string]models.AssetResult {
+        "CREATE": make(map[string]models.AssetResult),
+        "DELETE": make(map[string]models.AssetResult),
+    }
+    failed := false
+    failure := func(httpStatus int, err error) models.AssetResult {
+        failed = true
+        if httpStatus == http.StatusInternalServerError {
+            errLogger.Println(err.Error())
+            return models.AssetResult{Status: "failed", Reason: http.StatusText(httpStatus)}   // don't leak internal errors
+        }
+        return models.AssetResult{Status: "failed", Reason: err.Error()}
+    }
+
+    for _, asset := range creates {
+        httpStatus, err, totalsize := createSingleAsset(ctx, asset, uid, neoDB)
+        if err != nil {
+            results["CREATE"][asset.AssetID] = failure(httpStatus, err)
+        } else if httpStatus == http.StatusOK {
+            results["CREATE"][asset.AssetID] = models.AssetResult{Status: "existing", Totalsize: totalsize}
+        } else {
+            results["CREATE"][asset.AssetID] = models.AssetResult{Status: "created", Totalsize: totalsize}
+        }
+    }
+
+    for _, assetID := range deletes {
+        if httpStatus, err := deleteAssets(ctx, []string{assetID}, uid, neoDB); err != nil {
+            results["DELETE"][assetID] = failure(httpStatus, err)
+        } else {
+            results["DELETE"][assetID] = models.AssetResult{Status: "deleted"}
+        }
+    }
+
+    dataJSON, err := json.Marshal(results)
+    if err != nil {
+        response.WriteHeader(http.StatusInternalServerError)
+        errLogger.Println(err.Error())
+        return
+    }
+    response.Header().Set("Content-Type", "application/json")
+    if failed {
+        response.WriteHeader(http.StatusMultiStatus)
+    } else {
+        response.WriteHeader(http.StatusOK)
+    }
+    response.Write(dataJSON)
+}
+
+// createdAssetMediaType is accepted by POST /assets for the detailed models.CreatedAsset response
+const createdAssetMediaType = "application/vnd.tripup.asset+json"
+
+func createSingleAsset(ctx context.Context, asset models.Asset, uid string, neoDB database.Store) (int, error, *uint64) {
+    httpStatus, err, created := createSingleAssetDetailed(ctx, asset, uid, neoDB)
+    if err != nil {
+        return httpStatus, err, nil
+    }
+    return httpStatus, nil, created.Totalsize
+}
+
+func createSingleAssetDetailed(ctx context.Context, asset models.Asset, uid string, neoDB database.Store) (int, error, *models.CreatedAsset) {
     if err := validateArgsNotZero([]string{asset.AssetID, asset.RemotePath, asset.Key}); err != nil {
         return http.StatusBadRequest, err, nil
     }
@@ -812,36 +2030,102 @@ func createSingleAsset(asset asset, uid string, neoDB *database.Neo4j) (int, err
         return http.StatusBadRequest, errors.New("One of the Int args has a value of 0"), nil
     }
 
-    var totalsize *uint64
+    remotepaths := make(map[string]string)
     if asset.RemotePathOrig != nil {
-        originalLength, lowLength, err := storageBackend.Filesizes(*asset.RemotePathOrig)
-        // 128 KB minimum
-        if originalLength < 131072 {
-            originalLength = 131072
-        }
-        if lowLength < 131072 {
-            lowLength = 131072
+        remotepaths = storage.LegacyRenditions(*asset.RemotePathOrig)
+    }
+    for name, remotepath := range asset.Renditions {
+        if err := validateArgsNotZero([]string{name, remotepath}); err != nil {
+            return http.StatusBadRequest, errors.New("Invalid rendition name or remote path"), nil
         }
+        remotepaths[name] = remotepath
+    }
+
+    // the remaining fields are checked before sizeRenditions, which makes a storage request per rendition
+    // an empty location is ambiguous with no location, so clients omit the field instead
+    if asset.Location != nil && len(*asset.Location) == 0 {
+        return http.StatusBadRequest, errors.New("Location is empty, omit it if the asset has no location"), nil
+    }
+
+    // past dates are left alone, photos can be decades old, but future dates would sort ahead of every real asset
+    if asset.CreateDate != nil && maxCreateDateAhead != 0 {
+        createDate, err := parseClientTime(*asset.CreateDate)
         if err != nil {
-            errLogger.Println(*asset.RemotePathOrig)
-            return http.StatusInternalServerError, err, nil
+            return http.StatusBadRequest, errors.New("CreateDate is not an RFC3339 timestamp"), nil
+        }
+        if createDate.After(time.Now().Add(maxCreateDateAhead)) {
+            return http.StatusBadRequest, fmt.Errorf("CreateDate is more than %s in the future", maxCreateDateAhead), nil
         }
-        size := originalLength + lowLength
-        totalsize = &size
     }
 
+    appliedDefaults := make(map[string]string)
     if err := validateArgsNotZero([]string{asset.Type}); err != nil {
         asset.Type = "photo"
+        appliedDefaults["type"] = asset.Type
     }
 
-    err := neoDB.CreateAsset(uid, asset.AssetID, asset.Type, asset.RemotePath, asset.CreateDate, asset.Location, asset.Duration, asset.OriginalFilename, asset.OriginalUTI, asset.PixelWidth, asset.PixelHeight, asset.Md5, asset.Key, asset.RemotePathOrig, totalsize)
-    if err != nil {
+    var renditions map[string]database.Rendition
+    if len(remotepaths) != 0 {
+        var err error
+        renditions, err = sizeRenditions(ctx, remotepaths, asset.Type)
+        if err != nil {
+            errLogger.Println(remotepaths)
+            return http.StatusInternalServerError, err, nil
+        }
+    }
+
+    totalsize, err := neoDB.CreateAsset(uid, asset.AssetID, asset.Type, asset.RemotePath, asset.CreateDate, asset.Location, asset.Duration, asset.OriginalFilename, asset.OriginalUTI, asset.PixelWidth, asset.PixelHeight, asset.Md5, asset.Key, asset.RemotePathOrig, renditions)
+    if err == database.ErrAssetExists {
+        // re-created, e.g. on retry, the existing asset is kept as first created, so no defaults were applied this time
+        return http.StatusOK, nil, &models.CreatedAsset{AssetID: asset.AssetID, Totalsize: totalsize}
+    } else if err != nil {
         return http.StatusInternalServerError, err, nil
     }
-    return http.StatusCreated, nil, totalsize
+
+    created := &models.CreatedAsset{AssetID: asset.AssetID, Totalsize: totalsize, AppliedDefaults: appliedDefaults}
+    if len(renditions) != 0 {
+        created.Renditions = make(map[string]uint64)
+        for name, rendition := range renditions {
+            created.Renditions[name] = rendition.Size
+        }
+    }
+    return http.StatusCreated, nil, created
+}
+
+// minimumRenditionSize returns the least a rendition of assetType is counted as towards totalsize
+func minimumRenditionSize(assetType string) uint64 {
+    if size, ok := minimumRenditionSizes[assetType]; ok {
+        return size
+    }
+    return defaultMinimumRenditionSize
 }
 
-func deleteAssets(assetIDs []string, uid string, neoDB *database.Neo4j) (int, error) {
+// sizeRenditions looks up the stored size of each rendition by name, small renditions count as the minimum for assetType
+func sizeRenditions(ctx context.Context, remotepaths map[string]string, assetType string) (map[string]database.Rendition, error) {
+    var names []string
+    var urls []string
+    for name, remotepath := range remotepaths {
+        names = append(names, name)
+        urls = append(urls, remotepath)
+    }
+
+    sizes, err := storageBackend.RenditionSizes(ctx, urls)
+    if err != nil {
+        return nil, err
+    }
+
+    renditions := make(map[string]database.Rendition)
+    for index, name := range names {
+        size := sizes[index]
+        if minimum := minimumRenditionSize(assetType); size < minimum {
+            size = minimum
+        }
+        renditions[name] = database.Rendition{RemotePath: urls[index], Size: size}
+    }
+    return renditions, nil
+}
+
+func deleteAssets(ctx context.Context, assetIDs []string, uid string, neoDB database.Store) (int, error) {
     if len(assetIDs) == 0 {
         return http.StatusBadRequest, errors.New("AssetIDs is empty")
     }
@@ -851,18 +2135,71 @@ func deleteAssets(assetIDs []string, uid string, neoDB *database.Neo4j) (int, er
         return http.StatusInternalServerError, err
     }
 
-    err = storageBackend.Delete(*objectsToDelete)
+    err = deleteStoredObjects(ctx, *objectsToDelete)
     if err != nil {
         return http.StatusInternalServerError, err
     }
-
-    return http.StatusOK, nil
+
+    return http.StatusOK, nil
+}
+
+// deleteStoredObjects deletes objects the database no longer refers to. Objects that couldn't be deleted are logged rather
+// than failing the request, as a retry would no longer find them
+func deleteStoredObjects(ctx context.Context, paths []string) error {
+    err := storageBackend.Delete(ctx, paths)
+    var deleteErr *storage.DeleteError
+    if errors.As(err, &deleteErr) {
+        warnLogger.Println(deleteErr.Error())
+        return nil
+    }
+    return err
+}
+
+// deleteAssetOriginal drops the original of the callers asset to free storage, keeping the low rendition for viewing
+func deleteAssetOriginal(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    assetID := chi.URLParam(request, "assetID")
+    if _, err := uuid.Parse(assetID); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Invalid UUID string for Asset ID"))
+        return
+    }
+
+    path, totalsize, err := neoDB.RemoveOriginalForAsset(token.UID, assetID)
+    switch err {
+    case nil:
+    case database.ErrAssetNotFound, database.ErrNoOriginal:
+        response.WriteHeader(http.StatusNotFound)
+        response.Write([]byte(err.Error()))
+        return
+    default:
+        ServerErrorHandler(response, err)
+        return
+    }
+
+    if err := deleteStoredObjects(request.Context(), []string{path}); err != nil {
+        ServerErrorHandler(response, err)
+        return
+    }
+
+    dataJSON, err := json.Marshal(map[string]uint64{"totalsize": totalsize})
+    if err != nil {
+        response.WriteHeader(http.StatusInternalServerError)
+        errLogger.Println(err.Error())
+        return
+    }
+    response.WriteHeader(http.StatusOK)
+    response.Write(dataJSON)
 }
 
-func patchAssetsRemoteOriginalPaths(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func patchAssetsRemoteOriginalPaths(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
@@ -880,49 +2217,83 @@ func patchAssetsRemoteOriginalPaths(response http.ResponseWriter, request *http.
         return
     }
 
-    var err error
-    var resultData = make(map[string]int)
+    // with ?partial=true assets whose original is missing are reported in "failed" and the rest are still recorded,
+    // otherwise a missing original rejects the whole batch before anything is recorded
+    partial := request.URL.Query().Get("partial") == "true"
+    failed := make(map[string]string)
     for assetID, remotePathOriginal := range payload {
-        originalLength, lowLength, err := storageBackend.Filesizes(remotePathOriginal)
-        // 128 KB minimum
-        if originalLength < 131072 {
-            originalLength = 131072
+        exists, err := storageBackend.Exists(request.Context(), remotePathOriginal)
+        if err != nil {
+            ServerErrorHandler(response, err)
+            return
+        }
+        if !exists {
+            if !partial {
+                response.WriteHeader(http.StatusBadRequest)
+                response.Write([]byte("original not found in storage for asset " + assetID))
+                return
+            }
+            failed[assetID] = "original not found in storage"
         }
-        if lowLength < 131072 {
-            lowLength = 131072
+    }
+
+    var assetIDs []string
+    for assetID := range payload {
+        assetIDs = append(assetIDs, assetID)
+    }
+    assetTypes, err := neoDB.GetAssetTypes(token.UID, assetIDs)
+    if err != nil {
+        ServerErrorHandler(response, err)
+        return
+    }
+
+    var resultData = make(map[string]int)
+    for assetID, remotePathOriginal := range payload {
+        if _, ok := failed[assetID]; ok {
+            continue
         }
+        var renditions map[string]database.Rendition
+        renditions, err = sizeRenditions(request.Context(), storage.LegacyRenditions(remotePathOriginal), assetTypes[assetID])
         if err != nil {
             break
         }
 
-        err = neoDB.AddPathForOriginalAsset(token.UID, assetID, remotePathOriginal, originalLength + lowLength)
+        var totalsize uint64
+        totalsize, err = neoDB.AddPathForOriginalAsset(token.UID, assetID, remotePathOriginal, renditions)
         if err != nil {
             break
         }
 
-        resultData[assetID] = int(originalLength) + int(lowLength)
+        resultData[assetID] = int(totalsize)
     }
 
     if err != nil {
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
+        ServerErrorHandler(response, err)
         return
     }
 
-    dataJSON, err := json.Marshal(resultData)
+    var result interface{} = resultData
+    if partial {
+        result = map[string]interface{} {
+            "totalsizes": resultData,
+            "failed": failed,
+        }
+    }
+    dataJSON, err := json.Marshal(result)
     if err != nil {
         response.WriteHeader(http.StatusInternalServerError)
         errLogger.Println(err.Error())
+    } else if len(failed) != 0 {
+        response.WriteHeader(http.StatusMultiStatus)
+        response.Write(dataJSON)
     } else {
         response.WriteHeader(http.StatusOK)
         response.Write(dataJSON)
     }
 }
 
-func putAssetRemotePathOriginal(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func putAssetRemotePathOriginal(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         errLogger.Panicln("can't extract auth token")
     }
@@ -934,11 +2305,7 @@ func putAssetRemotePathOriginal(response http.ResponseWriter, request *http.Requ
         return
     }
 
-    type assetUpdate struct {
-        Remotepathorig string
-    }
-
-    var asset assetUpdate
+    var asset models.OriginalPath
     if err := json.NewDecoder(request.Body).Decode(&asset); err != nil {
         errLogger.Panicln(err)
     }
@@ -949,33 +2316,118 @@ func putAssetRemotePathOriginal(response http.ResponseWriter, request *http.Requ
         return
     }
 
-    originalLength, lowLength, err := storageBackend.Filesizes(asset.Remotepathorig)
-    // 128 KB minimum
-    if originalLength < 131072 {
-        originalLength = 131072
+    exists, err := storageBackend.Exists(request.Context(), asset.Remotepathorig)
+    if err != nil {
+        ServerErrorHandler(response, err)
+        return
     }
-    if lowLength < 131072 {
-        lowLength = 131072
+    if !exists {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("original not found in storage"))
+        return
     }
+
+    assetTypes, err := neoDB.GetAssetTypes(token.UID, []string{assetID})
     if err != nil {
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
+        ServerErrorHandler(response, err)
+        return
     }
 
-    err = neoDB.AddPathForOriginalAsset(token.UID, assetID, asset.Remotepathorig, originalLength + lowLength)
+    renditions, err := sizeRenditions(request.Context(), storage.LegacyRenditions(asset.Remotepathorig), assetTypes[assetID])
     if err != nil {
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
+        ServerErrorHandler(response, err)
+        return
+    }
+
+    _, err = neoDB.AddPathForOriginalAsset(token.UID, assetID, asset.Remotepathorig, renditions)
+    if err != nil {
+        ServerErrorHandler(response, err)
         return
     }
 
     response.WriteHeader(http.StatusOK)
 }
 
-func putAssetOriginalFilename(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
+func putAssetOriginalFilename(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    assetID := chi.URLParam(request, "assetID")
+    if _, err := uuid.Parse(assetID); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Invalid UUID string for Asset ID"))
+        return
+    }
+
+    var payload models.OriginalFilename
+    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte(err.Error()))
+        return
+    }
+
+    var err error
+    if payload.SetAt != nil {
+        err = neoDB.SetAssetsOriginalFilenamesVersioned(token.UID, map[string]database.OriginalFilenameUpdate {
+            assetID: {Filename: payload.Originalfilename, SetAt: database.EpochMillis(*payload.SetAt)},
+        })
+    } else {
+        err = neoDB.SetAssetsOriginalFilenames(token.UID, map[string]string {
+            assetID: payload.Originalfilename,
+        })
+    }
+    if err != nil {
+        ServerErrorHandler(response, err)
+    } else {
+        response.WriteHeader(http.StatusOK)
+    }
+}
+
+func setAssetArchived(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    assetID := chi.URLParam(request, "assetID")
+    if _, err := uuid.Parse(assetID); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Invalid UUID string for Asset ID"))
+        return
+    }
+
+    var payload models.ArchiveState
+    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+    if payload.Archived == nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("archived not set"))
+        return
+    }
+
+    err := neoDB.SetAssetArchived(token.UID, assetID, *payload.Archived)
+    switch err {
+    case nil:
+        response.WriteHeader(http.StatusOK)
+    case database.ErrAssetNotFound:
+        response.WriteHeader(http.StatusNotFound)
+        response.Write([]byte(err.Error()))
+    default:
+        ServerErrorHandler(response, err)
+    }
+}
 
-    token, ok := firebaseauth.AuthToken(request.Context())
+func setAssetTags(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
@@ -989,61 +2441,313 @@ func putAssetOriginalFilename(response http.ResponseWriter, request *http.Reques
         return
     }
 
-    var payload struct {
-        Originalfilename    string
+    var payload models.AssetTags
+    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+    if payload.Tags == nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("tags not set"))
+        return
+    }
+    if len(*payload.Tags) > maxAssetTags {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte(fmt.Sprintf("at most %d tags per asset", maxAssetTags)))
+        return
+    }
+
+    // tags are stored as a set, and passed to the database comma separated
+    var tags []string
+    seen := make(map[string]bool)
+    for _, tag := range *payload.Tags {
+        if len(tag) == 0 || len(tag) > maxAssetTagLength || strings.Contains(tag, ",") {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte(fmt.Sprintf("tags must be 1 to %d characters and not contain ','", maxAssetTagLength)))
+            return
+        }
+        if !seen[tag] {
+            seen[tag] = true
+            tags = append(tags, tag)
+        }
+    }
+
+    err := neoDB.SetAssetTags(token.UID, assetID, tags)
+    switch err {
+    case nil:
+        response.WriteHeader(http.StatusOK)
+    case database.ErrAssetNotFound:
+        response.WriteHeader(http.StatusNotFound)
+        response.Write([]byte(err.Error()))
+    default:
+        ServerErrorHandler(response, err)
+    }
+}
+
+func patchAssetsOriginalFilenames(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    // each value is either a filename string (legacy, always applied) or {"filename": ..., "setAt": ...} (applied if newer)
+    var payload map[string]json.RawMessage
+    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte(err.Error()))
+        return
+    }
+
+    if len(payload) == 0 {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("payload is empty"))
+        return
+    }
+
+    unversioned := make(map[string]string)
+    versioned := make(map[string]database.OriginalFilenameUpdate)
+    for assetID, value := range payload {
+        var filename string
+        if err := json.Unmarshal(value, &filename); err == nil {
+            unversioned[assetID] = filename
+            continue
+        }
+        var update models.VersionedOriginalFilename
+        if err := json.Unmarshal(value, &update); err != nil || update.SetAt.IsZero() {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("Invalid original filename for asset " + assetID))
+            return
+        }
+        versioned[assetID] = database.OriginalFilenameUpdate{Filename: update.Filename, SetAt: database.EpochMillis(update.SetAt)}
+    }
+
+    if len(unversioned) != 0 {
+        if err := neoDB.SetAssetsOriginalFilenames(token.UID, unversioned); err != nil {
+            ServerErrorHandler(response, err)
+            return
+        }
+    }
+    if len(versioned) != 0 {
+        if err := neoDB.SetAssetsOriginalFilenamesVersioned(token.UID, versioned); err != nil {
+            ServerErrorHandler(response, err)
+            return
+        }
+    }
+    response.WriteHeader(http.StatusOK)
+}
+
+// parseClientTime parses a timestamp sent by a client, in the same RFC3339 format time.Time fields are decoded from JSON
+func parseClientTime(value string) (time.Time, error) {
+    return time.Parse(time.RFC3339Nano, value)
+}
+
+// bounds of an open ended ?from=&to= range
+var minAssetDate = time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC)
+var maxAssetDate = time.Date(9999, time.December, 31, 23, 59, 59, 999999999, time.UTC)
+
+// parseDateParam parses a query parameter as either an RFC3339 timestamp, or a UTC date that covers the whole day, so
+// endOfDay selects its last instant for an inclusive upper bound
+func parseDateParam(value string, endOfDay bool) (time.Time, error) {
+    if date, err := time.Parse("2006-01-02", value); err == nil {
+        if endOfDay {
+            date = date.Add(24 * time.Hour - time.Millisecond)
+        }
+        return date, nil
+    }
+    return parseClientTime(value)
+}
+
+// getStoragePaths maps the paths clients give assets to where storage keeps them, which differs when object keys are
+// obfuscated. Clients upload to and download from the stored path, but record the path they gave on the asset
+func getStoragePaths(response http.ResponseWriter, request *http.Request) {
+    var payload models.StoragePaths
+    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+    if len(payload.Paths) == 0 {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Empty data supplied"))
+        return
+    }
+    if len(payload.Paths) > maxStoragePaths {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte(fmt.Sprintf("at most %d paths can be mapped per request", maxStoragePaths)))
+        return
+    }
+
+    stored := make(map[string]string)
+    for _, path := range payload.Paths {
+        storedPath, err := storage.StoredURL(storageBackend, path)
+        if err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("Invalid storage path: " + path))
+            return
+        }
+        stored[path] = storedPath
+    }
+
+    dataJSON, err := json.Marshal(map[string]interface{}{"paths": stored})
+    if err != nil {
+        response.WriteHeader(http.StatusInternalServerError)
+        errLogger.Println(err.Error())
+        return
+    }
+    response.WriteHeader(http.StatusOK)
+    response.Write(dataJSON)
+}
+
+func getAssetsOriginalFilenames(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
     }
+
+    var payload []string
     if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
         response.WriteHeader(http.StatusBadRequest)
         response.Write([]byte(err.Error()))
         return
     }
 
-    var data = map[string]string {
-        assetID: payload.Originalfilename,
+    if len(payload) == 0 {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("payload is empty"))
+        return
+    }
+
+    for _, assetID := range payload {
+        if _, err := uuid.Parse(assetID); err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("Invalid UUID string for Asset ID"))
+            return
+        }
+    }
+
+    filenames, err := neoDB.GetAssetsOriginalFilenames(token.UID, payload)
+    if err != nil {
+        ServerErrorHandler(response, err)
+        return
     }
-    if err := neoDB.SetAssetsOriginalFilenames(token.UID, data); err != nil {
+
+    dataJSON, err := json.Marshal(filenames)
+    if err != nil {
         response.WriteHeader(http.StatusInternalServerError)
         errLogger.Println(err.Error())
     } else {
         response.WriteHeader(http.StatusOK)
+        response.Write(dataJSON)
     }
 }
 
-func patchAssetsOriginalFilenames(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
+func getGroupsForAsset(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    assetID := chi.URLParam(request, "assetID")
+    if _, err := uuid.Parse(assetID); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Invalid UUID string for Asset ID"))
+        return
+    }
+
+    data, err := neoDB.GetGroupsForSharedAsset(token.UID, assetID)
+    switch err {
+    case nil:
+        dataJSON, err := json.Marshal(data)
+        if err != nil {
+            response.WriteHeader(http.StatusInternalServerError)
+            errLogger.Println(err.Error())
+        } else {
+            response.WriteHeader(http.StatusOK)
+            response.Write(dataJSON)
+        }
+    case io.EOF:
+        response.WriteHeader(http.StatusNoContent)
+    case database.ErrAssetNotFound:
+        response.WriteHeader(http.StatusNotFound)
+        response.Write([]byte(err.Error()))
+    default:
+        ServerErrorHandler(response, err)
+    }
+}
 
-    token, ok := firebaseauth.AuthToken(request.Context())
+func moveSharedAsset(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
         return
     }
 
-    var payload map[string]string
+    assetID := chi.URLParam(request, "assetID")
+    if _, err := uuid.Parse(assetID); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Invalid UUID string for Asset ID"))
+        return
+    }
+
+    var payload models.SharedAssetMove
     if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    if err := validateArgsNotZero([]string{payload.FromGroupID, payload.ToGroupID, payload.AssetKey}); err != nil {
         response.WriteHeader(http.StatusBadRequest)
         response.Write([]byte(err.Error()))
         return
     }
-
-    if len(payload) == 0 {
+    for _, groupID := range []string{payload.FromGroupID, payload.ToGroupID} {
+        if _, err := uuid.Parse(groupID); err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("Invalid UUID string for Group ID"))
+            return
+        }
+    }
+    if payload.FromGroupID == payload.ToGroupID {
         response.WriteHeader(http.StatusBadRequest)
-        response.Write([]byte("payload is empty"))
+        response.Write([]byte("Source and destination groups are the same"))
         return
     }
 
-    if err := neoDB.SetAssetsOriginalFilenames(token.UID, payload); err != nil {
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
-    } else {
+    err := neoDB.MoveSharedAsset(token.UID, assetID, payload.FromGroupID, payload.ToGroupID, payload.AssetKey)
+    switch err {
+    case nil:
         response.WriteHeader(http.StatusOK)
+        var batch notificationBatch
+        batch.addGroupExcept(neoDB, payload.FromGroupID, token.UID, notification.AssetsChangedForGroup, &map[string]string{"groupid": payload.FromGroupID})
+        batch.addGroupExcept(neoDB, payload.ToGroupID, token.UID, notification.AssetsAddedToGroupByUser, &map[string]string{"groupid": payload.ToGroupID})
+        batch.send(request.Context())
+    case database.ErrNotGroupMember:
+        response.WriteHeader(http.StatusForbidden)
+        response.Write([]byte(err.Error()))
+    case database.ErrAssetNotFound:
+        response.WriteHeader(http.StatusNotFound)
+        response.Write([]byte(err.Error()))
+    case database.ErrSharedKeyConflict:
+        // as for PATCH /groups/{groupID}/album/shared, the asset is already shared in the destination with another key
+        dataJSON, _ := json.Marshal(map[string][]string{"conflicts": []string{assetID}})
+        response.WriteHeader(http.StatusConflict)
+        response.Write(dataJSON)
+    default:
+        ServerErrorHandler(response, err)
     }
 }
 
-func amendGroupSharedAssets(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func amendGroupSharedAssets(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
@@ -1057,11 +2761,11 @@ func amendGroupSharedAssets(response http.ResponseWriter, request *http.Request,
         return
     }
 
-    var requestData struct {
-        AssetKeys []string  `json:",omitempty"`
-        AssetIDs []string
-        Share bool
+    if !requireGroupMember(response, neoDB, token.UID, groupID) {
+        return
     }
+
+    var requestData models.SharedAssetsAmendment
     if err := json.NewDecoder(request.Body).Decode(&requestData); err != nil {
         response.WriteHeader(http.StatusBadRequest)
         response.Write([]byte("Unable to decode JSON payload"))
@@ -1080,7 +2784,40 @@ func amendGroupSharedAssets(response http.ResponseWriter, request *http.Request,
         return
     }
 
-    var err error
+    // the share queries only match assets owned by the caller, but reject explicitly rather than silently ignoring others
+    unowned, err := neoDB.AssetsOwnedBy(token.UID, requestData.AssetIDs)
+    if err != nil {
+        ServerErrorHandler(response, err)
+        return
+    }
+    if len(unowned) != 0 {
+        dataJSON, _ := json.Marshal(map[string][]string{"unowned": unowned})
+        response.WriteHeader(http.StatusForbidden)
+        response.Write(dataJSON)
+        return
+    }
+
+    // re-sharing with a different key would break decryption for other members, re-sharing with the same key is a no-op
+    if requestData.Share {
+        existingKeys, err := neoDB.GetSharedAssetKeys(token.UID, groupID, requestData.AssetIDs)
+        if err != nil {
+            ServerErrorHandler(response, err)
+            return
+        }
+        var conflicts []string
+        for index, assetID := range requestData.AssetIDs {
+            if existingKey, shared := existingKeys[assetID]; shared && existingKey != requestData.AssetKeys[index] {
+                conflicts = append(conflicts, assetID)
+            }
+        }
+        if len(conflicts) != 0 {
+            dataJSON, _ := json.Marshal(map[string][]string{"conflicts": conflicts})
+            response.WriteHeader(http.StatusConflict)
+            response.Write(dataJSON)
+            return
+        }
+    }
+
     if requestData.Share {
         err = neoDB.ShareAssets(token.UID, groupID, requestData.AssetIDs, requestData.AssetKeys)
     } else {
@@ -1088,100 +2825,286 @@ func amendGroupSharedAssets(response http.ResponseWriter, request *http.Request,
     }
 
     if err != nil {
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
+        ServerErrorHandler(response, err)
     } else {
         response.WriteHeader(http.StatusOK)
-
-        // notify users
-        var userIDs []string
-        groupUsers, err := neoDB.GetUsersInGroup(token.UID, groupID)
-        if err == io.EOF {
-            return
-        }
-        for userID := range groupUsers {
-            userIDs = append(userIDs, userID)
-        }
         if requestData.Share {
-            err = notificationService.Notify(userIDs, notification.AssetsAddedToGroupByUser, &map[string]string{"groupid": groupID})
+            notifyGroupExcept(request.Context(), neoDB, groupID, token.UID, notification.AssetsAddedToGroupByUser, &map[string]string{"groupid": groupID})
         } else {
-            err = notificationService.Notify(userIDs, notification.AssetsChangedForGroup, &map[string]string{"groupid": groupID})
+            notifyGroupExcept(request.Context(), neoDB, groupID, token.UID, notification.AssetsChangedForGroup, &map[string]string{"groupid": groupID})
         }
+    }
+}
+
+// unshareAssetFromAllGroups makes the callers asset private again in one request, rather than unsharing it group by group
+func unshareAssetFromAllGroups(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    assetID := chi.URLParam(request, "assetID")
+    if _, err := uuid.Parse(assetID); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Invalid UUID string for Asset ID"))
+        return
+    }
+
+    groupIDs, err := neoDB.UnshareAssetFromAllGroups(token.UID, assetID)
+    switch err {
+    case nil:
+        dataJSON, err := json.Marshal(map[string][]string{"groups": groupIDs})
         if err != nil {
+            response.WriteHeader(http.StatusInternalServerError)
             errLogger.Println(err.Error())
             return
         }
+        response.WriteHeader(http.StatusOK)
+        response.Write(dataJSON)
+        var batch notificationBatch
+        for _, groupID := range groupIDs {
+            batch.addGroupExcept(neoDB, groupID, token.UID, notification.AssetsChangedForGroup, &map[string]string{"groupid": groupID})
+        }
+        batch.send(request.Context())
+    case database.ErrAssetNotFound:
+        response.WriteHeader(http.StatusNotFound)
+        response.Write([]byte(err.Error()))
+    default:
+        ServerErrorHandler(response, err)
     }
 }
 
-func SetFavourite(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func SetFavourite(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
-        errLogger.Panicln("can't extract auth token")
-    }
-
-    type Props struct {
-        TripID string
-        ImageID string
-        Favourite bool
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
     }
 
     // parse request body for photo details
-    var props Props
+    var props models.Favourite
     if err := json.NewDecoder(request.Body).Decode(&props); err != nil {
-        errLogger.Panicln(err)
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    if err := validateArgsNotZero([]string{props.TripID, props.ImageID}); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte(err.Error()))
+        return
     }
 
+    var err error
     if props.Favourite {
-        neoDB.SetFavourite(token.UID, props.TripID, props.ImageID)
+        err = neoDB.SetFavourite(token.UID, props.TripID, props.ImageID)
     } else {
-        neoDB.UnsetFavourite(token.UID, props.TripID, props.ImageID)
+        err = neoDB.UnsetFavourite(token.UID, props.TripID, props.ImageID)
     }
 
-    response.WriteHeader(http.StatusOK)
+    if err != nil {
+        ServerErrorHandler(response, err)
+    } else {
+        response.WriteHeader(http.StatusOK)
+    }
 }
 
-func patchSchema0(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+// getSchemaVersion reports the data schema the caller is on alongside the latest, clients migrate when they differ
+func getSchemaVersion(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
         return
     }
 
-    var patchData struct {
-        AssetKeys map[string]string   `json:",omitempty"`
-        AssetMD5s map[string]string   `json:",omitempty"`
+    user, err := neoDB.GetUser(token.UID)
+    switch err {
+    case nil:
+        dataJSON, err := json.Marshal(map[string]string {
+            "schemaVersion": (*user)["schemaVersion"],
+            "latestSchemaVersion": latestSchemaVersion,
+        })
+        if err != nil {
+            response.WriteHeader(http.StatusInternalServerError)
+            errLogger.Println(err.Error())
+            return
+        }
+        response.WriteHeader(http.StatusOK)
+        response.Write(dataJSON)
+    case io.EOF:
+        response.WriteHeader(http.StatusNotFound)
+    default:
+        ServerErrorHandler(response, err)
+    }
+}
+
+func patchSchema0(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
     }
+
+    var patchData models.Schema0Patch
     if err := json.NewDecoder(request.Body).Decode(&patchData); err != nil {
         response.WriteHeader(http.StatusBadRequest)
         response.Write([]byte("Unable to decode JSON payload"))
         return
     }
 
-    if err := neoDB.PatchSchema0(token.UID, patchData.AssetKeys, patchData.AssetMD5s); err != nil {
+    // retries after a successful migration are a no-op, so clients can safely repeat the request
+    err := neoDB.PatchSchema0(token.UID, patchData.AssetKeys, patchData.AssetMD5s)
+    switch err {
+    case nil, database.ErrSchemaMigrated:
+        response.WriteHeader(http.StatusOK)
+    case database.ErrSchemaNewer:
+        response.WriteHeader(http.StatusConflict)
+        response.Write([]byte(err.Error()))
+    case io.EOF:
+        response.WriteHeader(http.StatusNotFound)
+    default:
+        ServerErrorHandler(response, err)
+    }
+}
+
+// patchAssetKeys rotates the caller's keys for their own assets, separate from schema migration so it can be run periodically
+func patchAssetKeys(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    var keys map[string]string     // asset uuid -> new asset key
+    if err := json.NewDecoder(request.Body).Decode(&keys); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    if len(keys) == 0 {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("payload is empty"))
+        return
+    }
+    for assetID, key := range keys {
+        if _, err := uuid.Parse(assetID); err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("Invalid UUID string for Asset ID: " + assetID))
+            return
+        }
+        if err := validateArgsNotZero([]string{key}); err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("Invalid key for Asset ID: " + assetID))
+            return
+        }
+    }
+
+    updated, err := neoDB.UpdateAssetKeys(token.UID, keys)
+    if err != nil {
+        ServerErrorHandler(response, err)
+        return
+    }
+
+    // assets that weren't updated aren't owned by the caller
+    updatedSet := make(map[string]bool)
+    for _, assetID := range updated {
+        updatedSet[assetID] = true
+    }
+    notFound := []string{}
+    for assetID := range keys {
+        if !updatedSet[assetID] {
+            notFound = append(notFound, assetID)
+        }
+    }
+
+    dataJSON, err := json.Marshal(map[string][]string{"updated": updated, "notFound": notFound})
+    if err != nil {
         response.WriteHeader(http.StatusInternalServerError)
         errLogger.Println(err.Error())
         return
     }
     response.WriteHeader(http.StatusOK)
+    response.Write(dataJSON)
 }
 
-func getAssets(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func getAssets(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
         return
     }
 
-    data, err := neoDB.GetAssets(token.UID)
+    includeArchived := request.URL.Query().Get("includeArchived") == "true"
+
+    // ?sort=createDate|uploadDate|filename&order=asc|desc, unsorted by default
+    var order database.AssetOrder
+    if sortParam := request.URL.Query().Get("sort"); len(sortParam) != 0 {
+        if _, ok := database.AssetSortFields[sortParam]; !ok {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("sort must be one of createDate, uploadDate or filename"))
+            return
+        }
+        order.Field = sortParam
+    }
+    switch request.URL.Query().Get("order") {
+    case "", "asc":
+    case "desc":
+        order.Descending = true
+    default:
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("order must be asc or desc"))
+        return
+    }
+
+    // ?from=<date>&to=<date> filters on CreateDate, either end may be left open
+    fromParam, toParam := request.URL.Query().Get("from"), request.URL.Query().Get("to")
+    ranged := len(fromParam) != 0 || len(toParam) != 0
+    from, to := minAssetDate, maxAssetDate
+    if len(fromParam) != 0 {
+        var err error
+        if from, err = parseDateParam(fromParam, false); err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("from must be a date (YYYY-MM-DD) or RFC3339 timestamp"))
+            return
+        }
+    }
+    if len(toParam) != 0 {
+        var err error
+        if to, err = parseDateParam(toParam, true); err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("to must be a date (YYYY-MM-DD) or RFC3339 timestamp"))
+            return
+        }
+    }
+    if from.After(to) {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("from must not be after to"))
+        return
+    }
+
+    var data []interface{}
+    var err error
+    tag := request.URL.Query().Get("tag")
+    switch {
+    case len(tag) != 0 && ranged:
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("tag can't be combined with from or to"))
+        return
+    case len(tag) != 0:
+        data, err = neoDB.GetAssetsByTag(token.UID, tag, includeArchived, order)
+    case ranged:
+        data, err = neoDB.GetAssetsInDateRange(token.UID, from, to, includeArchived, order)
+    default:
+        data, err = neoDB.GetAssets(token.UID, includeArchived, order)
+    }
     switch err {
     case nil:
         dataJSON, err := json.Marshal(data)
@@ -1195,15 +3118,12 @@ func getAssets(response http.ResponseWriter, request *http.Request, neoDB *datab
     case io.EOF:
         response.WriteHeader(http.StatusNoContent)
     default:
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
+        ServerErrorHandler(response, err)
     }
 }
 
-func getAssetsSchema0(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func getAssetsSchema0(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
@@ -1224,15 +3144,83 @@ func getAssetsSchema0(response http.ResponseWriter, request *http.Request, neoDB
     case io.EOF:
         response.WriteHeader(http.StatusNoContent)
     default:
+        ServerErrorHandler(response, err)
+    }
+}
+
+// getAssetsByIDs returns the metadata of specific assets, so clients needn't download the whole library for a few assets
+// IDs the caller can't access are reported under notFound rather than failing the request
+func getAssetsByIDs(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
+    if !ok {
+        response.WriteHeader(http.StatusUnauthorized)
+        response.Write([]byte("Unable to extract token from request context"))
+        return
+    }
+
+    var payload models.AssetIDs
+    if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("Unable to decode JSON payload"))
+        return
+    }
+
+    if len(payload.AssetIDs) == 0 {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("No asset ids provided for request"))
+        return
+    }
+    if len(payload.AssetIDs) > maxAssetsPerFetch {
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte(fmt.Sprintf("at most %d asset ids can be fetched per request", maxAssetsPerFetch)))
+        return
+    }
+    for _, assetID := range payload.AssetIDs {
+        if _, err := uuid.Parse(assetID); err != nil {
+            response.WriteHeader(http.StatusBadRequest)
+            response.Write([]byte("Invalid UUID string for Asset ID: " + assetID))
+            return
+        }
+    }
+
+    data, err := neoDB.GetAssetsByIDs(token.UID, payload.AssetIDs)
+    if err != nil && err != io.EOF {
+        ServerErrorHandler(response, err)
+        return
+    }
+
+    found := make(map[string]bool)
+    for _, asset := range data {
+        if asset, ok := asset.(map[string]interface{}); ok {
+            if assetID, ok := asset["uuid"].(string); ok {
+                found[assetID] = true
+            }
+        }
+    }
+    notFound := []string{}
+    for _, assetID := range payload.AssetIDs {
+        if !found[assetID] {
+            notFound = append(notFound, assetID)
+        }
+    }
+    if data == nil {
+        data = []interface{}{}
+    }
+    dataJSON, err := json.Marshal(map[string]interface{} {
+        "assets": data,
+        "notFound": notFound,
+    })
+    if err != nil {
         response.WriteHeader(http.StatusInternalServerError)
         errLogger.Println(err.Error())
+        return
     }
+    response.WriteHeader(http.StatusOK)
+    response.Write(dataJSON)
 }
 
-func getAssetsForAllGroups(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func getAssetsForAllGroups(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
@@ -1254,15 +3242,12 @@ func getAssetsForAllGroups(response http.ResponseWriter, request *http.Request,
     case io.EOF:
         response.WriteHeader(http.StatusNoContent)
     default:
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
+        ServerErrorHandler(response, err)
     }
 }
 
-func leaveGroup(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func leaveGroup(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
@@ -1276,34 +3261,36 @@ func leaveGroup(response http.ResponseWriter, request *http.Request, neoDB *data
         return
     }
 
-    err := neoDB.LeaveGroup(token.UID, groupID)
+    // ?assets=keep leaves the assets the caller shared in the group for the remaining members, ?assets=remove unshares them
+    keepAssets := leaveGroupKeepsAssets
+    switch request.URL.Query().Get("assets") {
+    case "":
+    case "keep":
+        keepAssets = true
+    case "remove":
+        keepAssets = false
+    default:
+        response.WriteHeader(http.StatusBadRequest)
+        response.Write([]byte("assets must be keep or remove"))
+        return
+    }
+
+    unshared, err := neoDB.LeaveGroup(token.UID, groupID, keepAssets)
     if err != nil {
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
+        ServerErrorHandler(response, err)
     } else {
         response.WriteHeader(http.StatusOK)
-
-        // notify users
-        var userIDs []string
-        groupUsers, err := neoDB.GetUsersInGroup(token.UID, groupID)
-        if err == io.EOF {
-            return
-        }
-        for userID := range groupUsers {
-            userIDs = append(userIDs, userID)
-        }
-        err = notificationService.Notify(userIDs, notification.UserLeftGroup, &map[string]string{"groupid": groupID})
-        if err != nil {
-            errLogger.Println(err.Error())
-            return
+        var batch notificationBatch
+        batch.addGroupExcept(neoDB, groupID, token.UID, notification.UserLeftGroup, &map[string]string{"groupid": groupID})
+        if unshared != 0 {
+            batch.addGroupExcept(neoDB, groupID, token.UID, notification.AssetsChangedForGroup, &map[string]string{"groupid": groupID})
         }
+        batch.send(request.Context())
     }
 }
 
-func amendGroupAssets(response http.ResponseWriter, request *http.Request, neoDB *database.Neo4j) {
-    defer GenericErrorHandler(response)
-
-    token, ok := firebaseauth.AuthToken(request.Context())
+func amendGroupAssets(response http.ResponseWriter, request *http.Request, neoDB database.Store) {
+    token, ok := authToken(request.Context())
     if !ok {
         response.WriteHeader(http.StatusUnauthorized)
         response.Write([]byte("Unable to extract token from request context"))
@@ -1317,10 +3304,11 @@ func amendGroupAssets(response http.ResponseWriter, request *http.Request, neoDB
         return
     }
 
-    var requestData struct {
-        Add         bool
-        AssetIDs    []string
+    if !requireGroupMember(response, neoDB, token.UID, groupID) {
+        return
     }
+
+    var requestData models.GroupAssetsAmendment
     if err := json.NewDecoder(request.Body).Decode(&requestData); err != nil {
         response.WriteHeader(http.StatusBadRequest)
         response.Write([]byte("Unable to decode JSON payload"))
@@ -1341,26 +3329,11 @@ func amendGroupAssets(response http.ResponseWriter, request *http.Request, neoDB
     }
 
     if err != nil {
-        response.WriteHeader(http.StatusInternalServerError)
-        errLogger.Println(err.Error())
+        ServerErrorHandler(response, err)
     } else {
         response.WriteHeader(http.StatusOK)
-
         if !requestData.Add {
-            // notify users
-            var userIDs []string
-            groupUsers, err := neoDB.GetUsersInGroup(token.UID, groupID)
-            if err == io.EOF {
-                return
-            }
-            for userID := range groupUsers {
-                userIDs = append(userIDs, userID)
-            }
-            err = notificationService.Notify(userIDs, notification.AssetsChangedForGroup, &map[string]string{"groupid": groupID})
-            if err != nil {
-                errLogger.Println(err.Error())
-                return
-            }
+            notifyGroupExcept(request.Context(), neoDB, groupID, token.UID, notification.AssetsChangedForGroup, &map[string]string{"groupid": groupID})
         }
     }
 }
@@ -0,0 +1,1275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	firebaseAuth "firebase.google.com/go/auth"
+	"github.com/google/uuid"
+	"github.com/pressly/chi"
+
+	"github.com/tripupapp/tripup-server/auth"
+	"github.com/tripupapp/tripup-server/database"
+	"github.com/tripupapp/tripup-server/models"
+	"github.com/tripupapp/tripup-server/notification"
+)
+
+// tokenKey holds the firebase uid of the signed in user for requests made by the tests, in place of a verified token
+type tokenKey struct{}
+
+// recordingNotifier is a NotificationService that keeps every notification sent, in place of the dispatcher
+type recordingNotifier struct {
+    mutex   sync.Mutex
+    sent    []notification.NotificationRequest
+}
+
+func (notifier *recordingNotifier) Notify(ctx context.Context, userIDs []string, notificationType notification.Notification, additionalData *map[string]string) (*notification.Result, error) {
+    return notifier.NotifyMany(ctx, []notification.NotificationRequest{{UserIDs: userIDs, Notification: notificationType, AdditionalData: additionalData}})
+}
+
+func (notifier *recordingNotifier) NotifyMany(ctx context.Context, requests []notification.NotificationRequest) (*notification.Result, error) {
+    notifier.mutex.Lock()
+    defer notifier.mutex.Unlock()
+    notifier.sent = append(notifier.sent, requests...)
+    return &notification.Result{}, nil
+}
+
+// recipients returns the users sent the notification type, in the order they were sent to
+func (notifier *recordingNotifier) recipients(notificationType notification.Notification) []string {
+    notifier.mutex.Lock()
+    defer notifier.mutex.Unlock()
+    var userIDs []string
+    for _, request := range notifier.sent {
+        if request.Notification.Signal() == notificationType.Signal() {
+            userIDs = append(userIDs, request.UserIDs...)
+        }
+    }
+    return userIDs
+}
+
+func TestMain(m *testing.M) {
+    authToken = func(ctx context.Context) (*firebaseAuth.Token, bool) {
+        uid, ok := ctx.Value(tokenKey{}).(string)
+        if !ok {
+            return nil, false
+        }
+        return &firebaseAuth.Token{UID: uid, Claims: map[string]interface{}{}}, true
+    }
+    userAuthProviders = func(ctx context.Context, uid string) (auth.AuthProviders, error) {
+        return auth.AuthProviders{Email: "hashed-" + uid}, nil
+    }
+    cursorSecret = []byte("test cursor secret")
+    os.Exit(m.Run())
+}
+
+// useNotifier replaces the notification service for the duration of the test
+func useNotifier(t *testing.T) *recordingNotifier {
+    notifier := &recordingNotifier{}
+    previous := notificationService
+    notificationService = notifier
+    t.Cleanup(func() {
+        notificationService = previous
+    })
+    return notifier
+}
+
+// newUser creates a schema 1 user signed in as uid, returning their uuid
+func newUser(t *testing.T, store *database.MemStore, uid string) string {
+    userID := uuid.New().String()
+    if err := store.CreateUser(uid, userID, auth.AuthProviders{Email: "hashed-" + uid}, "publickey-" + uid, "privatekey-" + uid, "1"); err != nil {
+        t.Fatal(err)
+    }
+    return userID
+}
+
+// newGroup creates a group with the user signed in as uid as its only member, returning the group uuid
+func newGroup(t *testing.T, store *database.MemStore, uid string, name string) string {
+    groupID := uuid.New().String()
+    if err := store.CreateGroup(uid, groupID, name, "groupkey-" + uid); err != nil {
+        t.Fatal(err)
+    }
+    return groupID
+}
+
+// groupWithMembers creates a group owned by the user signed in as "owner" that each of uids has joined, returning the group
+// uuid and every member's uuid by uid
+func groupWithMembers(t *testing.T, store *database.MemStore, uids ...string) (string, map[string]string) {
+    members := map[string]string{"owner": newUser(t, store, "owner")}
+    groupID := newGroup(t, store, "owner", "holiday")
+    for _, uid := range uids {
+        members[uid] = newUser(t, store, uid)
+        if err := store.AddUsersToGroup("owner", groupID, []map[string]string{{"uuid": members[uid], "key": "invitekey"}}); err != nil {
+            t.Fatal(err)
+        }
+        if err := store.JoinGroup(uid, groupID, "groupkey-" + uid); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return groupID, members
+}
+
+// newAsset creates a photo owned by the user signed in as uid, returning the asset uuid
+func newAsset(t *testing.T, store *database.MemStore, uid string) string {
+    assetID := uuid.New().String()
+    if _, err := store.CreateAsset(uid, assetID, "photo", "https://s3.example.com/bucket/" + assetID, nil, nil, nil, nil, nil, 100, 100, "md5", "assetkey", nil, nil); err != nil {
+        t.Fatal(err)
+    }
+    return assetID
+}
+
+// sameIDs reports whether got and want hold the same IDs, regardless of order
+func sameIDs(got []string, want []string) bool {
+    if len(got) != len(want) {
+        return false
+    }
+    got, want = append([]string(nil), got...), append([]string(nil), want...)
+    sort.Strings(got)
+    sort.Strings(want)
+    for index := range got {
+        if got[index] != want[index] {
+            return false
+        }
+    }
+    return true
+}
+
+// sharedAssetIDs returns the assets shared in the group, as seen by the user signed in as uid
+func sharedAssetIDs(t *testing.T, store *database.MemStore, uid string, groupID string) []string {
+    groups, err := store.GetAssetsForAllGroups(uid)
+    if err != nil && err != io.EOF {
+        t.Fatal(err)
+    }
+    var assetIDs []string
+    for _, assetID := range groups[groupID]["sharedassetids"] {
+        assetIDs = append(assetIDs, assetID.(string))
+    }
+    return assetIDs
+}
+
+// fakeStorage is a StorageBackend holding objects of the given sizes by URL, in place of S3
+type fakeStorage struct {
+    sizes   map[string]uint64
+}
+
+func (fake *fakeStorage) Name() string {
+    return "fake"
+}
+
+func (fake *fakeStorage) RenditionSizes(ctx context.Context, urls []string) ([]uint64, error) {
+    var sizes []uint64
+    for _, url := range urls {
+        size, ok := fake.sizes[url]
+        if !ok {
+            return nil, fmt.Errorf("no object at %s", url)
+        }
+        sizes = append(sizes, size)
+    }
+    return sizes, nil
+}
+
+func (fake *fakeStorage) Exists(ctx context.Context, path string) (bool, error) {
+    _, ok := fake.sizes[path]
+    return ok, nil
+}
+
+func (fake *fakeStorage) Delete(ctx context.Context, paths []string) error {
+    for _, path := range paths {
+        delete(fake.sizes, path)
+    }
+    return nil
+}
+
+func (fake *fakeStorage) Shutdown(ctx context.Context) error {
+    return nil
+}
+
+// useStorage replaces the storage backend for the duration of the test with one holding objects of the given sizes
+func useStorage(t *testing.T, sizes map[string]uint64) *fakeStorage {
+    fake := &fakeStorage{sizes: sizes}
+    previous := storageBackend
+    storageBackend = fake
+    t.Cleanup(func() {
+        storageBackend = previous
+    })
+    return fake
+}
+
+// ownAsset returns the asset as listed by GET /assets for the user signed in as uid, who owns it
+func ownAsset(t *testing.T, store *database.MemStore, uid string, assetID string) map[string]interface{} {
+    assets, err := store.GetAssets(uid, true, database.AssetOrder{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, entry := range assets {
+        if entry := entry.(map[string]interface{}); entry["uuid"] == assetID && entry["groupid"] == nil {
+            return entry
+        }
+    }
+    t.Fatalf("asset %s not listed", assetID)
+    return nil
+}
+
+// serve calls handler with a request from the user signed in as uid, an empty uid sends it without a token. body is
+// encoded as JSON unless it is nil, and params are the route's URL parameters
+func serve(handler func(http.ResponseWriter, *http.Request, database.Store), store database.Store, method string, target string, uid string, body interface{}, params map[string]string) *httptest.ResponseRecorder {
+    var payload bytes.Buffer
+    if body != nil {
+        json.NewEncoder(&payload).Encode(body)
+    }
+    request := httptest.NewRequest(method, target, &payload)
+
+    routeContext := chi.NewRouteContext()
+    for name, value := range params {
+        routeContext.URLParams.Add(name, value)
+    }
+    ctx := context.WithValue(request.Context(), chi.RouteCtxKey, routeContext)
+    if len(uid) != 0 {
+        ctx = context.WithValue(ctx, tokenKey{}, uid)
+    }
+
+    response := httptest.NewRecorder()
+    handler(response, request.WithContext(ctx), store)
+    return response
+}
+
+func TestJoinGroup(t *testing.T) {
+    store := database.NewMemStore()
+    ownerID := newUser(t, store, "owner")
+    inviteeID := newUser(t, store, "invitee")
+    newUser(t, store, "stranger")
+    groupID := newGroup(t, store, "owner", "holiday")
+    if err := store.AddUsersToGroup("owner", groupID, []map[string]string{{"uuid": inviteeID, "key": "invitekey"}}); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name        string
+        uid         string
+        groupID     string
+        body        interface{}
+        want        int
+        notified    []string
+    }{
+        {name: "no token", uid: "", groupID: groupID, body: map[string]string{"key": "groupkey"}, want: http.StatusUnauthorized},
+        {name: "invalid group id", uid: "invitee", groupID: "holiday", body: map[string]string{"key": "groupkey"}, want: http.StatusBadRequest},
+        {name: "not invited", uid: "stranger", groupID: groupID, body: map[string]string{"key": "groupkey"}, want: http.StatusForbidden},
+        {name: "empty key", uid: "invitee", groupID: groupID, body: map[string]string{"key": ""}, want: http.StatusBadRequest},
+        {name: "missing key", uid: "invitee", groupID: groupID, body: map[string]string{}, want: http.StatusBadRequest},
+        {name: "invited", uid: "invitee", groupID: groupID, body: map[string]string{"key": "groupkey"}, want: http.StatusCreated, notified: []string{ownerID}},
+        {name: "retried join", uid: "invitee", groupID: groupID, body: map[string]string{"key": "groupkey"}, want: http.StatusOK},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            notifier := useNotifier(t)
+            response := serve(joinGroup, store, "PUT", "/groups/" + test.groupID, test.uid, test.body, map[string]string{"groupID": test.groupID})
+            if response.Code != test.want {
+                t.Fatalf("got status %d, want %d: %s", response.Code, test.want, response.Body)
+            }
+            notified := notifier.recipients(notification.UserJoinedGroup)
+            if len(notified) != len(test.notified) || (len(notified) != 0 && notified[0] != test.notified[0]) {
+                t.Errorf("notified %v, want %v", notified, test.notified)
+            }
+        })
+    }
+
+    members, err := store.GetUsersInGroup("owner", groupID)
+    if err != nil || len(members) != 1 {
+        t.Fatalf("got members %v, %v, want the invitee", members, err)
+    }
+}
+
+func TestGroupNotificationsExcludeActor(t *testing.T) {
+    tests := []struct {
+        name            string
+        handler         func(http.ResponseWriter, *http.Request, database.Store)
+        method          string
+        target          string
+        body            func(assetID string) interface{}
+        notification    notification.Notification
+    }{
+        {name: "leave", handler: leaveGroup, method: "DELETE", target: "/groups/%s?assets=keep", notification: notification.UserLeftGroup},
+        {name: "share", handler: amendGroupSharedAssets, method: "PATCH", target: "/groups/%s/album/shared", body: func(assetID string) interface{} {
+            return map[string]interface{}{"AssetIDs": []string{assetID}, "AssetKeys": []string{"sharedkey"}, "Share": true}
+        }, notification: notification.AssetsAddedToGroupByUser},
+        {name: "unshare", handler: amendGroupSharedAssets, method: "PATCH", target: "/groups/%s/album/shared", body: func(assetID string) interface{} {
+            return map[string]interface{}{"AssetIDs": []string{assetID}, "Share": false}
+        }, notification: notification.AssetsChangedForGroup},
+        {name: "remove assets", handler: amendGroupAssets, method: "PATCH", target: "/groups/%s/album", body: func(assetID string) interface{} {
+            return map[string]interface{}{"AssetIDs": []string{assetID}, "Add": false}
+        }, notification: notification.AssetsChangedForGroup},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            store := database.NewMemStore()
+            groupID, members := groupWithMembers(t, store, "actor", "other")
+            assetID := newAsset(t, store, "actor")
+            if err := store.AddAssetsToGroup("actor", groupID, []string{assetID}); err != nil {
+                t.Fatal(err)
+            }
+            var body interface{}
+            if test.body != nil {
+                body = test.body(assetID)
+            }
+
+            notifier := useNotifier(t)
+            response := serve(test.handler, store, test.method, fmt.Sprintf(test.target, groupID), "actor", body, map[string]string{"groupID": groupID})
+            if response.Code != http.StatusOK {
+                t.Fatalf("got status %d: %s", response.Code, response.Body)
+            }
+            if notified, want := notifier.recipients(test.notification), []string{members["owner"], members["other"]}; !sameIDs(notified, want) {
+                t.Errorf("notified %v, want %v, actor is %s", notified, want, members["actor"])
+            }
+        })
+    }
+}
+
+func TestNotifyGroupExcept(t *testing.T) {
+    store := database.NewMemStore()
+    groupID, members := groupWithMembers(t, store, "actor", "other")
+    inviteeID := newUser(t, store, "invitee")
+    if err := store.AddUsersToGroup("owner", groupID, []map[string]string{{"uuid": inviteeID, "key": "invitekey"}}); err != nil {
+        t.Fatal(err)
+    }
+    want := []string{members["owner"], members["other"], inviteeID}
+
+    t.Run("notify", func(t *testing.T) {
+        notifier := useNotifier(t)
+        notifyGroupExcept(context.Background(), store, groupID, "actor", notification.UserJoinedGroup, &map[string]string{"groupid": groupID})
+        if notified := notifier.recipients(notification.UserJoinedGroup); !sameIDs(notified, want) {
+            t.Errorf("notified %v, want %v", notified, want)
+        }
+    })
+    t.Run("batch", func(t *testing.T) {
+        notifier := useNotifier(t)
+        var batch notificationBatch
+        batch.addGroupExcept(store, groupID, "actor", notification.UserLeftGroup, &map[string]string{"groupid": groupID})
+        if len(notifier.sent) != 0 {
+            t.Fatalf("sent before send was called")
+        }
+        batch.send(context.Background())
+        if notified := notifier.recipients(notification.UserLeftGroup); !sameIDs(notified, want) {
+            t.Errorf("notified %v, want %v", notified, want)
+        }
+    })
+}
+
+func TestShareAssetsRequiresOwnership(t *testing.T) {
+    tests := []struct {
+        name    string
+        share   bool
+        own     bool    // include an asset the actor owns along with the other member's
+    }{
+        {name: "share", share: true},
+        {name: "share with an owned asset", share: true, own: true},
+        {name: "unshare", share: false},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            store := database.NewMemStore()
+            groupID, _ := groupWithMembers(t, store, "actor", "other")
+            othersAsset := newAsset(t, store, "other")
+            if err := store.AddAssetsToGroup("other", groupID, []string{othersAsset}); err != nil {
+                t.Fatal(err)
+            }
+            if !test.share {
+                if err := store.ShareAssets("other", groupID, []string{othersAsset}, []string{"otherkey"}); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            assetIDs := []string{othersAsset}
+            if test.own {
+                ownAsset := newAsset(t, store, "actor")
+                if err := store.AddAssetsToGroup("actor", groupID, []string{ownAsset}); err != nil {
+                    t.Fatal(err)
+                }
+                assetIDs = append([]string{ownAsset}, assetIDs...)
+            }
+            body := map[string]interface{}{"AssetIDs": assetIDs, "Share": test.share}
+            if test.share {
+                body["AssetKeys"] = assetIDs
+            }
+
+            notifier := useNotifier(t)
+            response := serve(amendGroupSharedAssets, store, "PATCH", "/groups/" + groupID + "/album/shared", "actor", body, map[string]string{"groupID": groupID})
+            if response.Code != http.StatusForbidden {
+                t.Fatalf("got status %d, want %d: %s", response.Code, http.StatusForbidden, response.Body)
+            }
+            var result map[string][]string
+            if err := json.NewDecoder(response.Body).Decode(&result); err != nil || !sameIDs(result["unowned"], []string{othersAsset}) {
+                t.Errorf("got %v, %v, want unowned %s", result, err, othersAsset)
+            }
+            if len(notifier.sent) != 0 {
+                t.Errorf("notified %v for a rejected request", notifier.sent)
+            }
+
+            // nothing in the request is applied, including assets the actor owns
+            shared := sharedAssetIDs(t, store, "owner", groupID)
+            if test.share && len(shared) != 0 {
+                t.Errorf("assets shared: %v", shared)
+            }
+            if !test.share && !sameIDs(shared, []string{othersAsset}) {
+                t.Errorf("other member's asset unshared: %v", shared)
+            }
+        })
+    }
+}
+
+func TestPatchAssetsRecreate(t *testing.T) {
+    const medium = "https://s3.example.com/bucket/medium"
+    created := models.Asset{AssetID: uuid.New().String(), Type: "photo", RemotePath: "https://s3.example.com/bucket/low", Renditions: map[string]string{"medium": medium}, PixelWidth: 100, PixelHeight: 100, Md5: "md5", Key: "assetkey"}
+    retried := created
+    retried.Key = "retriedkey"
+
+    tests := []struct {
+        name    string
+        target  string
+        want    string
+    }{
+        {name: "partial", target: "/assets?partial=true", want: `{"CREATE":{"%[1]s":{"status":"existing","totalsize":%[2]d}},"DELETE":{}}`},
+        {name: "legacy", target: "/assets", want: `{"%[1]s":%[2]d}`},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            store := database.NewMemStore()
+            newUser(t, store, "owner")
+            useStorage(t, map[string]uint64{medium: 2 * defaultMinimumRenditionSize})
+
+            response := serve(patchAssets, store, "PATCH", test.target, "owner", models.AssetBatch{CREATE: []models.Asset{created}}, nil)
+            if response.Code != http.StatusOK {
+                t.Fatalf("create got status %d: %s", response.Code, response.Body)
+            }
+            response = serve(patchAssets, store, "PATCH", test.target, "owner", models.AssetBatch{CREATE: []models.Asset{retried}}, nil)
+            if response.Code != http.StatusOK {
+                t.Fatalf("re-create got status %d: %s", response.Code, response.Body)
+            }
+            if got, want := strings.TrimSpace(response.Body.String()), fmt.Sprintf(test.want, created.AssetID, 2 * defaultMinimumRenditionSize); got != want {
+                t.Errorf("got %s, want %s", got, want)
+            }
+
+            // the asset is kept as first created
+            if key := ownAsset(t, store, "owner", created.AssetID)["key"]; key != created.Key {
+                t.Errorf("key replaced with %v", key)
+            }
+        })
+    }
+}
+
+func TestJoinGroupTwice(t *testing.T) {
+    store := database.NewMemStore()
+    ownerID := newUser(t, store, "owner")
+    inviteeID := newUser(t, store, "invitee")
+    groupID := newGroup(t, store, "owner", "holiday")
+    if err := store.AddUsersToGroup("owner", groupID, []map[string]string{{"uuid": inviteeID, "key": "invitekey"}}); err != nil {
+        t.Fatal(err)
+    }
+
+    notifier := useNotifier(t)
+    for attempt, key := range []string{"groupkey", "retriedkey"} {
+        response := serve(joinGroup, store, "PUT", "/groups/" + groupID, "invitee", map[string]string{"key": key}, map[string]string{"groupID": groupID})
+        if want := []int{http.StatusCreated, http.StatusOK}[attempt]; response.Code != want {
+            t.Fatalf("join %d got status %d, want %d: %s", attempt + 1, response.Code, want, response.Body)
+        }
+    }
+
+    if notified := notifier.recipients(notification.UserJoinedGroup); !sameIDs(notified, []string{ownerID}) {
+        t.Errorf("notified %v, want the owner once", notified)
+    }
+    groups, _, err := store.GetGroupsFiltered("invitee", "", "", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if key := groups[groupID]["key"]; key != "groupkey" {
+        t.Errorf("got key %v, want the key from the first join", key)
+    }
+}
+
+func TestPutAssetRemotePathOriginal(t *testing.T) {
+    const original = "https://s3.example.com/bucket/asset_original"
+    tests := []struct {
+        name    string
+        stored  map[string]uint64
+        want    int
+    }{
+        {name: "stored", stored: map[string]uint64{original: 2 * defaultMinimumRenditionSize, "https://s3.example.com/bucket/asset_low": defaultMinimumRenditionSize}, want: http.StatusOK},
+        {name: "missing original", stored: map[string]uint64{}, want: http.StatusBadRequest},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            store := database.NewMemStore()
+            newUser(t, store, "owner")
+            assetID := newAsset(t, store, "owner")
+            useStorage(t, test.stored)
+
+            response := serve(putAssetRemotePathOriginal, store, "PUT", "/assets/" + assetID + "/remotepathorig", "owner", map[string]string{"remotepathorig": original}, map[string]string{"assetID": assetID})
+            if response.Code != test.want {
+                t.Fatalf("got status %d, want %d: %s", response.Code, test.want, response.Body)
+            }
+            recorded := ownAsset(t, store, "owner", assetID)["remotepathorig"] == original
+            if recorded != (test.want == http.StatusOK) {
+                t.Errorf("original recorded: %v", recorded)
+            }
+        })
+    }
+}
+
+func TestPatchAssetsRejectsInvalidDeleteIDs(t *testing.T) {
+    for _, target := range []string{"/assets", "/assets?partial=true"} {
+        t.Run(target, func(t *testing.T) {
+            store := database.NewMemStore()
+            newUser(t, store, "owner")
+            assetID := newAsset(t, store, "owner")
+            objects := useStorage(t, map[string]uint64{"https://s3.example.com/bucket/" + assetID: defaultMinimumRenditionSize})
+
+            response := serve(patchAssets, store, "PATCH", target, "owner", models.AssetBatch{DELETE: []string{assetID, "not-a-uuid"}}, nil)
+            if response.Code != http.StatusBadRequest {
+                t.Fatalf("got status %d, want %d: %s", response.Code, http.StatusBadRequest, response.Body)
+            }
+            if !strings.Contains(response.Body.String(), "not-a-uuid") {
+                t.Errorf("message %q doesn't name the invalid ID", response.Body)
+            }
+
+            // the valid ID in the batch is kept too
+            ownAsset(t, store, "owner", assetID)
+            if len(objects.sizes) != 1 {
+                t.Errorf("objects deleted from storage")
+            }
+        })
+    }
+}
+
+func TestSizeRenditions(t *testing.T) {
+    previous := minimumRenditionSizes
+    minimumRenditionSizes = map[string]uint64{"photo": 1000, "video": 5000}
+    t.Cleanup(func() {
+        minimumRenditionSizes = previous
+    })
+
+    const url = "https://s3.example.com/bucket/medium"
+    tests := []struct {
+        name        string
+        assetType   string
+        stored      uint64
+        want        uint64
+    }{
+        {name: "photo below minimum", assetType: "photo", stored: 999, want: 1000},
+        {name: "photo at minimum", assetType: "photo", stored: 1000, want: 1000},
+        {name: "photo above minimum", assetType: "photo", stored: 1001, want: 1001},
+        {name: "video below minimum", assetType: "video", stored: 4999, want: 5000},
+        {name: "video at minimum", assetType: "video", stored: 5000, want: 5000},
+        {name: "video above minimum", assetType: "video", stored: 5001, want: 5001},
+        {name: "photo minimum doesn't apply to video", assetType: "video", stored: 1001, want: 5000},
+        {name: "unknown type uses the default", assetType: "audio", stored: 1, want: defaultMinimumRenditionSize},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            useStorage(t, map[string]uint64{url: test.stored})
+            renditions, err := sizeRenditions(context.Background(), map[string]string{"medium": url}, test.assetType)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if got := renditions["medium"]; got.Size != test.want || got.RemotePath != url {
+                t.Errorf("got %+v, want size %d", got, test.want)
+            }
+        })
+    }
+}
+
+func TestPatchAssetsMinimumByType(t *testing.T) {
+    previous := minimumRenditionSizes
+    minimumRenditionSizes = map[string]uint64{"photo": 1000, "video": 5000}
+    t.Cleanup(func() {
+        minimumRenditionSizes = previous
+    })
+
+    const medium = "https://s3.example.com/bucket/medium"
+    for assetType, want := range map[string]uint64{"photo": 1000, "video": 5000} {
+        t.Run(assetType, func(t *testing.T) {
+            store := database.NewMemStore()
+            newUser(t, store, "owner")
+            useStorage(t, map[string]uint64{medium: 1})
+
+            created := models.Asset{AssetID: uuid.New().String(), Type: assetType, RemotePath: "https://s3.example.com/bucket/low", Renditions: map[string]string{"medium": medium}, PixelWidth: 100, PixelHeight: 100, Md5: "md5", Key: "assetkey"}
+            response := serve(patchAssets, store, "PATCH", "/assets?partial=true", "owner", models.AssetBatch{CREATE: []models.Asset{created}}, nil)
+            if response.Code != http.StatusOK {
+                t.Fatalf("got status %d: %s", response.Code, response.Body)
+            }
+            if got, want := strings.TrimSpace(response.Body.String()), fmt.Sprintf(`{"CREATE":{"%s":{"status":"created","totalsize":%d}},"DELETE":{}}`, created.AssetID, want); got != want {
+                t.Errorf("got %s, want %s", got, want)
+            }
+        })
+    }
+}
+
+func TestCreateUserTwice(t *testing.T) {
+    store := database.NewMemStore()
+    var userIDs []string
+    for attempt, want := range []int{http.StatusCreated, http.StatusOK} {
+        response := serve(createUser, store, "POST", "/users", "user", models.NewUser{Publickey: "publickey", Privatekey: "privatekey"}, nil)
+        if response.Code != want {
+            t.Fatalf("attempt %d got status %d, want %d: %s", attempt + 1, response.Code, want, response.Body)
+        }
+        userIDs = append(userIDs, response.Body.String())
+    }
+
+    if _, err := uuid.Parse(userIDs[0]); err != nil {
+        t.Fatalf("got %q, want a uuid", userIDs[0])
+    }
+    if userIDs[1] != userIDs[0] {
+        t.Errorf("retry got %s, want the uuid from the first attempt %s", userIDs[1], userIDs[0])
+    }
+    user, err := store.GetUser("user")
+    if err != nil || (*user)["uuid"] != userIDs[0] {
+        t.Errorf("stored user %v, %v", user, err)
+    }
+}
+
+// collideIDs makes the next new uuid generated by the server each of taken in turn, before going back to random uuids
+func collideIDs(t *testing.T, taken ...string) {
+    previous := newID
+    newID = func() uuid.UUID {
+        if len(taken) == 0 {
+            return uuid.New()
+        }
+        id := uuid.MustParse(taken[0])
+        taken = taken[1:]
+        return id
+    }
+    t.Cleanup(func() {
+        newID = previous
+    })
+}
+
+func TestCreateIDCollision(t *testing.T) {
+    create := map[string]struct {
+        handler     func(http.ResponseWriter, *http.Request, database.Store)
+        body        interface{}
+        signedUp    bool
+    }{
+        "user": {handler: createUser, body: models.NewUser{Publickey: "publickey", Privatekey: "privatekey"}},
+        "group": {handler: createGroup, body: models.NewGroup{Name: "holiday", Key: "groupkey"}, signedUp: true},
+    }
+    for name, test := range create {
+        t.Run(name, func(t *testing.T) {
+            store := database.NewMemStore()
+            ownerID := newUser(t, store, "owner")
+            groupID := newGroup(t, store, "owner", "existing")
+            takenID := map[string]string{"user": ownerID, "group": groupID}[name]
+            if test.signedUp {
+                newUser(t, store, "creator")
+                newUser(t, store, "other")
+            }
+
+            t.Run("recovers", func(t *testing.T) {
+                collideIDs(t, takenID)
+                response := serve(test.handler, store, "POST", "/", "creator", test.body, nil)
+                if response.Code != http.StatusCreated {
+                    t.Fatalf("got status %d: %s", response.Code, response.Body)
+                }
+                if id := response.Body.String(); id == takenID {
+                    t.Errorf("got the uuid already in use")
+                } else if _, err := uuid.Parse(id); err != nil {
+                    t.Errorf("got %q, want a uuid", id)
+                }
+            })
+
+            t.Run("gives up", func(t *testing.T) {
+                var taken []string
+                for attempt := 0; attempt < maxIDAttempts; attempt++ {
+                    taken = append(taken, takenID)
+                }
+                collideIDs(t, taken...)
+                response := serve(test.handler, store, "POST", "/", "other", test.body, nil)
+                if response.Code != http.StatusInternalServerError {
+                    t.Errorf("got status %d, want %d: %s", response.Code, http.StatusInternalServerError, response.Body)
+                }
+            })
+        })
+    }
+}
+
+func TestPatchSchema0(t *testing.T) {
+    tests := []struct {
+        name        string
+        version     string
+        want        int
+        wantKey     string
+        wantVersion string
+    }{
+        {name: "migrates", version: "0", want: http.StatusOK, wantKey: "migratedkey", wantVersion: "1"},
+        {name: "re-applied is a no-op", version: "1", want: http.StatusOK, wantKey: "assetkey", wantVersion: "1"},
+        {name: "downgrade is rejected", version: "2", want: http.StatusConflict, wantKey: "assetkey", wantVersion: "2"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            store := database.NewMemStore()
+            if err := store.CreateUser("user", uuid.New().String(), auth.AuthProviders{Email: "hashed-user"}, "publickey", "privatekey", test.version); err != nil {
+                t.Fatal(err)
+            }
+            assetID := newAsset(t, store, "user")
+
+            patch := map[string]map[string]string{"AssetKeys": {assetID: "migratedkey"}, "AssetMD5s": {assetID: "migratedmd5"}}
+            response := serve(patchSchema0, store, "PATCH", "/schema/0", "user", patch, nil)
+            if response.Code != test.want {
+                t.Fatalf("got status %d, want %d: %s", response.Code, test.want, response.Body)
+            }
+
+            user, err := store.GetUser("user")
+            if err != nil {
+                t.Fatal(err)
+            }
+            if version := (*user)["schemaVersion"]; version != test.wantVersion {
+                t.Errorf("got schema version %s, want %s", version, test.wantVersion)
+            }
+            if key := ownAsset(t, store, "user", assetID)["key"]; key != test.wantKey {
+                t.Errorf("got key %v, want %s", key, test.wantKey)
+            }
+        })
+    }
+
+    t.Run("retried", func(t *testing.T) {
+        store := database.NewMemStore()
+        if err := store.CreateUser("user", uuid.New().String(), auth.AuthProviders{Email: "hashed-user"}, "publickey", "privatekey", "0"); err != nil {
+            t.Fatal(err)
+        }
+        assetID := newAsset(t, store, "user")
+        for attempt, key := range []string{"migratedkey", "retriedkey"} {
+            response := serve(patchSchema0, store, "PATCH", "/schema/0", "user", map[string]map[string]string{"AssetKeys": {assetID: key}}, nil)
+            if response.Code != http.StatusOK {
+                t.Fatalf("attempt %d got status %d: %s", attempt + 1, response.Code, response.Body)
+            }
+        }
+        if key := ownAsset(t, store, "user", assetID)["key"]; key != "migratedkey" {
+            t.Errorf("got key %v, want the key from the first attempt", key)
+        }
+    })
+}
+
+func TestAddUsersToGroupRejectsMalformedEntries(t *testing.T) {
+    previous, previousSize := maxGroupInvites, maxGroupSize
+    maxGroupInvites, maxGroupSize = 10, 10
+    t.Cleanup(func() {
+        maxGroupInvites, maxGroupSize = previous, previousSize
+    })
+
+    // an entry uuid of "other" is replaced with the uuid of a second registered user
+    tests := []struct {
+        name    string
+        entry   map[string]string
+        want    int
+    }{
+        {name: "valid", entry: map[string]string{"uuid": "other", "key": "invitekey"}, want: http.StatusOK},
+        {name: "missing uuid", entry: map[string]string{"key": "invitekey"}, want: http.StatusBadRequest},
+        {name: "invalid uuid", entry: map[string]string{"uuid": "not-a-uuid", "key": "invitekey"}, want: http.StatusBadRequest},
+        {name: "missing key", entry: map[string]string{"uuid": "other"}, want: http.StatusBadRequest},
+        {name: "empty key", entry: map[string]string{"uuid": "other", "key": ""}, want: http.StatusBadRequest},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            store := database.NewMemStore()
+            newUser(t, store, "owner")
+            groupID := newGroup(t, store, "owner", "holiday")
+            inviteeID := newUser(t, store, "invitee")
+            otherID := newUser(t, store, "other")
+            entry := make(map[string]string)
+            for name, value := range test.entry {
+                if name == "uuid" && value == "other" {
+                    value = otherID
+                }
+                entry[name] = value
+            }
+            notifier := useNotifier(t)
+
+            users := []map[string]string{{"uuid": inviteeID, "key": "invitekey"}, entry}
+            response := serve(addUsersToGroup, store, "PATCH", "/groups/" + groupID + "/users", "owner", models.GroupInvites{Users: users}, map[string]string{"groupID": groupID})
+            if response.Code != test.want {
+                t.Fatalf("got status %d, want %d: %s", response.Code, test.want, response.Body)
+            }
+
+            members, err := store.GetUsersInGroup("owner", groupID)
+            if err != nil && err != io.EOF {   // EOF when the owner is the only member
+                t.Fatal(err)
+            }
+            notified := notifier.recipients(notification.GroupInvite)
+            if test.want == http.StatusOK {
+                if _, ok := members[inviteeID]; !ok {
+                    t.Errorf("invitee not added: %v", members)
+                }
+                return
+            }
+            if !strings.Contains(response.Body.String(), "users[1]") {
+                t.Errorf("message %q doesn't name the malformed entry", response.Body)
+            }
+            if _, ok := members[inviteeID]; ok {
+                t.Errorf("valid entry added from a rejected batch")
+            }
+            if len(notified) != 0 {
+                t.Errorf("notified %v", notified)
+            }
+        })
+    }
+}
+
+func TestAddUsersToGroupMaxSize(t *testing.T) {
+    previous, previousSize := maxGroupInvites, maxGroupSize
+    maxGroupInvites, maxGroupSize = 10, 3
+    t.Cleanup(func() {
+        maxGroupInvites, maxGroupSize = previous, previousSize
+    })
+
+    store := database.NewMemStore()
+    newUser(t, store, "owner")
+    groupID := newGroup(t, store, "owner", "holiday")
+    memberID := newUser(t, store, "member")
+    useNotifier(t)
+    add := func(ids ...string) int {
+        var users []map[string]string
+        for _, id := range ids {
+            users = append(users, map[string]string{"uuid": id, "key": "invitekey"})
+        }
+        return serve(addUsersToGroup, store, "PATCH", "/groups/" + groupID + "/users", "owner", models.GroupInvites{Users: users}, map[string]string{"groupID": groupID}).Code
+    }
+    if code := add(memberID); code != http.StatusOK {
+        t.Fatalf("got status %d adding the second member", code)
+    }
+    // re-adding an existing member doesn't grow the group
+    if code := add(memberID, newUser(t, store, "third")); code != http.StatusOK {
+        t.Fatalf("got status %d filling the group", code)
+    }
+    if code := add(newUser(t, store, "fourth")); code != http.StatusConflict {
+        t.Fatalf("got status %d adding beyond the limit, want %d", code, http.StatusConflict)
+    }
+}
+
+func TestPatchAssetsOriginalFilenamesVersioning(t *testing.T) {
+    store := database.NewMemStore()
+    newUser(t, store, "user")
+    assetID := newAsset(t, store, "user")
+    patch := func(value interface{}) {
+        response := serve(patchAssetsOriginalFilenames, store, "PATCH", "/assets/originalfilenames", "user", map[string]interface{}{assetID: value}, nil)
+        if response.Code != http.StatusOK {
+            t.Fatalf("got status %d: %s", response.Code, response.Body)
+        }
+    }
+    filename := func() string {
+        filenames, err := store.GetAssetsOriginalFilenames("user", []string{assetID})
+        if err != nil {
+            t.Fatal(err)
+        }
+        return filenames[assetID]
+    }
+
+    patch(map[string]interface{}{"filename": "versioned.jpg", "setAt": time.Now().Add(-time.Hour)})
+    patch("legacy.jpg")
+    // made before the legacy update reached the server, so it must not overwrite it
+    patch(map[string]interface{}{"filename": "stale.jpg", "setAt": time.Now().Add(-time.Minute)})
+    if got := filename(); got != "legacy.jpg" {
+        t.Fatalf("got %q after a stale versioned update, want legacy.jpg", got)
+    }
+    patch(map[string]interface{}{"filename": "newer.jpg", "setAt": time.Now().Add(time.Minute)})
+    if got := filename(); got != "newer.jpg" {
+        t.Errorf("got %q after a newer versioned update, want newer.jpg", got)
+    }
+}
+
+func TestLeaveGroupSharedAssets(t *testing.T) {
+    tests := []struct {
+        name        string
+        query       string
+        keepDefault bool
+        want        int
+        wantKept    bool
+    }{
+        {name: "keep", query: "?assets=keep", want: http.StatusOK, wantKept: true},
+        {name: "remove", query: "?assets=remove", keepDefault: true, want: http.StatusOK},
+        {name: "default remove", want: http.StatusOK},
+        {name: "default keep", keepDefault: true, want: http.StatusOK, wantKept: true},
+        {name: "invalid", query: "?assets=archive", want: http.StatusBadRequest, wantKept: true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            previous := leaveGroupKeepsAssets
+            leaveGroupKeepsAssets = test.keepDefault
+            t.Cleanup(func() {
+                leaveGroupKeepsAssets = previous
+            })
+
+            store := database.NewMemStore()
+            groupID, members := groupWithMembers(t, store, "leaver", "other")
+            assetID := newAsset(t, store, "leaver")
+            if err := store.AddAssetsToGroup("leaver", groupID, []string{assetID}); err != nil {
+                t.Fatal(err)
+            }
+            if err := store.ShareAssets("leaver", groupID, []string{assetID}, []string{"sharedkey"}); err != nil {
+                t.Fatal(err)
+            }
+
+            notifier := useNotifier(t)
+            response := serve(leaveGroup, store, "DELETE", "/groups/" + groupID + test.query, "leaver", nil, map[string]string{"groupID": groupID})
+            if response.Code != test.want {
+                t.Fatalf("got status %d, want %d: %s", response.Code, test.want, response.Body)
+            }
+
+            shared := sharedAssetIDs(t, store, "other", groupID)
+            if kept := sameIDs(shared, []string{assetID}); kept != test.wantKept {
+                t.Errorf("got shared assets %v for the remaining members, want kept %v", shared, test.wantKept)
+            }
+
+            var want []string
+            if test.want == http.StatusOK && !test.wantKept {
+                want = []string{members["owner"], members["other"]}
+            }
+            if notified := notifier.recipients(notification.AssetsChangedForGroup); !sameIDs(notified, want) {
+                t.Errorf("notified %v of changed assets, want %v", notified, want)
+            }
+        })
+    }
+}
+
+func TestFirebaseUserDeletedWebhookBodyLimit(t *testing.T) {
+    store := database.NewMemStore()
+    newUser(t, store, "user")
+
+    response := serve(firebaseUserDeletedWebhook, store, "POST", "/webhooks/firebase/user-deleted", "", map[string]string{"uid": "user", "padding": strings.Repeat("a", maxSignedBodySize)}, nil)
+    if response.Code != http.StatusRequestEntityTooLarge {
+        t.Fatalf("got status %d, want %d: %s", response.Code, http.StatusRequestEntityTooLarge, response.Body)
+    }
+    if _, err := store.GetUser("user"); err != nil {
+        t.Errorf("user was deprovisioned by an oversized payload: %v", err)
+    }
+}
+
+// signedRequest returns a webhook request carrying payload, signed with secret as OneSignal does
+func signedRequest(secret string, target string, payload []byte) *http.Request {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(payload)
+    request := httptest.NewRequest("POST", target, bytes.NewReader(payload))
+    request.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+    return request
+}
+
+func TestOneSignalWebhookReceipts(t *testing.T) {
+    previous := oneSignalWebhookSecret
+    oneSignalWebhookSecret = "secret"
+    t.Cleanup(func() {
+        oneSignalWebhookSecret = previous
+    })
+
+    tests := []struct {
+        name        string
+        event       string
+        id          string
+        want        int
+        wantStatus  string
+    }{
+        {name: "delivered", event: "notification.delivered", id: "sent-id", want: http.StatusOK, wantStatus: "delivered"},
+        {name: "failed", event: "notification.failed", id: "sent-id", want: http.StatusOK, wantStatus: "failed"},
+        {name: "untracked event", event: "notification.displayed", id: "sent-id", want: http.StatusOK, wantStatus: "sent"},
+        {name: "event name containing fail", event: "notification.failover", id: "sent-id", want: http.StatusOK, wantStatus: "sent"},
+        {name: "unknown notification", event: "notification.failed", id: "other-id", want: http.StatusOK},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            store := database.NewMemStore()
+            recordSentNotifications(store)([]string{"sent-id"}, notification.GroupInvite)
+
+            payload, _ := json.Marshal(map[string]string{"event": test.event, "notificationId": test.id})
+            response := httptest.NewRecorder()
+            oneSignalWebhook(response, signedRequest("secret", "/webhooks/onesignal", payload), store)
+            if response.Code != test.want {
+                t.Fatalf("got status %d, want %d: %s", response.Code, test.want, response.Body)
+            }
+
+            if status := store.NotificationReceipt(test.id)["status"]; status != test.wantStatus {
+                t.Errorf("got status %q recorded for %s, want %q", status, test.id, test.wantStatus)
+            }
+        })
+    }
+
+    t.Run("oversized", func(t *testing.T) {
+        payload, _ := json.Marshal(map[string]string{"event": "notification.failed", "notificationId": "sent-id", "padding": strings.Repeat("a", maxSignedBodySize)})
+        response := httptest.NewRecorder()
+        oneSignalWebhook(response, signedRequest("secret", "/webhooks/onesignal", payload), database.NewMemStore())
+        if response.Code != http.StatusRequestEntityTooLarge {
+            t.Fatalf("got status %d, want %d: %s", response.Code, http.StatusRequestEntityTooLarge, response.Body)
+        }
+    })
+}
+
+func TestSharedKeyConflict(t *testing.T) {
+    tests := []struct {
+        name    string
+        move    bool    // move the asset into the group rather than share it there
+        key     string
+        want    int
+    }{
+        {name: "share with the same key", key: "groupkey", want: http.StatusOK},
+        {name: "share with another key", key: "otherkey", want: http.StatusConflict},
+        {name: "move with the same key", move: true, key: "groupkey", want: http.StatusOK},
+        {name: "move with another key", move: true, key: "otherkey", want: http.StatusConflict},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            store := database.NewMemStore()
+            newUser(t, store, "actor")
+            fromGroupID := newGroup(t, store, "actor", "from")
+            groupID := newGroup(t, store, "actor", "to")
+            assetID := newAsset(t, store, "actor")
+            for sharedGroupID, key := range map[string]string{fromGroupID: "fromkey", groupID: "groupkey"} {
+                if err := store.AddAssetsToGroup("actor", sharedGroupID, []string{assetID}); err != nil {
+                    t.Fatal(err)
+                }
+                if err := store.ShareAssets("actor", sharedGroupID, []string{assetID}, []string{key}); err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            useNotifier(t)
+            var response *httptest.ResponseRecorder
+            if test.move {
+                body := map[string]string{"FromGroupID": fromGroupID, "ToGroupID": groupID, "AssetKey": test.key}
+                response = serve(moveSharedAsset, store, "POST", "/assets/" + assetID + "/move", "actor", body, map[string]string{"assetID": assetID})
+            } else {
+                body := map[string]interface{}{"AssetIDs": []string{assetID}, "AssetKeys": []string{test.key}, "Share": true}
+                response = serve(amendGroupSharedAssets, store, "PATCH", "/groups/" + groupID + "/album/shared", "actor", body, map[string]string{"groupID": groupID})
+            }
+            if response.Code != test.want {
+                t.Fatalf("got status %d, want %d: %s", response.Code, test.want, response.Body)
+            }
+            if test.want == http.StatusConflict {
+                var result map[string][]string
+                if err := json.NewDecoder(response.Body).Decode(&result); err != nil || !sameIDs(result["conflicts"], []string{assetID}) {
+                    t.Errorf("got %v, %v, want conflicts %s", result, err, assetID)
+                }
+            }
+
+            keys, err := store.GetSharedAssetKeys("actor", groupID, []string{assetID})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if keys[assetID] != "groupkey" {
+                t.Errorf("got shared key %q, want the key members already decrypt with", keys[assetID])
+            }
+            // a rejected move leaves the asset in the source group
+            fromKeys, err := store.GetSharedAssetKeys("actor", fromGroupID, []string{assetID})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if moved := len(fromKeys) == 0; moved != (test.move && test.want == http.StatusOK) {
+                t.Errorf("got moved %v out of the source group, want %v", moved, !moved)
+            }
+        })
+    }
+}
+
+func TestCrossGroupAccess(t *testing.T) {
+    store := database.NewMemStore()
+    groupID, members := groupWithMembers(t, store, "member")
+    sharedAsset := newAsset(t, store, "member")
+    if err := store.AddAssetsToGroup("member", groupID, []string{sharedAsset}); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.ShareAssets("member", groupID, []string{sharedAsset}, []string{"sharedkey"}); err != nil {
+        t.Fatal(err)
+    }
+
+    // the outsider has a valid token and a group of their own, but isn't a member of groupID
+    newUser(t, store, "outsider")
+    outsidersGroup := newGroup(t, store, "outsider", "other")
+    outsidersAsset := newAsset(t, store, "outsider")
+    if err := store.AddAssetsToGroup("outsider", outsidersGroup, []string{outsidersAsset}); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.ShareAssets("outsider", outsidersGroup, []string{outsidersAsset}, []string{"outsiderkey"}); err != nil {
+        t.Fatal(err)
+    }
+
+    groupParams := map[string]string{"groupID": groupID}
+    tests := []struct {
+        name    string
+        handler func(http.ResponseWriter, *http.Request, database.Store)
+        method  string
+        target  string
+        body    interface{}
+        params  map[string]string
+    }{
+        {name: "group users", handler: getGroupUsers, method: "GET", target: "/groups/" + groupID + "/users", params: groupParams},
+        {name: "group users page", handler: getGroupUsers, method: "GET", target: "/groups/" + groupID + "/users?limit=10", params: groupParams},
+        {name: "group users with stats", handler: getGroupUsers, method: "GET", target: "/groups/" + groupID + "/users?withStats=true", params: groupParams},
+        {name: "add group assets", handler: amendGroupAssets, method: "PATCH", target: "/groups/" + groupID + "/album", body: map[string]interface{}{"Add": true, "AssetIDs": []string{outsidersAsset}}, params: groupParams},
+        {name: "remove group assets", handler: amendGroupAssets, method: "PATCH", target: "/groups/" + groupID + "/album", body: map[string]interface{}{"Add": false, "AssetIDs": []string{sharedAsset}}, params: groupParams},
+        {name: "share group assets", handler: amendGroupSharedAssets, method: "PATCH", target: "/groups/" + groupID + "/album/shared", body: map[string]interface{}{"AssetIDs": []string{outsidersAsset}, "AssetKeys": []string{"key"}, "Share": true}, params: groupParams},
+        {name: "move into group", handler: moveSharedAsset, method: "POST", target: "/assets/" + outsidersAsset + "/move", body: map[string]string{"FromGroupID": outsidersGroup, "ToGroupID": groupID, "AssetKey": "key"}, params: map[string]string{"assetID": outsidersAsset}},
+        {name: "rotate group key", handler: rotateGroupKey, method: "PUT", target: "/groups/" + groupID + "/key", body: map[string]string{members["owner"]: "key", members["member"]: "key"}, params: groupParams},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            notifier := useNotifier(t)
+            response := serve(test.handler, store, test.method, test.target, "outsider", test.body, test.params)
+            if response.Code != http.StatusForbidden && response.Code != http.StatusNotFound {
+                t.Fatalf("got status %d, want %d or %d: %s", response.Code, http.StatusForbidden, http.StatusNotFound, response.Body)
+            }
+            for _, leaked := range []string{members["owner"], members["member"], sharedAsset, "sharedkey", "groupkey-"} {
+                if strings.Contains(response.Body.String(), leaked) {
+                    t.Errorf("response leaked %s: %s", leaked, response.Body)
+                }
+            }
+            if len(notifier.sent) != 0 {
+                t.Errorf("notified %v for a rejected request", notifier.sent)
+            }
+        })
+    }
+
+    // nothing was changed by the rejected requests
+    if shared := sharedAssetIDs(t, store, "member", groupID); !sameIDs(shared, []string{sharedAsset}) {
+        t.Errorf("got shared assets %v, want %s", shared, sharedAsset)
+    }
+    if shared := sharedAssetIDs(t, store, "outsider", outsidersGroup); !sameIDs(shared, []string{outsidersAsset}) {
+        t.Errorf("got shared assets %v in the outsider's group, want %s", shared, outsidersAsset)
+    }
+
+    t.Run("all group albums", func(t *testing.T) {
+        response := serve(getAssetsForAllGroups, store, "GET", "/groups/album", "outsider", nil, nil)
+        if response.Code != http.StatusOK && response.Code != http.StatusNoContent {
+            t.Fatalf("got status %d: %s", response.Code, response.Body)
+        }
+        if strings.Contains(response.Body.String(), groupID) || strings.Contains(response.Body.String(), sharedAsset) {
+            t.Errorf("response leaked another group's album: %s", response.Body)
+        }
+    })
+}
+
+func TestRemovedContactStaysRemoved(t *testing.T) {
+    tests := []struct {
+        name        string
+        email       string  // reported by firebase after the removal
+        wantEmail   bool
+    }{
+        {name: "same email", email: "hashed-email", wantEmail: false},
+        {name: "new email", email: "hashed-new-email", wantEmail: true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            store := database.NewMemStore()
+            if err := store.CreateUser("user", uuid.New().String(), auth.AuthProviders{PhoneNumber: "hashed-number", Email: "hashed-email"}, "publickey", "privatekey", "1"); err != nil {
+                t.Fatal(err)
+            }
+            response := serve(removeUserContact, store, "DELETE", "/users/self/contact/email", "user", nil, map[string]string{"provider": "email"})
+            if response.Code != http.StatusOK {
+                t.Fatalf("remove got status %d: %s", response.Code, response.Body)
+            }
+
+            previous := userAuthProviders
+            userAuthProviders = func(ctx context.Context, uid string) (auth.AuthProviders, error) {
+                return auth.AuthProviders{PhoneNumber: "hashed-number", Email: test.email}, nil
+            }
+            t.Cleanup(func() {
+                userAuthProviders = previous
+            })
+            // the client refreshes contacts from its token on every sign in
+            for attempt := 0; attempt < 2; attempt++ {
+                if response := serve(updateUserContact, store, "PUT", "/users/self/contact", "user", nil, nil); response.Code != http.StatusOK {
+                    t.Fatalf("update got status %d: %s", response.Code, response.Body)
+                }
+            }
+
+            profile, err := store.GetUserProfile("user")
+            if err != nil {
+                t.Fatal(err)
+            }
+            providers := profile["authProviders"].([]string)
+            want := []string{"phone"}
+            if test.wantEmail {
+                want = append(want, "email")
+            }
+            if !sameIDs(providers, want) {
+                t.Errorf("got contacts %v, want %v", providers, want)
+            }
+        })
+    }
+}
+
+func TestContactTakeoverKeepsOnlyContact(t *testing.T) {
+    tests := []struct {
+        name        string
+        holder      auth.AuthProviders  // the other user holding the claimed number
+        wantHolder  []string
+    }{
+        {name: "released", holder: auth.AuthProviders{PhoneNumber: "hashed-number", Email: "hashed-holder"}, wantHolder: []string{"email"}},
+        {name: "only contact", holder: auth.AuthProviders{PhoneNumber: "hashed-number"}, wantHolder: []string{"phone"}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            store := database.NewMemStore()
+            if err := store.CreateUser("holder", uuid.New().String(), test.holder, "publickey", "privatekey", "1"); err != nil {
+                t.Fatal(err)
+            }
+            if err := store.CreateUser("user", uuid.New().String(), auth.AuthProviders{PhoneNumber: "hashed-number"}, "publickey", "privatekey", "1"); err != nil {
+                t.Fatal(err)
+            }
+
+            profile, err := store.GetUserProfile("holder")
+            if err != nil {
+                t.Fatal(err)
+            }
+            if providers := profile["authProviders"].([]string); !sameIDs(providers, test.wantHolder) {
+                t.Errorf("got holder contacts %v, want %v", providers, test.wantHolder)
+            }
+        })
+    }
+}
+
+func TestUpdateUserProfileAvatar(t *testing.T) {
+    store := database.NewMemStore()
+    newUser(t, store, "user")
+    newUser(t, store, "other")
+    ownAvatar := newAsset(t, store, "user")
+    othersAsset := newAsset(t, store, "other")
+
+    tests := []struct {
+        name    string
+        avatar  string
+        want    int
+    }{
+        {name: "own asset", avatar: ownAvatar, want: http.StatusOK},
+        {name: "no avatar", want: http.StatusOK},
+        {name: "missing asset", avatar: uuid.New().String(), want: http.StatusNotFound},
+        {name: "another user's asset", avatar: othersAsset, want: http.StatusForbidden},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if err := store.SetUserProfile("user", "nickname", ownAvatar); err != nil {
+                t.Fatal(err)
+            }
+            response := serve(updateUserProfile, store, "PUT", "/users/self/profile", "user", map[string]string{"Nickname": "nickname", "Avatar": test.avatar}, nil)
+            if response.Code != test.want {
+                t.Fatalf("got status %d, want %d: %s", response.Code, test.want, response.Body)
+            }
+
+            want := ownAvatar
+            if test.want == http.StatusOK {
+                want = test.avatar
+            }
+            profile, err := store.GetUserProfile("user")
+            if err != nil {
+                t.Fatal(err)
+            }
+            if avatar, _ := profile["avatar"].(string); avatar != want {
+                t.Errorf("got avatar %q, want %q", avatar, want)
+            }
+        })
+    }
+}
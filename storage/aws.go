@@ -2,68 +2,130 @@ package storage
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+    "context"
     "errors"
+    "log"
+    "net/http"
+    "os"
     "strings"
     URL "net/url"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/aws/request"
     "github.com/aws/aws-sdk-go/aws/session"
     "github.com/aws/aws-sdk-go/service/s3"
+
+    "github.com/tripupapp/tripup-server/logging"
 )
 
+// maximum keys per DeleteObjects request
+const s3DeleteBatchSize = 1000
+
+var warnLogger = log.New(logging.Writer(logging.Warn, os.Stderr), "[WARN] StorageLog: ", log.LstdFlags)
+
+// s3Client is the subset of the S3 API the backend uses
+type s3Client interface {
+    HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error)
+    DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error)
+    CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error)
+    DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error)
+}
+
 type s3storage struct {
-    session *session.Session
+    svc s3Client
 }
 
-func NewS3Backend() *s3storage {
-    return &s3storage{
-        session: session.Must(session.NewSessionWithOptions(session.Options{
-            SharedConfigState: session.SharedConfigEnable,
-        }))}
+// NewS3Backend creates an S3 backed storage, region is optional and overrides the shared AWS config when set. endpoint is
+// optional and points the backend at an S3 compatible provider, forcePathStyle addresses buckets as endpoint/bucket/key
+// rather than bucket.endpoint/key
+func NewS3Backend(region string, endpoint string, forcePathStyle bool) *s3storage {
+    var config aws.Config
+    if len(region) != 0 {
+        config.Region = aws.String(region)
+    }
+    if len(endpoint) != 0 {
+        config.Endpoint = aws.String(endpoint)
+    }
+    config.S3ForcePathStyle = aws.Bool(forcePathStyle)
+    s3session := session.Must(session.NewSessionWithOptions(session.Options{
+        Config: config,
+        SharedConfigState: session.SharedConfigEnable,
+    }))
+    // without a region every S3 call fails with a missing region error, say so at startup rather than on first use
+    if len(aws.StringValue(s3session.Config.Region)) == 0 {
+        warnLogger.Println("no AWS region configured, set AWS_REGION or a region in the shared AWS config")
+    }
+    // tag every S3 call with the trace of the client request that caused it
+    s3session.Handlers.Build.PushBack(func(r *request.Request) {
+        logging.TraceFromContext(r.Context()).SetHeaders(r.HTTPRequest.Header)
+    })
+    return &s3storage{svc: s3.New(s3session)}
 }
 
-func (*s3storage) Filesizes(originalURL string) (uint64, uint64, error) {
-    url, err := URL.Parse(originalURL)
-	if err != nil {
-		return 0, 0, err
-	}
+func (*s3storage) Name() string {
+    return "s3"
+}
 
-	path := strings.SplitN(url.Path, "/", 3)
-	bucket := path[1]
-    keyOriginal := path[2]
-    keyLow := strings.Replace(keyOriginal, "_original", "_low", -1)
+// RenditionSizes returns the size of each object in urls, in the same order
+func (s *s3storage) RenditionSizes(ctx context.Context, urls []string) ([]uint64, error) {
+    sizes := make([]uint64, len(urls))
+    for index, rawurl := range urls {
+        url, err := URL.Parse(rawurl)
+        if err != nil {
+            return nil, err
+        }
+        path := strings.SplitN(url.Path, "/", 3)
+        if len(path) != 3 {
+            return nil, errors.New("invalid storage url: " + rawurl)
+        }
+        bucket := path[1]
+        key := path[2]
 
-    sess := session.Must(session.NewSessionWithOptions(session.Options{
-        SharedConfigState: session.SharedConfigEnable,
-    }))
-    svc := s3.New(sess)
+        result, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+            Bucket: &bucket,
+            Key: &key,
+        })
+        if err != nil {
+            return nil, err
+        }
+        length := *result.ContentLength
+        if length < 0 {
+            return nil, errors.New("content length < 0 for " + rawurl)
+        }
+        sizes[index] = uint64(length)
+    }
+    return sizes, nil
+}
 
-    originalResult, err := svc.HeadObject(&s3.HeadObjectInput{
-        Bucket: &bucket,
-        Key: &keyOriginal,
-    })
+// Exists reports whether the object at rawurl is stored, a missing object is not an error
+func (s *s3storage) Exists(ctx context.Context, rawurl string) (bool, error) {
+    url, err := URL.Parse(rawurl)
     if err != nil {
-        return 0, 0, err
+        return false, err
     }
-    originalLength := *originalResult.ContentLength
-    if originalLength < 0 {
-        return 0, 0, errors.New("content length < 0 for original asset")
+    path := strings.SplitN(url.Path, "/", 3)
+    if len(path) != 3 {
+        return false, errors.New("invalid storage url: " + rawurl)
     }
+    bucket := path[1]
+    key := path[2]
 
-    lowResult, err := svc.HeadObject(&s3.HeadObjectInput{
+    _, err = s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
         Bucket: &bucket,
-        Key: &keyLow,
+        Key: &key,
     })
     if err != nil {
-        return 0, 0, err
-    }
-    lowLength := *lowResult.ContentLength
-    if lowLength < 0 {
-        return 0, 0, errors.New("content length < 0 for low asset")
+        var requestFailure awserr.RequestFailure
+        if errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusNotFound {
+            return false, nil
+        }
+        return false, err
     }
-
-    return uint64(originalLength), uint64(lowLength), nil
+    return true, nil
 }
 
-func (*s3storage) Delete(remotepaths []string) error {
+// Delete removes the objects at remotepaths, nothing is deleted if any path is invalid. Objects that couldn't be deleted
+// are returned in a DeleteError, the rest are still deleted
+func (s *s3storage) Delete(ctx context.Context, remotepaths []string) error {
     s3objects := map[string]*[]*s3.ObjectIdentifier{}
 
     for _, remotepath := range remotepaths {
@@ -72,36 +134,90 @@ func (*s3storage) Delete(remotepaths []string) error {
             return err
         }
         path := strings.SplitN(url.Path, "/", 3)
-	    bucket := path[1]
+        if len(path) != 3 {
+            return errors.New("invalid storage url: " + remotepath)
+        }
+        bucket := path[1]
         key := path[2]
 
         _, ok := s3objects[bucket]
-		if !ok {
-			s3objects[bucket] = &[]*s3.ObjectIdentifier{}
+        if !ok {
+            s3objects[bucket] = &[]*s3.ObjectIdentifier{}
         }
         *s3objects[bucket] = append(*s3objects[bucket], &s3.ObjectIdentifier {
             Key: &key,
         })
     }
 
-    sess := session.Must(session.NewSessionWithOptions(session.Options{
-        SharedConfigState: session.SharedConfigEnable,
-    }))
-    svc := s3.New(sess)
-
+    // DeleteObjects accepts at most s3DeleteBatchSize keys per request, so larger deletions are split across requests
+    var failed []string
     for bucket, objects := range s3objects {
-        input := &s3.DeleteObjectsInput {
-            Bucket: &bucket,
-            Delete: &s3.Delete{
-                Objects: *objects,
-                Quiet: aws.Bool(true),
-            },
-        }
-        _, err := svc.DeleteObjects(input)
-        if err != nil {
-            return err
+        for start := 0; start < len(*objects); start += s3DeleteBatchSize {
+            end := start + s3DeleteBatchSize
+            if end > len(*objects) {
+                end = len(*objects)
+            }
+            input := &s3.DeleteObjectsInput {
+                Bucket: aws.String(bucket),
+                Delete: &s3.Delete{
+                    Objects: (*objects)[start:end],
+                    Quiet: aws.Bool(true),
+                },
+            }
+            output, err := s.svc.DeleteObjectsWithContext(ctx, input)
+            if err != nil {
+                // the remaining batches may still succeed, so the whole batch is reported rather than giving up
+                for _, object := range (*objects)[start:end] {
+                    failed = append(failed, bucket + "/" + aws.StringValue(object.Key) + ": " + err.Error())
+                }
+                continue
+            }
+            // quiet mode only reports the keys that couldn't be deleted
+            for _, deleteError := range output.Errors {
+                failed = append(failed, bucket + "/" + aws.StringValue(deleteError.Key) + ": " + aws.StringValue(deleteError.Message))
+            }
         }
     }
 
+    if len(failed) != 0 {
+        return &DeleteError{Failed: failed}
+    }
+    return nil
+}
+
+// Move copies the object at fromurl to tourl, then deletes the original
+func (s *s3storage) Move(ctx context.Context, fromurl string, tourl string) error {
+    from, err := URL.Parse(fromurl)
+    if err != nil {
+        return err
+    }
+    to, err := URL.Parse(tourl)
+    if err != nil {
+        return err
+    }
+    fromPath := strings.SplitN(from.Path, "/", 3)
+    toPath := strings.SplitN(to.Path, "/", 3)
+    if len(fromPath) != 3 || len(toPath) != 3 {
+        return errors.New("invalid storage url: " + fromurl + " or " + tourl)
+    }
+
+    copySource := (&URL.URL{Path: fromPath[1] + "/" + fromPath[2]}).EscapedPath()
+    _, err = s.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+        Bucket: aws.String(toPath[1]),
+        Key: aws.String(toPath[2]),
+        CopySource: aws.String(copySource),
+    })
+    if err != nil {
+        return err
+    }
+    _, err = s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+        Bucket: aws.String(fromPath[1]),
+        Key: aws.String(fromPath[2]),
+    })
+    return err
+}
+
+// Shutdown is a no-op, S3 requests are stateless and the session holds no resources that need releasing
+func (s *s3storage) Shutdown(ctx context.Context) error {
     return nil
 }
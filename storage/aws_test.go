@@ -0,0 +1,144 @@
+package storage
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "testing"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/aws/request"
+    "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 records DeleteObjects requests, failing the keys in failKeys and every request to a bucket in failBuckets.
+// HeadObject requests fail with headErr
+type fakeS3 struct {
+    s3Client
+    requests    []*s3.DeleteObjectsInput
+    failKeys    map[string]bool
+    failBuckets map[string]bool
+    headErr     error
+}
+
+func (f *fakeS3) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+    if f.headErr != nil {
+        return nil, f.headErr
+    }
+    return &s3.HeadObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+    f.requests = append(f.requests, input)
+    if f.failBuckets[aws.StringValue(input.Bucket)] {
+        return nil, errors.New("request failed")
+    }
+    output := &s3.DeleteObjectsOutput{}
+    for _, object := range input.Delete.Objects {
+        if f.failKeys[aws.StringValue(object.Key)] {
+            output.Errors = append(output.Errors, &s3.Error{Key: object.Key, Message: aws.String("access denied")})
+        }
+    }
+    return output, nil
+}
+
+func paths(bucket string, count int) []string {
+    var result []string
+    for index := 0; index < count; index++ {
+        result = append(result, fmt.Sprintf("https://s3.example.com/%s/asset%d", bucket, index))
+    }
+    return result
+}
+
+func TestS3Delete(t *testing.T) {
+    tests := []struct {
+        name            string
+        paths           []string
+        failKeys        map[string]bool
+        failBuckets     map[string]bool
+        wantBatches     []int
+        wantFailed      int
+        wantErr         bool
+    }{
+        {name: "single batch", paths: paths("bucket", 3), wantBatches: []int{3}},
+        {name: "exactly one full batch", paths: paths("bucket", 1000), wantBatches: []int{1000}},
+        {name: "split over 1000 keys", paths: paths("bucket", 2500), wantBatches: []int{1000, 1000, 500}},
+        {name: "key failures are returned", paths: paths("bucket", 1001), failKeys: map[string]bool{"asset3": true, "asset1000": true}, wantBatches: []int{1000, 1}, wantFailed: 2},
+        {name: "failed request doesn't stop other batches", paths: append(paths("bad", 2), paths("good", 2)...), failBuckets: map[string]bool{"bad": true}, wantBatches: []int{2, 2}, wantFailed: 2},
+        {name: "malformed path deletes nothing", paths: append(paths("bucket", 2), "https://s3.example.com/bucket"), wantErr: true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            client := &fakeS3{failKeys: test.failKeys, failBuckets: test.failBuckets}
+            err := (&s3storage{svc: client}).Delete(context.Background(), test.paths)
+
+            var batches []int
+            for _, input := range client.requests {
+                if !aws.BoolValue(input.Delete.Quiet) {
+                    t.Errorf("request not in quiet mode")
+                }
+                batches = append(batches, len(input.Delete.Objects))
+            }
+            if len(batches) != len(test.wantBatches) {
+                t.Fatalf("got batches %v, want %v", batches, test.wantBatches)
+            }
+            // buckets are deleted in map order, so compare batch sizes regardless of order
+            total, wantTotal := 0, 0
+            for index := range batches {
+                total += batches[index]
+                wantTotal += test.wantBatches[index]
+                if batches[index] > s3DeleteBatchSize {
+                    t.Errorf("batch of %d keys exceeds %d", batches[index], s3DeleteBatchSize)
+                }
+            }
+            if total != wantTotal {
+                t.Errorf("deleted %d keys, want %d", total, wantTotal)
+            }
+
+            var deleteErr *DeleteError
+            switch {
+            case test.wantErr:
+                if err == nil || errors.As(err, &deleteErr) {
+                    t.Errorf("got %v, want invalid path error", err)
+                }
+            case test.wantFailed != 0:
+                if !errors.As(err, &deleteErr) {
+                    t.Fatalf("got %v, want DeleteError", err)
+                }
+                if len(deleteErr.Failed) != test.wantFailed {
+                    t.Errorf("got %d failed, want %d: %v", len(deleteErr.Failed), test.wantFailed, deleteErr.Failed)
+                }
+            case err != nil:
+                t.Errorf("unexpected error: %v", err)
+            }
+        })
+    }
+}
+
+func TestS3Exists(t *testing.T) {
+    tests := []struct {
+        name    string
+        url     string
+        headErr error
+        want    bool
+        wantErr bool
+    }{
+        {name: "stored", url: "https://s3.example.com/bucket/asset", want: true},
+        {name: "missing is not an error", url: "https://s3.example.com/bucket/asset", headErr: awserr.NewRequestFailure(awserr.New("NotFound", "not found", nil), 404, "id")},
+        {name: "forbidden", url: "https://s3.example.com/bucket/asset", headErr: awserr.NewRequestFailure(awserr.New("Forbidden", "forbidden", nil), 403, "id"), wantErr: true},
+        {name: "request failed", url: "https://s3.example.com/bucket/asset", headErr: errors.New("connection reset"), wantErr: true},
+        {name: "malformed url", url: "https://s3.example.com/bucket", wantErr: true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            exists, err := (&s3storage{svc: &fakeS3{headErr: test.headErr}}).Exists(context.Background(), test.url)
+            if (err != nil) != test.wantErr {
+                t.Fatalf("got error %v, want error %v", err, test.wantErr)
+            }
+            if exists != test.want {
+                t.Errorf("got %v, want %v", exists, test.want)
+            }
+        })
+    }
+}
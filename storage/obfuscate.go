@@ -0,0 +1,148 @@
+package storage
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "strings"
+    URL "net/url"
+)
+
+// mover is implemented by backends that can move an object to a new key, used to migrate objects to obfuscated keys
+type mover interface {
+    Move(ctx context.Context, fromurl string, tourl string) error
+}
+
+// obfuscatedStorage stores objects under an HMAC of their key, so a bucket listing doesn't map out the asset IDs that
+// clients put in their paths. Paths in the database stay as clients gave them and the stored key is derived again on every
+// access, so nothing needs reversing. While migrating, objects not yet moved are still found under their original key
+type obfuscatedStorage struct {
+    backend     StorageBackend
+    secret      []byte
+    migrating   bool
+}
+
+// NewObfuscatedBackend wraps backend so every object is accessed under its obfuscated key, migrating also looks for objects
+// under their original key until they've been moved with Migrate
+func NewObfuscatedBackend(backend StorageBackend, secret string, migrating bool) *obfuscatedStorage {
+    return &obfuscatedStorage{backend: backend, secret: []byte(secret), migrating: migrating}
+}
+
+// StoredURL returns the url backend keeps the object at rawurl under, which is rawurl itself unless keys are obfuscated
+func StoredURL(backend StorageBackend, rawurl string) (string, error) {
+    if obfuscated, ok := backend.(*obfuscatedStorage); ok {
+        return obfuscateURL(obfuscated.secret, rawurl)
+    }
+    if _, err := URL.Parse(rawurl); err != nil {
+        return "", err
+    }
+    return rawurl, nil
+}
+
+// obfuscateURL replaces the object key in rawurl with the hex HMAC-SHA256 of the key, keeping the host and bucket
+func obfuscateURL(secret []byte, rawurl string) (string, error) {
+    url, err := URL.Parse(rawurl)
+    if err != nil {
+        return "", err
+    }
+    path := strings.SplitN(url.Path, "/", 3)
+    if len(path) != 3 || len(path[2]) == 0 {
+        return "", errors.New("invalid storage url: " + rawurl)
+    }
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte(path[2]))
+    url.Path = "/" + path[1] + "/" + hex.EncodeToString(mac.Sum(nil))
+    url.RawPath = ""
+    return url.String(), nil
+}
+
+func (s *obfuscatedStorage) Name() string {
+    return s.backend.Name()
+}
+
+// RenditionSizes returns the size of each object in urls, in the same order
+func (s *obfuscatedStorage) RenditionSizes(ctx context.Context, urls []string) ([]uint64, error) {
+    stored := make([]string, len(urls))
+    for index, rawurl := range urls {
+        storedurl, err := s.locate(ctx, rawurl)
+        if err != nil {
+            return nil, err
+        }
+        stored[index] = storedurl
+    }
+    return s.backend.RenditionSizes(ctx, stored)
+}
+
+// Exists reports whether the object at rawurl is stored, under either key while migrating
+func (s *obfuscatedStorage) Exists(ctx context.Context, rawurl string) (bool, error) {
+    storedurl, err := obfuscateURL(s.secret, rawurl)
+    if err != nil {
+        return false, err
+    }
+    exists, err := s.backend.Exists(ctx, storedurl)
+    if err != nil || exists || !s.migrating {
+        return exists, err
+    }
+    return s.backend.Exists(ctx, rawurl)
+}
+
+// Delete removes the objects, while migrating both keys are deleted as either may hold the object
+func (s *obfuscatedStorage) Delete(ctx context.Context, remotepaths []string) error {
+    var stored []string
+    for _, remotepath := range remotepaths {
+        storedurl, err := obfuscateURL(s.secret, remotepath)
+        if err != nil {
+            return err
+        }
+        stored = append(stored, storedurl)
+        if s.migrating {
+            stored = append(stored, remotepath)
+        }
+    }
+    return s.backend.Delete(ctx, stored)
+}
+
+func (s *obfuscatedStorage) Shutdown(ctx context.Context) error {
+    return s.backend.Shutdown(ctx)
+}
+
+// Migrate moves the object at rawurl to its obfuscated key, returning false if there was nothing to move (already moved,
+// or never uploaded)
+func (s *obfuscatedStorage) Migrate(ctx context.Context, rawurl string) (bool, error) {
+    backend, ok := s.backend.(mover)
+    if !ok {
+        return false, errors.New(s.backend.Name() + " storage can't move objects")
+    }
+    storedurl, err := obfuscateURL(s.secret, rawurl)
+    if err != nil {
+        return false, err
+    }
+    if exists, err := s.backend.Exists(ctx, storedurl); err != nil || exists {
+        return false, err
+    }
+    if exists, err := s.backend.Exists(ctx, rawurl); err != nil || !exists {
+        return false, err
+    }
+    if err := backend.Move(ctx, rawurl, storedurl); err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// locate returns the url the object at rawurl is stored at, the obfuscated one unless migrating and it hasn't been moved
+func (s *obfuscatedStorage) locate(ctx context.Context, rawurl string) (string, error) {
+    storedurl, err := obfuscateURL(s.secret, rawurl)
+    if err != nil || !s.migrating {
+        return storedurl, err
+    }
+    exists, err := s.backend.Exists(ctx, storedurl)
+    if err != nil {
+        return "", err
+    }
+    if exists {
+        return storedurl, nil
+    }
+    return rawurl, nil
+}
@@ -1,6 +1,34 @@
 package storage
 
+import (
+    "context"
+    "fmt"
+    "strings"
+)
+
 type StorageBackend interface {
-    Filesizes(string) (uint64, uint64, error)
-    Delete(paths []string) error
+    Name() string
+    RenditionSizes(ctx context.Context, urls []string) ([]uint64, error)
+    Exists(ctx context.Context, path string) (bool, error)
+    Delete(ctx context.Context, paths []string) error
+    Shutdown(ctx context.Context) error
+}
+
+// DeleteError is returned by Delete when some of the objects couldn't be deleted, the others were. Failed describes each
+// object left in storage
+type DeleteError struct {
+    Failed  []string
+}
+
+func (e *DeleteError) Error() string {
+    return fmt.Sprintf("unable to delete %d objects, left in storage: %s", len(e.Failed), strings.Join(e.Failed, ", "))
+}
+
+// LegacyRenditions returns the renditions of an asset uploaded before named renditions, where the low rendition
+// is stored alongside the original with the "_original" suffix swapped for "_low"
+func LegacyRenditions(originalURL string) map[string]string {
+    return map[string]string {
+        "original": originalURL,
+        "low": strings.Replace(originalURL, "_original", "_low", -1),
+    }
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// certificateReloader serves the current TLS certificate, reloading it from disk on SIGHUP so it can be rotated without a restart
+type certificateReloader struct {
+    mutex       sync.RWMutex
+    certificate *tls.Certificate
+    certFile    string
+    keyFile     string
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+    reloader := &certificateReloader{certFile: certFile, keyFile: keyFile}
+    if err := reloader.reload(); err != nil {
+        return nil, err
+    }
+
+    hangup := make(chan os.Signal, 1)
+    signal.Notify(hangup, syscall.SIGHUP)
+    go func() {
+        for range hangup {
+            if err := reloader.reload(); err != nil {
+                errLogger.Println("unable to reload TLS certificate, keeping existing certificate:", err)
+            } else {
+                logger.Println("TLS certificate reloaded")
+            }
+        }
+    }()
+    return reloader, nil
+}
+
+func (reloader *certificateReloader) reload() error {
+    certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+    if err != nil {
+        return err
+    }
+    reloader.mutex.Lock()
+    defer reloader.mutex.Unlock()
+    reloader.certificate = &certificate
+    return nil
+}
+
+func (reloader *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    reloader.mutex.RLock()
+    defer reloader.mutex.RUnlock()
+    return reloader.certificate, nil
+}
+
+// newTLSConfig returns a TLS configuration restricted to TLS 1.2+ and modern AEAD cipher suites
+func newTLSConfig(reloader *certificateReloader) *tls.Config {
+    return &tls.Config{
+        MinVersion: tls.VersionTLS12,
+        CipherSuites: []uint16{
+            tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+            tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+            tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+            tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+            tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+            tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+        },
+        GetCertificate: reloader.getCertificate,
+        NextProtos: []string{"h2", "http/1.1"},    // prefer HTTP/2, net/http serves it natively over TLS
+    }
+}
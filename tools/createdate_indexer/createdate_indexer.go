@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	bolt "github.com/johnnadratowski/golang-neo4j-bolt-driver"
+)
+
+var logger = log.New(os.Stdout, "[INFO] ServerLog: ", log.LstdFlags | log.Lshortfile)
+var errLogger = log.New(os.Stderr, "[ERROR] ServerLog: ", log.LstdFlags | log.Lshortfile)
+
+type neo4j struct {
+    driverPool bolt.DriverPool
+}
+
+func (neo *neo4j) connect() {
+    user, exists := os.LookupEnv("TRIPUP_NEO_USER")
+    if !exists {
+        errLogger.Panicln("TRIPUP_NEO_USER not set")
+    }
+    pass, exists := os.LookupEnv("TRIPUP_NEO_PASS")
+    if !exists {
+        errLogger.Panicln("TRIPUP_NEO_PASS not set")
+    }
+    host, exists := os.LookupEnv("TRIPUP_NEO_HOST")
+    if !exists {
+        errLogger.Panicln("TRIPUP_NEO_HOST not set")
+    }
+    port, exists := os.LookupEnv("TRIPUP_NEO_PORT")
+    if !exists {
+        errLogger.Panicln("TRIPUP_NEO_PORT not set")
+    }
+
+    driverpool, err := bolt.NewDriverPool(
+        fmt.Sprintf("bolt://%s:%s@%s:%s", user, pass, host, port),
+        2)
+    if err != nil {
+        errLogger.Panicln("error creating driverpool")
+    } else {
+        neo.driverPool = driverpool
+    }
+}
+
+// backfills asset.createdatemillis for assets created before it was recorded, and indexes it for date range queries
+// safe to run repeatedly and while the server is running, assets created since are already recorded by CreateAsset
+func main() {
+    var neo4j = neo4j{}
+    neo4j.connect()
+
+    // schema changes can't share a transaction with writes, so create the index first on its own connection
+    conn1, err := neo4j.driverPool.OpenPool()
+    if err != nil {
+        errLogger.Panicln(err.Error())
+    }
+    if _, err := conn1.ExecNeo("CREATE INDEX ON :Asset(createdatemillis)", nil); err != nil {
+        errLogger.Panicln(err.Error())
+    }
+    conn1.Close()
+
+    // prepare neo4j query for assets with a CreateDate but no millisecond form
+    conn2, err := neo4j.driverPool.OpenPool()
+    if err != nil {
+        errLogger.Panicln(err.Error())
+    }
+    defer conn2.Close()
+    query, err := conn2.PrepareNeo(
+        "MATCH (asset:Asset) " +
+        "WHERE exists(asset.createdate) AND NOT exists(asset.createdatemillis) " +
+        "RETURN asset.uuid, asset.createdate ")
+    if err != nil {
+        errLogger.Panicln(err.Error())
+    }
+    defer query.Close()
+
+    // prepare statement for writing back, an asset replaced in the meantime keeps the value CreateAsset recorded
+    conn3, err := neo4j.driverPool.OpenPool()
+    if err != nil {
+        errLogger.Panicln(err.Error())
+    }
+    defer conn3.Close()
+    stmt, err := conn3.PrepareNeo(
+        "MATCH (asset:Asset { uuid: {assetid} }) " +
+        "WHERE asset.createdate = {createdate} " +
+        "SET asset.createdatemillis = {createdatemillis} ")
+    if err != nil {
+        errLogger.Panicln(err.Error())
+    }
+    defer stmt.Close()
+
+    // execute query
+    rows, err := query.QueryNeo(nil)
+    if err != nil {
+        errLogger.Panicln(err.Error())
+    }
+    var updated, unparseable int
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        // for each row, parse the CreateDate the same way as CreateAsset, then write back to neo4j
+        if err != nil {
+            errLogger.Panicln(err.Error())
+        }
+        var assetID = row[0].(string)
+        createDate, ok := row[1].(string)
+        if !ok {
+            continue
+        }
+
+        parsed, err := time.Parse(time.RFC3339Nano, createDate)
+        if err != nil {
+            errLogger.Printf("asset %s has an unparseable CreateDate %q, left out of date range queries\n", assetID, createDate)
+            unparseable++
+            continue
+        }
+        _, err = stmt.ExecNeo(map[string] interface{} {   // executing a statement just returns summary information
+            "assetid": assetID,
+            "createdate": createDate,
+            "createdatemillis": parsed.Unix() * 1000 + int64(parsed.Nanosecond()) / int64(time.Millisecond),
+        })
+        if err != nil {
+            errLogger.Panicln(err.Error())
+        }
+        updated++
+    }
+    logger.Printf("recorded createdatemillis for %d assets, %d unparseable\n", updated, unparseable)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -46,34 +47,39 @@ func (neo *neo4j) connect() {
 
 func main() {
     // initialise
-    var storageBackend = storage.NewS3Backend()
+    var storageBackend = storage.NewS3Backend("", "", false)
     var neo4j = neo4j{}
     neo4j.connect()
 
-    // prepare neo4j query for image remote paths
+    // prepare neo4j query for assets uploaded before named renditions
     conn1, err := neo4j.driverPool.OpenPool()
     if err != nil {
         errLogger.Panicln(err.Error())
     }
     defer conn1.Close()
     query, err := conn1.PrepareNeo(
-        "MATCH (asset:Image) " +
-        "WHERE NOT asset.remotepathorig IS NULL " +
-        "RETURN asset.remotepathorig ")
+        "MATCH (asset:Asset) " +
+        "WHERE NOT asset.remotepathorig IS NULL AND NOT (asset) - [:RENDITION] -> (:Rendition) " +
+        "RETURN asset.uuid, asset.remotepathorig ")
     if err != nil {
         errLogger.Panicln(err.Error())
     }
     defer query.Close()
 
-    // prepare statement for writing filesizes to neo4j
+    // prepare statement for writing renditions to neo4j, totalsize is recalculated as the sum of rendition sizes
     conn2, err := neo4j.driverPool.OpenPool()
     if err != nil {
         errLogger.Panicln(err.Error())
     }
     defer conn2.Close()
     stmt, err := conn2.PrepareNeo(
-        "MATCH (asset:Image { remotepathorig: {remotepathorig} }) " +
-        "SET asset.totalsize = {totalsize} ")
+        "MATCH (asset:Asset { uuid: {assetid} }) " +
+        "MERGE (asset) - [:RENDITION] -> (rendition:Rendition { name: {name} }) " +
+        "SET rendition.remotepath = {remotepath}, rendition.size = {size} " +
+        "WITH asset " +
+        "MATCH (asset) - [:RENDITION] -> (renditions:Rendition) " +
+        "WITH asset, sum(renditions.size) AS totalsize " +
+        "SET asset.totalsize = totalsize ")
     if err != nil {
         errLogger.Panicln(err.Error())
     }
@@ -85,26 +91,43 @@ func main() {
         errLogger.Panicln(err.Error())
     }
     for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
-        // for each row, calculate filesizes, then write back to neo4j
+        // for each row, calculate rendition sizes, then write back to neo4j
         if err != nil {
             errLogger.Panicln(err.Error())
         }
-        var remotePathOrig = row[0].(string)
-        originalLength, lowLength, err := storageBackend.Filesizes(remotePathOrig)
+        var assetID = row[0].(string)
+        var remotePathOrig = row[1].(string)
+
+        var names []string
+        var urls []string
+        for name, url := range storage.LegacyRenditions(remotePathOrig) {
+            names = append(names, name)
+            urls = append(urls, url)
+        }
+        sizes, err := storageBackend.RenditionSizes(context.Background(), urls)
         if err != nil {
             errLogger.Println(remotePathOrig)
             errLogger.Panicln(err.Error())
         }
 
-        result, err := stmt.ExecNeo(map[string] interface{} {   // executing a statement just returns summary information
-            "remotepathorig": remotePathOrig,
-            "totalsize": originalLength + lowLength,
-        })
-        if err != nil {
-            errLogger.Panicln(err.Error())
-        }
-        _, err = result.RowsAffected(); if err != nil {
-            errLogger.Panicln(err.Error())
+        for index, name := range names {
+            size := sizes[index]
+            // 128 KB minimum
+            if size < 131072 {
+                size = 131072
+            }
+            result, err := stmt.ExecNeo(map[string] interface{} {   // executing a statement just returns summary information
+                "assetid": assetID,
+                "name": name,
+                "remotepath": urls[index],
+                "size": size,
+            })
+            if err != nil {
+                errLogger.Panicln(err.Error())
+            }
+            _, err = result.RowsAffected(); if err != nil {
+                errLogger.Panicln(err.Error())
+            }
         }
     }
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	bolt "github.com/johnnadratowski/golang-neo4j-bolt-driver"
+	"github.com/tripupapp/tripup-server/storage"
+)
+
+var logger = log.New(os.Stdout, "[INFO] ServerLog: ", log.LstdFlags | log.Lshortfile)
+var errLogger = log.New(os.Stderr, "[ERROR] ServerLog: ", log.LstdFlags | log.Lshortfile)
+
+type neo4j struct {
+    driverPool bolt.DriverPool
+}
+
+func (neo *neo4j) connect() {
+    user, exists := os.LookupEnv("TRIPUP_NEO_USER")
+    if !exists {
+        errLogger.Panicln("TRIPUP_NEO_USER not set")
+    }
+    pass, exists := os.LookupEnv("TRIPUP_NEO_PASS")
+    if !exists {
+        errLogger.Panicln("TRIPUP_NEO_PASS not set")
+    }
+    host, exists := os.LookupEnv("TRIPUP_NEO_HOST")
+    if !exists {
+        errLogger.Panicln("TRIPUP_NEO_HOST not set")
+    }
+    port, exists := os.LookupEnv("TRIPUP_NEO_PORT")
+    if !exists {
+        errLogger.Panicln("TRIPUP_NEO_PORT not set")
+    }
+
+    driverpool, err := bolt.NewDriverPool(
+        fmt.Sprintf("bolt://%s:%s@%s:%s", user, pass, host, port),
+        1)
+    if err != nil {
+        errLogger.Panicln("error creating driverpool")
+    } else {
+        neo.driverPool = driverpool
+    }
+}
+
+// moves every stored object to its obfuscated key, run while the server has TRIPUP_STORAGE_KEY_MIGRATING set so objects are
+// found under either key. Safe to run repeatedly, objects already moved are skipped
+func main() {
+    // initialise
+    secret, exists := os.LookupEnv("TRIPUP_STORAGE_KEY_SECRET")
+    if !exists || len(secret) == 0 {
+        errLogger.Panicln("TRIPUP_STORAGE_KEY_SECRET not set")
+    }
+    var storageBackend = storage.NewObfuscatedBackend(storage.NewS3Backend(os.Getenv("AWS_REGION"), os.Getenv("AWS_ENDPOINT"), len(os.Getenv("AWS_ENDPOINT")) != 0), secret, true)
+    var neo4j = neo4j{}
+    neo4j.connect()
+
+    // prepare neo4j query for every path an asset has recorded, legacy paths overlap with rendition paths
+    conn, err := neo4j.driverPool.OpenPool()
+    if err != nil {
+        errLogger.Panicln(err.Error())
+    }
+    defer conn.Close()
+    query, err := conn.PrepareNeo(
+        "MATCH (asset:Asset) " +
+        "OPTIONAL MATCH (asset) - [:RENDITION] -> (rendition:Rendition) " +
+        "WITH [asset.remotepath, asset.remotepathorig] + collect(rendition.remotepath) AS paths " +
+        "UNWIND paths AS path " +
+        "WITH DISTINCT path " +
+        "WHERE path IS NOT NULL " +
+        "RETURN path ")
+    if err != nil {
+        errLogger.Panicln(err.Error())
+    }
+    defer query.Close()
+
+    // execute query
+    rows, err := query.QueryNeo(nil)
+    if err != nil {
+        errLogger.Panicln(err.Error())
+    }
+    var moved, skipped int
+    for row, _, err := rows.NextNeo(); err != io.EOF; row, _, err = rows.NextNeo() {
+        // for each path, move the object unless it already has been
+        if err != nil {
+            errLogger.Panicln(err.Error())
+        }
+        var path = row[0].(string)
+
+        ok, err := storageBackend.Migrate(context.Background(), path)
+        if err != nil {
+            errLogger.Println(path)
+            errLogger.Panicln(err.Error())
+        }
+        if ok {
+            moved++
+        } else {
+            skipped++
+        }
+    }
+    logger.Printf("moved %d objects to obfuscated keys, %d already moved or missing\n", moved, skipped)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pressly/chi/middleware"
+
+	"github.com/tripupapp/tripup-server/logging"
+)
+
+// Tracing carries the request ID and any W3C traceparent header into the request context, so the OneSignal and S3 calls
+// made on behalf of the request send them on. The request ID is echoed back, so clients can quote it when reporting issues
+// must be registered after middleware.RequestID
+func Tracing(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+        trace := logging.Trace{
+            RequestID: middleware.GetReqID(request.Context()),
+            Traceparent: request.Header.Get("traceparent"),
+        }
+        if len(trace.RequestID) != 0 {
+            response.Header().Set("X-Request-ID", trace.RequestID)
+        }
+        next.ServeHTTP(response, request.WithContext(logging.ContextWithTrace(request.Context(), trace)))
+    })
+}